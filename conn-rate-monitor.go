@@ -24,130 +24,58 @@ package main
 //  Apache 2.0 License Applies
 //  May, 2021
 //
+//  Everything but the command line is in the monitor package, which other programs can use too. See
+//  monitor/monitor.go.
+//
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"io/ioutil"
-
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"gopkg.in/mcuadros/go-syslog.v2"
+	"jdallen/a10-connection-rate-monitor/monitor"
 )
 
-// Configuration holds config structure
-type Configuration struct {
-	Debug        int    `json:"debug"`
-	MQTT_Broker  string `json:"mqtt_broker"`
-	Client_ID    string `json:"client_id"`
-	Syslog_port  int    `json:"syslog_port"`
-	MQTT_port    int    `json:"mqtt_port"`
-	Notify_Topic string `json:"notify_topic"`
-	Username     string `json:"username"`
-	Password     string `json:"password"`
-}
-
-var config Configuration
-
-var connHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	fmt.Println("MQTT Broker Connected...")
-}
-
-func getConfig(fn string) (Configuration, error) {
-	jsonFile, err := os.Open(fn)
-	if err != nil {
-		return Configuration{}, errors.New("Unable to open Config File!")
-	}
-	defer jsonFile.Close()
-
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-
-	var c Configuration
-	json.Unmarshal(byteValue, &c)
-
-	return c, nil
-}
+// agentVersion is set at build time with -ldflags "-X main.agentVersion=x.y.z"
+var agentVersion = "dev"
 
-//
-//---------------------------------------------------------------------------------------------
+// ---------------------------------------------------------------------------------------------
 func main() {
+	monitor.Version = agentVersion
 	//
-	// Get Config info
-	config, err := getConfig("./config.json")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "schema":
+			os.Exit(monitor.SchemaCommand(os.Args[2:]))
+		case "migrate-config":
+			os.Exit(monitor.MigrateCommand(os.Args[2:]))
+		case "rules":
+			os.Exit(monitor.RulesCommand(os.Args[2:]))
+		}
 	}
 
-	//------------------[  MQTT Setup Stuff  ]-----------------------
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("mqtt://%s:%d", config.MQTT_Broker, config.MQTT_port))
-	opts.SetClientID(config.Client_ID) // If running multiple clients, this needs to be unique, or remove for defaults
-	// -- This code defaults to no Auth being used on the MQTT Broker. Uncomment these two lines for Username/Password Auth
-	// opts.SetUsername(config.Username)
-	// opts.SetPassword(config.Password)
-	// -- TLS Auth requires much more code. See https://github.com/eclipse/paho.mqtt.golang/blob/master/cmd/ssl/main.go for example.
-	opts.SetKeepAlive(30) // 30 second keepalive PING for MQTT Broker connection.
-	opts.SetOnConnectHandler(connHandler)
-	opts.SetAutoReconnect(true)
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	m, err := monitor.New(monitor.WithConfigFile("./config.json"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(monitor.Exit(err))
 	}
 
-	//------------------[  Syslog Setup Stuff  ]---------------------
-	channel := make(syslog.LogPartsChannel)
-	handler := syslog.NewChannelHandler(channel)
-	server := syslog.NewServer()
-	server.SetFormat(syslog.RFC3164) // Thunder uses RFC 3164 format for its Syslog records.
-	server.SetHandler(handler)
-	server.ListenUDP("0.0.0.0:" + strconv.Itoa(config.Syslog_port))
-	server.Boot()
-	if config.Debug > 5 {
-		fmt.Println("Connection Rate Monitor running on port " + strconv.Itoa(config.Syslog_port) + "...")
-	}
+	// Stop, saving the counters, on the way out
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
 
 	//------------------[  MAIN  ]-----------------------------
-	go func(channel syslog.LogPartsChannel) {
-		for logParts := range channel {
-			//
-			// Log records ("logParts") come in from Thunder looking like this:
-			// map[client:10.1.11.44:5456 content:[ACOS]<4> Virtual server ws-vip connection rate limit 10 exceeded facility:16
-			//   hostname:Testing1 priority:132 severity:4 tag:a10logd timestamp:2021-05-18 22:03:04 +0000 UTC tls_peer:]
-			// map[client:10.1.11.44:5456 content:[AFLEX]<6> http-error-status-log:HTTP Error: 10.147.95.128 - 404 - /blatt
-			//   facility:16 hostname:Testing1 priority:134 severity:6 tag:a10logd timestamp:2021-05-18 22:05:41 +0000 UTC tls_peer:]
-			if config.Debug > 9 { // Output all incoming Syslog records.
-				fmt.Print(".")
-				fmt.Println(logParts)
-			}
-			m := fmt.Sprintf("%s", logParts["content"])
-			host := fmt.Sprintf("%s", logParts["hostname"])
-			if strings.HasPrefix(m, "[ACOS]") { // -- Only log lines from ACOS
-				//  Full 'content' field looks like: "[ACOS]<4> Virtual server ws-vip connection rate limit 10 exceeded"
-				if strings.Contains(m, "connection rate limit") && strings.Contains(m, "exceeded") {
-					msg := m[10:] // Cut off the prefix and just show the error text.
-					text := "A10 Thunder node = " + host + "::" + msg
-					if config.Debug > 5 {
-						fmt.Println(text)
-					}
-					token := client.Publish(config.Notify_Topic, 0, false, text)
-					token.Wait()
-					// Check for Error on Publish
-					if token.Error() != nil {
-						if config.Debug > 3 {
-							fmt.Print(">>> MQTT Publish Error: ")
-							fmt.Println(token.Error())
-						}
-					}
-				}
-			}
-			//fmt.Println(logParts)
-		}
-	}(channel)
-
-	server.Wait()
+	err = m.Run(ctx)
+	if err != nil {
+		fmt.Println(err)
+	}
+	os.Exit(monitor.Exit(err)) // See monitor/exit.go for the codes
 }
@@ -0,0 +1,124 @@
+// Package consumer is a small SDK for programs that take the A10 connection rate monitor's events off the
+// MQTT broker, so they don't each have to work out the topics, payload versions and duplicates:
+//
+//	opts := mqtt.NewClientOptions().AddBroker("mqtt://10.1.1.28:1883").SetClientID("itsm-bridge")
+//	client := mqtt.NewClient(opts)
+//	if t := client.Connect(); t.Wait() && t.Error() != nil {
+//		...
+//	}
+//	c := consumer.New(client, func(ev consumer.Event) {
+//		fmt.Println(ev.Hostname, ev.Type, ev.ObjectName, ev.Rate, ev.Limit)
+//	}, consumer.WithTopics("alert/A10Thunder/#"))
+//	if err := c.Start(); err != nil {
+//		...
+//	}
+//	defer c.Stop()
+//
+// The topics can be the "$share/<group>/..." filters from the agent's GET /subscriptions, to split the
+// events between several instances. The handler is called once per event: copies from other regions
+// (mqtt_mirror) and QoS 1 redeliveries are dropped, see Deduper.
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Consumer subscribes to the agent's topics and hands each event to a handler.
+type Consumer struct {
+	client  mqtt.Client
+	handler func(Event)
+	topics  []string
+	qos     byte
+	schema  *Schema
+	dedup   *Deduper
+	onError func(topic string, payload []byte, err error)
+}
+
+// Option changes how a Consumer works; see the With... functions.
+type Option func(*Consumer)
+
+// WithTopics sets the topic filters subscribed to. The default is "alert/A10Thunder/#".
+func WithTopics(filters ...string) Option {
+	return func(c *Consumer) { c.topics = filters }
+}
+
+// WithQoS sets the QoS subscribed with. The default is 1, which with dedup gives each event once.
+func WithQoS(qos byte) Option {
+	return func(c *Consumer) { c.qos = qos }
+}
+
+// WithSchema reads renamed fields from their old names too, see event.go.
+func WithSchema(s *Schema) Option {
+	return func(c *Consumer) { c.schema = s }
+}
+
+// WithDedupWindow sets how long events are remembered for dropping duplicates. 0 turns it off.
+func WithDedupWindow(d time.Duration) Option {
+	return func(c *Consumer) {
+		c.dedup = nil
+		if d > 0 {
+			c.dedup = NewDeduper(d)
+		}
+	}
+}
+
+// WithErrorHandler is called with payloads that can't be decoded. By default they are dropped.
+func WithErrorHandler(f func(topic string, payload []byte, err error)) Option {
+	return func(c *Consumer) { c.onError = f }
+}
+
+// New makes a Consumer on a connected client. Nothing is subscribed to until Start.
+func New(client mqtt.Client, handler func(Event), opts ...Option) *Consumer {
+	c := &Consumer{
+		client:  client,
+		handler: handler,
+		topics:  []string{"alert/A10Thunder/#"},
+		qos:     1,
+		dedup:   NewDeduper(10 * time.Minute),
+		onError: func(string, []byte, error) {},
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Start subscribes to the topics.
+func (c *Consumer) Start() error {
+	if len(c.topics) == 0 {
+		return errors.New("consumer: no topics to subscribe to")
+	}
+	filters := make(map[string]byte, len(c.topics))
+	for _, t := range c.topics {
+		filters[t] = c.qos
+	}
+	token := c.client.SubscribeMultiple(filters, c.receive)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("consumer: subscribe: %v", err)
+	}
+	return nil
+}
+
+// Stop unsubscribes from the topics.
+func (c *Consumer) Stop() error {
+	token := c.client.Unsubscribe(c.topics...)
+	token.Wait()
+	return token.Error()
+}
+
+func (c *Consumer) receive(_ mqtt.Client, msg mqtt.Message) {
+	ev, err := Decode(msg.Payload(), c.schema)
+	if err != nil {
+		c.onError(msg.Topic(), msg.Payload(), err)
+		return
+	}
+	if c.dedup != nil && !c.dedup.First(ev, time.Now()) {
+		return
+	}
+	c.handler(ev)
+}
@@ -0,0 +1,54 @@
+package consumer
+
+// Deduper drops events already handled: the copies mqtt_mirror sends to every region, which share an
+// "event_id", and redeliveries at QoS 1. Events without an event_id go by hostname, type, message and
+// timestamp.
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Deduper remembers the events it has seen for a while. Safe to use from several goroutines.
+type Deduper struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+	next   time.Time // When to next forget the old ones
+}
+
+// NewDeduper remembers each event for window.
+func NewDeduper(window time.Duration) *Deduper {
+	return &Deduper{window: window, seen: make(map[string]time.Time)}
+}
+
+// eventKey is what makes two deliveries the same event.
+func eventKey(ev Event) string {
+	if ev.EventID != "" {
+		return ev.EventID
+	}
+	h := sha1.Sum([]byte(ev.Hostname + "\x00" + ev.Type + "\x00" + ev.Message + "\x00" + ev.Timestamp))
+	return hex.EncodeToString(h[:])
+}
+
+// First says whether ev hasn't been seen in the window.
+func (d *Deduper) First(ev Event, now time.Time) bool {
+	key := eventKey(ev)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.After(d.next) {
+		for k, t := range d.seen {
+			if now.Sub(t) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.next = now.Add(d.window)
+	}
+	if t, ok := d.seen[key]; ok && now.Sub(t) < d.window {
+		return false
+	}
+	d.seen[key] = now
+	return true
+}
@@ -0,0 +1,135 @@
+package consumer
+
+// Event is the agent's payload as a Go type. Decode takes it whichever agent version sent it:
+//
+//	the JSON payload, with the field names 'schema dump' prints (see monitor/schema.go)
+//	the text payload of the first versions, "A10 Thunder node = <hostname>::<message>"
+//
+// Fields an agent renamed are read from the old name too when a Schema with the renames is given, so a
+// consumer keeps working against agents on either side of the rename.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Event is one published event. Fields the agent only sends sometimes are empty when it didn't.
+type Event struct {
+	Rule            string   `json:"rule"`
+	Type            string   `json:"type"`     // e.g. "conn.rate-limit"
+	Severity        string   `json:"severity"` // A Syslog severity name, e.g. "warning"
+	Hostname        string   `json:"hostname"` // The Thunder device
+	Message         string   `json:"message"`
+	Partition       string   `json:"partition"`
+	AlertID         string   `json:"alert_id"`       // What to ack the alert by, e.g. {"ack": AlertID} on the agent's acks topic
+	AlertState      string   `json:"alert_state"`    // "open", "acknowledged" or "resolved"
+	AlertOpened     string   `json:"alert_opened"`   // With AlertID, which time this alert is
+	IncidentID      string   `json:"incident_id"`    // The same on every event of one incident, open to resolved
+	AlertSequence   int      `json:"alert_sequence"` // Which event of the incident it is, from 1
+	Runbook         string   `json:"runbook"`
+	Remediation     string   `json:"remediation"`
+	Timestamp       string   `json:"timestamp"` // RFC 3339, UTC
+	Received        string   `json:"received"`
+	EventID         string   `json:"event_id"` // The same in every region
+	Regions         []string `json:"regions"`
+	CorrelationID   string   `json:"correlation_id"`
+	Correlated      []string `json:"correlated"` // Event types behind a correlated event
+	RepeatCount     int      `json:"repeat_count"`
+	SuppressedCount int      `json:"suppressed_count"`
+	Recovered       bool     `json:"recovered"` // An all-clear for RecoveredType on the object
+	RecoveredType   string   `json:"recovered_type"`
+	FirstSeen       string   `json:"first_seen"`
+	LastSeen        string   `json:"last_seen"`
+	ObjectType      string   `json:"object_type"`
+	ObjectName      string   `json:"object_name"`
+	Limit           *int     `json:"limit"` // nil when the device's message didn't give it
+	Rate            *int     `json:"rate"`
+
+	Test bool `json:"test"` // A drill from POST /drill, not a real alert
+
+	Format string                 `json:"-"` // "json", or "text" from the first agent versions
+	Fields map[string]interface{} `json:"-"` // The whole payload, including fields from custom rules
+}
+
+// Schema is what 'schema dump' prints. Only the renames in it are used.
+type Schema struct {
+	Version string        `json:"version"`
+	Format  string        `json:"format"`
+	Fields  []SchemaField `json:"fields"`
+}
+
+// SchemaField is one field in a Schema.
+type SchemaField struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Deprecated string `json:"deprecated,omitempty"` // Agent version the field was deprecated in
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+// LoadSchema reads a schema from 'schema dump'.
+func LoadSchema(fn string) (*Schema, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("consumer: %v", err)
+	}
+	s := &Schema{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("consumer: bad schema: %v", err)
+	}
+	return s, nil
+}
+
+// legacyPrefix starts every text payload.
+const legacyPrefix = "A10 Thunder node = "
+
+// Decode reads a payload. schema may be nil.
+func Decode(payload []byte, schema *Schema) (Event, error) {
+	payload = bytes.TrimSpace(payload)
+	if bytes.HasPrefix(payload, []byte(legacyPrefix)) {
+		return decodeText(string(payload))
+	}
+	fields := make(map[string]interface{})
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		return Event{}, fmt.Errorf("consumer: bad payload: %v", err)
+	}
+	if schema != nil {
+		for _, f := range schema.Fields {
+			if v, ok := fields[f.Name]; ok && f.ReplacedBy != "" {
+				if _, ok := fields[f.ReplacedBy]; !ok {
+					fields[f.ReplacedBy] = v // From an agent from before the rename
+				}
+			}
+		}
+	}
+	b, _ := json.Marshal(fields)
+	ev := Event{}
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return Event{}, fmt.Errorf("consumer: bad payload: %v", err)
+	}
+	ev.Format, ev.Fields = "json", fields
+	return ev, nil
+}
+
+// decodeText reads a text payload. Those versions only sent connection rate limit events.
+func decodeText(s string) (Event, error) {
+	i := strings.Index(s, "::")
+	if i < 0 {
+		return Event{}, errors.New("consumer: no '::' in text payload")
+	}
+	ev := Event{
+		Rule:     "conn-rate-limit",
+		Type:     "conn.rate-limit",
+		Severity: "warning",
+		Hostname: s[len(legacyPrefix):i],
+		Message:  s[i+2:],
+		Format:   "text",
+	}
+	ev.Fields = map[string]interface{}{"rule": ev.Rule, "type": ev.Type, "severity": ev.Severity, "hostname": ev.Hostname, "message": ev.Message}
+	return ev, nil
+}
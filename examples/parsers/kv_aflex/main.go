@@ -0,0 +1,48 @@
+// An example parser plugin: aFleX log statements written as "kv-log: key=value key=value ...", e.g. from
+// 'log "kv-log: event=slow-backend pool=web ms=1200"'. Build it with
+//
+//	go build -buildmode=plugin -o kv_aflex.so ./examples/parsers/kv_aflex
+//
+// and list the .so under "parser_plugins" in config.json.
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"jdallen/a10-connection-rate-monitor/plugin"
+)
+
+type kvParser struct{}
+
+func (kvParser) Name() string { return "kv-aflex" }
+
+func (kvParser) Parse(r plugin.Record) (plugin.Parsed, bool) {
+	if r.Module != "AFLEX" || !strings.HasPrefix(r.Message, "kv-log:") {
+		return plugin.Parsed{}, false
+	}
+	fields := map[string]interface{}{}
+	for _, kv := range strings.Fields(strings.TrimPrefix(r.Message, "kv-log:")) {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			continue
+		}
+		k, v := kv[:i], kv[i+1:]
+		if n, err := strconv.Atoi(v); err == nil {
+			fields[k] = n
+		} else {
+			fields[k] = v
+		}
+	}
+	ev, _ := fields["event"].(string)
+	if ev == "" {
+		ev = "log"
+	}
+	delete(fields, "event")
+	return plugin.Parsed{Type: "aflex." + ev, Fields: fields}, true
+}
+
+// Parser is what the agent looks up.
+var Parser kvParser
+
+func main() {} // Not used; plugins are built as package main
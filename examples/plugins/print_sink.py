@@ -0,0 +1,26 @@
+#!/usr/bin/env python3
+#
+#  print_sink.py  --  Minimal output plugin for the A10 connection rate monitor. Prints every alert
+#    to stderr. See PLUGINS.md for the protocol.
+#
+import json
+import sys
+
+
+def reply(msg_id, ok=True, error=None):
+    r = {"id": msg_id, "ok": ok}
+    if error:
+        r["error"] = error
+    sys.stdout.write(json.dumps(r) + "\n")
+    sys.stdout.flush()
+
+
+hello = json.loads(sys.stdin.readline())
+prefix = hello.get("options", {}).get("prefix", "ALERT")
+reply(0)
+
+for line in sys.stdin:
+    ev = json.loads(line)
+    p = ev["payload"]
+    print("%s %s %s" % (prefix, ev["topic"], p.get("message")), file=sys.stderr, flush=True)
+    reply(ev["id"])
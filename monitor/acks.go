@@ -0,0 +1,257 @@
+package monitor
+
+//
+//  acks.go  --  Acknowledgments and closures from outside, e.g. the ITSM system once someone has taken a
+//    ticket. An acknowledged alert isn't published again (matches are only counted) until it is closed or
+//    the ack runs out; closing it also drops any suppression window, so the next occurrence is news again.
+//
+//  They come in as JSON, to POST /acks on the API, through an SQS queue (see sqs.go) or on the MQTT topic
+//  acks.mqtt_topic:
+//
+//    { "key": "Testing1/conn.rate-limit/ws-vip", "action": "ack", "ticket": "INC0012345", "by": "jsmith", "for": "4h" }
+//    { "key": "Testing1/conn.rate-limit/ws-vip", "action": "close", "ticket": "INC0012345" }
+//    { "ack": "Testing1/conn.rate-limit/ws-vip", "by": "jsmith" }
+//
+//  The key is the suppression key (see suppress.go), which every event has as "alert_id". 'for' defaults
+//  to acks.hold in the config, or 24h. The short { "ack": ... } form, for responders acking straight from
+//  their MQTT client, lasts until the object recovers (see recovery.go) or a state rule reports it up, or
+//  acks.hold if that is sooner. An "up" is never held back by an ack, as it isn't a repeat of the alert.
+//
+//  "acks": { "hold": "24h", "mqtt_topic": "alert/A10Thunder/control/acks",
+//            "sqs": { "queue_url": "https://sqs.eu-west-1.amazonaws.com/123456789012/thunder-acks" } }
+//
+//  The MQTT topic is subscribed to at QoS 1, again each time the agent reconnects to the broker.
+//
+//  A snooze is quieter than an ack: the alert's events are counted but not published for 'for' (which it
+//  needs), whatever escalation would say, and the alert stays open rather than acknowledged. Only its
+//  all-clear, or an "up", gets through. It goes when it runs out, or with "unsnooze"; live snoozes are in GET
+//  /suppressions:
+//
+//    { "snooze": "Testing1/conn.rate-limit/ws-vip", "for": "30m", "by": "jsmith" }
+//    { "key": "Testing1/conn.rate-limit/ws-vip", "action": "unsnooze" }
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// AcksConfig holds the 'acks' section of the config.
+type AcksConfig struct {
+	Hold       string    `json:"hold"` // How long an ack lasts if the message doesn't say. Default "24h"
+	MQTT_Topic string    `json:"mqtt_topic"`
+	SQS        SQSConfig `json:"sqs"`
+}
+
+// Ack is an acknowledged alert.
+type Ack struct {
+	Key           string    `json:"key"`
+	Ticket        string    `json:"ticket,omitempty"`
+	By            string    `json:"by,omitempty"`
+	Source        string    `json:"source"` // "webhook", "sqs" or "mqtt"
+	At            time.Time `json:"at"`
+	Until         time.Time `json:"until"`
+	UntilRecovery bool      `json:"until_recovery,omitempty"` // Goes when the object recovers, too
+	Suppressed    uint64    `json:"suppressed"`               // Matches not published since
+}
+
+// Snooze is an alert that isn't published for a while.
+type Snooze struct {
+	Key     string    `json:"key"`
+	By      string    `json:"by,omitempty"`
+	Source  string    `json:"source"`
+	At      time.Time `json:"at"`
+	Until   time.Time `json:"until"`
+	Snoozed uint64    `json:"snoozed"` // Matches not published since
+}
+
+// AckMessage is what the ITSM system sends.
+type AckMessage struct {
+	Ack    string `json:"ack"`    // Short for key, with the ack lasting until recovery
+	Snooze string `json:"snooze"` // Short for key, with action "snooze"
+	Key    string `json:"key"`
+	Action string `json:"action"` // "ack" (default), "close", "snooze" or "unsnooze"
+	Ticket string `json:"ticket"`
+	By     string `json:"by"`
+	For    string `json:"for"` // e.g. "4h"
+}
+
+// ackHold parses acks.hold.
+func ackHold(s string) (time.Duration, error) {
+	if s == "" {
+		return 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Bad acks hold '%s'", s)
+	}
+	return d, nil
+}
+
+// acked says whether the key has a live ack, counting the match against it. Caller holds s.mu.
+func (s *Suppressions) acked(key string, now time.Time) bool {
+	a, ok := s.acks[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(a.Until) {
+		delete(s.acks, key)
+		return false
+	}
+	a.Suppressed++
+	return true
+}
+
+// ackedEvent says whether ev's alert is acknowledged, counting the match against the ack. emit checks it
+// before escalation (paging.go), whose steps would otherwise get an acked alert past Allow.
+func (s *Suppressions) ackedEvent(ev Event, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked(suppressKey(ev.Device, ev.Type, ev.Object), now)
+}
+
+// ApplyAck acknowledges or closes an alert.
+func (s *Suppressions) ApplyAck(msg AckMessage, source string, now time.Time) error {
+	untilRecovery := false
+	if msg.Ack != "" {
+		msg.Key, untilRecovery = msg.Ack, true
+	}
+	if msg.Snooze != "" {
+		msg.Key, msg.Action = msg.Snooze, "snooze"
+	}
+	if msg.Key == "" {
+		return errors.New("Ack with no key!")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToLower(msg.Action) {
+	case "", "ack", "acknowledge":
+		d := s.ackFor
+		if msg.For != "" {
+			var err error
+			if d, err = time.ParseDuration(msg.For); err != nil || d <= 0 {
+				return fmt.Errorf("Bad ack duration '%s'", msg.For)
+			}
+		}
+		s.acks[msg.Key] = &Ack{Key: msg.Key, Ticket: msg.Ticket, By: msg.By, Source: source, At: now, Until: now.Add(d), UntilRecovery: untilRecovery}
+		s.setAlertState(msg.Key, alertAcknowledged, msg.By, now)
+	case "close", "closed", "resolve", "resolved":
+		delete(s.acks, msg.Key)
+		delete(s.windows, msg.Key)
+		delete(s.accumulators, msg.Key)
+		s.setAlertState(msg.Key, alertResolved, msg.By, now)
+	case "snooze":
+		d, err := time.ParseDuration(msg.For)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("A snooze needs a duration in 'for', not '%s'", msg.For)
+		}
+		s.snoozes[msg.Key] = &Snooze{Key: msg.Key, By: msg.By, Source: source, At: now, Until: now.Add(d)}
+	case "unsnooze":
+		delete(s.snoozes, msg.Key)
+	default:
+		return fmt.Errorf("Unknown ack action '%s'", msg.Action)
+	}
+	return nil
+}
+
+// snoozed says whether the key is snoozed, counting the match against it.
+func (s *Suppressions) snoozed(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, ok := s.snoozes[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(z.Until) {
+		delete(s.snoozes, key)
+		return false
+	}
+	z.Snoozed++
+	return true
+}
+
+// Snoozes returns the live snoozes, sorted by key.
+func (s *Suppressions) Snoozes() []Snooze {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zs := []Snooze{}
+	for k, z := range s.snoozes {
+		if !now.Before(z.Until) {
+			delete(s.snoozes, k)
+			continue
+		}
+		zs = append(zs, *z)
+	}
+	sort.Slice(zs, func(i, j int) bool { return zs[i].Key < zs[j].Key })
+	return zs
+}
+
+// recovered drops an ack that lasts until the object recovers, and resolves the alert (see lifecycle.go).
+func (s *Suppressions) recovered(key string, now time.Time) {
+	s.mu.Lock()
+	if a, ok := s.acks[key]; ok && a.UntilRecovery {
+		delete(s.acks, key)
+	}
+	s.setAlertState(key, alertResolved, "", now)
+	s.mu.Unlock()
+}
+
+// Acks returns the live acks, sorted by key.
+func (s *Suppressions) Acks() []Ack {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	as := []Ack{}
+	for k, a := range s.acks {
+		if !now.Before(a.Until) {
+			delete(s.acks, k)
+			continue
+		}
+		as = append(as, *a)
+	}
+	sort.Slice(as, func(i, j int) bool { return as[i].Key < as[j].Key })
+	return as
+}
+
+// ackHandler is POST /acks.
+func (s *Suppressions) ackHandler(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	var msg AckMessage
+	if err := json.Unmarshal(b, &msg); err != nil {
+		countError(errAckBad)
+		http.Error(w, "Bad JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.ApplyAck(msg, "webhook", time.Now()); err != nil {
+		countError(errAckBad)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"result": "ok"})
+}
+
+// subscribeAcks takes acks from the MQTT topic. Called each time the client connects.
+func (s *Suppressions) subscribeAcks(c mqtt.Client, topic string, debug int) {
+	token := c.Subscribe(topic, 1, func(_ mqtt.Client, m mqtt.Message) {
+		var msg AckMessage
+		if err := json.Unmarshal(m.Payload(), &msg); err != nil {
+			reportError(debug, errAckBad, "Bad ack on "+m.Topic()+": "+err.Error())
+			return
+		}
+		if err := s.ApplyAck(msg, "mqtt", time.Now()); err != nil {
+			reportError(debug, errAckBad, "Bad ack on "+m.Topic()+": "+err.Error())
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		reportError(debug, errAckMQTT, "Unable to subscribe to "+topic+": "+token.Error().Error())
+	}
+}
@@ -0,0 +1,64 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+func serverStateRecord(host, server, state string) format.LogParts {
+	return format.LogParts{"hostname": host, "severity": 4, "timestamp": time.Now(),
+		"content": "[ACOS]<4> Server " + server + " state changed to " + state}
+}
+
+// An ack holds back the down, but not the up, which also ends an ack until recovery.
+func TestAckLetsUpThrough(t *testing.T) {
+	m := newTestMonitor(t, Configuration{})
+	m.a.process(context.Background(), serverStateRecord("thunder1", "s1", "DOWN"))
+	down := nextEvent(m)
+	if down == nil {
+		t.Fatal("down not published")
+	}
+	if err := m.a.suppress.ApplyAck(AckMessage{Ack: down.alertID()}, "test", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	m.a.process(context.Background(), serverStateRecord("thunder1", "s1", "DOWN"))
+	if ev := nextEvent(m); ev != nil {
+		t.Fatalf("acked down published: %+v", ev)
+	}
+	m.a.process(context.Background(), serverStateRecord("thunder1", "s1", "UP"))
+	up := nextEvent(m)
+	if up == nil || up.Fields["state"] != "up" {
+		t.Fatalf("up after ack: %+v", up)
+	}
+	if as := m.a.suppress.Acks(); len(as) != 0 {
+		t.Fatalf("ack until recovery still there after the up: %+v", as)
+	}
+	m.a.process(context.Background(), serverStateRecord("thunder1", "s1", "DOWN"))
+	if ev := nextEvent(m); ev == nil {
+		t.Fatal("down after the up not published")
+	}
+}
+
+// A timed ack outlives the up, which still gets through.
+func TestTimedAckOutlivesUp(t *testing.T) {
+	m := newTestMonitor(t, Configuration{})
+	m.a.process(context.Background(), serverStateRecord("thunder1", "s1", "DOWN"))
+	down := nextEvent(m)
+	if down == nil {
+		t.Fatal("down not published")
+	}
+	if err := m.a.suppress.ApplyAck(AckMessage{Key: down.alertID(), For: "1h"}, "test", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	m.a.process(context.Background(), serverStateRecord("thunder1", "s1", "UP"))
+	if ev := nextEvent(m); ev == nil {
+		t.Fatal("up held back by a timed ack")
+	}
+	m.a.process(context.Background(), serverStateRecord("thunder1", "s1", "DOWN"))
+	if ev := nextEvent(m); ev != nil {
+		t.Fatalf("down published under a timed ack: %+v", ev)
+	}
+}
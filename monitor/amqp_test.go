@@ -0,0 +1,342 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAMQPFrames(t *testing.T) {
+	var in bytes.Buffer
+	in.Write(amqpFrame(amqpMethod, 1, []byte("method")))
+	in.Write(amqpFrame(amqpHeartbeat, 0, nil))
+	in.Write(amqpFrame(amqpBody, 7, bytes.Repeat([]byte("x"), 300)))
+	r := bufio.NewReader(&in)
+	for _, want := range []struct {
+		typ     byte
+		channel uint16
+		payload string
+	}{{amqpMethod, 1, "method"}, {amqpHeartbeat, 0, ""}, {amqpBody, 7, strings.Repeat("x", 300)}} {
+		typ, ch, payload, err := readAMQPFrame(r)
+		if err != nil || typ != want.typ || ch != want.channel || string(payload) != want.payload {
+			t.Errorf("frame %d on %d, %d bytes, %v; want %d on %d, %d bytes", typ, ch, len(payload), err, want.typ, want.channel, len(want.payload))
+		}
+	}
+	if _, _, _, err := readAMQPFrame(r); err != io.EOF {
+		t.Errorf("after the last frame: %v", err)
+	}
+
+	bad := amqpFrame(amqpMethod, 1, []byte("method"))
+	bad[len(bad)-1] = 0
+	for name, b := range map[string][]byte{
+		"bad frame end":                       bad,
+		"the broker doesn't speak AMQP 0-9-1": []byte("AMQP\x00\x00\x09\x01"),
+		"frame of 4294967295 bytes":           {1, 0, 1, 0xff, 0xff, 0xff, 0xff},
+	} {
+		if _, _, _, err := readAMQPFrame(bufio.NewReader(bytes.NewReader(b))); err == nil || err.Error() != name {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+}
+
+func TestAMQPWriterReader(t *testing.T) {
+	var w amqpWriter
+	w.octet(7)
+	w.short(60)
+	w.long(131072)
+	w.longlong(1 << 40)
+	w.shortstr("amq.topic")
+	w.longstr("\x00guest\x00guest")
+	w.table(map[string]string{"product": "a10-connection-rate-monitor"})
+	w.short(99)
+
+	r := amqpReader{b: w.buf.Bytes()}
+	if v := r.octet(); v != 7 {
+		t.Errorf("octet %d", v)
+	}
+	if v := r.short(); v != 60 {
+		t.Errorf("short %d", v)
+	}
+	if v := r.long(); v != 131072 {
+		t.Errorf("long %d", v)
+	}
+	if v := r.longlong(); v != 1<<40 {
+		t.Errorf("longlong %d", v)
+	}
+	if v := r.shortstr(); v != "amq.topic" {
+		t.Errorf("shortstr %q", v)
+	}
+	if v := r.longstr(); string(v) != "\x00guest\x00guest" {
+		t.Errorf("longstr %q", v)
+	}
+	table := amqpReader{b: r.b[4:]} // The table's one field: name, type, value
+	if k, typ, v := table.shortstr(), table.octet(), table.longstr(); k != "product" || typ != 'S' || string(v) != "a10-connection-rate-monitor" {
+		t.Errorf("table field %q %c %q", k, typ, v)
+	}
+	r.table()
+	if v := r.short(); v != 99 || r.err != nil {
+		t.Errorf("after the table %d, %v", v, r.err)
+	}
+
+	r = amqpReader{b: []byte{5, 'a'}}
+	if v := r.shortstr(); v != "" || r.err == nil {
+		t.Errorf("short shortstr %q, %v", v, r.err)
+	}
+	if v := r.long(); v != 0 {
+		t.Errorf("read %d after an error", v)
+	}
+}
+
+// amqpPublished is a publish as the fake broker got it.
+type amqpPublished struct {
+	exchange, key string
+	mandatory     byte
+	flags         uint16
+	contentType   string
+	deliveryMode  byte
+	messageID     string
+	appID         string
+	body          string
+	bodyFrames    int
+}
+
+// fakeAMQP is a broker that logs anyone in, with frameMax, and answers each publish with the frames
+// answer gives (built with amqpMethodFrame), or closes the connection after the login if refuse.
+func fakeAMQP(t *testing.T, frameMax uint32, refuse bool, answer func(tag uint64) [][]byte) (addr string, got chan amqpPublished, login chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	got, login = make(chan amqpPublished, 10), make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveAMQP(c, frameMax, refuse, answer, got, login)
+		}
+	}()
+	return l.Addr().String(), got, login
+}
+
+func amqpMethodFrame(channel, class, method uint16, args func(w *amqpWriter)) []byte {
+	var w amqpWriter
+	w.short(class)
+	w.short(method)
+	if args != nil {
+		args(&w)
+	}
+	return amqpFrame(amqpMethod, channel, w.buf.Bytes())
+}
+
+func serveAMQP(c net.Conn, frameMax uint32, refuse bool, answer func(tag uint64) [][]byte, got chan amqpPublished, login chan string) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:]) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+	method := func() *amqpReader {
+		for {
+			typ, _, payload, err := readAMQPFrame(r)
+			if err != nil {
+				return nil
+			}
+			if typ == amqpMethod {
+				return &amqpReader{b: payload}
+			}
+		}
+	}
+	c.Write(amqpMethodFrame(0, amqpConnection, 10, func(w *amqpWriter) { // Start
+		w.octet(0)
+		w.octet(9)
+		w.table(map[string]string{"product": "fake"})
+		w.longstr("AMQPLAIN PLAIN")
+		w.longstr("en_US")
+	}))
+	p := method() // StartOk
+	if p == nil {
+		return
+	}
+	p.short()
+	p.short()
+	p.table()
+	mech := p.shortstr()
+	login <- mech + " " + string(p.longstr())
+	if refuse {
+		c.Write(amqpMethodFrame(0, amqpConnection, 50, func(w *amqpWriter) {
+			w.short(403)
+			w.shortstr("ACCESS_REFUSED - Login was refused")
+			w.short(0)
+			w.short(0)
+		}))
+		return
+	}
+	c.Write(amqpMethodFrame(0, amqpConnection, 30, func(w *amqpWriter) { // Tune
+		w.short(2047)
+		w.long(frameMax)
+		w.short(0)
+	}))
+	method() // TuneOk
+	if p = method(); p == nil {
+		return
+	}
+	p.short()
+	p.short()
+	login <- "vhost " + p.shortstr()
+	c.Write(amqpMethodFrame(0, amqpConnection, 41, func(w *amqpWriter) { w.shortstr("") }))
+	method() // Channel open
+	c.Write(amqpMethodFrame(1, amqpChannel, 11, func(w *amqpWriter) { w.longstr("") }))
+	method() // Confirm select
+	c.Write(amqpMethodFrame(1, amqpConfirm, 11, nil))
+
+	for tag := uint64(1); ; tag++ {
+		p := method() // Basic.Publish
+		if p == nil {
+			return
+		}
+		var pub amqpPublished
+		p.short()
+		p.short()
+		p.short()
+		pub.exchange, pub.key, pub.mandatory = p.shortstr(), p.shortstr(), p.octet()
+		_, _, hdr, err := readAMQPFrame(r)
+		if err != nil {
+			return
+		}
+		h := &amqpReader{b: hdr}
+		h.short()
+		h.short()
+		size := h.longlong()
+		pub.flags = h.short()
+		pub.contentType, pub.deliveryMode = h.shortstr(), h.octet()
+		if pub.flags&(1<<7) != 0 {
+			pub.messageID = h.shortstr()
+		}
+		h.longlong()
+		pub.appID = h.shortstr()
+		var body bytes.Buffer
+		for uint64(body.Len()) < size {
+			_, _, b, err := readAMQPFrame(r)
+			if err != nil {
+				return
+			}
+			if len(b) > int(frameMax)-8 {
+				return // Over the frame size the broker gave
+			}
+			body.Write(b)
+			pub.bodyFrames++
+		}
+		pub.body = body.String()
+		got <- pub
+		for _, f := range answer(tag) {
+			c.Write(f)
+		}
+	}
+}
+
+func amqpAck(tag uint64, multiple bool) []byte {
+	return amqpMethodFrame(1, amqpBasic, 80, func(w *amqpWriter) {
+		w.longlong(tag)
+		if multiple {
+			w.octet(1)
+		} else {
+			w.octet(0)
+		}
+	})
+}
+
+func amqpOut() *Outgoing {
+	return &Outgoing{Event: Event{Rule: &Rule{}}, Topic: "alert/A10Thunder",
+		Payload: map[string]interface{}{"rule": "conn-rate-limit", "event_id": "0123abcd", "message": strings.Repeat("m", 5000)}}
+}
+
+// The handshake, then a publish split into frames no bigger than the broker allows, confirmed with an ack.
+func TestAMQPPublish(t *testing.T) {
+	addr, got, login := fakeAMQP(t, 4096, false, func(tag uint64) [][]byte { return [][]byte{amqpAck(tag, tag > 1)} })
+	a, err := newAMQPSink(AMQPConfig{URL: "amqp://a10crm:pw@" + addr + "/alerts"}, "test-client", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Publish(context.Background(), amqpOut()); err != nil {
+		t.Fatal(err)
+	}
+	if l := <-login; l != "PLAIN \x00a10crm\x00pw" {
+		t.Errorf("login %q", l)
+	}
+	if l := <-login; l != "vhost alerts" {
+		t.Errorf("opened %q", l)
+	}
+	pub := <-got
+	if pub.exchange != "amq.topic" || pub.key != "alert.A10Thunder" || pub.mandatory != 1 {
+		t.Errorf("published to %q with key %q, mandatory %d", pub.exchange, pub.key, pub.mandatory)
+	}
+	if pub.contentType != "application/json" || pub.deliveryMode != 2 || pub.messageID != "0123abcd" || pub.appID != "a10crm" {
+		t.Errorf("properties %+v", pub)
+	}
+	if pub.bodyFrames != 2 || !strings.Contains(pub.body, `"rule":"conn-rate-limit"`) {
+		t.Errorf("body in %d frames: %.60q", pub.bodyFrames, pub.body)
+	}
+
+	// The next one on the same connection, confirmed by a multiple ack
+	if err := a.Publish(context.Background(), amqpOut()); err != nil {
+		t.Fatal(err)
+	}
+	if pub := <-got; pub.messageID != "0123abcd" {
+		t.Errorf("second publish %+v", pub)
+	}
+	if len(login) != 0 {
+		t.Error("logged in again")
+	}
+}
+
+func TestAMQPRejected(t *testing.T) {
+	for _, c := range []struct {
+		answer func(tag uint64) [][]byte
+		err    string
+	}{
+		{func(tag uint64) [][]byte {
+			return [][]byte{amqpMethodFrame(1, amqpBasic, 120, func(w *amqpWriter) { w.longlong(tag); w.octet(0) })}
+		}, "amqp: the broker nacked the message"},
+		{func(tag uint64) [][]byte {
+			ret := amqpMethodFrame(1, amqpBasic, 50, func(w *amqpWriter) {
+				w.short(312)
+				w.shortstr("NO_ROUTE")
+				w.shortstr("amq.topic")
+				w.shortstr("alert.A10Thunder")
+			})
+			return [][]byte{ret, amqpFrame(amqpHeader, 1, []byte{0, 60, 0, 0}), amqpAck(tag, false)}
+		}, "amqp: no queue took the message: 312 NO_ROUTE"},
+		{func(tag uint64) [][]byte {
+			return [][]byte{amqpMethodFrame(1, amqpChannel, 40, func(w *amqpWriter) {
+				w.short(404)
+				w.shortstr("NOT_FOUND - no exchange 'x'")
+				w.short(60)
+				w.short(40)
+			})}
+		}, "amqp: broker closed the channel: 404 NOT_FOUND - no exchange 'x'"},
+	} {
+		addr, _, _ := fakeAMQP(t, 131072, false, c.answer)
+		a, err := newAMQPSink(AMQPConfig{URL: "amqp://" + addr}, "", 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Publish(context.Background(), amqpOut()); err == nil || !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("error %v, want %q", err, c.err)
+		}
+	}
+
+	addr, _, _ := fakeAMQP(t, 131072, true, nil)
+	a, _ := newAMQPSink(AMQPConfig{URL: "amqp://" + addr}, "", 2*time.Second)
+	if err := a.Publish(context.Background(), amqpOut()); err == nil || !strings.Contains(err.Error(), "login refused for 'guest'") {
+		t.Errorf("refused login: %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package monitor
+
+//
+//  anomaly.go  --  Catching a VIP that is behaving unusually for it, even below the static thresholds. The
+//    events for each object (VIP etc.) on each device are counted per window, and an exponentially weighted
+//    moving average of those counts is kept as its baseline. A window well over the baseline publishes an
+//    anomaly event:
+//
+//  "anomaly": { "window": "1m", "alpha": 0.1, "factor": 3, "min_events": 5, "warmup": 30,
+//               "types": ["conn.rate-limit"], "topic": "alert/A10Thunder/anomaly", "severity": "warning" }
+//
+//    window      how long each count is over. "" (the default) = no anomaly detection
+//    alpha       how much each window moves the baseline, 0 to 1. Default 0.1
+//    factor      how many standard deviations over the baseline is unusual. Default 3
+//    min_events  a window needs at least this many events to be unusual at all. Default 5
+//    warmup      windows an object must have been seen for before it can be unusual. Default 30
+//    types       the event types counted. Default conn.rate-limit
+//    topic       default notify_topic + "/anomaly"
+//    severity    default warning
+//
+//  The event has type "<type>.anomaly", "count" (this window), "baseline" and "stddev" (before it was
+//  counted in), "deviation" (how many standard deviations over) and "window". Every match is counted,
+//  including ones held back by thresholds, suppression or silences. It goes through those like any other
+//  event, though, so it can be suppressed and silenced as "<type>.anomaly".
+//
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// AnomalyConfig holds the 'anomaly' section of the config.
+type AnomalyConfig struct {
+	Window     string   `json:"window"`
+	Alpha      float64  `json:"alpha"`
+	Factor     float64  `json:"factor"`
+	Min_Events int      `json:"min_events"`
+	Warmup     int      `json:"warmup"`
+	Types      []string `json:"types"`
+	Topic      string   `json:"topic"`
+	Severity   string   `json:"severity"`
+}
+
+// baseline is one object's EWMA of events per window.
+type baseline struct {
+	ev       Event // The latest, for the anomaly event
+	count    int   // In this window
+	mean     float64
+	variance float64
+	windows  int
+}
+
+type anomalies struct {
+	cfg    AnomalyConfig
+	window time.Duration
+	types  map[string]bool
+	rule   *Rule
+
+	mu    sync.Mutex
+	state map[string]*baseline
+}
+
+// newAnomalies is nil if anomaly detection is off.
+func newAnomalies(cfg AnomalyConfig) (*anomalies, error) {
+	if cfg.Window == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(cfg.Window)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("anomaly: bad window '%s'", cfg.Window)
+	}
+	if cfg.Alpha == 0 {
+		cfg.Alpha = 0.1
+	}
+	if cfg.Alpha < 0 || cfg.Alpha > 1 {
+		return nil, fmt.Errorf("anomaly: alpha must be between 0 and 1")
+	}
+	if cfg.Factor <= 0 {
+		cfg.Factor = 3
+	}
+	if cfg.Min_Events <= 0 {
+		cfg.Min_Events = 5
+	}
+	if cfg.Warmup <= 0 {
+		cfg.Warmup = 30
+	}
+	if len(cfg.Types) == 0 {
+		cfg.Types = []string{"conn.rate-limit"}
+	}
+	if cfg.Severity == "" {
+		cfg.Severity = "warning"
+	}
+	sev, ok := normalizeSeverity(cfg.Severity)
+	if !ok {
+		return nil, fmt.Errorf("anomaly: unknown severity '%s'", cfg.Severity)
+	}
+	rule := &Rule{Name: "anomaly", Severity: sev, Topic: cfg.Topic, subTopic: "anomaly"}
+	if err := rule.compileTopic(); err != nil {
+		return nil, err
+	}
+	types := make(map[string]bool)
+	for _, t := range cfg.Types {
+		types[t] = true
+	}
+	return &anomalies{cfg: cfg, window: d, types: types, rule: rule, state: make(map[string]*baseline)}, nil
+}
+
+// add counts an event.
+func (an *anomalies) add(ev Event) {
+	if an == nil || ev.summary() || ev.Test || !an.types[ev.Type] {
+		return
+	}
+	key := suppressKey(ev.Device, ev.Type, ev.Object)
+	an.mu.Lock()
+	b, ok := an.state[key]
+	if !ok {
+		b = &baseline{}
+		an.state[key] = b
+	}
+	b.ev = ev
+	b.count++
+	an.mu.Unlock()
+}
+
+// closeWindow moves every baseline on by a window, returning the anomaly events for the ones that were
+// unusual in it.
+func (an *anomalies) closeWindow() []Event {
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	var out []Event
+	for key, b := range an.state {
+		x := float64(b.count)
+		stddev := math.Sqrt(b.variance)
+		if b.windows >= an.cfg.Warmup && b.count >= an.cfg.Min_Events && x > b.mean+an.cfg.Factor*stddev {
+			dev := math.Inf(1)
+			if stddev > 0 {
+				dev = (x - b.mean) / stddev
+			}
+			out = append(out, an.event(b, stddev, dev))
+		}
+		if b.windows == 0 {
+			b.mean = x // The first window is the first baseline
+		} else {
+			diff := x - b.mean
+			incr := an.cfg.Alpha * diff
+			b.mean += incr
+			b.variance = (1 - an.cfg.Alpha) * (b.variance + diff*incr)
+		}
+		b.windows++
+		b.count = 0
+		if b.mean < 0.01 && b.windows > an.cfg.Warmup {
+			delete(an.state, key) // Gone quiet; starts warming up again if it comes back
+		}
+	}
+	return out
+}
+
+func (an *anomalies) event(b *baseline, stddev float64, dev float64) Event {
+	ev := b.ev
+	ev.Rule = an.rule
+	ev.Type = b.ev.Type + ".anomaly"
+	ev.Severity, ev.SyslogSeverity = an.rule.Severity, severityLevel(an.rule.Severity)
+	ev.Deadline = time.Time{}
+	ev.Escalation = 0
+	obj := b.ev.Object
+	if obj == "" {
+		obj = b.ev.Device
+	}
+	ev.Fields = map[string]interface{}{
+		"count":    b.count,
+		"baseline": math.Round(b.mean*100) / 100,
+		"stddev":   math.Round(stddev*100) / 100,
+		"window":   an.window.String(),
+	}
+	if !math.IsInf(dev, 1) {
+		ev.Fields["deviation"] = math.Round(dev*10) / 10
+	}
+	for _, k := range []string{"object_type", "object_name"} {
+		if v, ok := b.ev.Fields[k]; ok {
+			ev.Fields[k] = v
+		}
+	}
+	ev.Message = fmt.Sprintf("Unusual %s for %s: %d in %s, against a baseline of %.1f", b.ev.Type, obj, b.count, an.window, b.mean)
+	return ev
+}
+
+// detectAnomalies closes a window every window.
+func (a *agent) detectAnomalies(ctx context.Context) {
+	if a.anomaly == nil {
+		return
+	}
+	tick := time.NewTicker(a.anomaly.window)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			for _, ev := range a.anomaly.closeWindow() {
+				a.emit(ctx, a.config, ev)
+			}
+		}
+	}
+}
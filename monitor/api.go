@@ -0,0 +1,122 @@
+package monitor
+
+//
+//  api.go  --  A small HTTP API for looking at (and poking) the running agent. Turned on by setting
+//    'api_listen' in the config, e.g. "api_listen": "0.0.0.0:8080".
+//
+//    GET  /status            agent version, uptime and the lifetime counters
+//    GET  /counters          just the counters
+//    POST /counters/reset    zero the counters (?device=name for just one Thunder device)
+//    GET  /metrics           Prometheus metrics, see metrics.go
+//    GET  /suppressions      suppression windows and thresholds, which can be reset or extended (suppress.go)
+//    POST /acks              acknowledge or close an alert (acks.go)
+//    GET  /subscriptions     the shared subscription filters for consumers, with mqtt_shared (sharedsub.go)
+//    GET  /silences          maintenance windows, which can be added and removed (silences.go)
+//    GET  /tuning            thresholds and suppression windows, which can be changed live (tuning.go)
+//    POST /drill             send a synthetic test alert through the outputs, for paging drills (drill.go)
+//
+//  Anything that changes state needs 'api_token' set, and an "Authorization: Bearer <token>" header with it.
+//  Without a token the API only looks: the POSTs are refused (403), since anyone who can reach it could
+//  otherwise zero the counters or ack and snooze alerts.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var startTime = time.Now()
+
+// requireToken wraps a handler that changes state, so it checks the method and the bearer token. token is
+// 'api_token'; empty = the handler is refused.
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if token == "" {
+			http.Error(w, "Changing state needs an api_token", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(v, "", "  ")
+	w.Write(b)
+}
+
+func (c *Counters) registerAPI(mux *http.ServeMux, token string) {
+	mux.HandleFunc("/counters", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(c.JSON())
+	})
+	mux.HandleFunc("/counters/reset", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		c.Reset(r.URL.Query().Get("device"))
+		writeJSON(w, map[string]string{"result": "ok"})
+	}))
+}
+
+// newAPI is the API's mux, with the endpoints that aren't any one part's. Each Monitor has its own.
+func newAPI(token string, counters *Counters, metrics *Metrics, suppress *Suppressions, subscriptions func() []string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metrics.handler)
+	suppress.registerAPI(mux, token)
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := map[string]interface{}{
+			"version":  Version,
+			"started":  startTime.UTC().Format(time.RFC3339),
+			"uptime":   int(time.Since(startTime).Seconds()),
+			"counters": json.RawMessage(counters.JSON()),
+		}
+		if addr := syslogAddr(); addr != "" {
+			status["syslog_listen"] = addr // See listen.go
+		}
+		if metrics.health != nil {
+			status["outputs"] = metrics.health.slis(time.Now()) // See health.go
+		}
+		if subscriptions != nil {
+			status["subscriptions"] = subscriptions()
+		}
+		writeJSON(w, status)
+	})
+	if subscriptions != nil {
+		mux.HandleFunc("/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, subscriptions())
+		})
+	}
+	counters.registerAPI(mux, token)
+	return mux
+}
+
+// serveHTTP serves h on listen until stop is called, which shuts the server down, giving requests in
+// progress a second to finish. Once it returns the address is free again, for the next Run.
+func serveHTTP(what string, listen string, h http.Handler, debug int) (stop func()) {
+	srv := &http.Server{Addr: listen, Handler: h}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		err := srv.ListenAndServe()
+		if debug > 3 {
+			fmt.Println(">>> " + what + " listener stopped: " + err.Error())
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if srv.Shutdown(ctx) != nil {
+			srv.Close()
+		}
+		<-stopped
+	}
+}
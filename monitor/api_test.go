@@ -0,0 +1,67 @@
+package monitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Without an api_token nothing on the API changes state, and with one it takes the token.
+func TestAPIChangesNeedToken(t *testing.T) {
+	for _, token := range []string{"", "s3cret"} {
+		m := newTestMonitor(t, Configuration{API_Token: token})
+		mux := http.NewServeMux()
+		m.a.counters.registerAPI(mux, token)
+		m.a.suppress.registerAPI(mux, token)
+		m.a.registerTuningAPI(mux)
+		m.a.silences.registerAPI(mux, token)
+
+		for _, c := range []struct {
+			path, body string
+			want       int // With the token
+		}{
+			{"/counters/reset", ``, http.StatusOK},
+			{"/suppressions/reset", ``, http.StatusOK},
+			{"/suppressions/extend?key=thunder1/conn.rate-limit/ws-vip&by=10m", ``, http.StatusNotFound},
+			{"/acks", `{ "ack": "thunder1/conn.rate-limit/ws-vip" }`, http.StatusOK},
+			{"/acks", `{ "snooze": "thunder1/conn.rate-limit/ws-vip", "for": "1h" }`, http.StatusOK},
+			{"/tuning", `{ "suppress": { "ws-vip": "0s" } }`, http.StatusOK},
+			{"/silences", `{ "name": "all", "end": "2030-01-01T00:00:00Z" }`, http.StatusOK},
+			{"/silences/remove?name=all", ``, http.StatusOK},
+		} {
+			post := func(auth string) int {
+				r := httptest.NewRequest("POST", c.path, strings.NewReader(c.body))
+				if auth != "" {
+					r.Header.Set("Authorization", "Bearer "+auth)
+				}
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				return w.Code
+			}
+			if token == "" {
+				if code := post(""); code != http.StatusForbidden && code != http.StatusNotFound {
+					t.Errorf("POST %s without an api_token: %d", c.path, code)
+				}
+				continue
+			}
+			if code := post("wrong"); code != http.StatusUnauthorized {
+				t.Errorf("POST %s with the wrong token: %d", c.path, code)
+			}
+			if code := post(token); code != c.want {
+				t.Errorf("POST %s with the token: %d", c.path, code)
+			}
+		}
+		if token == "" && len(m.a.suppress.Acks())+len(m.a.suppress.Snoozes()) != 0 {
+			t.Error("acked or snoozed without an api_token")
+		}
+
+		for _, path := range []string{"/tuning", "/suppressions", "/counters", "/silences"} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("GET %s with token %q: %d", path, token, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package monitor
+
+//
+//  clusters.go  --  Merging what the members of a Thunder HA pair or aVCS cluster say, since both of them
+//    log the same VIP going over its limit and that is one problem, not two:
+//
+//  "clusters": [ { "name": "dc1-edge", "members": ["thunder-dc1-a", "thunder-dc1-b"], "window": "30s" } ]
+//
+//    name     what the cluster is called in the payload
+//    members  the members' hostnames, which may use shell-style wildcards like 'hosts' (hosts.go)
+//    window   how long after one member's event the same event from another member is taken to be the
+//             same alert. Default 30s
+//
+//  Every event from a member has "cluster" in the payload. For each event type and object in a cluster,
+//  the first member to report it is the one published; the same event from another member within the
+//  window of the last one is counted (a10crm_cluster_merged_total) and goes no further: no threshold,
+//  suppression or all-clear of its own. The published one has "cluster_members", the members that have
+//  reported it. If the member that was reporting it goes quiet for longer than the window, the next
+//  member to report it takes over, so a failover still gets its alert.
+//
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClusterConfig is one entry of the 'clusters' section.
+type ClusterConfig struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	Window  string   `json:"window"`
+}
+
+// clusterAlert is one event type and object in a cluster.
+type clusterAlert struct {
+	device  string // The member whose events are published
+	last    time.Time
+	members map[string]bool
+}
+
+type cluster struct {
+	ClusterConfig
+	window time.Duration
+	merged uint64
+}
+
+type clusters struct {
+	mu     sync.Mutex
+	list   []*cluster
+	alerts map[string]*clusterAlert
+}
+
+// newClusters checks the 'clusters' section. nil if there aren't any.
+func newClusters(cfg []ClusterConfig) (*clusters, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	c := &clusters{alerts: make(map[string]*clusterAlert)}
+	seen := make(map[string]bool)
+	for _, cc := range cfg {
+		if cc.Name == "" || len(cc.Members) == 0 {
+			return nil, fmt.Errorf("clusters: each needs a 'name' and 'members'")
+		}
+		if seen[cc.Name] {
+			return nil, fmt.Errorf("clusters: '%s' given twice", cc.Name)
+		}
+		seen[cc.Name] = true
+		if err := (&HostsConfig{Allow: cc.Members}).check(); err != nil {
+			return nil, fmt.Errorf("clusters: %s: %v", cc.Name, err)
+		}
+		cl := &cluster{ClusterConfig: cc, window: 30 * time.Second}
+		if cc.Window != "" {
+			d, err := time.ParseDuration(cc.Window)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("clusters: %s: bad window '%s'", cc.Name, cc.Window)
+			}
+			cl.window = d
+		}
+		c.list = append(c.list, cl)
+	}
+	return c, nil
+}
+
+// of is the cluster the device is a member of, nil if none. The first that lists it.
+func (c *clusters) of(device string) *cluster {
+	if c == nil {
+		return nil
+	}
+	for _, cl := range c.list {
+		if hostListed(device, cl.Members) {
+			return cl
+		}
+	}
+	return nil
+}
+
+// merge notes ev against its cluster. hold says another member has already reported it; otherwise ev has
+// had the cluster fields added.
+func (c *clusters) merge(ev *Event, now time.Time) (hold bool) {
+	cl := c.of(ev.Device)
+	if cl == nil {
+		return false
+	}
+	fields := make(map[string]interface{}, len(ev.Fields)+2)
+	for k, v := range ev.Fields {
+		fields[k] = v
+	}
+	fields["cluster"] = cl.Name
+	if ev.summary() {
+		ev.Fields = fields
+		return false
+	}
+	key := cl.Name + "::" + ev.Type + "::" + ev.Object
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.alerts) > 10000 {
+		c.prune(now)
+	}
+	ca, ok := c.alerts[key]
+	if !ok || now.Sub(ca.last) > cl.window {
+		ca = &clusterAlert{device: ev.Device, members: make(map[string]bool)}
+		c.alerts[key] = ca
+	}
+	ca.members[ev.Device] = true
+	if ca.device != ev.Device {
+		cl.merged++
+		return true
+	}
+	ca.last = now
+	members := make([]string, 0, len(ca.members))
+	for m := range ca.members {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	fields["cluster_members"] = members
+	ev.Fields = fields
+	return false
+}
+
+// prune drops the alerts not heard of for an hour, well past any sensible window. Caller holds c.mu.
+func (c *clusters) prune(now time.Time) {
+	for k, ca := range c.alerts {
+		if now.Sub(ca.last) > time.Hour {
+			delete(c.alerts, k)
+		}
+	}
+}
+
+// writeMetrics adds the merge counts, see metrics.go.
+func (c *clusters) writeMetrics(p *promWriter) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cl := range c.list {
+		p.metric("a10crm_cluster_merged_total", "counter", "Events held back because another member of the cluster had already reported them.", fmt.Sprintf(`cluster="%s"`, promLabel(cl.Name)), cl.merged)
+	}
+}
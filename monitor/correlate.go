@@ -0,0 +1,296 @@
+package monitor
+
+//
+//  correlate.go  --  Correlation rules: a higher-severity alert when several kinds of event turn up on the
+//    same device (or the same VIP) within a time window, e.g. the connection rate limit being hit while
+//    servers behind it go down, which means customers are feeling it rather than just noise. They go in
+//    the rules file next to the rules:
+//
+//  {
+//    "rules": [ ... ],
+//    "correlations": [
+//      { "name": "rate-limit-and-server-down",
+//        "when": ["event.type == \"conn.rate-limit\"", "event.type == \"server.state\" && event.state == \"down\""],
+//        "window": "60s",
+//        "by": "device",
+//        "severity": "critical" }
+//    ]
+//  }
+//
+//  Each "when" expression (see expr.go) is checked against every match. Once all of them have been true
+//  within the window for the same device ("by": "device", the default), the same device and object_name
+//  ("by": "object") or the same device and VIP ("by": "vip"), a composite event of type 'type' (default
+//  "correlated.<name>") is published to 'topic' (default notify_topic + "/correlated"), and the window
+//  starts over.
+//
+//  "by": "vip" ties a server or service group to the VIP in front of it, so a server going down can be
+//  put together with its VIP's rate limit: the VIP is the event's "vip" field if it has one, else the
+//  'vip' of its server, service group or object in the config's 'services' (see runbooks.go), else its
+//  object_name.
+//
+//  The composite event has a "correlation_id", and "events", the event that made each expression true.
+//  Events that match the correlation within the window after it fired get the same correlation_id, so
+//  they can be put with it; with "absorb": true they aren't published at all, only counted, and the
+//  composite event stands for them:
+//
+//      { "name": "vip-overloaded", "by": "vip", "window": "30s", "absorb": true,
+//        "when": ["event.type == \"conn.rate-limit\"", "event.type == \"server.state\" && event.state == \"down\""] }
+//
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Correlation is one correlation rule.
+type Correlation struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`     // Default "correlated." + name
+	When     []string `json:"when"`     // Expressions that must all have been true within the window
+	Window   string   `json:"window"`   // Default "60s"
+	By       string   `json:"by"`       // "device" (default), "object" or "vip"
+	Severity string   `json:"severity"` // Default "critical"
+	Topic    string   `json:"topic"`    // Default notify_topic + "/correlated"
+	Sinks    []string `json:"sinks"`    // Default all outputs, see sinks.go
+	Absorb   bool     `json:"absorb"`   // Don't publish the events that come after it fired, within the window
+
+	when   []*Expr
+	window time.Duration
+	rule   *Rule // What the composite events are published as
+}
+
+func (c *Correlation) compile() error {
+	if c.Name == "" {
+		return errors.New("Correlation with no name!")
+	}
+	if len(c.When) < 2 {
+		return fmt.Errorf("Correlation '%s' needs at least two 'when' expressions", c.Name)
+	}
+	for _, w := range c.When {
+		x, err := compileExpr(w)
+		if err != nil {
+			return fmt.Errorf("Correlation '%s': bad expression: %v", c.Name, err)
+		}
+		c.when = append(c.when, x)
+	}
+	c.window = 60 * time.Second
+	if c.Window != "" {
+		d, err := time.ParseDuration(c.Window)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Correlation '%s': bad window '%s'", c.Name, c.Window)
+		}
+		c.window = d
+	}
+	switch c.By {
+	case "":
+		c.By = "device"
+	case "device", "object", "vip":
+	default:
+		return fmt.Errorf("Correlation '%s': 'by' must be \"device\", \"object\" or \"vip\"", c.Name)
+	}
+	if c.Type == "" {
+		c.Type = "correlated." + c.Name
+	}
+	if c.Severity == "" {
+		c.Severity = "critical"
+	}
+	sev, ok := normalizeSeverity(c.Severity)
+	if !ok {
+		return fmt.Errorf("Correlation '%s': unknown severity '%s'", c.Name, c.Severity)
+	}
+	c.Severity = sev
+	c.rule = &Rule{Name: c.Name, Type: c.Type, Severity: c.Severity, Topic: c.Topic, Sinks: c.Sinks, subTopic: "correlated"}
+	return c.rule.compileTopic()
+}
+
+// loadCorrelations compiles the correlation rules from the rules file.
+func loadCorrelations(rf RulesFile) ([]*Correlation, error) {
+	for _, c := range rf.Correlations {
+		if err := c.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rf.Correlations, nil
+}
+
+// correlation state for one correlation rule and device (or device and object).
+type correlating struct {
+	seen    []time.Time // When each 'when' expression was last true
+	matched []string    // The event type that made it true
+	events  []Event     // The event that made it true
+}
+
+// fired is a correlation that went off, for giving the events after it its correlation_id.
+type fired struct {
+	id    string
+	until time.Time
+}
+
+type correlator struct {
+	rules    []*Correlation
+	services map[string]ServiceConfig // For "by": "vip"
+	mu       sync.Mutex
+	state    map[string]*correlating
+	fired    map[string]fired
+}
+
+func newCorrelator(rules []*Correlation, services map[string]ServiceConfig) *correlator {
+	return &correlator{rules: rules, services: services, state: make(map[string]*correlating), fired: make(map[string]fired)}
+}
+
+// vip is the VIP an event is about, for "by": "vip". "" if it can't tell.
+func (c *correlator) vip(event map[string]interface{}, obj string) string {
+	if v, _ := event["vip"].(string); v != "" {
+		return v
+	}
+	for _, f := range serviceFields {
+		name, _ := event[f].(string)
+		if svc, ok := c.services[name]; ok && name != "" && svc.VIP != "" {
+			return svc.VIP
+		}
+	}
+	return obj
+}
+
+// Observe records an event, returning the composite events (if any) it completes. An event that comes
+// after a correlation went off gets its correlation_id, and absorbed is true if it shouldn't be published.
+func (c *correlator) Observe(m *Event, now time.Time) (out []Event, absorbed bool) {
+	if len(c.rules) == 0 {
+		return nil, false
+	}
+	event := m.Payload()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.rules {
+		obj := m.Object
+		if r.By == "vip" {
+			obj = c.vip(event, m.Object)
+		}
+		if r.By != "device" && obj == "" {
+			continue
+		}
+		key := r.Name + "/" + m.Device
+		if r.By != "device" {
+			key += "/" + m.Partition + "/" + obj
+		}
+		st := c.state[key]
+		hit := false
+		for i, w := range r.when {
+			if !exprTrue(w, event) {
+				continue
+			}
+			hit = true
+			if st == nil {
+				st = &correlating{seen: make([]time.Time, len(r.when)), matched: make([]string, len(r.when)), events: make([]Event, len(r.when))}
+				c.state[key] = st
+			}
+			st.seen[i] = now
+			st.matched[i] = m.Type
+			st.events[i] = *m
+		}
+		if f, ok := c.fired[key]; hit && ok && now.Before(f.until) {
+			m.Fields["correlation_id"] = f.id
+			absorbed = absorbed || r.Absorb
+		}
+		if st == nil || !st.complete(now, r.window) {
+			continue
+		}
+		delete(c.state, key)
+		id := newEventID()
+		c.fired[key] = fired{id: id, until: now.Add(r.window)}
+		m.Fields["correlation_id"] = id
+		types := st.types()
+		f := map[string]interface{}{"correlated": types, "correlation_id": id, "events": st.summaries()}
+		if r.By != "device" {
+			f["object_name"] = obj
+		}
+		if r.By == "vip" {
+			f["vip"] = obj
+		}
+		msg := strings.Join(types, " + ") + " on " + m.Device
+		if r.By != "device" {
+			msg += " for " + obj
+		}
+		ce := Event{Rule: r.rule, Device: m.Device, Partition: m.Partition, Type: r.Type, Severity: r.Severity,
+			SyslogSeverity: severityLevel(r.Severity), Facility: m.Facility, Message: msg + " within " + r.window.String(),
+			Fields: f, Time: now, Received: now}
+		if r.By != "device" {
+			ce.Object = obj
+		}
+		out = append(out, ce)
+	}
+	c.expire(now)
+	return out, absorbed
+}
+
+// summaries is the event behind each expression, for the composite event's "events".
+func (st *correlating) summaries() []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, ev := range st.events {
+		s := map[string]interface{}{"type": ev.Type, "message": ev.Message, "timestamp": ev.Time.UTC().Format(time.RFC3339)}
+		if ev.Object != "" {
+			s["object_name"] = ev.Object
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// complete says whether every expression has been true within the window.
+func (st *correlating) complete(now time.Time, window time.Duration) bool {
+	for _, t := range st.seen {
+		if t.IsZero() || now.Sub(t) > window {
+			return false
+		}
+	}
+	return true
+}
+
+// types lists the distinct event types involved, sorted.
+func (st *correlating) types() []string {
+	seen := make(map[string]bool)
+	var ts []string
+	for _, t := range st.matched {
+		if !seen[t] {
+			seen[t] = true
+			ts = append(ts, t)
+		}
+	}
+	sort.Strings(ts)
+	return ts
+}
+
+// expire drops state that can no longer complete. Caller holds c.mu.
+func (c *correlator) expire(now time.Time) {
+	if len(c.fired) >= 1000 {
+		for k, f := range c.fired {
+			if !now.Before(f.until) {
+				delete(c.fired, k)
+			}
+		}
+	}
+	if len(c.state) < 1000 {
+		return // Not worth the bother
+	}
+	longest := time.Duration(0)
+	for _, r := range c.rules {
+		if r.window > longest {
+			longest = r.window
+		}
+	}
+	for k, st := range c.state {
+		stale := true
+		for _, t := range st.seen {
+			if !t.IsZero() && now.Sub(t) <= longest {
+				stale = false
+			}
+		}
+		if stale {
+			delete(c.state, k)
+		}
+	}
+}
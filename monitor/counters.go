@@ -0,0 +1,229 @@
+package monitor
+
+//
+//  counters.go  --  Lifetime counts of records received, matched and published, per Thunder device and
+//    per event type. If 'state_file' is set in the config they are saved there every 30 seconds and on
+//    shutdown, and loaded again at startup, so they survive restarts. POST /counters/reset on the API
+//    zeroes them (all of them, or just one device with ?device=name).
+//
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ClassCounters counts the records of one event type from one device.
+type ClassCounters struct {
+	Matched   uint64 `json:"matched"`
+	Published uint64 `json:"published"`
+}
+
+// DeviceCounters counts the records from one device.
+type DeviceCounters struct {
+	Received    uint64                    `json:"received"`
+	Substituted uint64                    `json:"timestamps_substituted"` // Records with a missing or bad timestamp
+	Filtered    uint64                    `json:"filtered"`               // Dropped by syslog_filter
+	Dropped     map[string]uint64         `json:"dropped,omitempty"`      // By drop rule, see drops.go
+	Silenced    map[string]uint64         `json:"silenced,omitempty"`     // Events held back, by silence. See silences.go
+	Classes     map[string]*ClassCounters `json:"classes"`
+}
+
+// Counters is safe to use from several goroutines.
+type Counters struct {
+	mu      sync.Mutex
+	Since   time.Time                  `json:"since"` // When counting started, or was last reset
+	Devices map[string]*DeviceCounters `json:"devices"`
+	file    string
+	changes uint64     // Counts changed, so Save knows whether there is anything to write
+	saved   uint64     // changes as of the last Save that made it to the file
+	saveMu  sync.Mutex // One Save at a time; c.mu isn't held while writing
+}
+
+func newCounters(fn string) *Counters {
+	c := &Counters{Since: time.Now().UTC(), Devices: make(map[string]*DeviceCounters), file: fn}
+	if fn == "" {
+		return c
+	}
+	if b, err := ioutil.ReadFile(fn); err == nil {
+		json.Unmarshal(b, c)
+		if c.Devices == nil {
+			c.Devices = make(map[string]*DeviceCounters)
+		}
+	}
+	return c
+}
+
+// device returns the counters for the device, creating them. Caller holds c.mu.
+func (c *Counters) device(host string) *DeviceCounters {
+	d, ok := c.Devices[host]
+	if !ok {
+		d = &DeviceCounters{Classes: make(map[string]*ClassCounters)}
+		c.Devices[host] = d
+	}
+	return d
+}
+
+// class returns the counters for the device and event type, creating them. Caller holds c.mu.
+func (c *Counters) class(host string, class string) *ClassCounters {
+	d := c.device(host)
+	cc, ok := d.Classes[class]
+	if !ok {
+		cc = &ClassCounters{}
+		d.Classes[class] = cc
+	}
+	return cc
+}
+
+func (c *Counters) Received(host string) {
+	c.mu.Lock()
+	c.device(host).Received++
+	c.changes++
+	c.mu.Unlock()
+}
+
+func (c *Counters) TimestampSubstituted(host string) {
+	c.mu.Lock()
+	c.device(host).Substituted++
+	c.changes++
+	c.mu.Unlock()
+}
+
+func (c *Counters) Filtered(host string) {
+	c.mu.Lock()
+	c.device(host).Filtered++
+	c.changes++
+	c.mu.Unlock()
+}
+
+func (c *Counters) Dropped(host string, rule string) {
+	c.mu.Lock()
+	d := c.device(host)
+	if d.Dropped == nil {
+		d.Dropped = make(map[string]uint64)
+	}
+	d.Dropped[rule]++
+	c.changes++
+	c.mu.Unlock()
+}
+
+func (c *Counters) Silenced(host string, silence string) {
+	c.mu.Lock()
+	d := c.device(host)
+	if d.Silenced == nil {
+		d.Silenced = make(map[string]uint64)
+	}
+	d.Silenced[silence]++
+	c.changes++
+	c.mu.Unlock()
+}
+
+func (c *Counters) Matched(host string, class string) {
+	c.mu.Lock()
+	c.class(host, class).Matched++
+	c.changes++
+	c.mu.Unlock()
+}
+
+func (c *Counters) Published(host string, class string) {
+	c.mu.Lock()
+	c.class(host, class).Published++
+	c.changes++
+	c.mu.Unlock()
+}
+
+// Reset zeroes the counters for one device, or all of them if host is "".
+func (c *Counters) Reset(host string) {
+	c.mu.Lock()
+	if host == "" {
+		c.Devices = make(map[string]*DeviceCounters)
+		c.Since = time.Now().UTC()
+	} else {
+		delete(c.Devices, host)
+	}
+	c.changes++
+	c.mu.Unlock()
+	c.Save()
+}
+
+// Totals are the counts summed over every device: received, matched and published, and how many devices.
+func (c *Counters) Totals() (received, matched, published uint64, devices int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range c.Devices {
+		received += d.Received
+		for _, cl := range d.Classes {
+			matched += cl.Matched
+			published += cl.Published
+		}
+	}
+	return received, matched, published, len(c.Devices)
+}
+
+// JSON returns a snapshot of the counters, for the API.
+func (c *Counters) JSON() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, _ := json.MarshalIndent(c, "", "  ")
+	return b
+}
+
+// Save writes the counters to the state file, if there is one and anything changed. saveEvery and a reset
+// on the API can both call it; they take turns.
+func (c *Counters) Save() error {
+	if c.file == "" {
+		return nil
+	}
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	c.mu.Lock()
+	changes := c.changes
+	if changes == c.saved {
+		c.mu.Unlock()
+		return nil
+	}
+	b, _ := json.Marshal(c)
+	c.mu.Unlock()
+
+	// A file of its own to write to, renamed over the state file so a crash mid-write doesn't lose everything
+	f, err := ioutil.TempFile(filepath.Dir(c.file), filepath.Base(c.file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err // Still unsaved, so the next Save tries again
+	}
+	c.mu.Lock()
+	c.saved = changes // Anything counted since is still to save
+	c.mu.Unlock()
+	return nil
+}
+
+// saveEvery keeps the state file up to date until ctx is done.
+func (c *Counters) saveEvery(ctx context.Context, d time.Duration) {
+	tick := time.NewTicker(d)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			c.Save()
+		}
+	}
+}
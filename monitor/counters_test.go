@@ -0,0 +1,61 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Saves from several goroutines at once each write a whole file, leave no temporary files behind, and a
+// failed one leaves the counters to be saved again.
+func TestCountersSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	fn := filepath.Join(dir, "state", "counters.json")
+	c := newCounters(fn)
+	c.Received("thunder1")
+	if err := c.Save(); err == nil {
+		t.Fatal("saved to a directory that isn't there")
+	}
+	os.Mkdir(filepath.Join(dir, "state"), 0755)
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := newCounters(fn); got.Devices["thunder1"] == nil || got.Devices["thunder1"].Received != 1 {
+		t.Fatalf("the failed save's counts weren't saved later: %+v", got.Devices)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Received("thunder1")
+			if i%5 == 0 {
+				c.Reset("thunder2")
+			} else if err := c.Save(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := newCounters(fn); got.Devices["thunder1"] == nil || got.Devices["thunder1"].Received != 21 {
+		t.Errorf("saved counts %+v, want 21 received", got.Devices["thunder1"])
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "state"))
+	if len(files) != 1 {
+		for _, f := range files {
+			t.Log(f.Name())
+		}
+		t.Errorf("%d files in the state directory, want just the state file", len(files))
+	}
+}
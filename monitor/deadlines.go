@@ -0,0 +1,69 @@
+package monitor
+
+//
+//  deadlines.go  --  Upper bounds on how long the steps between a Syslog record arriving and its alert going
+//    out may take, so a slow broker, plugin or template can't make an alert arbitrarily late:
+//
+//  "deadlines": { "event": "30s", "template": "200ms", "mqtt": "10s", "plugin": "10s", "grafana": "10s", "sink": "10s" }
+//
+//    event      the whole budget for an event, from the record being received to its last output attempt.
+//               Every step below gets its own limit or whatever is left of this, if that is less. Default none
+//    template   rendering the rule's "set" and "topic" templates and the event_key, together. Default 1s
+//    mqtt       each publish to the broker. Default 10s
+//    plugin     each output plugin's reply. Default 10s
+//    grafana    each call to Grafana. It is off the alert path, so the event budget doesn't apply. Default 10s
+//    sink       each publish to any other sink (Kafka, ...; see sinks.go). Default 10s
+//
+//  An MQTT publish that runs out of time goes to the spool like any other failed publish (see spool.go).
+//  Events whose budget ran out before all their outputs had them are counted as "late" in the heartbeat.
+//
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeadlineConfig holds the 'deadlines' section of the config.
+type DeadlineConfig struct {
+	Event    string `json:"event"`
+	Template string `json:"template"`
+	MQTT     string `json:"mqtt"`
+	Plugin   string `json:"plugin"`
+	Grafana  string `json:"grafana"`
+	Sink     string `json:"sink"`
+}
+
+type deadlines struct {
+	event    time.Duration // 0 = no budget
+	template time.Duration
+	mqtt     time.Duration
+	plugin   time.Duration
+	grafana  time.Duration
+	sink     time.Duration
+}
+
+func newDeadlines(cfg DeadlineConfig) (deadlines, error) {
+	d := deadlines{template: time.Second, mqtt: 10 * time.Second, plugin: 10 * time.Second, grafana: 10 * time.Second, sink: 10 * time.Second}
+	for _, f := range []struct {
+		name string
+		s    string
+		d    *time.Duration
+	}{
+		{"event", cfg.Event, &d.event},
+		{"template", cfg.Template, &d.template},
+		{"mqtt", cfg.MQTT, &d.mqtt},
+		{"plugin", cfg.Plugin, &d.plugin},
+		{"grafana", cfg.Grafana, &d.grafana},
+		{"sink", cfg.Sink, &d.sink},
+	} {
+		if f.s == "" {
+			continue
+		}
+		v, err := time.ParseDuration(f.s)
+		if err != nil || v <= 0 {
+			return deadlines{}, fmt.Errorf("Bad %s deadline '%s'", f.name, f.s)
+		}
+		*f.d = v
+	}
+	return d, nil
+}
@@ -0,0 +1,121 @@
+package monitor
+
+//
+//  dedup.go  --  Thunder repeats the same message every second for as long as an incident lasts. With a
+//    dedup window, the first of a run of identical events is published and the repeats are only counted;
+//    when the window closes, one summary saying how many there were is published in their place.
+//
+//  "dedup": { "window": "30s" }
+//
+//  Events are identical if they come from the same device (and partition), are of the same type and have
+//  the same message once case and spacing are evened out. The summary is the first event again, with
+//  "repeat_count" (all of them, the first included), "first_seen" and "last_seen" added. A run of one
+//  gets no summary.
+//
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupConfig holds the 'dedup' section of the config.
+type DedupConfig struct {
+	Window string `json:"window"` // e.g. "30s"; "" = no dedup
+}
+
+type dedupRun struct {
+	ev          Event
+	first, last time.Time
+	count       int
+}
+
+type deduper struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	runs map[string]*dedupRun
+}
+
+func newDeduper(cfg DedupConfig) (*deduper, error) {
+	if cfg.Window == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(cfg.Window)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("Bad dedup window '%s'", cfg.Window)
+	}
+	return &deduper{window: d, runs: make(map[string]*dedupRun)}, nil
+}
+
+// dedupHash is what makes two events the same.
+func dedupHash(ev Event) string {
+	msg := strings.Join(strings.Fields(strings.ToLower(ev.Message)), " ")
+	return sha256Hex([]byte(ev.Device + "\x00" + ev.Partition + "\x00" + ev.Type + "\x00" + msg))
+}
+
+// first says whether the event is the first of its run, counting it if it's a repeat.
+func (d *deduper) first(ev Event, now time.Time) bool {
+	if d == nil {
+		return true
+	}
+	h := dedupHash(ev)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.runs[h]; ok && now.Sub(r.first) < d.window {
+		r.count++
+		r.last = now
+		return false
+	}
+	d.runs[h] = &dedupRun{ev: ev, first: now, last: now, count: 1}
+	return true
+}
+
+// closed takes out the runs whose window is over, returning the summaries of those with repeats.
+func (d *deduper) closed(now time.Time) []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []Event
+	for h, r := range d.runs {
+		if now.Sub(r.first) < d.window {
+			continue
+		}
+		delete(d.runs, h)
+		if r.count < 2 {
+			continue
+		}
+		ev := r.ev
+		ev.Fields = make(map[string]interface{}, len(r.ev.Fields)+2)
+		for k, v := range r.ev.Fields {
+			ev.Fields[k] = v
+		}
+		ev.Fields["first_seen"] = r.first.UTC().Format(time.RFC3339)
+		ev.Fields["last_seen"] = r.last.UTC().Format(time.RFC3339)
+		ev.Repeats = r.count
+		ev.Deadline = time.Time{} // Gets a budget of its own, see deadlines.go
+		ev.Message = fmt.Sprintf("%s (repeated %d times in %s)", r.ev.Message, r.count, r.last.Sub(r.first).Round(time.Second))
+		out = append(out, ev)
+	}
+	return out
+}
+
+// dedupSummaries publishes the summaries as the windows close.
+func (a *agent) dedupSummaries(ctx context.Context) {
+	if a.dedup == nil {
+		return
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			for _, ev := range a.dedup.closed(now) {
+				a.emit(ctx, a.config, ev)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Repeats within the window are held back and counted, whatever their case and spacing; once it closes
+// one summary stands for the run, and the next is news again.
+func TestDedupWindow(t *testing.T) {
+	m := newTestMonitor(t, Configuration{Dedup: DedupConfig{Window: "1h"}})
+	s := &payloadSink{}
+	m.a.sinks.sinks, m.a.sinks.busy = []Sink{s}, make([]int32, 1)
+	rec := connRateRecord("thunder1")
+	m.a.process(context.Background(), rec)
+	rec["content"] = "[ACOS]<4> Virtual server  WS-VIP connection rate limit 10 exceeded"
+	m.a.process(context.Background(), rec)
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	m.a.process(context.Background(), connRateRecord("thunder2")) // Another device, another run
+	if len(s.got) != 2 {
+		t.Fatalf("%d published in the window, want 2", len(s.got))
+	}
+
+	for _, ev := range m.a.dedup.closed(time.Now().Add(time.Hour)) {
+		m.a.emit(context.Background(), m.a.config, ev)
+	}
+	if len(s.got) != 3 {
+		t.Fatalf("%d published once the window closed, want a summary for thunder1 only", len(s.got))
+	}
+	sum := s.got[2]
+	if sum["repeat_count"] != 3 || sum["hostname"] != "thunder1" || sum["first_seen"] == nil || sum["last_seen"] == nil {
+		t.Errorf("summary %v", sum)
+	}
+
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	if len(s.got) != 4 {
+		t.Error("first event after the window held back")
+	}
+}
+
+func TestDedupConfig(t *testing.T) {
+	if d, err := newDeduper(DedupConfig{}); d != nil || err != nil {
+		t.Errorf("no window: %v, %v", d, err)
+	}
+	for _, w := range []string{"30", "-1s", "0s"} {
+		if _, err := newDeduper(DedupConfig{Window: w}); err == nil {
+			t.Errorf("window '%s' accepted", w)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package monitor
+
+//
+//  digest.go  --  A rollup of the events every few minutes, for teams that want the trend rather than every
+//    alert:
+//
+//  "digest": { "interval": "5m", "topic": "alert/A10Thunder/digest", "only": false }
+//
+//    interval  how often a digest is published. "" (the default) = no digests
+//    topic     where it goes. Default notify_topic + "/digest"
+//    only      publish just the digests to MQTT, not the events (plugins and Grafana still get them)
+//
+//  A digest counts every match in the interval per device, VIP (or other object) and event type, whether
+//  or not it was published, and is sent even when there weren't any:
+//
+//    { "type": "digest", "message": "14 events from 2 devices in 5m0s", "from": "...", "until": "...",
+//      "total": 14, "counts": [ { "hostname": "Testing1", "object": "ws-vip", "type": "conn.rate-limit", "count": 12 }, ... ] }
+//
+//  Summaries (dedup.go, suppress.go) and all-clears (recovery.go) aren't counted again.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DigestConfig holds the 'digest' section of the config.
+type DigestConfig struct {
+	Interval string `json:"interval"`
+	Topic    string `json:"topic"`
+	Only     bool   `json:"only"`
+}
+
+type digestKey struct {
+	device, object, typ string
+}
+
+type digester struct {
+	interval time.Duration
+	topic    string
+	only     bool
+
+	mu     sync.Mutex
+	from   time.Time
+	counts map[digestKey]int
+}
+
+// newDigester is nil if there are no digests.
+func newDigester(cfg DigestConfig, notifyTopic string) (*digester, error) {
+	if cfg.Interval == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(cfg.Interval)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("Bad digest interval '%s'", cfg.Interval)
+	}
+	topic := cfg.Topic
+	if topic == "" {
+		topic = notifyTopic + "/digest"
+	}
+	return &digester{interval: d, topic: topic, only: cfg.Only, from: time.Now(), counts: make(map[digestKey]int)}, nil
+}
+
+// add counts an event.
+func (d *digester) add(ev Event) {
+	if d == nil || ev.summary() {
+		return
+	}
+	d.mu.Lock()
+	d.counts[digestKey{ev.Device, ev.Object, ev.Type}]++
+	d.mu.Unlock()
+}
+
+// replaces says whether events only go to MQTT in the digest.
+func (d *digester) replaces() bool {
+	return d != nil && d.only
+}
+
+// take builds the digest up to now and starts the next one.
+func (d *digester) take(now time.Time) map[string]interface{} {
+	d.mu.Lock()
+	counts, from := d.counts, d.from
+	d.counts, d.from = make(map[digestKey]int), now
+	d.mu.Unlock()
+
+	keys := make([]digestKey, 0, len(counts))
+	devices := make(map[string]bool)
+	total := 0
+	for k, n := range counts {
+		keys = append(keys, k)
+		devices[k.device] = true
+		total += n
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.device != b.device {
+			return a.device < b.device
+		}
+		if a.object != b.object {
+			return a.object < b.object
+		}
+		return a.typ < b.typ
+	})
+	list := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, map[string]interface{}{"hostname": k.device, "object": k.object, "type": k.typ, "count": counts[k]})
+	}
+	return map[string]interface{}{
+		"type":    "digest",
+		"message": fmt.Sprintf("%d events from %d devices in %s", total, len(devices), now.Sub(from).Round(time.Second)),
+		"from":    from.UTC().Format(time.RFC3339),
+		"until":   now.UTC().Format(time.RFC3339),
+		"total":   total,
+		"counts":  list,
+	}
+}
+
+// digests publishes a digest every interval.
+func (a *agent) digests(ctx context.Context) {
+	if a.digest == nil || a.client == nil {
+		return
+	}
+	tick := time.NewTicker(a.digest.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			payload := a.digest.take(now)
+			addTags(payload, a.config.Tags)
+			text, _ := json.Marshal(payload)
+			if err := a.publishMQTT(ctx, a.digest.topic, 1, text); err != nil {
+				reportError(a.config.Debug, timeoutCode(err, errDeliverMQTT, errDeliverMQTTTime), "Digest Publish Error: "+err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package monitor
+
+//
+//  drill.go  --  Paging drills. POST /drill sends a synthetic alert out through every output a real one of
+//    the same rule would go to (MQTT with its spool and mirrors, output plugins, Grafana), so on-call teams
+//    can check the whole delivery chain end to end:
+//
+//    curl -X POST -H "Authorization: Bearer $TOKEN" http://agent:8080/drill \
+//         -d '{"rule": "conn-rate-limit", "device": "Testing1", "object": "ws-vip"}'
+//
+//    rule      the rule the alert is from, and so its topic, sinks and severity. Default conn-rate-limit
+//    device    the Thunder device it says it is from. Default "drill"
+//    object    the VIP (or other object). Default "drill-vip"
+//    message   the log message; if the rule's regex matches it, its fields are filled in as for a real one.
+//              Default "Virtual server <object> connection rate limit 100 exceeded"
+//    fields    payload fields to add
+//    severity  instead of the rule's
+//
+//  The alert always has "test": true and a message starting "TEST: ". It isn't held back by thresholds,
+//  silences, dedup or suppression, and isn't counted with the real events. The API needs 'api_token' set
+//  for /drill to be there at all.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DrillRequest is what POST /drill takes.
+type DrillRequest struct {
+	Rule     string                 `json:"rule"`
+	Device   string                 `json:"device"`
+	Object   string                 `json:"object"`
+	Message  string                 `json:"message"`
+	Fields   map[string]interface{} `json:"fields"`
+	Severity string                 `json:"severity"`
+}
+
+// drillEvent builds the synthetic event for req.
+func (a *agent) drillEvent(req DrillRequest) (Event, bool) {
+	if req.Rule == "" {
+		req.Rule = "conn-rate-limit"
+	}
+	if req.Device == "" {
+		req.Device = "drill"
+	}
+	if req.Object == "" {
+		req.Object = "drill-vip"
+	}
+	if req.Message == "" {
+		req.Message = "Virtual server " + req.Object + " connection rate limit 100 exceeded"
+	}
+	var rule *Rule
+	for _, r := range a.currentRules().rules {
+		if r.Name == req.Rule {
+			rule = r
+		}
+	}
+	if rule == nil {
+		return Event{}, false
+	}
+	now := time.Now()
+	rec := record{Device: req.Device, Module: rule.Module, Message: req.Message, Severity: 4, Time: now, Received: now}
+	fields, ok := rule.match(rec.Module, rec.Message)
+	if !ok {
+		fields = map[string]interface{}{"object_name": req.Object}
+	}
+	for k, v := range req.Fields {
+		fields[k] = v
+	}
+	severity := rule.Severity
+	if req.Severity != "" {
+		severity = req.Severity
+	}
+	ev := rec.event(rule, severity, fields)
+	ev.Message = "TEST: " + ev.Message
+	ev.Test = true
+	return ev, true
+}
+
+func (a *agent) registerDrillAPI(ctx context.Context, mux *http.ServeMux) {
+	if a.config.API_Token == "" {
+		return // Anyone who can reach the API could page people
+	}
+	mux.HandleFunc("/drill", requireToken(a.config.API_Token, func(w http.ResponseWriter, r *http.Request) {
+		req := DrillRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err.Error() != "EOF" {
+			http.Error(w, "Bad drill: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ev, ok := a.drillEvent(req)
+		if !ok {
+			http.Error(w, "No rule called '"+req.Rule+"'", http.StatusNotFound)
+			return
+		}
+		if a.config.Debug > 0 {
+			fmt.Println(">>> Drill: " + ev.Device + "::" + ev.Message)
+		}
+		a.deliver(ctx, a.config, ev)
+		writeJSON(w, map[string]interface{}{"result": "ok", "event": ev.Payload()})
+	}))
+}
@@ -0,0 +1,91 @@
+package monitor
+
+//
+//  drops.go  --  Drop rules, for silencing chronic noise at the agent. They are checked before any match
+//    rule, and a record one of them matches goes no further: no event, no correlation, nothing published.
+//    They go in the rules file, and are reloaded with it:
+//
+//  "drop": [
+//    { "name": "hm-1-flapping", "hostname": "thunder-lab-2", "contains": ["Health monitor hm-1"] },
+//    { "name": "aflex-debug", "module": "AFLEX", "regex": "^debug: " }
+//  ]
+//
+//  A drop rule needs a regex (which may use %{PATTERN}s, see patterns.go) or a contains list, or both;
+//  "module" and "hostname" narrow it to one module or device. How many records each one dropped, per
+//  device, is in the counters and a10crm_records_dropped_total, so a drop rule that has started hiding
+//  more than it should shows up.
+//
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DropRule is one kind of record to throw away.
+type DropRule struct {
+	Name     string   `json:"name"`
+	Module   string   `json:"module"`
+	Hostname string   `json:"hostname"` // Only records from this device. Default all
+	Regex    string   `json:"regex"`
+	Contains []string `json:"contains"`
+	re       *regexp.Regexp
+}
+
+func (d *DropRule) compile(patterns map[string]string) error {
+	if d.Name == "" {
+		return errors.New("Drop rule with no name!")
+	}
+	if d.Regex == "" && len(d.Contains) == 0 {
+		return fmt.Errorf("Drop rule '%s' needs a regex or contains list", d.Name)
+	}
+	if d.Regex != "" {
+		src, err := expandPatterns(d.Regex, patterns)
+		if err != nil {
+			return fmt.Errorf("Drop rule '%s': %v", d.Name, err)
+		}
+		if d.re, err = regexp.Compile(src); err != nil {
+			return fmt.Errorf("Drop rule '%s': bad regex: %v", d.Name, err)
+		}
+	}
+	return nil
+}
+
+func (d *DropRule) match(rec record) bool {
+	if d.Module != "" && !strings.EqualFold(d.Module, rec.Module) {
+		return false
+	}
+	if d.Hostname != "" && !strings.EqualFold(d.Hostname, rec.Device) {
+		return false
+	}
+	for _, c := range d.Contains {
+		if !strings.Contains(rec.Message, c) {
+			return false
+		}
+	}
+	return d.re == nil || d.re.MatchString(rec.Message)
+}
+
+// dropRules are tried in order; the first that matches drops the record.
+type dropRules []*DropRule
+
+// match is the drop rule that drops rec, or nil.
+func (ds dropRules) match(rec record) *DropRule {
+	for _, d := range ds {
+		if d.match(rec) {
+			return d
+		}
+	}
+	return nil
+}
+
+// loadDropRules compiles the drop rules from the rules file.
+func loadDropRules(rf RulesFile) (dropRules, error) {
+	for _, d := range rf.Drop {
+		if err := d.compile(rf.Patterns); err != nil {
+			return nil, err
+		}
+	}
+	return rf.Drop, nil
+}
@@ -0,0 +1,187 @@
+package monitor
+
+//
+//  enrich.go  --  A cache in front of every lookup the agent makes to add to an event, so a storm of alerts
+//    about the same few VIPs doesn't become a storm of lookups. Each source has its own time to live and
+//    size limit:
+//
+//  "enrich_cache": { "dns": { "ttl": "10m", "max_entries": 10000 } }
+//
+//    ttl          how long an answer (including "nothing found") is kept. Default 5m
+//    max_entries  answers kept at most; past that the expired ones, then the oldest, go. Default 10000
+//
+//  The sources are:
+//
+//    dns          reverse DNS, the "rdns" template function: "set": { "client_name": "{{rdns .client_ip}}" }
+//
+//  Lookups of the same thing at the same time wait for the first one rather than all going out. Hits,
+//  misses and evictions per source are in the metrics (a10crm_enrich_cache_*).
+//
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig holds one source's entry in the 'enrich_cache' section of the config.
+type CacheConfig struct {
+	TTL         string `json:"ttl"`
+	Max_Entries int    `json:"max_entries"`
+}
+
+type cacheEntry struct {
+	value   string
+	stored  time.Time
+	expires time.Time
+	ready   chan struct{} // Closed once value is there
+}
+
+// enrichCache is one source's cache.
+type enrichCache struct {
+	name   string
+	lookup func(ctx context.Context, key string) (string, error)
+
+	mu        sync.Mutex
+	ttl       time.Duration
+	max       int
+	entries   map[string]*cacheEntry
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// enrichCaches are the sources, by name. Like the template functions that use them, they are process-wide.
+var enrichCaches = map[string]*enrichCache{
+	"dns": newEnrichCache("dns", reverseDNS),
+}
+
+func newEnrichCache(name string, lookup func(ctx context.Context, key string) (string, error)) *enrichCache {
+	return &enrichCache{name: name, lookup: lookup, ttl: 5 * time.Minute, max: 10000, entries: make(map[string]*cacheEntry)}
+}
+
+// configureEnrichCaches applies the 'enrich_cache' section.
+func configureEnrichCaches(cfg map[string]CacheConfig) error {
+	for name, cc := range cfg {
+		c, ok := enrichCaches[name]
+		if !ok {
+			return fmt.Errorf("enrich_cache: unknown source '%s'", name)
+		}
+		ttl := 5 * time.Minute
+		if cc.TTL != "" {
+			d, err := time.ParseDuration(cc.TTL)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("enrich_cache: bad ttl '%s' for %s", cc.TTL, name)
+			}
+			ttl = d
+		}
+		max := cc.Max_Entries
+		if max <= 0 {
+			max = 10000
+		}
+		c.mu.Lock()
+		c.ttl, c.max = ttl, max
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// get is the cached answer for key, looking it up if there isn't one. A failed lookup is cached as "", but
+// not one given up on because ctx was done.
+func (c *enrichCache) get(ctx context.Context, key string) string {
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && (e.expires.IsZero() || now.Before(e.expires)) {
+		c.hits++
+		c.mu.Unlock()
+		select {
+		case <-e.ready: // Someone else's lookup, if it is still going
+			return e.value
+		case <-ctx.Done():
+			return ""
+		}
+	}
+	c.misses++
+	if len(c.entries) >= c.max {
+		c.evict(now)
+	}
+	e := &cacheEntry{stored: now, ready: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	v, err := c.lookup(ctx, key)
+	if err != nil {
+		v = ""
+	}
+	c.mu.Lock()
+	e.value, e.expires = v, time.Now().Add(c.ttl)
+	if err != nil && ctx.Err() != nil && c.entries[key] == e {
+		delete(c.entries, key) // Given up on, not an answer; the next get asks again
+	}
+	c.mu.Unlock()
+	close(e.ready)
+	return v
+}
+
+// evict makes room: every expired entry goes, or if none have, the oldest. Caller holds c.mu.
+func (c *enrichCache) evict(now time.Time) {
+	var oldest string
+	for k, e := range c.entries {
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			delete(c.entries, k)
+			c.evictions++
+		} else if oldest == "" || e.stored.Before(c.entries[oldest].stored) {
+			oldest = k
+		}
+	}
+	if len(c.entries) >= c.max && oldest != "" {
+		delete(c.entries, oldest)
+		c.evictions++
+	}
+}
+
+// writeEnrichMetrics adds the cache metrics, see metrics.go.
+func writeEnrichMetrics(p *promWriter) {
+	names := make([]string, 0, len(enrichCaches))
+	for name := range enrichCaches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, m := range []struct {
+		name string
+		kind string
+		help string
+		v    func(c *enrichCache) interface{}
+	}{
+		{"a10crm_enrich_cache_hits_total", "counter", "Enrichment lookups answered from the cache.", func(c *enrichCache) interface{} { return c.hits }},
+		{"a10crm_enrich_cache_misses_total", "counter", "Enrichment lookups that had to go to the source.", func(c *enrichCache) interface{} { return c.misses }},
+		{"a10crm_enrich_cache_evictions_total", "counter", "Cached answers dropped to stay within max_entries.", func(c *enrichCache) interface{} { return c.evictions }},
+		{"a10crm_enrich_cache_entries", "gauge", "Answers in the cache.", func(c *enrichCache) interface{} { return len(c.entries) }},
+	} {
+		for _, name := range names {
+			c := enrichCaches[name]
+			c.mu.Lock()
+			v := m.v(c)
+			c.mu.Unlock()
+			p.metric(m.name, m.kind, m.help, fmt.Sprintf(`source="%s"`, name), v)
+		}
+	}
+}
+
+// reverseDNS is the first name for an IP address.
+func reverseDNS(ctx context.Context, ip string) (string, error) {
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("not an IP address: '%s'", ip)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return "", err
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
@@ -0,0 +1,141 @@
+package monitor
+
+//
+//  errors.go  --  Every way the agent itself can fail, each with a code that stays the same between
+//    releases, so dashboards and alerts about the agent can key on it:
+//
+//    listen.bind            the Syslog port was taken; the next fallback port is tried (listen.go)
+//    parse.syslog           a record the Syslog library couldn't parse (it is still processed, as far as it goes)
+//    parse.rules            the rules file didn't reload; the old rules stay in use
+//    render.template        a "set" or "topic" template or the event_key failed; the field is left out
+//    render.timeout         ... or didn't finish within the template deadline (deadlines.go)
+//    deliver.mqtt           a publish to the broker failed; the event is spooled if there is a spool
+//    deliver.mqtt_timeout   ... or didn't finish within its deadline
+//    deliver.spool_full     a spool lane was full, so an event that needed spooling was dropped
+//    deliver.spool_io       the spool couldn't be written or read
+//    deliver.plugin         an output plugin failed or rejected an event
+//    deliver.plugin_timeout ... or didn't reply within its deadline
+//    deliver.grafana        a Grafana annotation call failed, or its queue was full
+//    deliver.mirror         a publish to another region's broker failed or timed out (mirror.go)
+//    deliver.kafka          a produce to Kafka failed (kafka.go)
+//    deliver.kafka_timeout  ... or didn't finish within the sink deadline
+//    deliver.nats           a publish to NATS failed, or JetStream didn't take it (nats.go)
+//    deliver.nats_timeout   ... or wasn't confirmed within the sink deadline
+//    deliver.amqp           a publish to AMQP failed, or the broker nacked or returned it (amqp.go)
+//    deliver.amqp_timeout   ... or wasn't confirmed within the sink deadline
+//    deliver.webhook        a webhook call failed, after any retries (webhook.go)
+//    deliver.webhook_timeout ... or ran out of the sink deadline
+//    deliver.slack          a Slack post failed, or Slack turned it down (slack.go)
+//    deliver.slack_timeout  ... or ran out of the sink deadline
+//    deliver.teams          a Teams post failed, or the connector turned it down (teams.go)
+//    deliver.teams_timeout  ... or ran out of the sink deadline
+//    deliver.sink           a publish to any other sink (sinks.go) failed
+//    deliver.sink_busy      an output was still busy with an earlier event, past the wait, and couldn't keep
+//                           this one for later (sinks.go)
+//    deliver.events         Events() (monitor.go) was full and an event was dropped
+//    acks.bad_message       an ack (API, SQS or MQTT) that couldn't be used
+//    acks.sqs               a call to SQS failed
+//    acks.mqtt              subscribing to acks.mqtt_topic failed (acks.go)
+//    profiling.push         a profile push to Pyroscope failed
+//
+//  Each one is counted in a10crm_errors_total{code="..."} and in the heartbeat's "errors", and logged at
+//  debug > 3 as ">>> [code] ...". A spooled event that is there because its publish failed has the code in
+//  the spool record's "error" too.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// The error codes. Don't change or reuse them; add new ones.
+const (
+	errListenBind         = "listen.bind"
+	errParseSyslog        = "parse.syslog"
+	errParseRules         = "parse.rules"
+	errRenderTemplate     = "render.template"
+	errRenderTimeout      = "render.timeout"
+	errDeliverMQTT        = "deliver.mqtt"
+	errDeliverMQTTTime    = "deliver.mqtt_timeout"
+	errSpoolFull          = "deliver.spool_full"
+	errSpoolIO            = "deliver.spool_io"
+	errDeliverPlugin      = "deliver.plugin"
+	errDeliverPluginTim   = "deliver.plugin_timeout"
+	errDeliverGrafana     = "deliver.grafana"
+	errDeliverMirror      = "deliver.mirror"
+	errDeliverKafka       = "deliver.kafka"
+	errDeliverKafkaTime   = "deliver.kafka_timeout"
+	errDeliverNATS        = "deliver.nats"
+	errDeliverNATSTime    = "deliver.nats_timeout"
+	errDeliverAMQP        = "deliver.amqp"
+	errDeliverAMQPTime    = "deliver.amqp_timeout"
+	errDeliverWebhook     = "deliver.webhook"
+	errDeliverWebhookTime = "deliver.webhook_timeout"
+	errDeliverSlack       = "deliver.slack"
+	errDeliverSlackTime   = "deliver.slack_timeout"
+	errDeliverTeams       = "deliver.teams"
+	errDeliverTeamsTime   = "deliver.teams_timeout"
+	errDeliverSink        = "deliver.sink"
+	errDeliverSinkBusy    = "deliver.sink_busy"
+	errDeliverEvents      = "deliver.events"
+	errAckBad             = "acks.bad_message"
+	errAckSQS             = "acks.sqs"
+	errAckMQTT            = "acks.mqtt"
+	errProfilingPush      = "profiling.push"
+)
+
+// errorCounts is how many of each error there have been. It is process-wide, like the API.
+var errorCounts = struct {
+	sync.Mutex
+	n map[string]uint64
+}{n: make(map[string]uint64)}
+
+// countError counts one error.
+func countError(code string) {
+	errorCounts.Lock()
+	errorCounts.n[code]++
+	errorCounts.Unlock()
+}
+
+// reportError counts an error and logs it if debug is high enough.
+func reportError(debug int, code string, msg string) {
+	countError(code)
+	if debug > 3 {
+		fmt.Println(">>> [" + code + "] " + msg)
+	}
+}
+
+// timeoutCode is the _timeout variant of code if err is a deadline running out.
+func timeoutCode(err error, code string, timeout string) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return timeout
+	}
+	return code
+}
+
+// errorSnapshot is a copy of the counts, for the heartbeat.
+func errorSnapshot() map[string]uint64 {
+	errorCounts.Lock()
+	defer errorCounts.Unlock()
+	out := make(map[string]uint64, len(errorCounts.n))
+	for k, v := range errorCounts.n {
+		out[k] = v
+	}
+	return out
+}
+
+// writeErrorMetrics adds a10crm_errors_total, see metrics.go.
+func writeErrorMetrics(p *promWriter) {
+	counts := errorSnapshot()
+	codes := make([]string, 0, len(counts))
+	for c := range counts {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	for _, c := range codes {
+		p.metric("a10crm_errors_total", "counter", "Failures of the agent itself, by code (see errors.go).", fmt.Sprintf(`code="%s"`, c), counts[c])
+	}
+}
@@ -0,0 +1,164 @@
+package monitor
+
+//
+//  escalate.go  --  Turns up the logging for a Thunder device while it has an alert going, so the debug
+//    output (and, optionally, a copy of its raw Syslog records) exists for exactly the time it is wanted.
+//    The alert counts as over once 'hold' seconds pass without another one from that device.
+//
+//  "escalation": { "debug": 8, "hold": 300, "min_severity": "warning", "capture_dir": "/var/log/conn-rate-mon" }
+//
+//  With 'capture_dir' set, each escalation writes the device's records, one JSON object per line, to
+//  <capture_dir>/<device>-<start time>.jsonl.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// EscalationConfig holds the 'escalation' section of the config.
+type EscalationConfig struct {
+	Debug        int    `json:"debug"`        // Debug level for the device while it has an alert. 0 = off
+	Hold         int    `json:"hold"`         // Seconds. Default 300
+	Min_Severity string `json:"min_severity"` // Alerts less severe than this don't count. Default "warning"
+	Capture_Dir  string `json:"capture_dir"`  // Also keep the raw records here
+}
+
+type escalated struct {
+	since   time.Time
+	until   time.Time
+	capture *os.File
+}
+
+type escalation struct {
+	cfg     EscalationConfig
+	minSev  int
+	debug   int // The normal level, for the messages about it
+	mu      sync.Mutex
+	devices map[string]*escalated
+}
+
+func newEscalation(cfg EscalationConfig, debug int) *escalation {
+	if cfg.Hold <= 0 {
+		cfg.Hold = 300
+	}
+	minSev := severityLevel(cfg.Min_Severity)
+	if minSev < 0 {
+		minSev = severityLevel("warning")
+	}
+	return &escalation{cfg: cfg, minSev: minSev, debug: debug, devices: make(map[string]*escalated)}
+}
+
+// severityLevel is the Syslog number for a severity name, or -1.
+func severityLevel(name string) int {
+	for i, n := range severityNames {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// trigger is called for every alert. It starts (or keeps going) the escalation for the device.
+func (e *escalation) trigger(host string, severity string) {
+	if e.cfg.Debug <= 0 && e.cfg.Capture_Dir == "" {
+		return
+	}
+	if sev := severityLevel(severity); sev < 0 || sev > e.minSev {
+		return
+	}
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if d, ok := e.devices[host]; ok {
+		d.until = now.Add(time.Duration(e.cfg.Hold) * time.Second)
+		return
+	}
+	d := &escalated{since: now, until: now.Add(time.Duration(e.cfg.Hold) * time.Second)}
+	if e.cfg.Capture_Dir != "" {
+		fn := filepath.Join(e.cfg.Capture_Dir, safeFileName(host)+"-"+now.UTC().Format("20060102T150405Z")+".jsonl")
+		f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Println(">>> Unable to open capture file: " + err.Error())
+		} else {
+			d.capture = f
+		}
+	}
+	e.devices[host] = d
+	fmt.Printf(">>> Alert on %s: logging at debug level %d until it clears\n", host, e.level(e.debug))
+}
+
+// level is the debug level to use for a device with an alert going.
+func (e *escalation) level(base int) int {
+	if e.cfg.Debug > base {
+		return e.cfg.Debug
+	}
+	return base
+}
+
+// debugFor returns the debug level to use for a record from the device.
+func (e *escalation) debugFor(host string, base int) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.devices[host]; ok {
+		return e.level(base)
+	}
+	return base
+}
+
+// capture keeps a copy of the record, if the device has an alert going and capture_dir is set.
+func (e *escalation) capture(host string, logParts format.LogParts) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if d, ok := e.devices[host]; ok && d.capture != nil {
+		b, _ := json.Marshal(logParts)
+		d.capture.Write(append(b, '\n'))
+	}
+}
+
+// expireEvery puts devices back to normal once their alerts have cleared, until ctx is done.
+func (e *escalation) expireEvery(ctx context.Context, d time.Duration) {
+	if e.cfg.Debug <= 0 && e.cfg.Capture_Dir == "" {
+		return
+	}
+	tick := time.NewTicker(d)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-tick.C:
+		}
+		e.mu.Lock()
+		for host, dev := range e.devices {
+			if now.Before(dev.until) {
+				continue
+			}
+			if dev.capture != nil {
+				dev.capture.Close()
+			}
+			delete(e.devices, host)
+			fmt.Printf(">>> Alert on %s cleared after %s: logging back to normal\n", host, now.Sub(dev.since).Round(time.Second))
+		}
+		e.mu.Unlock()
+	}
+}
+
+// safeFileName keeps a device name from wandering out of the capture directory.
+func safeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == 0 {
+			return '_'
+		}
+		return r
+	}, s)
+}
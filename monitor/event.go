@@ -0,0 +1,183 @@
+package monitor
+
+//
+//  event.go  --  The agent's own shapes for what comes in and what goes out. A syslog record is taken apart
+//    once, into a record; whatever turns records into events (rules, parser plugins, correlations) hands
+//    back an Event; and every output works from the Event's payload, so they all publish the same JSON.
+//
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// record is one syslog record, taken apart.
+type record struct {
+	Device      string
+	Tag         string
+	Module      string // From the "[ACOS]<4>" prefix, "" if there isn't one
+	Partition   string // RBA/L3V partition the message came from, "" if it doesn't say
+	Message     string // The log text with the module prefix and partition cut out
+	Severity    int
+	Facility    int
+	Time        time.Time // From the record, or the receive time if it had none (Substituted)
+	Received    time.Time
+	Substituted bool
+}
+
+// newRecord takes apart what the syslog server hands over.
+func newRecord(logParts format.LogParts, received time.Time, tc *TimestampConfig) record {
+	rec := record{Received: received}
+	rec.Device = fmt.Sprintf("%s", logParts["hostname"])
+	if rec.Device == "" { // Header too mangled to find it in, see lenient.go
+		rec.Device = clientHost(fmt.Sprintf("%s", logParts["client"]))
+	}
+	rec.Tag, _ = logParts["tag"].(string)
+	rec.Severity, _ = logParts["severity"].(int)
+	rec.Facility, _ = logParts["facility"].(int)
+	rec.Substituted, _ = logParts["timestamp_substituted"].(bool)
+	zoned, _ := logParts["timestamp_zoned"].(bool)
+	if rec.Time, _ = logParts["timestamp"].(time.Time); rec.Time.IsZero() {
+		rec.Time = received
+	} else if !zoned {
+		rec.Time = tc.deviceTime(rec.Device, rec.Time, received)
+	}
+	//  Full 'content' field looks like: "[ACOS]<4> Virtual server ws-vip connection rate limit 10 exceeded"
+	rec.Module, rec.Message = splitMessage(fmt.Sprintf("%s", logParts["content"]))
+	rec.Partition, rec.Message = splitPartition(rec.Message)
+	return rec
+}
+
+// Event is something worth telling the outputs about.
+type Event struct {
+	Rule           *Rule // What it matched: topic, suppression, runbook and so on
+	Device         string
+	Partition      string
+	Type           string
+	Object         string // The VIP, server, ... it is about, "" if it doesn't say
+	Severity       string
+	SyslogSeverity int // Of the record, where Severity can be set by the rule
+	Facility       int
+	Message        string
+	Fields         map[string]interface{}
+	Time           time.Time
+	Received       time.Time
+	Substituted    bool
+	Repeats        int       // On a dedup summary, how many events it stands for. See dedup.go
+	Suppressed     uint64    // On a suppression summary, how many events were held back. See suppress.go
+	Recovered      bool      // An all-clear, see recovery.go
+	Escalation     int       // The escalation step it is at, 0 if none. See paging.go
+	Test           bool      // A drill, not a real alert. See drill.go
+	Deadline       time.Time // When its time budget runs out; zero if there is none. See deadlines.go
+}
+
+// summary says whether the event stands for others (a dedup or suppression summary, or an all-clear),
+// so it is published without being counted towards thresholds, dedup or suppression again.
+func (e Event) summary() bool {
+	return e.Repeats > 0 || e.Suppressed > 0 || e.Recovered
+}
+
+// backUp says whether the event reports its object back up: a state rule's "state" is "up", which the
+// "updown" conversion also makes of recovered, passed and succeeded (see rules.go).
+func (e Event) backUp() bool {
+	s, _ := e.Fields["state"].(string)
+	return s == "up" && !e.Recovered
+}
+
+// newEventID is a random ID, for telling events (or groups of them) apart.
+func newEventID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// event makes an event of the record. severity "" means the record's own.
+func (rec record) event(r *Rule, severity string, fields map[string]interface{}) Event {
+	if n, ok := normalizeSeverity(severity); ok {
+		severity = n
+	} else {
+		severity = severityName(rec.Severity) // Not given, or not a severity. See qos.go
+	}
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	obj, _ := fields["object_name"].(string)
+	return Event{Rule: r, Device: rec.Device, Partition: rec.Partition, Type: r.Type, Object: obj,
+		Severity: severity, SyslogSeverity: rec.Severity, Facility: rec.Facility, Message: rec.Message,
+		Fields: fields, Time: rec.Time, Received: rec.Received, Substituted: rec.Substituted}
+}
+
+// Payload builds the JSON payload published for the event. The common field names here must
+// match payloadFields in schema.go.
+func (e Event) Payload() map[string]interface{} {
+	return e.payload(context.Background())
+}
+
+// alertID is the suppression key of the alert the event is about; for an all-clear, the one it clears.
+func (e Event) alertID() string {
+	typ := e.Type
+	if t, ok := e.Fields["recovered_type"].(string); ok && e.Recovered {
+		typ = t
+	}
+	return suppressKey(e.Device, typ, e.Object)
+}
+
+// payload is Payload with the rule's "set" templates rendered within ctx, see deadlines.go.
+func (e Event) payload(ctx context.Context) map[string]interface{} {
+	p := map[string]interface{}{
+		"rule":     e.Rule.Name,
+		"type":     e.Type,
+		"severity": e.Severity,
+		"hostname": e.Device,
+		"message":  e.Message,
+	}
+	if e.Partition != "" {
+		p["partition"] = e.Partition
+	}
+	p["alert_id"] = e.alertID() // What to ack it by, see acks.go
+	if e.Substituted {
+		p["timestamp_substituted"] = true
+	}
+	if e.Repeats > 0 {
+		p["repeat_count"] = e.Repeats
+	}
+	if e.Test {
+		p["test"] = true
+	}
+	for k, v := range e.Fields {
+		p[k] = v
+	}
+	if len(e.Rule.set) > 0 {
+		// Every template sees the fields as they were before any of them are set
+		set := make(map[string]string, len(e.Rule.set))
+		for k, t := range e.Rule.set {
+			if s, err := renderTemplate(ctx, t, p); err == nil {
+				set[k] = s
+			} else {
+				countError(timeoutCode(err, errRenderTemplate, errRenderTimeout))
+			}
+		}
+		for k, s := range set {
+			p[k] = s
+		}
+	}
+	if set := e.Rule.setFor(e.Severity); len(set) > 0 {
+		rendered := make(map[string]string, len(set))
+		for k, t := range set {
+			if s, err := renderTemplate(ctx, t, p); err == nil {
+				rendered[k] = s
+			} else {
+				countError(timeoutCode(err, errRenderTemplate, errRenderTimeout))
+			}
+		}
+		for k, s := range rendered {
+			p[k] = s
+		}
+	}
+	return p
+}
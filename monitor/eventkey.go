@@ -0,0 +1,51 @@
+package monitor
+
+//
+//  eventkey.go  --  The event key is what keyed outputs use to decide which partition an event goes to, and
+//    with it which events are kept in order with each other: the Kafka sink, and output plugins delivering to
+//    something partitioned (Event Hubs, Kinesis, ...). It's a Go template over the payload fields, set with
+//    'event_key' in the config:
+//
+//    "event_key": "{{.hostname}}"                     per device (the default)
+//    "event_key": "{{.hostname}}/{{.object_name}}"    per VIP
+//
+//  The functions in templates.go can be used, e.g. "{{sha256 .hostname}}".
+//
+//  Output plugins get it in the "key" field of each event, and Kafka has it as the record key unless the
+//  kafka section gives a 'key' of its own (see kafka.go). The other outputs don't use it. MQTT has no
+//  partitions, and NATS (JetStream too) and AMQP route on the subject or routing key, whose templates (see
+//  nats.go and amqp.go) can be made of the same fields where ordering per device or VIP matters.
+//
+
+import (
+	"context"
+	"fmt"
+	"text/template"
+)
+
+const defaultEventKey = "{{.hostname}}"
+
+type eventKeyer struct {
+	tmpl *template.Template
+}
+
+func newEventKeyer(src string) (*eventKeyer, error) {
+	if src == "" {
+		src = defaultEventKey
+	}
+	t, err := parseTemplate("event_key", src)
+	if err != nil {
+		return nil, fmt.Errorf("Bad event_key template: %v", err)
+	}
+	return &eventKeyer{tmpl: t}, nil
+}
+
+// Key renders the key for one event. Fields missing from the payload come out empty.
+func (k *eventKeyer) Key(ctx context.Context, payload map[string]interface{}) string {
+	s, err := renderTemplate(ctx, k.tmpl, payload)
+	if err != nil {
+		countError(timeoutCode(err, errRenderTemplate, errRenderTimeout))
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,85 @@
+package monitor
+
+//
+//  exit.go  --  Why the agent stopped, for supervisors and deploy tooling. New and Run return an *ExitError
+//    for the failures there is something specific to do about, and main exits with its code after printing
+//    one JSON status line to stderr:
+//
+//    {"status":"failed","code":3,"reason":"bind","error":"listen udp 0.0.0.0:5514: bind: address already in use"}
+//
+//    0  stopped      stopped by a signal (the status is "stopped")
+//    1  fatal        anything else that stopped the pipeline
+//    2  config       the config or rules file is missing or doesn't check out
+//    3  bind         the Syslog port couldn't be listened on
+//    4  broker_auth  the MQTT broker turned down the agent's credentials or client ID
+//    5  broker       the MQTT broker couldn't be connected to
+//    6  duplicate    another agent is running with the same config (see lock.go)
+//
+//  A config error won't go away on a restart, where a bind or broker failure might.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Exit codes, see above.
+const (
+	ExitOK         = 0
+	ExitFatal      = 1
+	ExitConfig     = 2
+	ExitBind       = 3
+	ExitBrokerAuth = 4
+	ExitBroker     = 5
+	ExitDuplicate  = 6
+)
+
+// ExitError is an error with the exit code and reason to stop with.
+type ExitError struct {
+	Code   int
+	Reason string
+	Err    error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+func (e *ExitError) Unwrap() error { return e.Err }
+
+func exitError(code int, reason string, err error) error {
+	var ee *ExitError
+	if err == nil || errors.As(err, &ee) {
+		return err
+	}
+	return &ExitError{Code: code, Reason: reason, Err: err}
+}
+
+// brokerError tells a refused login from a broker that can't be reached.
+func brokerError(err error) error {
+	for _, refused := range []error{packets.ErrorRefusedBadUsernameOrPassword, packets.ErrorRefusedNotAuthorised, packets.ErrorRefusedIDRejected} {
+		if errors.Is(err, refused) {
+			return exitError(ExitBrokerAuth, "broker_auth", fmt.Errorf("MQTT broker refused the connection: %w", err))
+		}
+	}
+	return exitError(ExitBroker, "broker", fmt.Errorf("Unable to connect to MQTT broker: %w", err))
+}
+
+// Exit prints the status line for err (nil for a clean stop) to stderr and returns the code to exit with.
+func Exit(err error) int {
+	status := struct {
+		Status string `json:"status"`
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+		Error  string `json:"error,omitempty"`
+	}{"stopped", ExitOK, "stopped", ""}
+	if err != nil {
+		ee := &ExitError{Code: ExitFatal, Reason: "fatal", Err: err}
+		errors.As(err, &ee)
+		status.Status, status.Code, status.Reason, status.Error = "failed", ee.Code, ee.Reason, err.Error()
+	}
+	line, _ := json.Marshal(status)
+	fmt.Fprintln(os.Stderr, string(line))
+	return status.Code
+}
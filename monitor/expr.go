@@ -0,0 +1,684 @@
+package monitor
+
+//
+//  expr.go  --  A small expression language for filtering events, in the style of CEL:
+//
+//    event.limit >= 500 && event.hostname.startsWith("prod-")
+//    event.object_name in ["ws-vip", "api-vip"] || event.severity == "critical"
+//    !event.message.contains("test") && event.message.matches("^Virtual (server|port)")
+//
+//  Supported: numbers, "strings" or 'strings', true, false, null, [lists], event.field access,
+//    ! && || == != < <= > >= + - in, ( ), and the string methods startsWith, endsWith, contains,
+//    matches (regex) and size(). A field that isn't in the event is null. == and in compare lists and
+//    objects element by element.
+//
+//  Expressions are compiled once (when the rules are loaded) and then evaluated against each event.
+//
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a compiled expression.
+type Expr struct {
+	src  string
+	root exprNode
+}
+
+type exprNode interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+// compileExpr parses the expression source.
+func compileExpr(src string) (*Expr, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected '%s' at %d", p.peek().text, p.peek().pos)
+	}
+	return &Expr{src: src, root: n}, nil
+}
+
+// Bool evaluates the expression against the event fields; anything but true is false.
+func (e *Expr) Bool(event map[string]interface{}) (bool, error) {
+	v, err := e.root.eval(map[string]interface{}{"event": event})
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression is %T, not bool", v)
+	}
+	return b, nil
+}
+
+func (e *Expr) String() string { return e.src }
+
+// exprTrue is Bool for when an error just means "no".
+func exprTrue(e *Expr, event map[string]interface{}) bool {
+	ok, _ := e.Bool(event)
+	return ok
+}
+
+//------------------[  Lexer  ]-----------------------------
+
+const (
+	tokEOF = iota
+	tokNum
+	tokStr
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+var exprOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "(", ")", "[", "]", ".", ","}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	i := 0
+outer:
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, exprToken{tokNum, src[i:j], i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			toks = append(toks, exprToken{tokIdent, src[i:j], i})
+			i = j
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && rune(src[j]) != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				sb.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, exprToken{tokStr, sb.String(), i})
+			i = j + 1
+		default:
+			for _, op := range exprOps {
+				if strings.HasPrefix(src[i:], op) {
+					toks = append(toks, exprToken{tokOp, op, i})
+					i += len(op)
+					continue outer
+				}
+			}
+			return nil, fmt.Errorf("unexpected '%c' at %d", c, i)
+		}
+	}
+	return append(toks, exprToken{tokEOF, "end of expression", len(src)}), nil
+}
+
+//------------------[  Parser  ]-----------------------------
+
+type exprParser struct {
+	toks []exprToken
+	i    int
+}
+
+func (p *exprParser) peek() exprToken { return p.toks[p.i] }
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) accept(kind int, text string) bool {
+	if t := p.peek(); t.kind == kind && t.text == text {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(tokOp, text) {
+		return fmt.Errorf("expected '%s' at %d", text, p.peek().pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.accept(tokOp, "||") {
+		var r exprNode
+		if r, err = p.parseAnd(); err == nil {
+			l = &logicNode{op: "||", l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	l, err := p.parseCmp()
+	for err == nil && p.accept(tokOp, "&&") {
+		var r exprNode
+		if r, err = p.parseCmp(); err == nil {
+			l = &logicNode{op: "&&", l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+var cmpOps = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *exprParser) parseCmp() (exprNode, error) {
+	l, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if (t.kind == tokOp && cmpOps[t.text]) || (t.kind == tokIdent && t.text == "in") {
+		p.next()
+		r, err := p.parseAdd()
+		if err != nil {
+			return nil, err
+		}
+		return &cmpNode{op: t.text, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseAdd() (exprNode, error) {
+	l, err := p.parseUnary()
+	for err == nil && (p.peek().text == "+" || p.peek().text == "-") && p.peek().kind == tokOp {
+		op := p.next().text
+		var r exprNode
+		if r, err = p.parseUnary(); err == nil {
+			l = &arithNode{op: op, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept(tokOp, "!") {
+		n, err := p.parseUnary()
+		return &notNode{n}, err
+	}
+	if p.accept(tokOp, "-") {
+		n, err := p.parseUnary()
+		return &arithNode{op: "-", l: &litNode{0.0}, r: n}, err
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	n, err := p.parsePrimary()
+	for err == nil {
+		switch {
+		case p.accept(tokOp, "."):
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, fmt.Errorf("expected a name at %d", name.pos)
+			}
+			if p.accept(tokOp, "(") {
+				var args []exprNode
+				if args, err = p.parseList(")"); err == nil {
+					n, err = newCallNode(name.text, n, args)
+				}
+			} else {
+				n = &fieldNode{obj: n, name: name.text}
+			}
+		case p.accept(tokOp, "["):
+			var idx exprNode
+			if idx, err = p.parseOr(); err == nil {
+				if err = p.expect("]"); err == nil {
+					n = &indexNode{obj: n, idx: idx}
+				}
+			}
+		default:
+			return n, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *exprParser) parseList(end string) ([]exprNode, error) {
+	var items []exprNode
+	if p.accept(tokOp, end) {
+		return items, nil
+	}
+	for {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, n)
+		if p.accept(tokOp, end) {
+			return items, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNum:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number '%s' at %d", t.text, t.pos)
+		}
+		return &litNode{f}, nil
+	case tokStr:
+		return &litNode{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &litNode{true}, nil
+		case "false":
+			return &litNode{false}, nil
+		case "null":
+			return &litNode{nil}, nil
+		}
+		return &varNode{t.text}, nil
+	case tokOp:
+		if t.text == "(" {
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		}
+		if t.text == "[" {
+			items, err := p.parseList("]")
+			return &listNode{items}, err
+		}
+	}
+	return nil, fmt.Errorf("unexpected '%s' at %d", t.text, t.pos)
+}
+
+//------------------[  Evaluation  ]-----------------------------
+
+type litNode struct{ v interface{} }
+
+func (n *litNode) eval(env map[string]interface{}) (interface{}, error) { return n.v, nil }
+
+type varNode struct{ name string }
+
+func (n *varNode) eval(env map[string]interface{}) (interface{}, error) {
+	v, ok := env[n.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown name '%s'", n.name)
+	}
+	return v, nil
+}
+
+type listNode struct{ items []exprNode }
+
+func (n *listNode) eval(env map[string]interface{}) (interface{}, error) {
+	var l []interface{}
+	for _, item := range n.items {
+		v, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+	return l, nil
+}
+
+type fieldNode struct {
+	obj  exprNode
+	name string
+}
+
+func (n *fieldNode) eval(env map[string]interface{}) (interface{}, error) {
+	v, err := n.obj.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return lookupField(v, n.name), nil
+}
+
+type indexNode struct{ obj, idx exprNode }
+
+func (n *indexNode) eval(env map[string]interface{}) (interface{}, error) {
+	v, err := n.obj.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	i, err := n.idx.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := v.([]interface{}); ok {
+		if f, ok := toNumber(i); ok && int(f) >= 0 && int(f) < len(l) {
+			return l[int(f)], nil
+		}
+		return nil, nil
+	}
+	return lookupField(v, fmt.Sprint(i)), nil
+}
+
+func lookupField(v interface{}, name string) interface{} {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m[name]
+	case map[string]string:
+		if s, ok := m[name]; ok {
+			return s
+		}
+	}
+	return nil
+}
+
+type notNode struct{ n exprNode }
+
+func (n *notNode) eval(env map[string]interface{}) (interface{}, error) {
+	v, err := n.n.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a bool, not %T", v)
+	}
+	return !b, nil
+}
+
+type logicNode struct {
+	op   string
+	l, r exprNode
+}
+
+func (n *logicNode) eval(env map[string]interface{}) (interface{}, error) {
+	l, err := n.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	lb, ok := l.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s needs bools, not %T", n.op, l)
+	}
+	if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+		return lb, nil
+	}
+	r, err := n.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	rb, ok := r.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s needs bools, not %T", n.op, r)
+	}
+	return rb, nil
+}
+
+type arithNode struct {
+	op   string
+	l, r exprNode
+}
+
+func (n *arithNode) eval(env map[string]interface{}) (interface{}, error) {
+	l, err := n.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if ls, ok := l.(string); ok && n.op == "+" {
+		if rs, ok := r.(string); ok {
+			return ls + rs, nil
+		}
+	}
+	lf, lok := toNumber(l)
+	rf, rok := toNumber(r)
+	if !lok || !rok {
+		return nil, fmt.Errorf("can't do %T %s %T", l, n.op, r)
+	}
+	if n.op == "+" {
+		return lf + rf, nil
+	}
+	return lf - rf, nil
+}
+
+type cmpNode struct {
+	op   string
+	l, r exprNode
+}
+
+func (n *cmpNode) eval(env map[string]interface{}) (interface{}, error) {
+	l, err := n.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return exprEqual(l, r), nil
+	case "!=":
+		return !exprEqual(l, r), nil
+	case "in":
+		list, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'in' needs a list, not %T", r)
+		}
+		for _, item := range list {
+			if exprEqual(l, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if l == nil || r == nil {
+		return false, nil // Missing fields never compare
+	}
+	var c int
+	lf, lok := toNumber(l)
+	rf, rok := toNumber(r)
+	ls, lsok := l.(string)
+	rs, rsok := r.(string)
+	switch {
+	case lok && rok:
+		c = compareFloat(lf, rf)
+	case lsok && rsok:
+		c = strings.Compare(ls, rs)
+	default:
+		return nil, fmt.Errorf("can't compare %T %s %T", l, n.op, r)
+	}
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+func compareFloat(a, b float64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// exprEqual is ==: numbers by value whatever their type, lists and objects element by element. Whatever
+// the event holds, it doesn't panic; a plain a == b would, on two lists.
+func exprEqual(a, b interface{}) bool {
+	af, aok := toNumber(a)
+	bf, bok := toNumber(b)
+	if aok && bok {
+		return af == bf
+	}
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !exprEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if w, ok := bv[k]; !ok || !exprEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if t := reflect.TypeOf(a); t != reflect.TypeOf(b) {
+		return false
+	} else if !t.Comparable() {
+		return reflect.DeepEqual(a, b) // []string and the like, from Go code rather than JSON
+	}
+	return a == b
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+type callNode struct {
+	method string
+	obj    exprNode
+	args   []exprNode
+	re     *regexp.Regexp // matches() with a literal pattern is compiled up front
+}
+
+var exprMethods = map[string]int{"startsWith": 1, "endsWith": 1, "contains": 1, "matches": 1, "size": 0}
+
+func newCallNode(method string, obj exprNode, args []exprNode) (exprNode, error) {
+	nargs, ok := exprMethods[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown method '%s'", method)
+	}
+	if len(args) != nargs {
+		return nil, fmt.Errorf("%s() takes %d argument(s)", method, nargs)
+	}
+	n := &callNode{method: method, obj: obj, args: args}
+	if method == "matches" {
+		if lit, ok := args[0].(*litNode); ok {
+			s, ok := lit.v.(string)
+			if !ok {
+				return nil, errors.New("matches() needs a string pattern")
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, fmt.Errorf("matches(): %v", err)
+			}
+			n.re = re
+		}
+	}
+	return n, nil
+}
+
+func (n *callNode) eval(env map[string]interface{}) (interface{}, error) {
+	v, err := n.obj.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.method == "size" {
+		switch s := v.(type) {
+		case string:
+			return float64(len(s)), nil
+		case []interface{}:
+			return float64(len(s)), nil
+		case nil:
+			return 0.0, nil
+		}
+		return nil, fmt.Errorf("size() of %T", v)
+	}
+	if v == nil {
+		return false, nil // Missing field
+	}
+	s, ok := v.(string)
+	if !ok {
+		s = fmt.Sprint(v)
+	}
+	a, err := n.args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+	arg, ok := a.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s() needs a string argument", n.method)
+	}
+	switch n.method {
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	case "contains":
+		return strings.Contains(s, arg), nil
+	}
+	re := n.re
+	if re == nil {
+		if re, err = regexp.Compile(arg); err != nil {
+			return nil, fmt.Errorf("matches(): %v", err)
+		}
+	}
+	return re.MatchString(s), nil
+}
@@ -0,0 +1,135 @@
+package monitor
+
+import "testing"
+
+var exprEvent = map[string]interface{}{
+	"hostname":    "prod-thunder-1",
+	"object_name": "ws-vip",
+	"severity":    "critical",
+	"limit":       500,
+	"rate":        612.5,
+	"message":     "Virtual server ws-vip connection rate limit 500 exceeded",
+	"regions":     []interface{}{"us-east", "eu-west"},
+	"tags":        map[string]interface{}{"team": "web", "tier": 1.0},
+	"sites":       []string{"dc1", "dc2"},
+}
+
+func TestExprEval(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		want bool
+	}{
+		{`event.limit >= 500 && event.hostname.startsWith("prod-")`, true},
+		{`event.limit > 500`, false},
+		{`event.rate > event.limit`, true},
+		{`event.limit + 100 == 600`, true},
+		{`event.limit - 1 < 500`, true},
+		{`event.object_name in ["ws-vip", "api-vip"]`, true},
+		{`event.object_name in ['db-vip']`, false},
+		{`!event.message.contains("test") && event.message.matches("^Virtual (server|port)")`, true},
+		{`event.message.endsWith("exceeded")`, true},
+		{`event.hostname.size() == 14`, true},
+		{`event.regions.size() == 2`, true},
+		{`event.missing == null`, true},
+		{`event.missing.startsWith("x")`, false},
+		{`event.missing < 3`, false},
+		{`event.severity == "critical" || event.limit == 0`, true},
+		{`!(event.severity == "critical")`, false},
+		{`event.limit == 500.0`, true},
+		{`"a" < "b"`, true},
+		{`true && !false`, true},
+		{`event.tags.team == "web"`, true},
+		{`event.regions[1] == "eu-west"`, true},
+
+		// Lists and objects compare by value, and never panic
+		{`event.regions == ["us-east", "eu-west"]`, true},
+		{`event.regions == ["eu-west", "us-east"]`, false},
+		{`event.regions == ["us-east"]`, false},
+		{`["a"] == ["a"]`, true},
+		{`[1, 2] == [1.0, 2]`, true},
+		{`[["x"]] == [["x"]]`, true},
+		{`event.regions in [["us-east", "eu-west"], ["x"]]`, true},
+		{`event.regions in [["x"]]`, false},
+		{`event.regions != "us-east"`, true},
+		{`event.tags == event.tags`, true},
+		{`event.sites == event.sites`, true},
+		{`event.sites == event.regions`, false},
+	} {
+		e, err := compileExpr(c.src)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		got, err := e.Bool(exprEvent)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+		} else if got != c.want {
+			t.Errorf("%s = %v, want %v", c.src, got, c.want)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	for _, src := range []string{
+		`event.limit`,               // Not a bool
+		`event.object_name in "ws"`, // in needs a list
+		`event.hostname < 3`,
+		`event.limit.size()`,
+	} {
+		e, err := compileExpr(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if _, err := e.Bool(exprEvent); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+		if exprTrue(e, exprEvent) {
+			t.Errorf("%s: exprTrue on an error", src)
+		}
+	}
+}
+
+func TestExprParseErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`event.limit >=`,
+		`(event.limit > 1`,
+		`event.limit > 1)`,
+		`event.object_name in ["a", ]`,
+		`event.message.nosuch("x")`,
+		`event.message.contains()`,
+		`event.message.matches("(")`,
+		`event.message.matches(1)`,
+		`"unterminated`,
+		`event.limit # 1`,
+	} {
+		if _, err := compileExpr(src); err == nil {
+			t.Errorf("%q: compiled", src)
+		}
+	}
+}
+
+func TestExprEqual(t *testing.T) {
+	for _, c := range []struct {
+		a, b interface{}
+		want bool
+	}{
+		{1, 1.0, true},
+		{int64(3), uint64(3), true},
+		{"1", 1, false},
+		{nil, nil, true},
+		{nil, []interface{}{}, false},
+		{[]interface{}{}, nil, false},
+		{[]interface{}{"a"}, []interface{}{"a"}, true},
+		{map[string]interface{}{"a": 1}, map[string]interface{}{"a": 1.0}, true},
+		{map[string]interface{}{"a": 1}, map[string]interface{}{"b": 1}, false},
+		{[]string{"a"}, []string{"a"}, true},
+		{[]string{"a"}, []interface{}{"a"}, false},
+		{map[string]string{"a": "b"}, map[string]string{"a": "b"}, true},
+	} {
+		if got := exprEqual(c.a, c.b); got != c.want {
+			t.Errorf("exprEqual(%#v, %#v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package monitor
+
+//
+//  flaps.go  --  Flap detection for up/down events. A backend that keeps going up and down would otherwise
+//    be an alert for every change; a rule with "flap" collapses that into one alert while it lasts:
+//
+//    { "name": "server-state", "flap": { "transitions": 4, "within": "10m" } }
+//
+//    transitions  changes of "state" (up to down, down to up) that make it flapping. Default 4
+//    within       how close together they have to be, and how long without a change ends it. Default 10m
+//
+//  Each server (or VIP, and port, if the event has one) on a device is tracked apart. The change that
+//  makes it flapping is published as type "<type>.flapping" (e.g. "server.state.flapping"), severity
+//  warning, with "transitions" and "flapping_since"; the changes after it are only counted. Once it has
+//  gone "within" without changing, a "<type>.stable" event (severity info) gives the state it settled in,
+//  with "transitions" (all of them, while it was flapping) and "flapping_since". Both go to the rule's
+//  topic and sinks, and can be suppressed and silenced like the rule's own events.
+//
+//  The built-in server-state and vip-state rules have "flap" on, with the defaults; "flap": null in the
+//  rules file turns it off.
+//
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FlapPolicy is a rule's "flap".
+type FlapPolicy struct {
+	Transitions int    `json:"transitions"`
+	Within      string `json:"within"`
+
+	within time.Duration
+}
+
+func (p *FlapPolicy) compile(r *Rule) error {
+	if p.Transitions == 0 {
+		p.Transitions = 4
+	}
+	if p.Transitions < 2 {
+		return fmt.Errorf("Rule '%s': flap needs at least 2 transitions", r.Name)
+	}
+	p.within = 10 * time.Minute
+	if p.Within != "" {
+		d, err := time.ParseDuration(p.Within)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Rule '%s': bad flap window '%s'", r.Name, p.Within)
+		}
+		p.within = d
+	}
+	// What the flapping and stable events go out under: the rule, without what only makes sense for its
+	// own events
+	fr := *r
+	fr.Flap, fr.Threshold, fr.Recover, fr.Escalate = nil, nil, "", nil
+	fr.recover, fr.flapRule = 0, nil
+	r.flapRule = &fr
+	return nil
+}
+
+// flapState is one object's changes.
+type flapState struct {
+	ev          Event // The latest
+	seen        time.Time
+	state       string
+	changes     []time.Time // Within the window, oldest first
+	flapping    bool
+	since       time.Time // When it started flapping
+	transitions int       // Since then
+}
+
+type flaps struct {
+	mu      sync.Mutex
+	objects map[string]*flapState
+}
+
+func newFlaps() *flaps {
+	return &flaps{objects: make(map[string]*flapState)}
+}
+
+func flapKey(ev Event) string {
+	key := suppressKey(ev.Device, ev.Type, ev.Object)
+	if port, ok := ev.Fields["port"]; ok && port != nil {
+		key += fmt.Sprintf(":%v", port)
+	}
+	return key
+}
+
+// flapName is what the event is about, e.g. "server s1 port 80".
+func flapName(ev Event) string {
+	name := ev.Object
+	if t, ok := ev.Fields["object_type"].(string); ok && t != "" {
+		name = t + " " + name
+	}
+	if port, ok := ev.Fields["port"]; ok && port != nil {
+		name += fmt.Sprintf(" port %v", port)
+	}
+	return name
+}
+
+// seen notes a state event. hold says it shouldn't be published: it is a change while the object is
+// flapping. With start, it is the change that made it flapping, and flapping is the event to publish for
+// it instead.
+func (f *flaps) seen(ev Event, now time.Time) (flapping Event, start bool, hold bool) {
+	p := ev.Rule.Flap
+	state, _ := ev.Fields["state"].(string)
+	if state == "" {
+		return Event{}, false, false
+	}
+	key := flapKey(ev)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.objects[key]
+	if !ok {
+		f.objects[key] = &flapState{ev: ev, seen: now, state: state}
+		return Event{}, false, false
+	}
+	s.ev, s.seen = ev, now
+	if state == s.state {
+		return Event{}, false, s.flapping // The same again; when flapping, still part of it
+	}
+	s.state = state
+	s.changes = append(s.changes, now)
+	for len(s.changes) > 0 && now.Sub(s.changes[0]) > p.within {
+		s.changes = s.changes[1:]
+	}
+	if s.flapping {
+		s.transitions++
+		return Event{}, false, true
+	}
+	if len(s.changes) < p.Transitions {
+		return Event{}, false, false
+	}
+	s.flapping, s.since, s.transitions = true, s.changes[0], len(s.changes)
+	return s.event(".flapping", "warning", fmt.Sprintf("%s is flapping: %d changes in %s", flapName(ev), len(s.changes), now.Sub(s.since).Round(time.Second))), true, true
+}
+
+// event is the flapping or stable event for the object.
+func (s *flapState) event(suffix string, severity string, message string) Event {
+	ev := s.ev
+	ev.Rule = s.ev.Rule.flapRule
+	ev.Type = s.ev.Type + suffix
+	ev.Severity = severity
+	ev.Message = message
+	ev.Deadline = time.Time{}
+	ev.Fields = make(map[string]interface{}, len(s.ev.Fields)+2)
+	for k, v := range s.ev.Fields {
+		ev.Fields[k] = v
+	}
+	ev.Fields["transitions"] = s.transitions
+	ev.Fields["flapping_since"] = s.since.UTC().Format(time.RFC3339)
+	return ev
+}
+
+// closed takes out the objects that have settled, returning their stable events. An object not heard
+// from in a day is forgotten; until then its state is kept, so the change after a quiet spell still counts.
+func (f *flaps) closed(now time.Time) []Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []Event
+	for k, s := range f.objects {
+		if s.flapping && now.Sub(s.changes[len(s.changes)-1]) >= s.ev.Rule.Flap.within {
+			out = append(out, s.event(".stable", "info", fmt.Sprintf("%s has stopped flapping, %s after %d changes", flapName(s.ev), s.state, s.transitions)))
+			s.flapping, s.changes, s.transitions = false, nil, 0
+		}
+		if !s.flapping && now.Sub(s.seen) >= 24*time.Hour {
+			delete(f.objects, k)
+		}
+	}
+	return out
+}
+
+// flapSummaries publishes the stable events as the objects settle.
+func (a *agent) flapSummaries(ctx context.Context) {
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			for _, ev := range a.flaps.closed(now) {
+				a.emit(ctx, a.config, ev)
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package monitor
+
+//
+//  grafana.go  --  Marks incidents on Grafana dashboards. When an alert starts for a service (VIP or other
+//    object) a region annotation is created through the Grafana HTTP API, and once 'hold' seconds go by
+//    without another alert for it the region is closed off, so the traffic graphs show exactly when it
+//    was happening.
+//
+//  "grafana": { "url": "http://grafana:3000", "api_key": "glsa_...", "hold": 300, "tags": ["a10"],
+//               "filter": "event.type == \"conn.rate-limit\"",
+//               "dashboards": { "ws-vip": {"dashboard_uid": "web-traffic", "panel_id": 4} },
+//               "default_dashboard": {"dashboard_uid": "thunder"} }
+//
+//  Services not in 'dashboards' go on 'default_dashboard', or are organization-wide annotations if there
+//  isn't one.
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// GrafanaDashboard says where a service's annotations go.
+type GrafanaDashboard struct {
+	Dashboard_UID string `json:"dashboard_uid"`
+	Panel_ID      int    `json:"panel_id"` // 0 = the whole dashboard
+}
+
+// GrafanaConfig holds the 'grafana' section of the config.
+type GrafanaConfig struct {
+	URL               string                      `json:"url"`
+	API_Key           string                      `json:"api_key"`
+	Hold              int                         `json:"hold"` // Seconds. Default 300
+	Tags              []string                    `json:"tags"`
+	Filter            string                      `json:"filter"` // Only annotate events this is true for, see expr.go
+	Dashboards        map[string]GrafanaDashboard `json:"dashboards"`
+	Default_Dashboard *GrafanaDashboard           `json:"default_dashboard"`
+}
+
+type grafanaIncident struct {
+	id      int64 // Annotation ID, 0 if creating it failed
+	started time.Time
+	last    time.Time
+	events  int
+	text    string
+}
+
+type grafanaOutput struct {
+	lost uint64 // Events not annotated because the queue was full. Updated atomically, so kept first
+
+	cfg    GrafanaConfig
+	filter *Expr
+	health *outputHealth // See health.go
+	client *http.Client
+	debug  int
+	queue  chan map[string]interface{}
+
+	incidents map[string]*grafanaIncident // Only touched by run()
+}
+
+func newGrafanaOutput(cfg GrafanaConfig, timeout time.Duration, debug int) (*grafanaOutput, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	if cfg.Hold <= 0 {
+		cfg.Hold = 300
+	}
+	g := &grafanaOutput{cfg: cfg, client: &http.Client{Timeout: timeout}, debug: debug,
+		queue: make(chan map[string]interface{}, 1000), incidents: make(map[string]*grafanaIncident)}
+	if cfg.Filter != "" {
+		f, err := compileExpr(cfg.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("Bad grafana filter: %v", err)
+		}
+		g.filter = f
+	}
+	return g, nil
+}
+
+// publish hands an event over. It never blocks: Grafana being slow mustn't hold up the alerts.
+func (g *grafanaOutput) publish(payload map[string]interface{}) {
+	if g == nil || (g.filter != nil && !exprTrue(g.filter, payload)) {
+		return
+	}
+	select {
+	case g.queue <- payload:
+	default:
+		atomic.AddUint64(&g.lost, 1)
+		reportError(g.debug, errDeliverGrafana, "Grafana queue full, event not annotated")
+	}
+}
+
+// Name is "grafana", see sinks.go.
+func (g *grafanaOutput) Name() string { return "grafana" }
+
+// Publish queues out for annotating; run keeps the output health for it.
+func (g *grafanaOutput) Publish(ctx context.Context, out *Outgoing) error {
+	g.publish(out.Payload)
+	return errSinkQueued
+}
+
+// run annotates the queued events until ctx is done.
+func (g *grafanaOutput) run(ctx context.Context) {
+	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-g.queue:
+			g.event(ctx, p, time.Now())
+		case now := <-tick.C:
+			g.closeCleared(ctx, now)
+		}
+	}
+}
+
+func grafanaService(p map[string]interface{}) string {
+	s, _ := p["object_name"].(string)
+	if s == "" {
+		s, _ = p["hostname"].(string)
+	}
+	return s
+}
+
+// event starts an incident for the service, or adds to the one going.
+func (g *grafanaOutput) event(ctx context.Context, p map[string]interface{}, now time.Time) {
+	svc := grafanaService(p)
+	class := fmt.Sprintf("%v", p["type"])
+	key := svc + "/" + class
+	inc, ok := g.incidents[key]
+	if ok {
+		inc.last = now
+		inc.events++
+		return
+	}
+	inc = &grafanaIncident{started: now, last: now, events: 1,
+		text: fmt.Sprintf("%s on %s (%v): %v", class, svc, p["hostname"], p["message"])}
+	g.incidents[key] = inc
+
+	tags := append([]string{class}, g.cfg.Tags...)
+	if svc != "" {
+		tags = append(tags, svc)
+	}
+	body := map[string]interface{}{"time": now.UnixNano() / 1e6, "tags": tags, "text": inc.text}
+	d := g.cfg.Default_Dashboard
+	if sd, ok := g.cfg.Dashboards[svc]; ok {
+		d = &sd
+	}
+	if d != nil {
+		body["dashboardUID"] = d.Dashboard_UID
+		if d.Panel_ID != 0 {
+			body["panelId"] = d.Panel_ID
+		}
+	}
+	var res struct {
+		ID int64 `json:"id"`
+	}
+	if err := g.call(ctx, "POST", "/api/annotations", body, &res); err != nil {
+		reportError(g.debug, errDeliverGrafana, "Grafana annotation error: "+err.Error())
+		return
+	}
+	inc.id = res.ID
+}
+
+// closeCleared ends the annotation of each incident that has gone quiet.
+func (g *grafanaOutput) closeCleared(ctx context.Context, now time.Time) {
+	hold := time.Duration(g.cfg.Hold) * time.Second
+	var done []*grafanaIncident
+	for k, inc := range g.incidents {
+		if now.Sub(inc.last) >= hold {
+			done = append(done, inc)
+			delete(g.incidents, k)
+		}
+	}
+	for _, inc := range done {
+		if inc.id == 0 {
+			continue
+		}
+		body := map[string]interface{}{
+			"timeEnd": inc.last.UnixNano() / 1e6,
+			"text":    fmt.Sprintf("%s\nCleared after %s, %d events", inc.text, inc.last.Sub(inc.started).Round(time.Second), inc.events),
+		}
+		if err := g.call(ctx, "PATCH", fmt.Sprintf("/api/annotations/%d", inc.id), body, nil); err != nil {
+			reportError(g.debug, errDeliverGrafana, "Grafana annotation error: "+err.Error())
+		}
+	}
+}
+
+func (g *grafanaOutput) call(ctx context.Context, method string, path string, body interface{}, res interface{}) (err error) {
+	defer func(start time.Time) { g.health.record("grafana", err == nil, time.Since(start)) }(time.Now())
+	b, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(g.cfg.URL, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.cfg.API_Key != "" {
+		req.Header.Set("Authorization", "Bearer "+g.cfg.API_Key)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("Grafana said " + resp.Status)
+	}
+	if res != nil {
+		return json.NewDecoder(resp.Body).Decode(res)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package monitor
+
+//
+//  health.go  --  How well each output is delivering: the share of events it took, and how long it took
+//    them, over a rolling window. A sink that has quietly started failing shows up here before it is
+//    missed in an incident:
+//
+//  "output_health": { "window": "15m", "min_success": 0.99, "min_deliveries": 20 }
+//
+//    window          how far back the figures go, to the minute. Default 15m
+//    min_success     below this share delivered, an agent.output_degraded event goes to diag_topic, and
+//                    agent.output_recovered once it is back over. 0 (the default) = no events
+//    min_deliveries  a window with fewer tries than this is too small to judge. Default 20
+//
+//  The outputs are "mqtt" (the publish to mqtt_broker; mirrors have their own figures, see mirror.go),
+//  "grafana", "kafka", "nats", "amqp", "slack", "teams" and each plugin and webhook by name. An event that
+//  goes to the spool isn't counted; the spool has metrics of its own (see spool.go). The figures are in GET
+//  /status as "outputs" and in the metrics as a10crm_output_success_ratio, a10crm_output_deliveries,
+//  a10crm_output_latency_seconds (mean) and a10crm_output_latency_max_seconds, each by output.
+//
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthConfig holds the 'output_health' section of the config.
+type HealthConfig struct {
+	Window         string  `json:"window"`
+	Min_Success    float64 `json:"min_success"`
+	Min_Deliveries int     `json:"min_deliveries"`
+}
+
+// healthBucket is one minute of one output.
+type healthBucket struct {
+	minute  int64 // Unix minutes
+	ok      uint64
+	failed  uint64
+	latency time.Duration // Total, for the mean
+	max     time.Duration
+}
+
+// outputSLI is one output's figures over the window.
+type outputSLI struct {
+	Deliveries  uint64  `json:"deliveries"`
+	Failed      uint64  `json:"failed"`
+	Success     float64 `json:"success_rate"` // 1 with no deliveries
+	Latency_Avg float64 `json:"latency_avg_ms"`
+	Latency_Max float64 `json:"latency_max_ms"`
+	Degraded    bool    `json:"degraded,omitempty"`
+}
+
+type outputHealth struct {
+	cfg     HealthConfig
+	minutes int
+
+	mu       sync.Mutex
+	outputs  map[string][]healthBucket // A ring of minutes buckets each
+	degraded map[string]bool
+}
+
+func newOutputHealth(cfg HealthConfig) (*outputHealth, error) {
+	window := 15 * time.Minute
+	if cfg.Window != "" {
+		d, err := time.ParseDuration(cfg.Window)
+		if err != nil || d < time.Minute {
+			return nil, fmt.Errorf("output_health: bad window '%s', it needs to be a minute or more", cfg.Window)
+		}
+		window = d
+	}
+	if cfg.Min_Success < 0 || cfg.Min_Success > 1 {
+		return nil, fmt.Errorf("output_health: min_success must be between 0 and 1")
+	}
+	if cfg.Min_Deliveries <= 0 {
+		cfg.Min_Deliveries = 20
+	}
+	return &outputHealth{cfg: cfg, minutes: int(window / time.Minute), outputs: make(map[string][]healthBucket), degraded: make(map[string]bool)}, nil
+}
+
+// record counts one try at delivering to output, which took took.
+func (h *outputHealth) record(output string, ok bool, took time.Duration) {
+	if h == nil {
+		return
+	}
+	minute := time.Now().Unix() / 60
+	h.mu.Lock()
+	ring, found := h.outputs[output]
+	if !found {
+		ring = make([]healthBucket, h.minutes)
+		h.outputs[output] = ring
+	}
+	b := &ring[minute%int64(h.minutes)]
+	if b.minute != minute {
+		*b = healthBucket{minute: minute}
+	}
+	if ok {
+		b.ok++
+	} else {
+		b.failed++
+	}
+	b.latency += took
+	if took > b.max {
+		b.max = took
+	}
+	h.mu.Unlock()
+}
+
+// slis is every output's figures over the window to now.
+func (h *outputHealth) slis(now time.Time) map[string]outputSLI {
+	out := make(map[string]outputSLI)
+	if h == nil {
+		return out
+	}
+	oldest := now.Unix()/60 - int64(h.minutes) + 1
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, ring := range h.outputs {
+		var s outputSLI
+		var total, max time.Duration
+		for _, b := range ring {
+			if b.minute < oldest {
+				continue
+			}
+			s.Deliveries += b.ok + b.failed
+			s.Failed += b.failed
+			total += b.latency
+			if b.max > max {
+				max = b.max
+			}
+		}
+		s.Success = 1
+		if s.Deliveries > 0 {
+			s.Success = float64(s.Deliveries-s.Failed) / float64(s.Deliveries)
+			s.Latency_Avg = float64(total/time.Duration(s.Deliveries)) / float64(time.Millisecond)
+		}
+		s.Latency_Max = float64(max) / float64(time.Millisecond)
+		s.Degraded = h.degraded[name]
+		out[name] = s
+	}
+	return out
+}
+
+// check is the outputs that have just gone below min_success, and those that have just come back.
+func (h *outputHealth) check(now time.Time) (degraded []string, recovered []string, slis map[string]outputSLI) {
+	slis = h.slis(now)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, s := range slis {
+		if s.Deliveries < uint64(h.cfg.Min_Deliveries) {
+			continue // Too few to say either way
+		}
+		bad := s.Success < h.cfg.Min_Success
+		if bad && !h.degraded[name] {
+			degraded = append(degraded, name)
+		} else if !bad && h.degraded[name] {
+			recovered = append(recovered, name)
+		}
+		h.degraded[name] = bad
+	}
+	sort.Strings(degraded)
+	sort.Strings(recovered)
+	return degraded, recovered, slis
+}
+
+// watchOutputs tells diag_topic when an output goes below min_success, or comes back.
+func (a *agent) watchOutputs(ctx context.Context) {
+	if a.health == nil || a.health.cfg.Min_Success == 0 {
+		return
+	}
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			degraded, recovered, slis := a.health.check(now)
+			for _, name := range degraded {
+				s := slis[name]
+				a.diagnostic(ctx, map[string]interface{}{
+					"type":         "agent.output_degraded",
+					"message":      fmt.Sprintf("Output %s delivered %.1f%% of %d events in the last %dm", name, s.Success*100, s.Deliveries, a.health.minutes),
+					"output":       name,
+					"success_rate": s.Success,
+					"min_success":  a.health.cfg.Min_Success,
+					"deliveries":   s.Deliveries,
+					"failed":       s.Failed,
+				})
+			}
+			for _, name := range recovered {
+				s := slis[name]
+				a.diagnostic(ctx, map[string]interface{}{
+					"type":         "agent.output_recovered",
+					"message":      fmt.Sprintf("Output %s is delivering again, %.1f%% in the last %dm", name, s.Success*100, a.health.minutes),
+					"output":       name,
+					"success_rate": s.Success,
+					"deliveries":   s.Deliveries,
+				})
+			}
+		}
+	}
+}
+
+// writeMetrics adds the per-output metrics, see metrics.go.
+func (h *outputHealth) writeMetrics(p *promWriter) {
+	if h == nil {
+		return
+	}
+	slis := h.slis(time.Now())
+	names := make([]string, 0, len(slis))
+	for name := range slis {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, m := range []struct {
+		name string
+		kind string
+		help string
+		v    func(s outputSLI) interface{}
+	}{
+		{"a10crm_output_success_ratio", "gauge", "Share of deliveries each output took, over output_health's window.", func(s outputSLI) interface{} { return s.Success }},
+		{"a10crm_output_deliveries", "gauge", "Deliveries tried on each output, over output_health's window.", func(s outputSLI) interface{} { return s.Deliveries }},
+		{"a10crm_output_latency_seconds", "gauge", "Mean time each output took to deliver, over output_health's window.", func(s outputSLI) interface{} { return s.Latency_Avg / 1000 }},
+		{"a10crm_output_latency_max_seconds", "gauge", "Longest time each output took to deliver, over output_health's window.", func(s outputSLI) interface{} { return s.Latency_Max / 1000 }},
+	} {
+		for _, name := range names {
+			p.metric(m.name, m.kind, m.help, fmt.Sprintf(`output="%s"`, promLabel(name)), m.v(slis[name]))
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package monitor
+
+//
+//  heartbeat.go  --  A periodic agent.heartbeat event on 'diag_topic', so central monitoring can tell an
+//    agent with nothing to report from one that is backed up and throwing events away. Besides the record
+//    counts it carries the flow control state: what is waiting in the spool (spool.go), whether publishing
+//    is being held back by mqtt_rate (smoother.go), and everything dropped since the last heartbeat.
+//
+//  "heartbeat": 60                       seconds between heartbeats; 0 (the default) = none
+//  "heartbeat_topic": "ops/a10crm/alive"  where they go instead. Default diag_topic
+//
+//  Each one says which agent it is from: "agent_id" is client_id (unique per broker anyway), or the
+//  hostname without one, and "hostname", "started" and "uptime" go with it. "counts" is the per-device
+//  counters (counters.go) summed up: received, matched and published since they were last reset, and how
+//  many devices have been heard from. A consumer that expects a heartbeat every minute and hasn't had one
+//  in three knows the agent is dead or wedged, whether or not the Thunders have anything to say.
+//
+//  "state" is "ok", "backed_up" (records or spooled events waiting) or "shedding" (something was dropped
+//  since the last heartbeat).
+//
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatTopic is where the heartbeat goes.
+func (a *agent) heartbeatTopic() string {
+	if a.config.Heartbeat_Topic != "" {
+		return a.config.Heartbeat_Topic
+	}
+	return a.diagTopic()
+}
+
+// agentID is what the heartbeat calls this agent.
+func (a *agent) agentID() string {
+	if a.config.Client_ID != "" {
+		return a.config.Client_ID
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+func (a *agent) heartbeat(ctx context.Context) {
+	if a.config.Heartbeat <= 0 {
+		return
+	}
+	var dropped uint64
+	tick := time.NewTicker(time.Duration(a.config.Heartbeat) * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			var hb map[string]interface{}
+			hb, dropped = a.heartbeatEvent(dropped)
+			a.diagnosticTo(ctx, a.heartbeatTopic(), hb)
+		}
+	}
+}
+
+// heartbeatEvent builds the heartbeat. It returns the total dropped so far, for the next one.
+func (a *agent) heartbeatEvent(lastDropped uint64) (map[string]interface{}, uint64) {
+	received := atomic.LoadUint64(&a.received)
+	processed := atomic.LoadUint64(&a.processed)
+	stuck := atomic.LoadUint64(&a.stuck)
+	backlog := uint64(0)
+	if received > processed+stuck {
+		backlog = received - processed - stuck
+	}
+	lost := atomic.LoadUint64(&a.lost)
+	drops := map[string]interface{}{"mqtt": lost}
+	total := lost
+	spooled := 0
+	hb := map[string]interface{}{
+		"type":      "agent.heartbeat",
+		"message":   "Agent heartbeat",
+		"agent_id":  a.agentID(),
+		"started":   startTime.UTC().Format(time.RFC3339),
+		"uptime":    int(time.Since(startTime).Seconds()),
+		"received":  received,
+		"processed": processed,
+		"backlog":   backlog,
+		"stuck":     stuck,
+		"dropped":   drops,
+	}
+	if host, err := os.Hostname(); err == nil {
+		hb["hostname"] = host
+	}
+	if a.counters != nil {
+		r, m, p, d := a.counters.Totals()
+		hb["counts"] = map[string]interface{}{"received": r, "matched": m, "published": p, "devices": d}
+	}
+	if addr := syslogAddr(); addr != "" {
+		hb["syslog_listen"] = addr
+	}
+	if a.spool != nil {
+		pending, dropped := a.spool.stats()
+		for _, p := range pending {
+			spooled += p
+		}
+		for _, d := range dropped {
+			total += d
+		}
+		hb["spool"] = pending
+		drops["spool"] = dropped
+	}
+	if a.bucket != nil {
+		tokens, throttled := a.bucket.state()
+		hb["throttle"] = map[string]interface{}{
+			"per_second": a.bucket.rate,
+			"throttling": tokens < 1,
+			"throttled":  throttled, // Events held back or sent to the spool so far
+		}
+	}
+	if a.grafana != nil {
+		g := atomic.LoadUint64(&a.grafana.lost)
+		drops["grafana"] = g
+		total += g
+	}
+	if e := atomic.LoadUint64(&a.eventsLost); e > 0 {
+		drops["events"] = e // Embedded, and Events() not read fast enough. See monitor.go
+		total += e
+	}
+	if late := atomic.LoadUint64(&a.late); late > 0 {
+		hb["late"] = late // Events whose time budget ran out, see deadlines.go
+	}
+	if a.storm != nil {
+		active, held := a.storm.state()
+		hb["storm"] = map[string]interface{}{"active": active, "held": held} // See storm.go
+	}
+	if a.mirror != nil {
+		hb["regions"] = a.mirror.stats() // See mirror.go
+	}
+	if errs := errorSnapshot(); len(errs) > 0 {
+		hb["errors"] = errs // By code, see errors.go
+	}
+	hb["spooled"] = spooled
+	hb["dropped_since_last"] = total - lastDropped
+	switch {
+	case total > lastDropped:
+		hb["state"] = "shedding"
+	case backlog > 0 || spooled > 0:
+		hb["state"] = "backed_up"
+	default:
+		hb["state"] = "ok"
+	}
+	return hb, total
+}
@@ -0,0 +1,47 @@
+package monitor
+
+//
+//  hosts.go  --  Allow and deny lists for the hostname of the Thunder device a record came from, for when
+//    the agent shares a Syslog feed with other devices. Entries can use shell-style wildcards. A host on
+//    the deny list is always dropped; if there is an allow list, only hosts on it are kept.
+//
+//  "hosts": { "allow": ["prod-thunder-*", "Testing1"], "deny": ["prod-thunder-lab*"] }
+//
+//  Records from dropped hosts aren't counted anywhere, so other teams' devices don't show up in the
+//  counters or metrics.
+//
+
+import "path"
+
+// HostsConfig holds the 'hosts' section of the config.
+type HostsConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+func hostListed(host string, list []string) bool {
+	for _, pat := range list {
+		if ok, _ := path.Match(pat, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// keep says whether records from the host are wanted.
+func (h *HostsConfig) keep(host string) bool {
+	if hostListed(host, h.Deny) {
+		return false
+	}
+	return len(h.Allow) == 0 || hostListed(host, h.Allow)
+}
+
+// check reports the first bad pattern, since path.Match only says so when it is used.
+func (h *HostsConfig) check() error {
+	for _, pat := range append(append([]string{}, h.Allow...), h.Deny...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,730 @@
+package monitor
+
+//
+//  kafka.go  --  Kafka as an output, for sites whose event bus is Kafka rather than MQTT. Talks the Kafka
+//    protocol directly (Metadata v4, Produce v3, SASL), so no client library is needed for one producer:
+//
+//  "kafka": { "brokers": ["kafka-1:9092", "kafka-2:9092"], "topic": "a10-alerts",
+//             "sasl": { "mechanism": "SCRAM-SHA-512", "username": "a10crm", "password": "..." }, "tls": {} }
+//
+//    brokers   where to get the cluster's metadata from; the others are found from it
+//    topic     the topic every event goes to. It has to be there already
+//    key       the record key, a template like 'event_key' (eventkey.go), for Kafka to be keyed differently
+//              from the other partitioned outputs. Default the event key, so per device unless 'event_key'
+//              says otherwise ("{{.hostname}}/{{.object_name}}" keeps each VIP's events in order instead)
+//    acks      "all" (the default), "leader" or "none", as for any Kafka producer
+//    sasl      "mechanism" PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, with "username" and "password"
+//    tls       see tls.go
+//    filter    only send events this expression is true for, see expr.go
+//    fields    only send these payload fields, see project.go
+//
+//  The value is the payload as JSON. Partitions are picked from the key the way the Java client does it
+//  (murmur2), so other producers keyed the same way line up. Each event is one produce request, within
+//  the "sink" deadline (deadlines.go); a broker that has stopped leading the partition gets one retry after
+//  fresh metadata. The sink is called "kafka" in rules' "sinks" (sinks.go) and the output health.
+//
+//  Why not sarama or kafka-go: both bring compression codecs, consumer groups and admin calls along with
+//  the producer, and their current releases need a newer Go than the 1.15 this module builds with. Making
+//  small JSON records takes only the three requests above and v2 record batches (CRC-32C), so that is all
+//  there is: no compression, idempotence or transactions, and brokers from Kafka 1.0 on. kafka_test.go
+//  checks the framing, the batches and the partitioning against a fake broker.
+//
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// KafkaConfig holds the 'kafka' section of the config.
+type KafkaConfig struct {
+	Brokers []string   `json:"brokers"`
+	Topic   string     `json:"topic"`
+	Key     string     `json:"key"`
+	Acks    string     `json:"acks"`
+	SASL    *KafkaSASL `json:"sasl"`
+	TLS     *TLSConfig `json:"tls"`
+	Filter  string     `json:"filter"`
+	Fields  []string   `json:"fields"`
+}
+
+// KafkaSASL is the 'sasl' part of the 'kafka' section.
+type KafkaSASL struct {
+	Mechanism string `json:"mechanism"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+// kafkaMetadataAge is how long the partition leaders are used before they are asked for again.
+const kafkaMetadataAge = 5 * time.Minute
+
+// The Kafka API keys used.
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSaslHandshake    = 17
+	kafkaSaslAuthenticate = 36
+)
+
+type kafkaSink struct {
+	cfg      KafkaConfig
+	clientID string
+	acks     int16
+	key      *template.Template // From 'key'; nil = the event key
+	filter   *Expr
+	fields   projection
+	tls      *tls.Config
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	brokers map[int32]string // Node ID to address, from the metadata
+	leaders map[int32]int32  // Partition to the node leading it
+	metaAt  time.Time
+	conns   map[string]*kafkaConn
+	next    uint32 // Round robin for events with no key
+}
+
+// newKafkaSink is nil if there are no brokers.
+func newKafkaSink(cfg KafkaConfig, clientID string, timeout time.Duration) (*kafkaSink, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, nil
+	}
+	if cfg.Topic == "" {
+		return nil, errors.New("kafka: a 'topic' is needed")
+	}
+	if clientID == "" {
+		clientID = "a10crm"
+	}
+	k := &kafkaSink{cfg: cfg, clientID: clientID, timeout: timeout, conns: make(map[string]*kafkaConn)}
+	switch strings.ToLower(cfg.Acks) {
+	case "", "all", "-1":
+		k.acks = -1
+	case "leader", "1":
+		k.acks = 1
+	case "none", "0":
+		k.acks = 0
+	default:
+		return nil, fmt.Errorf("kafka: acks is \"all\", \"leader\" or \"none\", not '%s'", cfg.Acks)
+	}
+	if cfg.SASL != nil {
+		cfg.SASL.Mechanism = strings.ToUpper(cfg.SASL.Mechanism)
+		switch cfg.SASL.Mechanism {
+		case "":
+			cfg.SASL.Mechanism = "PLAIN"
+		case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		default:
+			return nil, fmt.Errorf("kafka: unknown SASL mechanism '%s'", cfg.SASL.Mechanism)
+		}
+		k.cfg.SASL = cfg.SASL
+	}
+	var err error
+	if cfg.Key != "" {
+		if k.key, err = parseTemplate("kafka.key", cfg.Key); err != nil {
+			return nil, fmt.Errorf("kafka: bad key template: %v", err)
+		}
+	}
+	if cfg.Filter != "" {
+		if k.filter, err = compileExpr(cfg.Filter); err != nil {
+			return nil, fmt.Errorf("kafka: bad filter: %v", err)
+		}
+	}
+	if k.fields, err = compileProjection(cfg.Fields); err != nil {
+		return nil, fmt.Errorf("kafka: %v", err)
+	}
+	if k.tls, err = cfg.TLS.config("kafka"); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Name is "kafka", see sinks.go.
+func (k *kafkaSink) Name() string { return "kafka" }
+
+// Publish produces out to the topic.
+func (k *kafkaSink) Publish(ctx context.Context, out *Outgoing) error {
+	if k.filter != nil && !exprTrue(k.filter, out.Payload) {
+		return errSinkSkipped
+	}
+	ctx, cancel := context.WithTimeout(ctx, k.timeout)
+	defer cancel()
+	key := out.Key
+	if k.key != nil {
+		var err error
+		if key, err = renderTemplate(ctx, k.key, out.Payload); err != nil {
+			countError(timeoutCode(err, errRenderTemplate, errRenderTimeout))
+			key = ""
+		}
+	}
+	value, _ := json.Marshal(k.fields.apply(out.Payload))
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	err := k.produce(ctx, []byte(key), value, time.Now())
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%v: %w", err, ctx.Err()) // A connection deadline says i/o timeout; count it as one
+	}
+	if err != nil {
+		return &sinkError{timeoutCode(err, errDeliverKafka, errDeliverKafkaTime), err}
+	}
+	return nil
+}
+
+// kafkaRetry is an error fresh metadata may get past.
+type kafkaRetry struct{ error }
+
+// produce sends one record, trying once more with fresh metadata if the leader has moved. Caller holds
+// k.mu.
+func (k *kafkaSink) produce(ctx context.Context, key, value []byte, now time.Time) error {
+	var err error
+	for try := 0; try < 2; try++ {
+		if try > 0 || len(k.leaders) == 0 || now.Sub(k.metaAt) > kafkaMetadataAge {
+			if err = k.refresh(ctx); err != nil {
+				return err
+			}
+		}
+		if err = k.produceOnce(ctx, key, value, now); err == nil {
+			return nil
+		}
+		if _, ok := err.(kafkaRetry); !ok {
+			return err
+		}
+	}
+	return err
+}
+
+func (k *kafkaSink) produceOnce(ctx context.Context, key, value []byte, now time.Time) error {
+	partition := k.partition(key)
+	leader, ok := k.leaders[partition]
+	addr := k.brokers[leader]
+	if !ok || leader < 0 || addr == "" {
+		return kafkaRetry{fmt.Errorf("kafka: no leader for partition %d of '%s'", partition, k.cfg.Topic)}
+	}
+	c, err := k.conn(ctx, addr)
+	if err != nil {
+		return kafkaRetry{err}
+	}
+	var w kafkaWriter
+	w.int16(-1) // No transactional ID
+	w.int16(k.acks)
+	w.int32(int32(k.timeout / time.Millisecond))
+	w.int32(1)
+	w.str(k.cfg.Topic)
+	w.int32(1)
+	w.int32(partition)
+	w.bytes(kafkaRecordBatch(key, value, now))
+	resp, err := c.roundTrip(ctx, kafkaProduce, 3, k.clientID, w.buf.Bytes(), k.acks != 0)
+	if err != nil {
+		k.drop(addr)
+		return kafkaRetry{err}
+	}
+	if k.acks == 0 {
+		return nil
+	}
+	r := kafkaReader{b: resp}
+	for t := r.int32(); t > 0 && r.err == nil; t-- {
+		r.str()
+		for p := r.int32(); p > 0 && r.err == nil; p-- {
+			r.int32()
+			code := r.int16()
+			r.int64()
+			r.int64()
+			if code != 0 {
+				err := fmt.Errorf("kafka: produce to '%s' failed: %s", k.cfg.Topic, kafkaErrorName(code))
+				if kafkaStale(code) {
+					return kafkaRetry{err}
+				}
+				return err
+			}
+		}
+	}
+	if r.err != nil {
+		k.drop(addr)
+		return fmt.Errorf("kafka: bad produce response: %v", r.err)
+	}
+	return nil
+}
+
+// partition is the partition for key: murmur2 like the Java client's default partitioner, or round robin
+// with no key.
+func (k *kafkaSink) partition(key []byte) int32 {
+	n := uint32(len(k.leaders))
+	if len(key) == 0 {
+		k.next++
+		return int32(k.next % n)
+	}
+	return int32(uint32(murmur2(key)&0x7fffffff) % n)
+}
+
+// refresh gets the brokers and the partition leaders for the topic from the first broker that answers.
+// Caller holds k.mu.
+func (k *kafkaSink) refresh(ctx context.Context) error {
+	var w kafkaWriter
+	w.int32(1)
+	w.str(k.cfg.Topic)
+	w.int8(0) // Don't create it
+	var last error
+	addrs := append([]string{}, k.cfg.Brokers...)
+	for _, a := range k.brokers {
+		addrs = append(addrs, a)
+	}
+	for _, addr := range addrs {
+		c, err := k.conn(ctx, addr)
+		if err != nil {
+			last = err
+			continue
+		}
+		resp, err := c.roundTrip(ctx, kafkaMetadata, 4, k.clientID, w.buf.Bytes(), true)
+		if err != nil {
+			k.drop(addr)
+			last = err
+			continue
+		}
+		return k.readMetadata(resp)
+	}
+	return fmt.Errorf("kafka: no broker answered: %v", last)
+}
+
+func (k *kafkaSink) readMetadata(resp []byte) error {
+	r := kafkaReader{b: resp}
+	r.int32() // Throttle
+	brokers := make(map[int32]string)
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id := r.int32()
+		host := r.str()
+		port := r.int32()
+		r.nullStr() // Rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.nullStr() // Cluster ID
+	r.int32()   // Controller
+	leaders := make(map[int32]int32)
+	var code int16
+	for t := r.int32(); t > 0 && r.err == nil; t-- {
+		code = r.int16()
+		r.str()
+		r.int8()
+		for p := r.int32(); p > 0 && r.err == nil; p-- {
+			r.int16()
+			id := r.int32()
+			leaders[id] = r.int32()
+			r.int32s() // Replicas
+			r.int32s() // In sync
+		}
+	}
+	switch {
+	case r.err != nil:
+		return fmt.Errorf("kafka: bad metadata response: %v", r.err)
+	case code != 0:
+		return fmt.Errorf("kafka: topic '%s': %s", k.cfg.Topic, kafkaErrorName(code))
+	case len(leaders) == 0:
+		return fmt.Errorf("kafka: topic '%s' has no partitions", k.cfg.Topic)
+	}
+	k.brokers, k.leaders, k.metaAt = brokers, leaders, time.Now()
+	return nil
+}
+
+// conn is the open connection to addr, connecting (and authenticating) if there isn't one. Caller holds
+// k.mu.
+func (k *kafkaSink) conn(ctx context.Context, addr string) (*kafkaConn, error) {
+	if c := k.conns[addr]; c != nil {
+		return c, nil
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %v", err)
+	}
+	if k.tls != nil {
+		host, _, _ := net.SplitHostPort(addr)
+		tc := tls.Client(nc, forHost(k.tls, host))
+		if dl, ok := ctx.Deadline(); ok {
+			tc.SetDeadline(dl)
+		}
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("kafka: TLS to %s: %v", addr, err)
+		}
+		nc = tc
+	}
+	c := &kafkaConn{conn: nc, r: bufio.NewReader(nc)}
+	if k.cfg.SASL != nil {
+		if err := k.authenticate(ctx, c); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	k.conns[addr] = c
+	return c, nil
+}
+
+// drop closes the connection to addr, after it went wrong. Caller holds k.mu.
+func (k *kafkaSink) drop(addr string) {
+	if c := k.conns[addr]; c != nil {
+		c.conn.Close()
+		delete(k.conns, addr)
+	}
+}
+
+// authenticate does the SASL exchange on a new connection.
+func (k *kafkaSink) authenticate(ctx context.Context, c *kafkaConn) error {
+	s := k.cfg.SASL
+	var w kafkaWriter
+	w.str(s.Mechanism)
+	resp, err := c.roundTrip(ctx, kafkaSaslHandshake, 1, k.clientID, w.buf.Bytes(), true)
+	if err != nil {
+		return fmt.Errorf("kafka: SASL handshake: %v", err)
+	}
+	r := kafkaReader{b: resp}
+	if code := r.int16(); code != 0 || r.err != nil {
+		return fmt.Errorf("kafka: broker won't do SASL %s: %s", s.Mechanism, kafkaErrorName(code))
+	}
+	step := func(auth []byte) ([]byte, error) {
+		var w kafkaWriter
+		w.bytes(auth)
+		resp, err := c.roundTrip(ctx, kafkaSaslAuthenticate, 0, k.clientID, w.buf.Bytes(), true)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: SASL: %v", err)
+		}
+		r := kafkaReader{b: resp}
+		code := r.int16()
+		msg := r.nullStr()
+		reply := r.bytesField()
+		if r.err != nil {
+			return nil, fmt.Errorf("kafka: bad SASL response: %v", r.err)
+		}
+		if code != 0 {
+			if msg == "" {
+				msg = kafkaErrorName(code)
+			}
+			return nil, fmt.Errorf("kafka: SASL: %s", msg)
+		}
+		return reply, nil
+	}
+	switch s.Mechanism {
+	case "SCRAM-SHA-256":
+		return scramAuth(sha256.New, s.Username, s.Password, step)
+	case "SCRAM-SHA-512":
+		return scramAuth(sha512.New, s.Username, s.Password, step)
+	}
+	_, err = step([]byte("\x00" + s.Username + "\x00" + s.Password))
+	return err
+}
+
+// scramAuth is the client side of SCRAM (RFC 5802), with step sending a message and giving the reply.
+func scramAuth(h func() hash.Hash, user, password string, step func([]byte) ([]byte, error)) error {
+	mac := func(key []byte, msg string) []byte {
+		m := hmac.New(h, key)
+		m.Write([]byte(msg))
+		return m.Sum(nil)
+	}
+	b := make([]byte, 18)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	user = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	firstBare := "n=" + user + ",r=" + nonce
+	reply, err := step([]byte("n,," + firstBare))
+	if err != nil {
+		return err
+	}
+	serverFirst := string(reply)
+	attrs := scramAttrs(serverFirst)
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	iter, _ := strconv.Atoi(attrs["i"])
+	if err != nil || iter <= 0 || !strings.HasPrefix(attrs["r"], nonce) {
+		return errors.New("kafka: SASL: bad SCRAM challenge from the broker")
+	}
+
+	// Hi(): PBKDF2 with HMAC, one block
+	u := mac([]byte(password), string(salt)+"\x00\x00\x00\x01")
+	salted := append([]byte{}, u...)
+	for i := 1; i < iter; i++ {
+		u = mac([]byte(password), string(u))
+		for j := range salted {
+			salted[j] ^= u[j]
+		}
+	}
+	clientKey := mac(salted, "Client Key")
+	sum := h()
+	sum.Write(clientKey)
+	storedKey := sum.Sum(nil)
+	finalBare := "c=biws,r=" + attrs["r"]
+	authMessage := firstBare + "," + serverFirst + "," + finalBare
+	proof := mac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	reply, err = step([]byte(finalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	final := scramAttrs(string(reply))
+	if e, ok := final["e"]; ok {
+		return fmt.Errorf("kafka: SASL: %s", e)
+	}
+	want := base64.StdEncoding.EncodeToString(mac(mac(salted, "Server Key"), authMessage))
+	if final["v"] != want {
+		return errors.New("kafka: SASL: the broker's SCRAM signature is wrong")
+	}
+	return nil
+}
+
+// scramAttrs splits "r=...,s=...,i=..." up.
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(msg, ",") {
+		if len(kv) > 2 && kv[1] == '=' {
+			attrs[kv[:1]] = kv[2:]
+		}
+	}
+	return attrs
+}
+
+// kafkaConn is a connection to one broker. Used under kafkaSink.mu.
+type kafkaConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	corr int32
+}
+
+// roundTrip sends one request and, with reply, reads its response, giving the body after the header.
+func (c *kafkaConn) roundTrip(ctx context.Context, api, version int16, clientID string, body []byte, reply bool) ([]byte, error) {
+	dl, _ := ctx.Deadline() // Zero, no deadline, if there isn't one
+	c.conn.SetDeadline(dl)
+	c.corr++
+	var w kafkaWriter
+	w.int32(0) // Size, filled in below
+	w.int16(api)
+	w.int16(version)
+	w.int32(c.corr)
+	w.str(clientID)
+	w.buf.Write(body)
+	req := w.buf.Bytes()
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, err
+	}
+	if !reply {
+		return nil, nil
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 64<<20 {
+		return nil, fmt.Errorf("response of %d bytes", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	if corr := int32(binary.BigEndian.Uint32(resp)); corr != c.corr {
+		return nil, fmt.Errorf("response %d to request %d", corr, c.corr)
+	}
+	return resp[4:], nil
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaRecordBatch is a v2 record batch of one record.
+func kafkaRecordBatch(key, value []byte, now time.Time) []byte {
+	var rec kafkaWriter
+	rec.int8(0)   // Attributes
+	rec.varint(0) // Timestamp delta
+	rec.varint(0) // Offset delta
+	rec.varbytes(key)
+	rec.varbytes(value)
+	rec.varint(0) // No headers
+
+	var body kafkaWriter // From the attributes on, what the CRC covers
+	ms := now.UnixNano() / int64(time.Millisecond)
+	body.int16(0) // Attributes: no compression, create time
+	body.int32(0) // Last offset delta
+	body.int64(ms)
+	body.int64(ms)
+	body.int64(-1) // No producer ID
+	body.int16(-1)
+	body.int32(-1)
+	body.int32(1)
+	body.varint(int64(rec.buf.Len()))
+	body.buf.Write(rec.buf.Bytes())
+
+	var w kafkaWriter
+	w.int64(0)                                 // Base offset
+	w.int32(int32(4 + 1 + 4 + body.buf.Len())) // Length: leader epoch, magic, CRC and the rest
+	w.int32(-1)                                // Partition leader epoch
+	w.int8(2)                                  // Magic
+	w.int32(int32(crc32.Checksum(body.buf.Bytes(), crc32c)))
+	w.buf.Write(body.buf.Bytes())
+	return w.buf.Bytes()
+}
+
+// murmur2 is the Java client's hash for picking a partition from a key.
+func murmur2(data []byte) int32 {
+	const m, r = 0x5bd1e995, 24
+	n := len(data)
+	h := uint32(0x9747b28c) ^ uint32(n)
+	for i := 0; i+4 <= n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[n&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaStale says whether a produce error code means the metadata is out of date.
+func kafkaStale(code int16) bool {
+	return code == 3 || code == 5 || code == 6
+}
+
+var kafkaErrors = map[int16]string{
+	2: "CORRUPT_MESSAGE", 3: "UNKNOWN_TOPIC_OR_PARTITION", 5: "LEADER_NOT_AVAILABLE", 6: "NOT_LEADER_OR_FOLLOWER",
+	7: "REQUEST_TIMED_OUT", 10: "MESSAGE_TOO_LARGE", 19: "NOT_ENOUGH_REPLICAS", 20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED", 33: "UNSUPPORTED_SASL_MECHANISM", 34: "ILLEGAL_SASL_STATE",
+	35: "UNSUPPORTED_VERSION", 58: "SASL_AUTHENTICATION_FAILED",
+}
+
+func kafkaErrorName(code int16) string {
+	if s, ok := kafkaErrors[code]; ok {
+		return s
+	}
+	return fmt.Sprintf("error %d", code)
+}
+
+// kafkaWriter builds requests, big-endian as Kafka has them.
+type kafkaWriter struct{ buf bytes.Buffer }
+
+func (w *kafkaWriter) int8(v int8) { w.buf.WriteByte(byte(v)) }
+func (w *kafkaWriter) int16(v int16) {
+	binary.Write(&w.buf, binary.BigEndian, v)
+}
+func (w *kafkaWriter) int32(v int32) {
+	binary.Write(&w.buf, binary.BigEndian, v)
+}
+func (w *kafkaWriter) int64(v int64) {
+	binary.Write(&w.buf, binary.BigEndian, v)
+}
+func (w *kafkaWriter) str(s string) {
+	w.int16(int16(len(s)))
+	w.buf.WriteString(s)
+}
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.buf.Write(b)
+}
+func (w *kafkaWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// varbytes is a record's key or value: -1 for none.
+func (w *kafkaWriter) varbytes(b []byte) {
+	if len(b) == 0 {
+		w.varint(-1)
+		return
+	}
+	w.varint(int64(len(b)))
+	w.buf.Write(b)
+}
+
+// kafkaReader reads responses. After the first error everything reads as zero and err says why.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = errors.New("response cut short")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+func (r *kafkaReader) int16() int16 {
+	if b := r.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+func (r *kafkaReader) int32() int32 {
+	if b := r.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+func (r *kafkaReader) int64() int64 {
+	if b := r.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+func (r *kafkaReader) str() string { return string(r.take(int(r.int16()))) }
+func (r *kafkaReader) nullStr() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+func (r *kafkaReader) bytesField() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.take(int(n))
+}
+func (r *kafkaReader) int32s() {
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.int32()
+	}
+}
@@ -0,0 +1,395 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The vectors from the Java client's own murmur2 test (UtilsTest), so keys go to the partitions other
+// producers send them to.
+func TestMurmur2(t *testing.T) {
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := murmur2([]byte(key)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestKafkaPartition(t *testing.T) {
+	k := &kafkaSink{leaders: map[int32]int32{0: 1, 1: 1, 2: 1}}
+	for key, want := range map[string]int32{
+		"21":     (-973932308 & 0x7fffffff) % 3,
+		"foobar": (-790332482 & 0x7fffffff) % 3,
+		"abc":    479470107 % 3,
+	} {
+		if got := k.partition([]byte(key)); got != want {
+			t.Errorf("partition(%q) = %d, want %d", key, got, want)
+		}
+	}
+	seen := map[int32]bool{}
+	for i := 0; i < 3; i++ {
+		seen[k.partition(nil)] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("round robin without a key gave %v", seen)
+	}
+}
+
+func TestKafkaWriterReader(t *testing.T) {
+	var w kafkaWriter
+	w.int8(-2)
+	w.int16(-300)
+	w.int32(70000)
+	w.int64(-1 << 40)
+	w.str("a10-alerts")
+	w.int16(-1) // A null string
+	w.bytes([]byte("value"))
+	w.int32(-1) // Null bytes
+	w.int32(2)  // An array of int32s
+	w.int32(7)
+	w.int32(8)
+	w.int32(99)
+
+	r := kafkaReader{b: w.buf.Bytes()}
+	if v := r.int8(); v != -2 {
+		t.Errorf("int8 %d", v)
+	}
+	if v := r.int16(); v != -300 {
+		t.Errorf("int16 %d", v)
+	}
+	if v := r.int32(); v != 70000 {
+		t.Errorf("int32 %d", v)
+	}
+	if v := r.int64(); v != -1<<40 {
+		t.Errorf("int64 %d", v)
+	}
+	if v := r.str(); v != "a10-alerts" {
+		t.Errorf("str %q", v)
+	}
+	if v := r.nullStr(); v != "" {
+		t.Errorf("nullStr %q", v)
+	}
+	if v := r.bytesField(); string(v) != "value" {
+		t.Errorf("bytes %q", v)
+	}
+	if v := r.bytesField(); v != nil {
+		t.Errorf("null bytes %q", v)
+	}
+	r.int32s()
+	if v := r.int32(); v != 99 || r.err != nil {
+		t.Errorf("after the array %d, %v", v, r.err)
+	}
+
+	// Cut short, it says so and reads zeros from then on
+	r = kafkaReader{b: []byte{0, 5, 'a'}}
+	if v := r.str(); v != "" || r.err == nil {
+		t.Errorf("short str %q, %v", v, r.err)
+	}
+	if v := r.int32(); v != 0 {
+		t.Errorf("read %d after an error", v)
+	}
+}
+
+// kafkaVarint reads a zigzag varint, as records have them.
+func kafkaVarint(t *testing.T, b []byte) (int64, []byte) {
+	t.Helper()
+	v, n := binary.Varint(b)
+	if n <= 0 {
+		t.Fatalf("bad varint in % x", b)
+	}
+	return v, b[n:]
+}
+
+// A record batch, taken apart again field by field.
+func TestKafkaRecordBatch(t *testing.T) {
+	if got := crc32.Checksum([]byte("123456789"), crc32c); got != 0xe3069283 {
+		t.Fatalf("CRC-32C check value %#x", got) // The Castagnoli polynomial, not IEEE
+	}
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	ms := now.UnixNano() / int64(time.Millisecond)
+	for _, key := range []string{"thunder1/ws-vip", ""} {
+		b := kafkaRecordBatch([]byte(key), []byte(`{"rule":"r"}`), now)
+		r := kafkaReader{b: b}
+		if v := r.int64(); v != 0 {
+			t.Errorf("base offset %d", v)
+		}
+		if n := r.int32(); int(n) != len(b)-12 {
+			t.Errorf("batch length %d, the rest is %d", n, len(b)-12)
+		}
+		r.int32() // Leader epoch
+		if v := r.int8(); v != 2 {
+			t.Errorf("magic %d", v)
+		}
+		crc := uint32(r.int32())
+		if got := crc32.Checksum(r.b, crc32c); got != crc {
+			t.Errorf("CRC %#x, the batch has %#x", got, crc)
+		}
+		r.int16() // Attributes
+		r.int32() // Last offset delta
+		if first, max := r.int64(), r.int64(); first != ms || max != ms {
+			t.Errorf("timestamps %d, %d", first, max)
+		}
+		r.int64()
+		r.int16()
+		r.int32()
+		if n := r.int32(); n != 1 {
+			t.Errorf("%d records", n)
+		}
+		size, rest := kafkaVarint(t, r.b)
+		if int(size) != len(rest) {
+			t.Errorf("record length %d, %d bytes left", size, len(rest))
+		}
+		rest = rest[1:] // Attributes
+		_, rest = kafkaVarint(t, rest)
+		_, rest = kafkaVarint(t, rest)
+		n, rest := kafkaVarint(t, rest)
+		if key == "" && n != -1 {
+			t.Errorf("no key is %d long", n)
+		} else if key != "" && string(rest[:n]) != key {
+			t.Errorf("key %q", rest[:n])
+		}
+		if n > 0 {
+			rest = rest[n:]
+		}
+		n, rest = kafkaVarint(t, rest)
+		if string(rest[:n]) != `{"rule":"r"}` {
+			t.Errorf("value %q", rest[:n])
+		}
+		if h, rest := kafkaVarint(t, rest[n:]); h != 0 || len(rest) != 0 {
+			t.Errorf("%d headers, %d bytes after", h, len(rest))
+		}
+	}
+}
+
+// kafkaRequest is a request as the fake broker read it.
+type kafkaRequest struct {
+	api, version int16
+	clientID     string
+	body         []byte
+}
+
+// fakeKafka is a broker that answers Metadata and Produce requests with what reply gives. It is the only
+// broker, leader of every partition.
+func fakeKafka(t *testing.T, reply func(req kafkaRequest, self string) []byte) (addr string, got chan kafkaRequest) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	got = make(chan kafkaRequest, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				in := bufio.NewReader(c)
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(in, size[:]); err != nil {
+						return
+					}
+					b := make([]byte, binary.BigEndian.Uint32(size[:]))
+					if _, err := io.ReadFull(in, b); err != nil {
+						return
+					}
+					r := kafkaReader{b: b}
+					req := kafkaRequest{api: r.int16(), version: r.int16()}
+					corr := r.int32()
+					req.clientID = r.str()
+					req.body = r.b
+					got <- req
+					body := reply(req, l.Addr().String())
+					if body == nil {
+						continue // acks none
+					}
+					var w kafkaWriter
+					w.int32(int32(4 + len(body)))
+					w.int32(corr)
+					w.buf.Write(body)
+					c.Write(w.buf.Bytes())
+				}
+			}(c)
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+// kafkaMetadataReply is a Metadata v4 response naming self as the one broker and leader for the
+// partitions, with the topic error code.
+func kafkaMetadataReply(self, topic string, partitions int, code int16) []byte {
+	host, port, _ := net.SplitHostPort(self)
+	p, _ := strconv.Atoi(port)
+	var w kafkaWriter
+	w.int32(0) // Throttle
+	w.int32(1)
+	w.int32(1) // Node 1
+	w.str(host)
+	w.int32(int32(p))
+	w.int16(-1) // No rack
+	w.int16(-1) // No cluster ID
+	w.int32(1)  // Controller
+	w.int32(1)
+	w.int16(code)
+	w.str(topic)
+	w.int8(0)
+	w.int32(int32(partitions))
+	for i := 0; i < partitions; i++ {
+		w.int16(0)
+		w.int32(int32(i))
+		w.int32(1) // Leader
+		w.int32(1)
+		w.int32(1) // Replicas
+		w.int32(1)
+		w.int32(1) // In sync
+	}
+	return w.buf.Bytes()
+}
+
+func kafkaProduceReply(topic string, partition int32, code int16) []byte {
+	var w kafkaWriter
+	w.int32(1)
+	w.str(topic)
+	w.int32(1)
+	w.int32(partition)
+	w.int16(code)
+	w.int64(42) // Base offset
+	w.int64(-1) // Log append time
+	w.int32(0)  // Throttle
+	return w.buf.Bytes()
+}
+
+// A produce through a broker that stopped leading the partition: metadata, a produce turned down as
+// NOT_LEADER_OR_FOLLOWER, fresh metadata, and the produce again.
+func TestKafkaProduce(t *testing.T) {
+	produces := 0
+	addr, got := fakeKafka(t, func(req kafkaRequest, self string) []byte {
+		switch req.api {
+		case kafkaMetadata:
+			return kafkaMetadataReply(self, "a10-alerts", 3, 0)
+		case kafkaProduce:
+			r := kafkaReader{b: req.body}
+			r.nullStr()
+			r.int16()
+			r.int32()
+			r.int32()
+			r.str()
+			r.int32()
+			p := r.int32()
+			if produces++; produces == 1 {
+				return kafkaProduceReply("a10-alerts", p, 6)
+			}
+			return kafkaProduceReply("a10-alerts", p, 0)
+		}
+		t.Errorf("unexpected API %d", req.api)
+		return nil
+	})
+	k, err := newKafkaSink(KafkaConfig{Brokers: []string{addr}, Topic: "a10-alerts", Fields: []string{"rule"}}, "test-client", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := map[string]interface{}{"rule": "conn-rate-limit", "hostname": "thunder1", "object_name": "ws-vip"}
+	if err := k.Publish(context.Background(), &Outgoing{Event: Event{Rule: &Rule{}}, Payload: payload, Key: "thunder1/ws-vip"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ api, version int16 }{{kafkaMetadata, 4}, {kafkaProduce, 3}, {kafkaMetadata, 4}, {kafkaProduce, 3}}
+	for i, w := range want {
+		req := <-got
+		if req.api != w.api || req.version != w.version || req.clientID != "test-client" {
+			t.Fatalf("request %d: API %d v%d from %q, want API %d v%d", i, req.api, req.version, req.clientID, w.api, w.version)
+		}
+		if req.api == kafkaMetadata {
+			r := kafkaReader{b: req.body}
+			if n, topic, create := r.int32(), r.str(), r.int8(); n != 1 || topic != "a10-alerts" || create != 0 || r.err != nil {
+				t.Errorf("metadata request for %d topics, %q, create %d", n, topic, create)
+			}
+			continue
+		}
+		r := kafkaReader{b: req.body}
+		txn, acks, timeout := r.int16(), r.int16(), r.int32()
+		if txn != -1 || acks != -1 || timeout != 5000 {
+			t.Errorf("produce: transactional ID %d, acks %d, timeout %d", txn, acks, timeout)
+		}
+		if n, topic, np := r.int32(), r.str(), r.int32(); n != 1 || topic != "a10-alerts" || np != 1 {
+			t.Errorf("produce to %d topics, %q, %d partitions", n, topic, np)
+		}
+		if p := r.int32(); p != k.partition([]byte("thunder1/ws-vip")) {
+			t.Errorf("produce to partition %d", p)
+		}
+		batch := r.bytesField()
+		if r.err != nil || len(r.b) != 0 {
+			t.Fatalf("produce request: %v, %d bytes over", r.err, len(r.b))
+		}
+		if !bytes.Contains(batch, []byte("thunder1/ws-vip")) || !bytes.Contains(batch, []byte(`{"rule":"conn-rate-limit"}`)) {
+			t.Errorf("batch without the key and projected value: %q", batch)
+		}
+	}
+}
+
+// An error for the topic in the metadata is the publish's error.
+func TestKafkaMetadataError(t *testing.T) {
+	addr, _ := fakeKafka(t, func(req kafkaRequest, self string) []byte {
+		return kafkaMetadataReply(self, "a10-alerts", 0, 3)
+	})
+	k, err := newKafkaSink(KafkaConfig{Brokers: []string{addr}, Topic: "a10-alerts"}, "", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.Publish(context.Background(), &Outgoing{Event: Event{Rule: &Rule{}}, Payload: map[string]interface{}{}})
+	if err == nil || err.Error() != "kafka: topic 'a10-alerts': UNKNOWN_TOPIC_OR_PARTITION" {
+		t.Errorf("error %v", err)
+	}
+}
+
+// The record key is the event key, unless the kafka section gives one of its own.
+func TestKafkaKey(t *testing.T) {
+	for _, c := range []struct{ key, want, not string }{{"", "thunder1", "ws-vip"}, {"{{.object_name}}", "ws-vip", "thunder1"}} {
+		addr, got := fakeKafka(t, func(req kafkaRequest, self string) []byte {
+			if req.api == kafkaMetadata {
+				return kafkaMetadataReply(self, "a10-alerts", 1, 0)
+			}
+			return kafkaProduceReply("a10-alerts", 0, 0)
+		})
+		k, err := newKafkaSink(KafkaConfig{Brokers: []string{addr}, Topic: "a10-alerts", Key: c.key, Fields: []string{"rule"}}, "", 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := map[string]interface{}{"rule": "conn-rate-limit", "hostname": "thunder1", "object_name": "ws-vip"}
+		if err := k.Publish(context.Background(), &Outgoing{Event: Event{Rule: &Rule{}}, Payload: payload, Key: "thunder1"}); err != nil {
+			t.Fatal(err)
+		}
+		<-got // Metadata
+		req := <-got
+		r := kafkaReader{b: req.body}
+		r.nullStr()
+		r.int16()
+		r.int32()
+		r.int32()
+		r.str()
+		r.int32()
+		r.int32()
+		batch := r.bytesField()
+		if r.err != nil || !bytes.Contains(batch, []byte(c.want)) || bytes.Contains(batch, []byte(c.not)) {
+			t.Errorf("key %q: batch %q, want the key %q", c.key, batch, c.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package monitor
+
+//
+//  lenient.go  --  RFC 3164 parsing that copes with relays stripping or mangling the timestamp. The Syslog
+//    library does take those records, but puts the whole header (bad timestamp, hostname and tag) in front
+//    of the content and uses the sender's IP for the hostname, so no rule matches them. Here the header is
+//    picked apart again: the hostname and tag are recovered, the receive time stands in for the timestamp,
+//    and "timestamp_substituted" is set so the payload (and the counters) can say so.
+//
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// lenientRFC3164 is syslog.RFC3164 with the above fixed up.
+type lenientRFC3164 struct {
+	format.RFC3164
+}
+
+func (f *lenientRFC3164) GetParser(line []byte) format.LogParser {
+	return &lenientParser{line: line, inner: f.RFC3164.GetParser(line)}
+}
+
+type lenientParser struct {
+	line  []byte
+	inner format.LogParser
+	parts format.LogParts
+}
+
+func (p *lenientParser) Location(l *time.Location) { p.inner.Location(l) }
+
+func (p *lenientParser) Dump() format.LogParts { return p.parts }
+
+func (p *lenientParser) Parse() error {
+	err := p.inner.Parse()
+	p.parts = p.inner.Dump()
+	if err != nil {
+		return err
+	}
+	rest, ok := afterPriority(p.line)
+	if good, zoned := goodTimestamp(rest); ok && good {
+		p.parts["timestamp_zoned"] = zoned // Else it is read in the device's timezone, see timestamps.go
+		return nil
+	}
+	host, tag, content := splitHeader(string(bytes.Trim(rest, " ")))
+	p.parts["hostname"] = host // "" = use the sender's address, see agent.process
+	if tag != "" {
+		p.parts["tag"] = tag
+	}
+	p.parts["content"] = content
+	p.parts["timestamp"] = time.Now().UTC()
+	p.parts["timestamp_substituted"] = true
+	p.parts["timestamp_zoned"] = true
+	return nil
+}
+
+// afterPriority returns what follows the "<132>" at the start of the record.
+func afterPriority(line []byte) ([]byte, bool) {
+	if len(line) < 3 || line[0] != '<' {
+		return line, false
+	}
+	i := bytes.IndexByte(line, '>')
+	if i < 2 || i > 4 {
+		return line, false
+	}
+	return line[i+1:], true
+}
+
+// goodTimestamp is the check the library makes: a time.Stamp or RFC3339 timestamp right at the start.
+// Only RFC3339 ones say what timezone they are in.
+func goodTimestamp(b []byte) (good bool, zoned bool) {
+	for _, f := range []string{time.Stamp, time.RFC3339} {
+		if len(b) >= len(f) {
+			if _, err := time.Parse(f, string(b[:len(f)])); err == nil {
+				return true, f == time.RFC3339
+			}
+		}
+	}
+	return false, false
+}
+
+// Things left over from a timestamp the library couldn't read: "May 18", "2021/05/18", "22:03:04.123",
+// "+0000", "UTC" and so on.
+var timestampJunk = regexp.MustCompile(`^(?:(?i:jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\s+\d{1,2}\b|\d{4}[-/.]\d{1,2}[-/.]\d{1,2}(?:T[\d:.]+)?|\d{1,2}[-/.]\d{1,2}[-/.]\d{2,4}|\d{1,2}:\d{2}(?::\d{2})?(?:\.\d+)?|\d{4}\b|[+-]\d{2}:?\d{2}|Z|UTC|GMT)[Z,]?\s*`)
+
+// splitHeader picks the hostname and tag out of what comes after the priority, once any remains of a
+// timestamp have been dropped. "Testing1 a10logd: [ACOS]<4> ..." gives "Testing1", "a10logd" and the rest.
+func splitHeader(s string) (host string, tag string, content string) {
+	for {
+		m := timestampJunk.FindString(s)
+		if m == "" {
+			break
+		}
+		s = s[len(m):]
+	}
+	if strings.HasPrefix(s, "[") {
+		return "", "", s // Went straight to the "[ACOS]<4>" part
+	}
+	word := func(s string) string {
+		if i := strings.IndexByte(s, ' '); i > 0 {
+			return s[:i]
+		}
+		return s
+	}
+	rest := s
+	if w := word(rest); !strings.HasSuffix(w, ":") && !strings.Contains(w, "[") {
+		host = w
+		rest = strings.TrimLeft(rest[len(w):], " ")
+	}
+	if w := word(rest); strings.HasSuffix(w, ":") && !strings.HasPrefix(w, "[") {
+		tag = strings.TrimSuffix(w, ":")
+		if i := strings.IndexByte(tag, '['); i > 0 {
+			tag = tag[:i] // "a10logd[123]:"
+		}
+		rest = strings.TrimLeft(rest[len(w):], " ")
+	}
+	if tag == "" && !strings.HasPrefix(rest, "[") {
+		return "", "", s // Doesn't look like a header after all
+	}
+	return host, tag, rest
+}
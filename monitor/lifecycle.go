@@ -0,0 +1,119 @@
+package monitor
+
+//
+//  lifecycle.go  --  Where each alert is in its life: open, acknowledged or resolved. An alert is one
+//    object (VIP, server, ...) alerting on one device for one event type, and its ID is its suppression
+//    key (see suppress.go), the "alert_id" in the payload, so it is the same however many times it is
+//    published, from whichever agent:
+//
+//    open          the first event published for it opens it
+//    acknowledged  an ack came in for it (see acks.go)
+//    resolved      it recovered (see recovery.go), a state rule reported the object up (server "up",
+//                  health monitor "recovered", ...), or an ack closed it. The next event opens it again
+//
+//  Every published payload has "alert_state" and "alert_opened" (RFC 3339), so consumers can tell a
+//  repeat of an alert they have from a new one, and drop what they hold when it is resolved. With them go
+//  "incident_id", new each time the alert opens and the same on everything published for it until it is
+//  resolved (repeats, suppression summaries, escalations and the all-clear), and "alert_sequence", which
+//  of those it is from 1, so subscribers can stitch an incident together and tell if they missed part of
+//  it. The incident ID is this agent's; alert_id and alert_opened are the same from every agent. The alerts
+//  are on GET /alerts (?state=open for only those). A resolved alert is kept an hour; one that has had
+//  nothing published for a day is forgotten.
+//
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Alert states
+const (
+	alertOpen         = "open"
+	alertAcknowledged = "acknowledged"
+	alertResolved     = "resolved"
+)
+
+// Alert is one alert's lifecycle.
+type Alert struct {
+	ID           string     `json:"id"`
+	Incident     string     `json:"incident_id"` // New each time it opens
+	State        string     `json:"state"`
+	Opened       time.Time  `json:"opened"`
+	Acknowledged *time.Time `json:"acknowledged,omitempty"`
+	By           string     `json:"by,omitempty"` // Who acknowledged or closed it, if the ack said
+	Resolved     *time.Time `json:"resolved,omitempty"`
+	Last         time.Time  `json:"last"`      // When it was last published
+	Published    uint64     `json:"published"` // Events published for it since it opened
+}
+
+// published moves ev's alert along for an event about to be published, returning it. An all-clear or an
+// "up" is the end of the incident it is published in, so it resolves the alert rather than opening one.
+func (s *Suppressions) published(ev Event, now time.Time) Alert {
+	id := ev.alertID()
+	recovering := ev.Recovered || ev.backUp()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.alerts[id]
+	if !ok || (a.State == alertResolved && !recovering) {
+		a = &Alert{ID: id, Incident: newEventID(), State: alertOpen, Opened: now}
+		s.alerts[id] = a
+	}
+	if recovering {
+		s.setAlertState(id, alertResolved, "", now)
+	}
+	a.Last = now
+	a.Published++
+	return *a
+}
+
+// setAlertState moves an alert to acknowledged or resolved. Caller holds s.mu.
+func (s *Suppressions) setAlertState(id string, state string, by string, now time.Time) {
+	a, ok := s.alerts[id]
+	if !ok || a.State == alertResolved {
+		return
+	}
+	switch state {
+	case alertAcknowledged:
+		a.Acknowledged = &now
+	case alertResolved:
+		a.Resolved = &now
+	}
+	a.State = state
+	if by != "" {
+		a.By = by
+	}
+}
+
+// pruneAlerts forgets alerts resolved more than an hour ago, and those with nothing published for a day.
+// Caller holds s.mu.
+func (s *Suppressions) pruneAlerts(now time.Time) {
+	if now.Sub(s.pruned) < time.Minute {
+		return
+	}
+	s.pruned = now
+	for id, a := range s.alerts {
+		if (a.State == alertResolved && now.Sub(*a.Resolved) >= time.Hour) || now.Sub(a.Last) >= 24*time.Hour {
+			delete(s.alerts, id)
+		}
+	}
+}
+
+// Alerts returns the alerts, sorted by ID. state "" is all of them.
+func (s *Suppressions) Alerts(state string) []Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneAlerts(time.Now())
+	as := []Alert{}
+	for _, a := range s.alerts {
+		if state == "" || a.State == state {
+			as = append(as, *a)
+		}
+	}
+	sort.Slice(as, func(i, j int) bool { return as[i].ID < as[j].ID })
+	return as
+}
+
+func (s *Suppressions) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Alerts(r.URL.Query().Get("state")))
+}
@@ -0,0 +1,63 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+)
+
+// A server going down opens its alert, coming back up resolves it in the same incident, and going down
+// again is a new incident.
+func TestLifecycleUpResolves(t *testing.T) {
+	m := newTestMonitor(t, Configuration{})
+	s := &payloadSink{}
+	m.a.sinks.sinks, m.a.sinks.busy = []Sink{s}, make([]int32, 1)
+	for _, state := range []string{"DOWN", "UP", "DOWN"} {
+		m.a.process(context.Background(), serverStateRecord("thunder1", "s1", state))
+	}
+	if len(s.got) != 3 {
+		t.Fatalf("%d published", len(s.got))
+	}
+	down, up, again := s.got[0], s.got[1], s.got[2]
+	if down["alert_state"] != alertOpen || up["alert_state"] != alertResolved || again["alert_state"] != alertOpen {
+		t.Errorf("states %v, %v, %v", down["alert_state"], up["alert_state"], again["alert_state"])
+	}
+	if up["incident_id"] != down["incident_id"] || up["alert_sequence"] != uint64(2) {
+		t.Errorf("up is %v #%v, down was %v", up["incident_id"], up["alert_sequence"], down["incident_id"])
+	}
+	if again["incident_id"] == down["incident_id"] || again["alert_sequence"] != uint64(1) {
+		t.Errorf("down after the up is %v #%v, still the first incident", again["incident_id"], again["alert_sequence"])
+	}
+	as := m.a.suppress.Alerts("")
+	if len(as) != 1 || as[0].State != alertOpen || as[0].Resolved != nil {
+		t.Errorf("alerts %+v", as)
+	}
+}
+
+// An up for an alert there wasn't is resolved, not opened.
+func TestLifecycleUpAlone(t *testing.T) {
+	m := newTestMonitor(t, Configuration{})
+	m.a.process(context.Background(), serverStateRecord("thunder1", "s1", "UP"))
+	as := m.a.suppress.Alerts("")
+	if len(as) != 1 || as[0].State != alertResolved || as[0].Resolved == nil {
+		t.Errorf("alerts %+v", as)
+	}
+}
+
+// An ack moves the alert to acknowledged, and a close resolves it.
+func TestLifecycleAckAndClose(t *testing.T) {
+	m := newTestMonitor(t, Configuration{})
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	ev := nextEvent(m)
+	if ev == nil {
+		t.Fatal("not published")
+	}
+	for _, c := range []struct{ action, want string }{{"ack", alertAcknowledged}, {"close", alertResolved}} {
+		if err := m.a.suppress.ApplyAck(AckMessage{Key: ev.alertID(), Action: c.action, By: "jsmith"}, "test", ev.Received); err != nil {
+			t.Fatal(err)
+		}
+		as := m.a.suppress.Alerts("")
+		if len(as) != 1 || as[0].State != c.want || as[0].By != "jsmith" {
+			t.Errorf("after %s: %+v", c.action, as)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package monitor
+
+//
+//  listen.go  --  Getting the Syslog port. If 'syslog_port' is taken, the agent says what has it (from /proc,
+//    on Linux) and tries the 'syslog_fallback_ports' in order:
+//
+//  "syslog_port": 5514, "syslog_fallback_ports": [5515, 5516]
+//
+//  Each port that was taken is logged and counted as listen.bind (see errors.go). The address it ended up
+//  on is in GET /status and the heartbeat as "syslog_listen", and an agent.listening event with it goes to
+//  diag_topic, so the Thunder's 'logging host' can be pointed at it. If none of the ports can be had, Run
+//  fails with ExitBind (see exit.go).
+//
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	syslog "gopkg.in/mcuadros/go-syslog.v2"
+)
+
+// syslogListen is the address the Syslog server is on, "" before it is up. Process-wide, like the API.
+var syslogListen atomic.Value
+
+func syslogAddr() string {
+	s, _ := syslogListen.Load().(string)
+	return s
+}
+
+// listenSyslog puts the server on the first port it can have. It returns the address.
+func (a *agent) listenSyslog(server *syslog.Server) (string, error) {
+	ports := append([]int{a.config.Syslog_port}, a.config.Syslog_Fallback_Ports...)
+	var taken []string
+	for _, port := range ports {
+		addr := "0.0.0.0:" + strconv.Itoa(port)
+		err := server.ListenUDP(addr)
+		if err == nil {
+			syslogListen.Store(addr)
+			return addr, nil
+		}
+		why := err.Error()
+		if holder := portHolder(port); holder != "" {
+			why = "in use by " + holder
+		}
+		reportError(a.config.Debug, errListenBind, fmt.Sprintf("Syslog port %d: %s", port, why))
+		taken = append(taken, fmt.Sprintf("port %d %s", port, why))
+	}
+	return "", fmt.Errorf("Unable to listen for Syslog: %s", strings.Join(taken, "; "))
+}
+
+// listening tells diag_topic where the agent is listening.
+func (a *agent) listening(ctx context.Context, addr string) {
+	a.diagnostic(ctx, map[string]interface{}{
+		"type":          "agent.listening",
+		"message":       "Listening for Syslog on " + addr,
+		"syslog_listen": addr,
+		"fallback":      addr != "0.0.0.0:"+strconv.Itoa(a.config.Syslog_port),
+	})
+}
+
+// portHolder is the process with a UDP socket on port, e.g. "rsyslogd (pid 812)", or "" if that can't be
+// found out (not Linux, or not allowed to look).
+func portHolder(port int) string {
+	inodes := make(map[string]bool)
+	for _, fn := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(b), "\n")[1:] {
+			f := strings.Fields(line)
+			if len(f) < 10 {
+				continue
+			}
+			// local_address is "0100007F:1589", the port in hex
+			i := strings.LastIndex(f[1], ":")
+			if p, err := strconv.ParseInt(f[1][i+1:], 16, 32); err == nil && int(p) == port && f[9] != "0" {
+				inodes["socket:["+f[9]+"]"] = true
+			}
+		}
+	}
+	if len(inodes) == 0 {
+		return ""
+	}
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !inodes[link] {
+			continue
+		}
+		pid := strings.Split(fd, "/")[2]
+		comm, _ := ioutil.ReadFile("/proc/" + pid + "/comm")
+		return fmt.Sprintf("%s (pid %s)", strings.TrimSpace(string(comm)), pid)
+	}
+	return "another process"
+}
@@ -0,0 +1,98 @@
+package monitor
+
+//
+//  lock.go  --  One agent per config. Run takes a lock on a file next to the config file, so a second agent
+//    started with the same config (a stale process that never went away, a second copy of the service)
+//    doesn't publish every event twice:
+//
+//  "instance": { "lock_file": "/run/a10-crm.lock", "takeover": true }
+//
+//    lock_file  default the config file with ".lock" on the end; "none" for no lock. With WithConfig
+//               (monitor.go) there is no lock unless this is set
+//    takeover   stop the agent that has the lock (SIGTERM) and wait for it to go, rather than not starting
+//
+//  The lock file holds the pid of the agent that has it. The lock goes with the process, so one left behind
+//  by an agent that crashed doesn't stop the next one. Without takeover, finding another agent is an
+//  ExitDuplicate error (see exit.go). With it, the pid is only signalled if it is running this same program
+//  (going by /proc/<pid>/exe): where processes share a pid namespace (containers sharing the host's, say)
+//  the pid in the file may be some unrelated process in ours. If it isn't, or there is no /proc to check,
+//  that is an ExitDuplicate too. There is no lock on Windows, so takeover is a config error there.
+//
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InstanceConfig holds the 'instance' section of the config.
+type InstanceConfig struct {
+	Lock_File string `json:"lock_file"`
+	Takeover  bool   `json:"takeover"`
+}
+
+// takeoverWait is how long the agent being taken over has to stop.
+const takeoverWait = 15 * time.Second
+
+// lockPath is the lock file to use, "" for none.
+func (m *Monitor) lockPath() string {
+	switch fn := m.a.config.Instance.Lock_File; {
+	case fn == "none":
+		return ""
+	case fn != "":
+		return fn
+	case m.settings.config == nil:
+		return m.settings.configFile + ".lock"
+	}
+	return ""
+}
+
+// acquireLock takes the lock on fn, returning the func that gives it back.
+func acquireLock(fn string, takeover bool, debug int) (func(), error) {
+	if takeover && !canLock {
+		return nil, exitError(ExitConfig, "config", errors.New("instance.takeover needs a lock file, which there isn't on Windows"))
+	}
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open lock file %s: %v", fn, err)
+	}
+	if !tryLock(f) {
+		b, _ := ioutil.ReadFile(fn)
+		pid := strings.TrimSpace(string(b))
+		if !takeover {
+			f.Close()
+			return nil, exitError(ExitDuplicate, "duplicate", fmt.Errorf("Another agent (pid %s) is already running with this config (lock file %s)", pid, fn))
+		}
+		n, err := strconv.Atoi(pid)
+		if err != nil {
+			f.Close()
+			return nil, exitError(ExitDuplicate, "duplicate", fmt.Errorf("Another agent has lock file %s, and no pid in it to stop", fn))
+		}
+		if exe, ok := agentProcess(n); !ok {
+			f.Close()
+			return nil, exitError(ExitDuplicate, "duplicate", fmt.Errorf("Lock file %s is held, but pid %d is %s, not this agent, so it wasn't stopped", fn, n, exe))
+		}
+		if debug > 0 {
+			fmt.Println(">>> Taking over from the agent with pid " + pid)
+		}
+		stopProcess(n)
+		for deadline := time.Now().Add(takeoverWait); !tryLock(f); {
+			if time.Now().After(deadline) {
+				f.Close()
+				return nil, exitError(ExitDuplicate, "duplicate", fmt.Errorf("The agent with pid %s didn't stop within %s (lock file %s)", pid, takeoverWait, fn))
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return func() {
+		f.Truncate(0) // Left in place: removing it could let two agents lock different files of the same name
+		unlock(f)
+		f.Close()
+	}, nil
+}
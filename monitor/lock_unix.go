@@ -0,0 +1,41 @@
+//go:build !windows
+// +build !windows
+
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const canLock = true
+
+func tryLock(f *os.File) bool {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+}
+
+func unlock(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// agentProcess says whether pid is running this same program, and what it is running. Without /proc
+// (macOS, the BSDs) it can't tell, so it says no.
+func agentProcess(pid int) (exe string, ok bool) {
+	exe, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if err != nil {
+		return "unknown", false
+	}
+	exe = strings.TrimSuffix(exe, " (deleted)") // Its binary has been replaced, by an upgrade say
+	self, err := os.Executable()
+	if err != nil {
+		return exe, false
+	}
+	return exe, filepath.Base(exe) == filepath.Base(self)
+}
+
+func stopProcess(pid int) {
+	syscall.Kill(pid, syscall.SIGTERM)
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package monitor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestAgentProcess(t *testing.T) {
+	if _, err := os.Stat("/proc/self/exe"); err != nil {
+		t.Skip("no /proc")
+	}
+	if _, ok := agentProcess(os.Getpid()); !ok {
+		t.Error("this process isn't an agent")
+	}
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer cmd.Process.Kill()
+	if exe, ok := agentProcess(cmd.Process.Pid); ok {
+		t.Errorf("sleep (%s) is an agent", exe)
+	}
+}
+
+// With the lock held and someone else's pid in the file, takeover leaves that process be.
+func TestTakeoverNotAnAgent(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer cmd.Process.Kill()
+	fn := filepath.Join(t.TempDir(), "agent.lock")
+	if err := ioutil.WriteFile(fn, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	holder, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+	if !tryLock(holder) {
+		t.Fatal("can't take the lock")
+	}
+	_, err = acquireLock(fn, true, 0)
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.Code != ExitDuplicate {
+		t.Fatalf("got %v, want an ExitDuplicate error", err)
+	}
+	if err := cmd.Process.Signal(syscall.Signal(0)); err != nil {
+		t.Errorf("sleep was stopped: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package monitor
+
+import (
+	"os"
+)
+
+// No lock on Windows, see lock.go.
+
+const canLock = false
+
+func tryLock(f *os.File) bool { return true }
+
+func unlock(f *os.File) {}
+
+func agentProcess(pid int) (string, bool) { return "unknown", false }
+
+func stopProcess(pid int) {}
@@ -0,0 +1,122 @@
+package monitor
+
+//
+//  magnitude.go  --  Raising an event's severity by how far over its limit the traffic is, so a VIP at
+//    five times its connection rate limit doesn't look the same as one just over it:
+//
+//    { "name": "conn-rate-limit", "magnitude": { "steps": [
+//        { "over": 1.5, "severity": "error" }, { "over": 2, "severity": "critical" }, { "over": 5, "severity": "alert" } ] } }
+//
+//    value    the field with how much there was. Default "rate"
+//    limit    the field with the limit it went over. Default "limit"
+//    steps    the severity from each ratio of value to limit up, lowest first. Default the ones above
+//
+//  Where the message gives both, the payload gets "exceed_ratio" (value / limit, to two places), and the
+//  event the severity of the highest step it reached, if that is more severe than the rule's; with
+//  "base_severity", what it would have been. The severity is raised before anything else sees the event,
+//  so its QoS (qos.go), escalated logging (escalate.go) and any silence on severity go by the raised one.
+//  For an object that keeps going over its limit, however far, "escalate" (paging.go) raises it by time.
+//
+//  The built-in conn-rate-limit rule has "magnitude" on, with the defaults; "magnitude": null in the rules
+//  file turns it off.
+//
+
+import (
+	"fmt"
+	"math"
+)
+
+// MagnitudePolicy is a rule's "magnitude".
+type MagnitudePolicy struct {
+	Value string          `json:"value"`
+	Limit string          `json:"limit"`
+	Steps []MagnitudeStep `json:"steps"`
+}
+
+// MagnitudeStep is one step of a MagnitudePolicy.
+type MagnitudeStep struct {
+	Over     float64 `json:"over"`
+	Severity string  `json:"severity"`
+}
+
+// defaultMagnitudeSteps are the steps of a "magnitude" that doesn't give any.
+var defaultMagnitudeSteps = []MagnitudeStep{
+	{Over: 1.5, Severity: "error"},
+	{Over: 2, Severity: "critical"},
+	{Over: 5, Severity: "alert"},
+}
+
+func (p *MagnitudePolicy) compile(r *Rule) error {
+	if p.Value == "" {
+		p.Value = "rate"
+	}
+	if p.Limit == "" {
+		p.Limit = "limit"
+	}
+	if len(p.Steps) == 0 {
+		p.Steps = append([]MagnitudeStep{}, defaultMagnitudeSteps...)
+	}
+	for i := range p.Steps {
+		s := &p.Steps[i]
+		if s.Over <= 0 {
+			return fmt.Errorf("Rule '%s': magnitude step %d needs an 'over' ratio above 0", r.Name, i+1)
+		}
+		if i > 0 && s.Over <= p.Steps[i-1].Over {
+			return fmt.Errorf("Rule '%s': magnitude steps must go up, lowest 'over' first", r.Name)
+		}
+		sev, ok := normalizeSeverity(s.Severity)
+		if !ok {
+			return fmt.Errorf("Rule '%s': unknown severity '%s' in magnitude step %d", r.Name, s.Severity, i+1)
+		}
+		s.Severity = sev
+	}
+	return nil
+}
+
+// ratio is how far over its limit ev is. False if it doesn't say.
+func (p *MagnitudePolicy) ratio(ev Event) (float64, bool) {
+	v, ok := toNumber(ev.Fields[p.Value])
+	if !ok {
+		return 0, false
+	}
+	l, ok := toNumber(ev.Fields[p.Limit])
+	if !ok || l <= 0 {
+		return 0, false
+	}
+	return v / l, true
+}
+
+// raiseSeverity applies the rule's magnitude to ev.
+func (ev *Event) raiseSeverity() {
+	if ev.Rule == nil || ev.Rule.Magnitude == nil {
+		return
+	}
+	p := ev.Rule.Magnitude
+	ratio, ok := p.ratio(*ev)
+	if !ok {
+		return
+	}
+	fields := make(map[string]interface{}, len(ev.Fields)+2)
+	for k, v := range ev.Fields {
+		fields[k] = v
+	}
+	fields["exceed_ratio"] = math.Round(ratio*100) / 100
+	for i := len(p.Steps) - 1; i >= 0; i-- {
+		s := p.Steps[i]
+		if ratio < s.Over {
+			continue
+		}
+		if moreSevere(s.Severity, ev.Severity) {
+			fields["base_severity"] = ev.Severity
+			ev.Severity = s.Severity
+		}
+		break
+	}
+	ev.Fields = fields
+}
+
+// moreSevere says whether severity a is more severe than b. Anything is more severe than "".
+func moreSevere(a, b string) bool {
+	la, lb := severityLevel(a), severityLevel(b)
+	return la >= 0 && (lb < 0 || la < lb)
+}
@@ -0,0 +1,270 @@
+package monitor
+
+//
+//  metrics.go  --  Prometheus metrics on GET /metrics of the API (see api.go), in the plain text
+//    exposition format.
+//
+//  Per-VIP metrics are off by default, since a big deployment can have tens of thousands of virtual
+//  servers. When turned on, only the top 'max_vips' objects by event count get their own series at each
+//  scrape; the rest are summed into object="__other__". At most 'max_tracked' objects are counted at all,
+//  anything past that goes straight to __other__.
+//
+//  For those objects, the limit and rate an event gave (its "limit" and "rate" fields, such as the
+//  conn-rate-limit rule's) are gauges too, a10crm_object_limit and a10crm_object_rate, so how far over the
+//  limit a VIP went can be graphed and alerted on rather than read out of the MQTT payloads.
+//
+//  "metrics": { "per_vip": true, "max_vips": 100, "max_tracked": 50000 }
+//
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsConfig holds the 'metrics' section of the config.
+type MetricsConfig struct {
+	Per_VIP     bool `json:"per_vip"`
+	Max_VIPs    int  `json:"max_vips"`    // Default 100
+	Max_Tracked int  `json:"max_tracked"` // Default 50000
+}
+
+const overflowLabel = "__other__"
+
+type objectKey struct {
+	object string
+	class  string
+}
+
+// Metrics holds what the counters don't: per-object counts.
+type Metrics struct {
+	cfg      MetricsConfig
+	counters *Counters
+	tags     string  // Labels on every series, see tags.go
+	spool    *spool  // nil if there isn't one
+	mirror   *mirror // nil if there isn't one
+	health   *outputHealth
+	rates    *rates // nil if there aren't any
+	windows  *deviceWindows
+	clusters *clusters // nil if there aren't any
+	storm    *storm    // nil if there is no breaker
+
+	mu       sync.Mutex
+	objects  map[objectKey]uint64
+	values   map[objectKey]objectValues // Last limit and rate seen, for the objects in objects
+	overflow map[string]uint64          // By event type, for objects past max_tracked
+}
+
+func newMetrics(cfg MetricsConfig, counters *Counters, tags map[string]string) *Metrics {
+	if cfg.Max_VIPs <= 0 {
+		cfg.Max_VIPs = 100
+	}
+	if cfg.Max_Tracked <= 0 {
+		cfg.Max_Tracked = 50000
+	}
+	return &Metrics{cfg: cfg, counters: counters, tags: tagLabels(tags), objects: make(map[objectKey]uint64),
+		values: make(map[objectKey]objectValues), overflow: make(map[string]uint64)}
+}
+
+// objectValues are the numbers the last event about an object gave. nil if it didn't give them.
+type objectValues struct {
+	limit interface{}
+	rate  interface{}
+}
+
+// numericField is fields[name] if it is a number, else nil.
+func numericField(fields map[string]interface{}, name string) interface{} {
+	switch v := fields[name].(type) {
+	case int, int64, float64:
+		return v
+	}
+	return nil
+}
+
+// ObjectEvent counts a matched event against the VIP (or other object) it was about, keeping the limit and
+// rate from its fields.
+func (m *Metrics) ObjectEvent(object string, class string, fields map[string]interface{}) {
+	if !m.cfg.Per_VIP || object == "" {
+		return
+	}
+	k := objectKey{object, class}
+	m.mu.Lock()
+	if _, ok := m.objects[k]; ok || len(m.objects) < m.cfg.Max_Tracked {
+		m.objects[k]++
+		if v := (objectValues{numericField(fields, "limit"), numericField(fields, "rate")}); v.limit != nil || v.rate != nil {
+			m.values[k] = v
+		}
+	} else {
+		m.overflow[class]++
+	}
+	m.mu.Unlock()
+}
+
+// promLabel escapes a label value for the text exposition format.
+func promLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// promWriter groups the lines of each metric under one HELP/TYPE header.
+type promWriter struct {
+	w    io.Writer
+	seen map[string]bool
+	tags string // Added to every line's labels
+}
+
+func (p *promWriter) metric(name string, kind string, help string, labels string, value interface{}) {
+	if !p.seen[name] {
+		fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		p.seen[name] = true
+	}
+	if p.tags != "" {
+		if labels != "" {
+			labels = "," + labels
+		}
+		labels = p.tags + labels
+	}
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(p.w, "%s%s %v\n", name, labels, value)
+}
+
+func (m *Metrics) write(w io.Writer) {
+	p := &promWriter{w: w, seen: make(map[string]bool), tags: m.tags}
+	p.metric("a10crm_uptime_seconds", "gauge", "Seconds since the agent started.", "", int(time.Since(startTime).Seconds()))
+
+	m.counters.mu.Lock()
+	devices := make([]string, 0, len(m.counters.Devices))
+	for d := range m.counters.Devices {
+		devices = append(devices, d)
+	}
+	sort.Strings(devices)
+	for _, d := range devices {
+		dc := m.counters.Devices[d]
+		p.metric("a10crm_records_received_total", "counter", "Syslog records received.", fmt.Sprintf(`device="%s"`, promLabel(d)), dc.Received)
+	}
+	for _, d := range devices {
+		dc := m.counters.Devices[d]
+		p.metric("a10crm_records_filtered_total", "counter", "Records dropped by syslog_filter.", fmt.Sprintf(`device="%s"`, promLabel(d)), dc.Filtered)
+	}
+	for _, d := range devices {
+		dc := m.counters.Devices[d]
+		rules := make([]string, 0, len(dc.Dropped))
+		for r := range dc.Dropped {
+			rules = append(rules, r)
+		}
+		sort.Strings(rules)
+		for _, r := range rules {
+			p.metric("a10crm_records_dropped_total", "counter", "Records thrown away by a drop rule.", fmt.Sprintf(`device="%s",rule="%s"`, promLabel(d), promLabel(r)), dc.Dropped[r])
+		}
+	}
+	for _, d := range devices {
+		dc := m.counters.Devices[d]
+		names := make([]string, 0, len(dc.Silenced))
+		for s := range dc.Silenced {
+			names = append(names, s)
+		}
+		sort.Strings(names)
+		for _, s := range names {
+			p.metric("a10crm_events_silenced_total", "counter", "Events not published because of a silence.", fmt.Sprintf(`device="%s",silence="%s"`, promLabel(d), promLabel(s)), dc.Silenced[s])
+		}
+	}
+	for _, d := range devices {
+		dc := m.counters.Devices[d]
+		p.metric("a10crm_timestamps_substituted_total", "counter", "Records whose missing or bad timestamp was replaced by the receive time.", fmt.Sprintf(`device="%s"`, promLabel(d)), dc.Substituted)
+	}
+	for _, d := range devices {
+		dc := m.counters.Devices[d]
+		for _, c := range sortedKeys(dc.Classes) {
+			p.metric("a10crm_events_matched_total", "counter", "Records that matched a rule.", fmt.Sprintf(`device="%s",type="%s"`, promLabel(d), promLabel(c)), dc.Classes[c].Matched)
+		}
+	}
+	for _, d := range devices {
+		dc := m.counters.Devices[d]
+		for _, c := range sortedKeys(dc.Classes) {
+			p.metric("a10crm_events_published_total", "counter", "Events published to MQTT.", fmt.Sprintf(`device="%s",type="%s"`, promLabel(d), promLabel(c)), dc.Classes[c].Published)
+		}
+	}
+	m.counters.mu.Unlock()
+	m.spool.writeMetrics(p)
+	m.mirror.writeMetrics(p)
+	m.health.writeMetrics(p)
+	m.rates.writeMetrics(p)
+	m.windows.writeMetrics(p)
+	m.clusters.writeMetrics(p)
+	m.storm.writeMetrics(p)
+	writeEnrichMetrics(p)
+	writeErrorMetrics(p)
+
+	if !m.cfg.Per_VIP {
+		return
+	}
+	m.mu.Lock()
+	keys := make([]objectKey, 0, len(m.objects))
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m.objects[keys[i]] != m.objects[keys[j]] {
+			return m.objects[keys[i]] > m.objects[keys[j]]
+		}
+		return keys[i].object < keys[j].object
+	})
+	other := make(map[string]uint64)
+	for c, n := range m.overflow {
+		other[c] = n
+	}
+	top := make(map[string]bool)
+	var shown []objectKey
+	for _, k := range keys {
+		if !top[k.object] && len(top) >= m.cfg.Max_VIPs {
+			other[k.class] += m.objects[k]
+			continue
+		}
+		top[k.object] = true
+		shown = append(shown, k)
+		p.metric("a10crm_object_events_total", "counter", "Matched events per VIP/object (top max_vips, rest in __other__).", fmt.Sprintf(`object="%s",type="%s"`, promLabel(k.object), promLabel(k.class)), m.objects[k])
+	}
+	classes := make([]string, 0, len(other))
+	for c := range other {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+	for _, c := range classes {
+		p.metric("a10crm_object_events_total", "counter", "Matched events per VIP/object (top max_vips, rest in __other__).", fmt.Sprintf(`object="%s",type="%s"`, overflowLabel, promLabel(c)), other[c])
+	}
+	for _, k := range shown {
+		if v := m.values[k].limit; v != nil {
+			p.metric("a10crm_object_limit", "gauge", "The limit the last event about the VIP/object gave.", fmt.Sprintf(`object="%s",type="%s"`, promLabel(k.object), promLabel(k.class)), v)
+		}
+	}
+	for _, k := range shown {
+		if v := m.values[k].rate; v != nil {
+			p.metric("a10crm_object_rate", "gauge", "The rate over the limit the last event about the VIP/object gave.", fmt.Sprintf(`object="%s",type="%s"`, promLabel(k.object), promLabel(k.class)), v)
+		}
+	}
+	distinct := make(map[string]bool)
+	for _, k := range keys {
+		distinct[k.object] = true
+	}
+	p.metric("a10crm_objects_tracked", "gauge", "Distinct VIPs/objects being counted.", "", len(distinct))
+	m.mu.Unlock()
+}
+
+func sortedKeys(m map[string]*ClassCounters) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *Metrics) handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
@@ -0,0 +1,256 @@
+package monitor
+
+//
+//  migrate.go  --  The structured config layout, and the 'migrate-config' subcommand that turns a flat
+//    config.json (everything at the top level, as it started out) into it. The agent reads either; the
+//    structured one groups the settings by where they act:
+//
+//  { "agent":   { "debug": 3, "tags": {...}, "api": {"listen": "0.0.0.0:8080"}, "metrics": {...}, ... },
+//    "inputs":  { "syslog": { "port": 5514, "filter": {...}, "hosts": {...}, ... }, "acks": {...} },
+//    "rules":   { "file": "rules.json", "watch": 30, "services": {...} },
+//    "outputs": { "mqtt": { "broker": "10.1.1.28", "port": 1883, "topic": "alert/A10Thunder", ... },
+//                 "plugins": [...], "grafana": {...}, "redact": [...] } }
+//
+//  Usage:
+//    a10-connection-rate-monitor migrate-config [config.json [new.json]]   # new.json defaults to stdout
+//
+//  Every flat setting has exactly one place in the layout below, so nothing changes meaning on the way.
+//  Settings that are deprecated or do nothing are warned about; ones it doesn't know are kept at the top
+//  level, with a warning, and still work.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// configLayout maps each flat setting to its place in the structured config.
+var configLayout = []struct {
+	flat string
+	path string
+}{
+	{"debug", "agent.debug"},
+	{"tags", "agent.tags"},
+	{"state_file", "agent.state_file"},
+	{"instance", "agent.instance"},
+	{"profiling", "agent.profiling"},
+	{"api_listen", "agent.api.listen"},
+	{"api_token", "agent.api.token"},
+	{"metrics", "agent.metrics"},
+	{"diag_topic", "agent.diag_topic"},
+	{"heartbeat", "agent.heartbeat"},
+	{"heartbeat_topic", "agent.heartbeat_topic"},
+	{"watchdog_timeout", "agent.watchdog_timeout"},
+	{"deadlines", "agent.deadlines"},
+	{"escalation", "agent.escalation"},
+	{"syslog_port", "inputs.syslog.port"},
+	{"syslog_fallback_ports", "inputs.syslog.fallback_ports"},
+	{"syslog_filter", "inputs.syslog.filter"},
+	{"reassemble", "inputs.syslog.reassemble"},
+	{"hosts", "inputs.syslog.hosts"},
+	{"clusters", "inputs.syslog.clusters"},
+	{"timestamps", "inputs.syslog.timestamps"},
+	{"parser_plugins", "inputs.syslog.parser_plugins"},
+	{"acks", "inputs.acks"},
+	{"rules_file", "rules.file"},
+	{"rules_watch", "rules.watch"},
+	{"services", "rules.services"},
+	{"thresholds", "rules.thresholds"},
+	{"anomaly", "rules.anomaly"},
+	{"device_silence", "rules.device_silence"},
+	{"enrich_cache", "rules.enrich_cache"},
+	{"mqtt_broker", "outputs.mqtt.broker"},
+	{"mqtt_port", "outputs.mqtt.port"},
+	{"client_id", "outputs.mqtt.client_id"},
+	{"username", "outputs.mqtt.username"},
+	{"password", "outputs.mqtt.password"},
+	{"notify_topic", "outputs.mqtt.topic"},
+	{"partition_topics", "outputs.mqtt.partition_topics"},
+	{"mqtt_filter", "outputs.mqtt.filter"},
+	{"mqtt_fields", "outputs.mqtt.fields"},
+	{"mqtt_rate", "outputs.mqtt.rate"},
+	{"mqtt_qos", "outputs.mqtt.qos"},
+	{"mqtt_mirror", "outputs.mqtt.mirror"},
+	{"mqtt_shared", "outputs.mqtt.shared"},
+	{"spool", "outputs.mqtt.spool"},
+	{"plugins", "outputs.plugins"},
+	{"grafana", "outputs.grafana"},
+	{"kafka", "outputs.kafka"},
+	{"nats", "outputs.nats"},
+	{"amqp", "outputs.amqp"},
+	{"webhooks", "outputs.webhooks"},
+	{"slack", "outputs.slack"},
+	{"teams", "outputs.teams"},
+	{"output_health", "outputs.health"},
+	{"event_key", "outputs.event_key"},
+	{"redact", "outputs.redact"},
+	{"dedup", "outputs.dedup"},
+	{"silences", "outputs.silences"},
+	{"quiet_hours", "outputs.quiet_hours"},
+	{"holidays", "outputs.holidays"},
+	{"digest", "outputs.mqtt.digest"},
+	{"storm", "outputs.storm"},
+	{"report", "outputs.mqtt.report"},
+	{"rates", "outputs.mqtt.rates"},
+	{"emit_deprecated", "outputs.emit_deprecated"},
+}
+
+// configWarnings are settings that are deprecated or don't do anything.
+var configWarnings = map[string]string{
+	"username":        "not used: MQTT authentication isn't turned on in this build",
+	"password":        "not used: MQTT authentication isn't turned on in this build",
+	"emit_deprecated": "deprecated payload fields are only kept for one release cycle, see schema.go",
+}
+
+// structuredSections are the top-level keys that mark a config as structured.
+var structuredSections = []string{"agent", "inputs", "rules", "outputs"}
+
+func isStructuredConfig(raw map[string]json.RawMessage) bool {
+	for _, s := range structuredSections {
+		if _, ok := raw[s]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupPath finds a dotted path in a nested config.
+func lookupPath(tree map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	for i, p := range parts {
+		v, ok := tree[p]
+		if !ok {
+			return nil, false
+		}
+		if i == len(parts)-1 {
+			return v, true
+		}
+		if tree, ok = v.(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// setPath puts v at a dotted path in a nested config, making the sections on the way.
+func setPath(tree map[string]interface{}, path string, v interface{}) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := tree[p].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			tree[p] = next
+		}
+		tree = next
+	}
+	tree[parts[len(parts)-1]] = v
+}
+
+// flattenConfig turns a structured config back into the flat one the agent works from.
+func flattenConfig(b []byte) ([]byte, error) {
+	var tree map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber() // Keep numbers exactly as written
+	if err := d.Decode(&tree); err != nil {
+		return nil, err
+	}
+	flat := make(map[string]interface{})
+	for k, v := range tree {
+		if !isSection(k) {
+			flat[k] = v // Unknown to the layout, see migrateConfig
+		}
+	}
+	for _, l := range configLayout {
+		if v, ok := lookupPath(tree, l.path); ok {
+			flat[l.flat] = v
+		}
+	}
+	return json.Marshal(flat)
+}
+
+func isSection(k string) bool {
+	for _, s := range structuredSections {
+		if k == s {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateConfig turns a flat config into a structured one, returning warnings about what it found.
+func migrateConfig(b []byte) ([]byte, []string, error) {
+	var flat map[string]json.RawMessage
+	if err := json.Unmarshal(b, &flat); err != nil {
+		return nil, nil, err
+	}
+	if isStructuredConfig(flat) {
+		return nil, nil, errors.New("Config is already structured!")
+	}
+	var warnings []string
+	tree := make(map[string]interface{})
+	placed := make(map[string]bool)
+	for _, l := range configLayout {
+		v, ok := flat[l.flat]
+		if !ok {
+			continue
+		}
+		setPath(tree, l.path, v)
+		placed[l.flat] = true
+		if w, ok := configWarnings[l.flat]; ok {
+			warnings = append(warnings, fmt.Sprintf("'%s': %s", l.flat, w))
+		}
+	}
+	for _, k := range sortedRawKeys(flat) {
+		if !placed[k] {
+			tree[k] = flat[k]
+			warnings = append(warnings, fmt.Sprintf("'%s': unknown setting, left at the top level", k))
+		}
+	}
+	out, err := json.MarshalIndent(tree, "", "    ")
+	return out, warnings, err
+}
+
+func sortedRawKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MigrateCommand runs the 'migrate-config' subcommand, returning the exit status.
+func MigrateCommand(args []string) int {
+	in := "./config.json"
+	if len(args) > 0 {
+		in = args[0]
+	}
+	b, err := ioutil.ReadFile(in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to open Config File!")
+		return 2
+	}
+	out, warnings, err := migrateConfig(b)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to migrate config: "+err.Error())
+		return 2
+	}
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "Warning: "+w)
+	}
+	if len(args) > 1 {
+		if err := ioutil.WriteFile(args[1], append(out, '\n'), 0600); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		return 0
+	}
+	fmt.Println(string(out))
+	return 0
+}
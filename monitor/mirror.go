@@ -0,0 +1,202 @@
+package monitor
+
+//
+//  mirror.go  --  Publishing every MQTT event to brokers in other regions as well as mqtt_broker, at the
+//    same time, for deployments that need alerts delivered even if a whole region is lost:
+//
+//  "mqtt_mirror": { "region": "us-east", "brokers": [ { "region": "eu-west", "broker": "mqtt.eu.example.com", "port": 1883 } ] }
+//
+//    region    the region of mqtt_broker itself
+//    brokers   the other regions' brokers. client_id defaults to the agent's
+//
+//  Every payload has an "event_id" (see pipeline.go), the same in every region; with mirroring on, MQTT
+//  messages keep it whatever mqtt_fields says and get "regions", the regions it was sent to, as well, so
+//  consumers that read more than one region can drop the copies. How many events each
+//  region took and failed is in the heartbeat's "regions" and in a10crm_region_published_total and
+//  a10crm_region_failed_total. Only mqtt_broker has the spool (see spool.go); an event a mirror doesn't
+//  take is counted as deliver.mirror (see errors.go) and not retried. A mirror that is down when the
+//  agent starts is connected to when it comes up.
+//
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MirrorConfig holds the 'mqtt_mirror' section of the config.
+type MirrorConfig struct {
+	Region  string         `json:"region"`
+	Brokers []MirrorBroker `json:"brokers"`
+}
+
+// MirrorBroker is one other region's broker.
+type MirrorBroker struct {
+	Region    string `json:"region"`
+	Broker    string `json:"broker"`
+	Port      int    `json:"port"` // Default 1883
+	Client_ID string `json:"client_id"`
+}
+
+// regionStats is how one region's broker is doing.
+type regionStats struct {
+	published uint64
+	failed    uint64
+}
+
+type mirrorBroker struct {
+	regionStats
+	region string
+	client mqtt.Client
+}
+
+type mirror struct {
+	primary regionStats
+	region  string
+	regions []string // Every region, mqtt_broker's first
+	brokers []*mirrorBroker
+	timeout time.Duration
+	debug   int
+}
+
+// newMirror sets up the mirror brokers. nil if there aren't any.
+func newMirror(cfg MirrorConfig, clientID string, timeout time.Duration, debug int) (*mirror, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, nil
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("mqtt_mirror needs the 'region' of mqtt_broker")
+	}
+	m := &mirror{region: cfg.Region, regions: []string{cfg.Region}, timeout: timeout, debug: debug}
+	seen := map[string]bool{cfg.Region: true}
+	for _, b := range cfg.Brokers {
+		if b.Region == "" || b.Broker == "" {
+			return nil, fmt.Errorf("mqtt_mirror brokers need a 'region' and a 'broker'")
+		}
+		if seen[b.Region] {
+			return nil, fmt.Errorf("mqtt_mirror: region '%s' given twice", b.Region)
+		}
+		seen[b.Region] = true
+		if b.Port == 0 {
+			b.Port = 1883
+		}
+		if b.Client_ID == "" {
+			b.Client_ID = clientID
+		}
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker(fmt.Sprintf("mqtt://%s:%d", b.Broker, b.Port))
+		opts.SetClientID(b.Client_ID)
+		opts.SetKeepAlive(30)
+		opts.SetAutoReconnect(true)
+		opts.SetConnectRetry(true) // A region being down at start-up mustn't stop the agent
+		m.brokers = append(m.brokers, &mirrorBroker{region: b.Region, client: mqtt.NewClient(opts)})
+		m.regions = append(m.regions, b.Region)
+	}
+	return m, nil
+}
+
+// connect starts connecting to the mirrors, without waiting for them.
+func (m *mirror) connect() {
+	if m == nil {
+		return
+	}
+	for _, b := range m.brokers {
+		b.client.Connect()
+	}
+}
+
+func (m *mirror) disconnect() {
+	if m == nil {
+		return
+	}
+	for _, b := range m.brokers {
+		b.client.Disconnect(250)
+	}
+}
+
+// hint is mp with the fields consumers need to drop the copies from other regions: the event_id deliver gave
+// the whole payload, and the regions. mp can be the payload the other sinks get, so it is left as it is.
+func (m *mirror) hint(mp, payload map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return mp
+	}
+	out := make(map[string]interface{}, len(mp)+2)
+	for k, v := range mp {
+		out[k] = v
+	}
+	out["event_id"] = payload["event_id"]
+	out["regions"] = m.regions
+	return out
+}
+
+// publish sends to every mirror at once. The returned func waits for them all.
+func (m *mirror) publish(ctx context.Context, topic string, qos byte, text []byte) (wait func()) {
+	if m == nil {
+		return func() {}
+	}
+	var wg sync.WaitGroup
+	for _, b := range m.brokers {
+		wg.Add(1)
+		go func(b *mirrorBroker) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, m.timeout)
+			defer cancel()
+			token := b.client.Publish(topic, qos, false, text)
+			var err error
+			select {
+			case <-token.Done():
+				err = token.Error()
+			case <-ctx.Done():
+				err = fmt.Errorf("MQTT publish: %w", ctx.Err())
+			}
+			if err != nil {
+				atomic.AddUint64(&b.failed, 1)
+				reportError(m.debug, errDeliverMirror, "Mirror publish to "+b.region+" failed: "+err.Error())
+				return
+			}
+			atomic.AddUint64(&b.published, 1)
+		}(b)
+	}
+	return wg.Wait
+}
+
+// primaryDone records how the publish to mqtt_broker went.
+func (m *mirror) primaryDone(ok bool) {
+	if m == nil {
+		return
+	}
+	if ok {
+		atomic.AddUint64(&m.primary.published, 1)
+	} else {
+		atomic.AddUint64(&m.primary.failed, 1)
+	}
+}
+
+// stats is the counts by region, for the heartbeat.
+func (m *mirror) stats() map[string]map[string]uint64 {
+	out := map[string]map[string]uint64{
+		m.region: {"published": atomic.LoadUint64(&m.primary.published), "failed": atomic.LoadUint64(&m.primary.failed)},
+	}
+	for _, b := range m.brokers {
+		out[b.region] = map[string]uint64{"published": atomic.LoadUint64(&b.published), "failed": atomic.LoadUint64(&b.failed)}
+	}
+	return out
+}
+
+// writeMetrics adds the per-region metrics, see metrics.go.
+func (m *mirror) writeMetrics(p *promWriter) {
+	if m == nil {
+		return
+	}
+	stats := m.stats()
+	for _, r := range m.regions {
+		p.metric("a10crm_region_published_total", "counter", "Events each region's broker took, with mqtt_mirror.", fmt.Sprintf(`region="%s"`, promLabel(r)), stats[r]["published"])
+	}
+	for _, r := range m.regions {
+		p.metric("a10crm_region_failed_total", "counter", "Events each region's broker didn't take, with mqtt_mirror.", fmt.Sprintf(`region="%s"`, promLabel(r)), stats[r]["failed"])
+	}
+}
@@ -0,0 +1,30 @@
+package monitor
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The hint goes on a copy: the payload it starts from can be the one every other sink gets.
+func TestMirrorHintLeavesPayloadAlone(t *testing.T) {
+	payload := map[string]interface{}{"rule": "conn-rate-limit", "event_id": "abc"}
+	m := &mirror{regions: []string{"us-east", "eu-west"}}
+	mp := m.hint(payload, payload)
+	if len(payload) != 2 {
+		t.Errorf("payload now %v", payload)
+	}
+	if mp["event_id"] != "abc" || !reflect.DeepEqual(mp["regions"], m.regions) || mp["rule"] != "conn-rate-limit" {
+		t.Errorf("hinted payload %v", mp)
+	}
+
+	// Projected down to fields without the event_id, it still gets it
+	mp = m.hint(map[string]interface{}{"rule": "conn-rate-limit"}, payload)
+	if mp["event_id"] != "abc" {
+		t.Errorf("projected payload %v", mp)
+	}
+
+	var none *mirror
+	if mp := none.hint(payload, payload); len(mp) != 2 {
+		t.Errorf("without a mirror %v", mp)
+	}
+}
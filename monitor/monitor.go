@@ -0,0 +1,538 @@
+package monitor
+
+//
+//  monitor.go  --  The monitor as a Go library, for programs that want the events in-process instead of over
+//    MQTT. The a10-connection-rate-monitor binary is a small main around it:
+//
+//    m, err := monitor.New(monitor.WithConfigFile("/etc/a10/config.json"), monitor.WithoutMQTT())
+//    if err != nil { ... }
+//    go m.Run(ctx)
+//    for ev := range m.Events() {
+//        fmt.Println(ev.Device, ev.Type, ev.Object, ev.Fields)
+//    }
+//
+//  Events() carries every event that gets past dedup and suppression, i.e. the ones that are published.
+//  With WithoutSyslog the listener isn't started and records are fed in with Handle instead, so just the
+//  parsing, rules and correlation can be used behind some other Syslog receiver.
+//
+//  Each Monitor has its own API, which stops with Run, so several can run in one process, or one be run
+//  again on the same address. A SIGHUP reloads all of them, and profiling is process-wide, so turn it on in
+//  one only.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// Configuration holds config structure
+type Configuration struct {
+	Debug                 int                      `json:"debug"`
+	MQTT_Broker           string                   `json:"mqtt_broker"`
+	Client_ID             string                   `json:"client_id"`
+	Tags                  map[string]string        `json:"tags"` // Static labels (site, region, ...) on every event and metric. See tags.go
+	Syslog_port           int                      `json:"syslog_port"`
+	Syslog_Fallback_Ports []int                    `json:"syslog_fallback_ports"` // Ports to try if syslog_port is taken. See listen.go
+	MQTT_port             int                      `json:"mqtt_port"`
+	Notify_Topic          string                   `json:"notify_topic"`
+	Partition_Topics      map[string]string        `json:"partition_topics"` // Use instead of notify_topic for events from these partitions
+	Syslog_Filter         SyslogFilterConfig       `json:"syslog_filter"`    // Drop/route by Syslog severity and facility. See sevfilter.go
+	Reassemble            ReassembleConfig         `json:"reassemble"`       // Messages split over several records. See reassemble.go
+	Hosts                 HostsConfig              `json:"hosts"`            // Allow/deny lists of Thunder hostnames. See hosts.go
+	Clusters              []ClusterConfig          `json:"clusters"`         // HA pairs and aVCS clusters whose members' alerts are merged. See clusters.go
+	Timestamps            TimestampConfig          `json:"timestamps"`       // Device timezones, and which time events carry. See timestamps.go
+	Acks                  AcksConfig               `json:"acks"`             // Acknowledgments from the ITSM system. See acks.go
+	Username              string                   `json:"username"`
+	Password              string                   `json:"password"`
+	Rules_File            string                   `json:"rules_file"`     // Extra match rules. See rules.go
+	Rules_Watch           int                      `json:"rules_watch"`    // Seconds between checks of the rules file for changes. 0 = only on SIGHUP. See reload.go
+	Parser_Plugins        []string                 `json:"parser_plugins"` // Go plugins for other log formats. See parsers.go
+	Plugins               []PluginConfig           `json:"plugins"`        // Out-of-process outputs. See plugins.go
+	Grafana               GrafanaConfig            `json:"grafana"`        // Incident annotations on dashboards. See grafana.go
+	Kafka                 KafkaConfig              `json:"kafka"`          // Kafka as an output. See kafka.go
+	NATS                  NATSConfig               `json:"nats"`           // NATS, or JetStream, as an output. See nats.go
+	AMQP                  AMQPConfig               `json:"amqp"`           // AMQP 0-9-1 (RabbitMQ) as an output. See amqp.go
+	Webhooks              []WebhookConfig          `json:"webhooks"`       // HTTP webhooks as outputs. See webhook.go
+	Slack                 SlackConfig              `json:"slack"`          // Slack as an output. See slack.go
+	Teams                 TeamsConfig              `json:"teams"`          // Microsoft Teams as an output. See teams.go
+	Output_Health         HealthConfig             `json:"output_health"`  // Delivery success and latency per output. See health.go
+	Profiling             ProfilingConfig          `json:"profiling"`      // See profiling.go
+	State_File            string                   `json:"state_file"`     // Where the lifetime counters are kept. See counters.go
+	Instance              InstanceConfig           `json:"instance"`       // One agent per config. See lock.go
+	API_Listen            string                   `json:"api_listen"`     // Address for the HTTP API, e.g. "0.0.0.0:8080". See api.go
+	API_Token             string                   `json:"api_token"`
+	Metrics               MetricsConfig            `json:"metrics"`          // See metrics.go
+	Event_Key             string                   `json:"event_key"`        // Partition key template for Kafka and output plugins. See eventkey.go
+	MQTT_Filter           string                   `json:"mqtt_filter"`      // Only publish events this expression is true for. See expr.go
+	MQTT_Fields           []string                 `json:"mqtt_fields"`      // Only publish these payload fields. See project.go
+	Spool                 SpoolConfig              `json:"spool"`            // Where MQTT events wait while the broker is away. See spool.go
+	MQTT_Rate             RateConfig               `json:"mqtt_rate"`        // Publishes per second to the broker. See smoother.go
+	MQTT_QoS              map[string]int           `json:"mqtt_qos"`         // QoS by severity. See qos.go
+	MQTT_Mirror           MirrorConfig             `json:"mqtt_mirror"`      // The same events to brokers in other regions. See mirror.go
+	MQTT_Shared           SharedConfig             `json:"mqtt_shared"`      // Topic checks and subscriptions for MQTT 5 shared subscriptions. See sharedsub.go
+	Redact                []RedactRule             `json:"redact"`           // Personal data masked before anything is published. See redact.go
+	Dedup                 DedupConfig              `json:"dedup"`            // Identical events within a window published once, with a count. See dedup.go
+	Digest                DigestConfig             `json:"digest"`           // A rollup of the events every interval. See digest.go
+	Storm                 StormConfig              `json:"storm"`            // Summaries instead of events past a rate over every device. See storm.go
+	Report                ReportConfig             `json:"report"`           // The top VIPs and devices every interval. See report.go
+	Rates                 RatesConfig              `json:"rates"`            // Events per minute per VIP, every interval. See rates.go
+	Silences              []*Silence               `json:"silences"`         // Maintenance windows when events are counted but not published. See silences.go
+	Quiet_Hours           []*QuietHours            `json:"quiet_hours"`      // Times when events go to another topic, QoS or outputs. See quiet.go
+	Holidays              map[string][]string      `json:"holidays"`         // Named lists of dates, for quiet hours. See quiet.go
+	Services              map[string]ServiceConfig `json:"services"`         // Runbooks per VIP/service group. See runbooks.go
+	Thresholds            ThresholdsConfig         `json:"thresholds"`       // Threshold overrides per VIP and device, and a default. See thresholds.go
+	Anomaly               AnomalyConfig            `json:"anomaly"`          // Alerts on objects far off their usual event rate. See anomaly.go
+	Device_Silence        DeviceSilenceConfig      `json:"device_silence"`   // Alerts on devices that stop sending. See quietdevices.go
+	Enrich_Cache          map[string]CacheConfig   `json:"enrich_cache"`     // TTL and size of each lookup cache. See enrich.go
+	Escalation            EscalationConfig         `json:"escalation"`       // More logging for a device while it has an alert. See escalate.go
+	Diag_Topic            string                   `json:"diag_topic"`       // Events about the agent itself. Default notify_topic + "/agent"
+	Heartbeat             int                      `json:"heartbeat"`        // Seconds between agent.heartbeat events on diag_topic; 0 = none. See heartbeat.go
+	Heartbeat_Topic       string                   `json:"heartbeat_topic"`  // Where the heartbeat goes instead of diag_topic
+	Watchdog_Timeout      int                      `json:"watchdog_timeout"` // Seconds. See watchdog.go
+	Deadlines             DeadlineConfig           `json:"deadlines"`        // Time limits on each step, and for the whole event. See deadlines.go
+	// Keep publishing deprecated payload fields for one more release cycle. See schema.go
+	Emit_Deprecated bool `json:"emit_deprecated"`
+}
+
+var connHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
+	fmt.Println("MQTT Broker Connected...")
+}
+
+// LoadConfig reads a config file, flat or structured (see migrate.go).
+func LoadConfig(fn string) (Configuration, error) {
+	jsonFile, err := os.Open(fn)
+	if err != nil {
+		return Configuration{}, errors.New("Unable to open Config File!")
+	}
+	defer jsonFile.Close()
+
+	byteValue, _ := ioutil.ReadAll(jsonFile)
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(byteValue, &raw) == nil && isStructuredConfig(raw) {
+		if byteValue, err = flattenConfig(byteValue); err != nil {
+			return Configuration{}, errors.New("Unable to read Config File!")
+		}
+	}
+
+	var c Configuration
+	json.Unmarshal(byteValue, &c)
+
+	return c, nil
+}
+
+// settings is what the Options set.
+type settings struct {
+	configFile string
+	config     *Configuration
+	noMQTT     bool
+	noSyslog   bool
+	buffer     int
+}
+
+// Option is an option to New.
+type Option func(*settings)
+
+// WithConfigFile reads the config from fn. The default is "./config.json".
+func WithConfigFile(fn string) Option {
+	return func(s *settings) { s.configFile = fn }
+}
+
+// WithConfig uses c instead of reading a config file.
+func WithConfig(c Configuration) Option {
+	return func(s *settings) { s.config = &c }
+}
+
+// WithoutMQTT doesn't connect to a broker: events only go to Events(), the output plugins and Grafana.
+func WithoutMQTT() Option {
+	return func(s *settings) { s.noMQTT = true }
+}
+
+// WithoutSyslog doesn't start the Syslog listener; records are given to Handle instead.
+func WithoutSyslog() Option {
+	return func(s *settings) { s.noSyslog = true }
+}
+
+// WithEventBuffer sets how many events Events() holds before new ones are dropped. Default 1000.
+func WithEventBuffer(n int) Option {
+	return func(s *settings) { s.buffer = n }
+}
+
+// Monitor is a configured monitor, started with Run.
+type Monitor struct {
+	a        *agent
+	settings settings
+}
+
+// New sets up a monitor from its config. Nothing is started, or connected to, until Run. Errors are
+// *ExitErrors with ExitConfig, see exit.go.
+func New(opts ...Option) (*Monitor, error) {
+	m, err := newMonitor(opts...)
+	if err != nil {
+		return nil, exitError(ExitConfig, "config", err)
+	}
+	return m, nil
+}
+
+func newMonitor(opts ...Option) (*Monitor, error) {
+	s := settings{configFile: "./config.json", buffer: 1000}
+	for _, o := range opts {
+		o(&s)
+	}
+	var config Configuration
+	if s.config != nil {
+		config = *s.config
+	} else {
+		var err error
+		if config, err = LoadConfig(s.configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkTags(config.Tags); err != nil {
+		return nil, err
+	}
+	if err := config.Timestamps.check(); err != nil {
+		return nil, err
+	}
+	if err := config.Hosts.check(); err != nil {
+		return nil, errors.New("Bad hosts pattern: " + err.Error())
+	}
+
+	rules, err := loadRuleState(&config)
+	if err != nil {
+		return nil, err
+	}
+	if err := configureEnrichCaches(config.Enrich_Cache); err != nil {
+		return nil, err
+	}
+	if err := config.MQTT_Shared.check(); err != nil {
+		return nil, err
+	}
+	if err := checkSharedTopics(&config, rules); err != nil {
+		return nil, err
+	}
+	parsers, err := loadParsers(config.Parser_Plugins)
+	if err != nil {
+		return nil, err
+	}
+
+	reassembler, err := newReassembler(config.Reassemble)
+	if err != nil {
+		return nil, err
+	}
+	dedup, err := newDeduper(config.Dedup)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := newDigester(config.Digest, config.Notify_Topic)
+	if err != nil {
+		return nil, err
+	}
+	storm, err := newStorm(config.Storm)
+	if err != nil {
+		return nil, err
+	}
+	report, err := newReporter(config.Report, config.Notify_Topic)
+	if err != nil {
+		return nil, err
+	}
+	rates, err := newRates(config.Rates, config.Notify_Topic)
+	if err != nil {
+		return nil, err
+	}
+	silences, err := newSilences(config.Silences)
+	if err != nil {
+		return nil, err
+	}
+	quiet, err := newQuietHours(config.Quiet_Hours, config.Holidays, sinkNames(&config))
+	if err != nil {
+		return nil, err
+	}
+	anomaly, err := newAnomalies(config.Anomaly)
+	if err != nil {
+		return nil, err
+	}
+	quietDevs, err := newQuietDevices(config.Device_Silence, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	redact, err := newRedactor(config.Redact)
+	if err != nil {
+		return nil, err
+	}
+	keyer, err := newEventKeyer(config.Event_Key)
+	if err != nil {
+		return nil, err
+	}
+
+	mqttFields, err := compileProjection(config.MQTT_Fields)
+	if err != nil {
+		return nil, errors.New("Bad mqtt_fields: " + err.Error())
+	}
+	qos, err := newQoSLevels(config.MQTT_QoS)
+	if err != nil {
+		return nil, err
+	}
+
+	deadlines, err := newDeadlines(config.Deadlines)
+	if err != nil {
+		return nil, err
+	}
+	grafana, err := newGrafanaOutput(config.Grafana, deadlines.grafana, config.Debug)
+	if err != nil {
+		return nil, err
+	}
+	plugins, err := newOutputPlugins(config.Plugins, deadlines.plugin)
+	if err != nil {
+		return nil, err
+	}
+
+	var mqttFilter *Expr
+	if config.MQTT_Filter != "" {
+		if mqttFilter, err = compileExpr(config.MQTT_Filter); err != nil {
+			return nil, errors.New("Bad mqtt_filter: " + err.Error())
+		}
+	}
+
+	counters := newCounters(config.State_File)
+	metrics := newMetrics(config.Metrics, counters, config.Tags)
+	spool, err := newSpool(config.Spool, config.Debug)
+	if err != nil {
+		return nil, err
+	}
+	metrics.spool = spool
+	health, err := newOutputHealth(config.Output_Health)
+	if err != nil {
+		return nil, err
+	}
+	metrics.health = health
+	metrics.rates = rates
+	if grafana != nil {
+		grafana.health = health
+	}
+	bucket, err := newTokenBucket(config.MQTT_Rate)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := ackHold(config.Acks.Hold)
+	if err != nil {
+		return nil, err
+	}
+	suppress := newSuppressions(hold)
+	if err := suppress.serviceWindows(config.Services); err != nil {
+		return nil, err
+	}
+	if err := suppress.setThresholds(config.Thresholds); err != nil {
+		return nil, err
+	}
+	clusters, err := newClusters(config.Clusters)
+	if err != nil {
+		return nil, err
+	}
+	metrics.clusters = clusters
+	metrics.storm = storm
+	windows := newDeviceWindows()
+	suppress.deviceCounts = windows
+	metrics.windows = windows
+
+	var client mqtt.Client
+	if !s.noMQTT {
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker(fmt.Sprintf("mqtt://%s:%d", config.MQTT_Broker, config.MQTT_port))
+		opts.SetClientID(config.Client_ID) // If running multiple clients, this needs to be unique, or remove for defaults
+		// -- This code defaults to no Auth being used on the MQTT Broker. Uncomment these two lines for Username/Password Auth
+		// opts.SetUsername(config.Username)
+		// opts.SetPassword(config.Password)
+		// -- TLS Auth requires much more code. See https://github.com/eclipse/paho.mqtt.golang/blob/master/cmd/ssl/main.go for example.
+		opts.SetKeepAlive(30) // 30 second keepalive PING for MQTT Broker connection.
+		opts.SetOnConnectHandler(connHandler)
+		if topic := config.Acks.MQTT_Topic; topic != "" {
+			opts.SetOnConnectHandler(func(c mqtt.Client) {
+				connHandler(c)
+				suppress.subscribeAcks(c, topic, config.Debug)
+			})
+		}
+		opts.SetAutoReconnect(true)
+		client = mqtt.NewClient(opts)
+	}
+	var mirror *mirror
+	if client != nil {
+		if mirror, err = newMirror(config.MQTT_Mirror, config.Client_ID, deadlines.mqtt, config.Debug); err != nil {
+			return nil, err
+		}
+		metrics.mirror = mirror
+	}
+
+	a := &agent{
+		config:        config,
+		client:        client,
+		counters:      counters,
+		metrics:       metrics,
+		suppress:      suppress,
+		recovery:      newRecoveries(),
+		flaps:         newFlaps(),
+		pager:         newPager(),
+		escalation:    newEscalation(config.Escalation, config.Debug),
+		grafana:       grafana,
+		health:        health,
+		keyer:         keyer,
+		redact:        redact,
+		spool:         spool,
+		reassembler:   reassembler,
+		dedup:         dedup,
+		digest:        digest,
+		report:        report,
+		rates:         rates,
+		windows:       windows,
+		clusters:      clusters,
+		storm:         storm,
+		silences:      silences,
+		anomaly:       anomaly,
+		quietDevices:  quietDevs,
+		quiet:         quiet,
+		bucket:        bucket,
+		deadlines:     deadlines,
+		qos:           qos,
+		mirror:        mirror,
+		parsers:       parsers,
+		mqttFilter:    mqttFilter,
+		mqttFields:    mqttFields,
+		channel:       make(syslog.LogPartsChannel),
+		events:        make(chan Event, s.buffer),
+		lastProcessed: time.Now().UnixNano(),
+	}
+	if a.sinks, err = a.newSinks(plugins); err != nil {
+		return nil, err
+	}
+	a.ruleState.Store(rules)
+	return &Monitor{a: a, settings: s}, nil
+}
+
+// Events is every event the monitor publishes. It isn't closed when Run returns. If nothing reads it, events
+// are dropped (and counted in the heartbeat) once the buffer is full, rather than holding up the pipeline.
+func (m *Monitor) Events() <-chan Event {
+	return m.a.events
+}
+
+// ErrNotRunning is Handle's error outside Run, where nothing would ever take the record.
+var ErrNotRunning = errors.New("The monitor isn't running")
+
+// Handle processes one Syslog record, for use with WithoutSyslog. The keys are the ones go-syslog uses:
+// "hostname", "content", "timestamp", "severity", ... It waits for the pipeline to take the record, and
+// gives ErrNotRunning if Run hasn't started or has returned.
+func (m *Monitor) Handle(logParts format.LogParts) error {
+	if atomic.LoadInt32(&m.a.running) == 0 {
+		return ErrNotRunning
+	}
+	m.a.Handle(logParts, 0, nil)
+	return nil
+}
+
+// Run starts the monitor and runs it until ctx is done. Everything it started stops with ctx: the listener,
+// the background jobs, and any publish or HTTP call in progress. Then the lifetime counters are saved.
+// Failing to listen or to connect to the broker gives an *ExitError saying which, see exit.go.
+func (m *Monitor) Run(ctx context.Context) error {
+	a, config := m.a, m.a.config
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // Stops everything below if Run returns early
+	a.done = ctx.Done()
+	atomic.StoreInt32(&a.running, 1) // After done is set, for Handle
+	defer atomic.StoreInt32(&a.running, 0)
+	if fn := m.lockPath(); fn != "" {
+		release, err := acquireLock(fn, config.Instance.Takeover, config.Debug)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	if a.client != nil {
+		if token := a.client.Connect(); token.Wait() && token.Error() != nil {
+			return brokerError(token.Error())
+		}
+		defer a.client.Disconnect(250)
+		a.mirror.connect()
+		defer a.mirror.disconnect()
+	}
+
+	defer startProfiling(ctx, config.Profiling, config.Debug)()
+	go a.counters.saveEvery(ctx, 30*time.Second)
+	defer a.counters.Save()
+	if config.Acks.SQS.Queue_URL != "" {
+		sqs, err := newSQSClient(config.Acks.SQS)
+		if err != nil {
+			return exitError(ExitConfig, "config", err)
+		}
+		go pollSQS(ctx, sqs, a.suppress, config.Debug)
+	}
+	var subscriptions func() []string
+	if config.MQTT_Shared.Group != "" {
+		subscriptions = func() []string { return sharedSubscriptions(&a.config, a.currentRules()) }
+	}
+	api := newAPI(config.API_Token, a.counters, a.metrics, a.suppress, subscriptions)
+	a.silences.registerAPI(api, config.API_Token)
+	a.registerDrillAPI(ctx, api)
+	a.registerTuningAPI(api)
+	if config.API_Listen != "" {
+		defer serveHTTP("API", config.API_Listen, api, config.Debug)()
+	}
+
+	go a.watchRules(ctx)
+	go a.escalation.expireEvery(ctx, 10*time.Second)
+	if a.grafana != nil {
+		go a.grafana.run(ctx)
+	}
+	if a.spool != nil && a.client != nil {
+		go a.spool.run(ctx, a.client.IsConnectionOpen, func(ctx context.Context, topic string, qos byte, text []byte) error {
+			a.bucket.wait()
+			return a.publishMQTT(ctx, topic, qos, text)
+		})
+	}
+
+	//------------------[  Syslog Setup Stuff  ]---------------------
+	if !m.settings.noSyslog {
+		server := syslog.NewServer()
+		server.SetFormat(&lenientRFC3164{}) // Thunder uses RFC 3164 format for its Syslog records. See lenient.go
+		server.SetHandler(a)
+		addr, err := a.listenSyslog(server)
+		if err != nil {
+			return exitError(ExitBind, "bind", err)
+		}
+		if err := server.Boot(); err != nil {
+			return exitError(ExitBind, "bind", err)
+		}
+		defer server.Kill()
+		go a.listening(ctx, addr)
+		if config.Debug > 5 {
+			fmt.Println("Connection Rate Monitor running on " + addr + "...")
+		}
+	}
+
+	go a.consume(ctx, 0)
+	go a.watchdog(ctx)
+	go a.heartbeat(ctx)
+	go a.reassembleTimeouts(ctx)
+	go a.dedupSummaries(ctx)
+	go a.suppressSummaries(ctx)
+	go a.recoverySummaries(ctx)
+	go a.flapSummaries(ctx)
+	go a.digests(ctx)
+	go a.watchStorm(ctx)
+	go a.reports(ctx)
+	go a.publishRates(ctx)
+	go a.watchOutputs(ctx)
+	go a.detectAnomalies(ctx)
+	go a.watchDevices(ctx)
+
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,70 @@
+package monitor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Records handed in outside Run are refused rather than left waiting for ever.
+func TestHandleNeedsRun(t *testing.T) {
+	m := newTestMonitor(t, Configuration{})
+	if err := m.Handle(connRateRecord("thunder1")); err != ErrNotRunning {
+		t.Fatalf("Handle before Run: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+	for m.Handle(connRateRecord("thunder1")) == ErrNotRunning {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-m.Events():
+	case <-time.After(5 * time.Second):
+		t.Fatal("record handed in during Run not published")
+	}
+	cancel()
+	<-done
+	if err := m.Handle(connRateRecord("thunder1")); err != ErrNotRunning {
+		t.Fatalf("Handle after Run: %v", err)
+	}
+}
+
+// Each Monitor has its own API, gone when Run returns, so the next can have the same address.
+func TestRunAgainOnSameAPIAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	for i := 0; i < 2; i++ {
+		m := newTestMonitor(t, Configuration{API_Listen: addr})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- m.Run(ctx) }()
+		up := false
+		for try := 0; try < 100 && !up; try++ {
+			if resp, err := http.Get("http://" + addr + "/status"); err == nil {
+				resp.Body.Close()
+				up = resp.StatusCode == http.StatusOK
+			} else {
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		if !up {
+			t.Fatalf("run %d: API not up on %s", i+1, addr)
+		}
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+		if resp, err := http.Get("http://" + addr + "/status"); err == nil {
+			resp.Body.Close()
+			t.Fatalf("run %d: API still up after Run returned", i+1)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package monitor
+
+//
+//  nats.go  --  NATS as an output, with or without JetStream. Talks the NATS client protocol directly, as
+//    kafka.go does Kafka's:
+//
+//  "nats": { "servers": ["nats://nats-1:4222", "nats://nats-2:4222"], "subject": "a10.alerts.{{.hostname}}",
+//            "jetstream": true, "stream": "A10_ALERTS", "token": "..." }
+//
+//    servers    tried in turn until one connects. "tls://" (or a 'tls' section, or a server that wants
+//               it) is TLS
+//    subject    a template over the payload, like a rule's "topic". Default the event's MQTT topic with
+//               "." for "/", e.g. "alert.A10Thunder.rate"
+//    jetstream  publish to JetStream and wait for the stream to say it has the event, rather than just
+//               for the server to have it. Default false
+//    stream     with jetstream, the stream that must take it (Nats-Expected-Stream)
+//    username, password, token   to log in with, if the server wants it
+//    tls        see tls.go
+//    filter     only send events this expression is true for, see expr.go
+//    fields     only send these payload fields, see project.go
+//
+//  The message is the payload as JSON. Every publish is confirmed before the next, within the "sink"
+//  deadline (deadlines.go): by a PING round trip, or with jetstream by the stream's ack. JetStream messages
+//  have a Nats-Msg-Id (the payload's "event_id"), so the one retry after the connection drops can't store
+//  an event twice. The sink is called "nats" in rules' "sinks" (sinks.go) and the output health.
+//
+//  Why not nats.go: its current release (v1.54) needs Go 1.26, against this module's 1.15, and brings nkeys
+//  and a compression library with it. The client protocol is lines of text, and a publisher uses little of
+//  it: CONNECT, PUB or HPUB, PING and PONG, +OK and -ERR, and a SUB on one inbox for JetStream's acks.
+//  Logging in with an nkey or a .creds file isn't done. nats_test.go runs it both ways against a fake
+//  server.
+//
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// NATSConfig holds the 'nats' section of the config.
+type NATSConfig struct {
+	Servers   []string   `json:"servers"`
+	Subject   string     `json:"subject"`
+	JetStream bool       `json:"jetstream"`
+	Stream    string     `json:"stream"`
+	Username  string     `json:"username"`
+	Password  string     `json:"password"`
+	Token     string     `json:"token"`
+	TLS       *TLSConfig `json:"tls"`
+	Filter    string     `json:"filter"`
+	Fields    []string   `json:"fields"`
+}
+
+type natsSink struct {
+	cfg      NATSConfig
+	clientID string
+	subject  *template.Template // nil = from the MQTT topic
+	filter   *Expr
+	fields   projection
+	tls      *tls.Config
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	conn *natsConn // nil until the first publish, or after it went wrong
+}
+
+// newNATSSink is nil if there are no servers.
+func newNATSSink(cfg NATSConfig, clientID string, timeout time.Duration) (*natsSink, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, nil
+	}
+	if cfg.Stream != "" && !cfg.JetStream {
+		return nil, errors.New("nats: 'stream' is only for 'jetstream'")
+	}
+	n := &natsSink{cfg: cfg, clientID: clientID, timeout: timeout}
+	var err error
+	if cfg.Subject != "" {
+		if n.subject, err = parseTemplate("nats.subject", cfg.Subject); err != nil {
+			return nil, fmt.Errorf("nats: bad subject template: %v", err)
+		}
+	}
+	if cfg.Filter != "" {
+		if n.filter, err = compileExpr(cfg.Filter); err != nil {
+			return nil, fmt.Errorf("nats: bad filter: %v", err)
+		}
+	}
+	if n.fields, err = compileProjection(cfg.Fields); err != nil {
+		return nil, fmt.Errorf("nats: %v", err)
+	}
+	if n.tls, err = cfg.TLS.config("nats"); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Name is "nats", see sinks.go.
+func (n *natsSink) Name() string { return "nats" }
+
+// Publish sends out to its subject, and waits for it to be taken.
+func (n *natsSink) Publish(ctx context.Context, out *Outgoing) error {
+	if n.filter != nil && !exprTrue(n.filter, out.Payload) {
+		return errSinkSkipped
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+	subject := strings.Replace(out.Topic, "/", ".", -1)
+	if n.subject != nil {
+		s, err := renderTemplate(ctx, n.subject, out.Payload)
+		if err != nil {
+			return &sinkError{timeoutCode(err, errRenderTemplate, errRenderTimeout), fmt.Errorf("nats: subject: %v", err)}
+		}
+		subject = s
+	}
+	if err := checkNATSSubject(subject); err != nil {
+		return &sinkError{errDeliverNATS, err}
+	}
+	data, _ := json.Marshal(n.fields.apply(out.Payload))
+	id, _ := out.Payload["event_id"].(string)
+	if id == "" {
+		id = newEventID()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var err error
+	for try := 0; try < 2; try++ {
+		var retry bool
+		if retry, err = n.publish(ctx, subject, id, data); err == nil || !retry {
+			break
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%v: %w", err, ctx.Err())
+	}
+	if err != nil {
+		return &sinkError{timeoutCode(err, errDeliverNATS, errDeliverNATSTime), err}
+	}
+	return nil
+}
+
+// publish is one try. retry says the connection went wrong, so another try on a new one may work.
+// Caller holds n.mu.
+func (n *natsSink) publish(ctx context.Context, subject, id string, data []byte) (retry bool, err error) {
+	if n.conn == nil {
+		if n.conn, err = n.connect(ctx); err != nil {
+			return false, err
+		}
+	}
+	c := n.conn
+	if c.maxPayload > 0 && len(data) > c.maxPayload {
+		return false, fmt.Errorf("nats: payload of %d bytes is over the server's max_payload", len(data))
+	}
+	if !n.cfg.JetStream {
+		err = c.write(fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", subject, len(data), data))
+		if err == nil {
+			err = c.wait(ctx, "")
+		}
+	} else {
+		c.replies++
+		reply := c.inbox + "." + strconv.FormatUint(c.replies, 10)
+		hdr := "NATS/1.0\r\nNats-Msg-Id: " + id + "\r\n"
+		if n.cfg.Stream != "" {
+			hdr += "Nats-Expected-Stream: " + n.cfg.Stream + "\r\n"
+		}
+		hdr += "\r\n"
+		err = c.write(fmt.Sprintf("HPUB %s %s %d %d\r\n%s%s\r\n", subject, reply, len(hdr), len(hdr)+len(data), hdr, data))
+		if err == nil {
+			err = c.wait(ctx, reply)
+		}
+	}
+	if err == nil {
+		return false, nil
+	}
+	if _, ok := err.(natsRejected); ok {
+		return false, err // The connection is fine; the stream said no
+	}
+	c.close()
+	n.conn = nil
+	return ctx.Err() == nil, err
+}
+
+// natsRejected is JetStream not taking a message.
+type natsRejected string
+
+func (e natsRejected) Error() string { return string(e) }
+
+// connect opens a connection to the first server that will have one.
+func (n *natsSink) connect(ctx context.Context) (*natsConn, error) {
+	var last error
+	for _, s := range n.cfg.Servers {
+		c, err := n.dial(ctx, s)
+		if err == nil {
+			return c, nil
+		}
+		last = err
+	}
+	return nil, last
+}
+
+// natsInfo is the part of the server's INFO that matters here.
+type natsInfo struct {
+	TLS_Required bool `json:"tls_required"`
+	Headers      bool `json:"headers"`
+	Max_Payload  int  `json:"max_payload"`
+}
+
+func (n *natsSink) dial(ctx context.Context, server string) (*natsConn, error) {
+	useTLS := n.tls != nil
+	addr := server
+	if i := strings.Index(addr, "://"); i >= 0 {
+		useTLS = useTLS || addr[:i] == "tls"
+		addr = addr[i+3:]
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "4222")
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("nats: %v", err)
+	}
+	fail := func(err error) (*natsConn, error) {
+		nc.Close()
+		return nil, fmt.Errorf("nats: %s: %v", addr, err)
+	}
+	dl, _ := ctx.Deadline()
+	nc.SetDeadline(dl)
+	r := bufio.NewReader(nc)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return fail(err)
+	}
+	var info natsInfo
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		return fail(errors.New("not a NATS server"))
+	}
+	if useTLS || info.TLS_Required {
+		t := n.tls
+		if t == nil {
+			t = &tls.Config{}
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		tc := tls.Client(nc, forHost(t, host))
+		if err := tc.Handshake(); err != nil {
+			return fail(fmt.Errorf("TLS: %v", err))
+		}
+		nc, r = tc, bufio.NewReader(tc)
+	}
+	if n.cfg.JetStream && !info.Headers {
+		return fail(errors.New("the server is too old for JetStream publishing (no headers)"))
+	}
+	opts := map[string]interface{}{
+		"verbose": false, "pedantic": false, "tls_required": useTLS || info.TLS_Required, "name": n.clientID,
+		"lang": "go", "version": Version, "protocol": 1, "headers": info.Headers, "no_responders": info.Headers,
+	}
+	for k, v := range map[string]string{"user": n.cfg.Username, "pass": n.cfg.Password, "auth_token": n.cfg.Token} {
+		if v != "" {
+			opts[k] = v
+		}
+	}
+	connect, _ := json.Marshal(opts)
+	c := &natsConn{conn: nc, maxPayload: info.Max_Payload, pongs: make(chan struct{}, 1), msgs: make(chan natsMsg, 8), done: make(chan struct{})}
+	hello := "CONNECT " + string(connect) + "\r\n"
+	if n.cfg.JetStream {
+		c.inbox = "_INBOX." + newEventID()
+		hello += "SUB " + c.inbox + ".* 1\r\n"
+	}
+	if _, err := nc.Write([]byte(hello + "PING\r\n")); err != nil {
+		return fail(err)
+	}
+	nc.SetDeadline(time.Time{})
+	go c.read(r)
+	if err := c.wait(ctx, ""); err != nil {
+		c.close()
+		return nil, fmt.Errorf("nats: %s: %v", addr, err)
+	}
+	return c, nil
+}
+
+// natsConn is a connection to one server, with a goroutine reading what it sends.
+type natsConn struct {
+	conn       net.Conn
+	maxPayload int
+	inbox      string // Where JetStream acks come back to
+	replies    uint64 // Used under natsSink.mu
+
+	wmu   sync.Mutex // Writes, from publish and from read's PONGs
+	pongs chan struct{}
+	msgs  chan natsMsg
+	done  chan struct{} // Closed when read stops, with err saying why
+	err   error
+}
+
+// natsMsg is a message on the inbox: a JetStream ack, or a status such as 503 no responders.
+type natsMsg struct {
+	subject string
+	status  string
+	data    []byte
+}
+
+func (c *natsConn) write(s string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write([]byte(s))
+	return err
+}
+
+func (c *natsConn) close() { c.conn.Close() }
+
+// read handles what the server sends until the connection closes.
+func (c *natsConn) read(r *bufio.Reader) {
+	defer close(c.done)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.err = err
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "PING":
+			c.write("PONG\r\n")
+		case "PONG":
+			select {
+			case c.pongs <- struct{}{}:
+			default:
+			}
+		case "-ERR":
+			c.err = errors.New(strings.Trim(strings.TrimPrefix(line, f[0]), " '"))
+			c.conn.Close()
+			return
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply] <size>, HMSG <subject> <sid> [reply] <header size> <size>
+			hdrLen := 0
+			if f[0] == "HMSG" && len(f) >= 5 {
+				hdrLen, _ = strconv.Atoi(f[len(f)-2])
+			}
+			size, err := strconv.Atoi(f[len(f)-1])
+			if err != nil || size < hdrLen || len(f) < 3 {
+				c.err = errors.New("bad message from the server: " + line)
+				c.conn.Close()
+				return
+			}
+			body := make([]byte, size+2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				c.err = err
+				return
+			}
+			m := natsMsg{subject: f[1], data: body[hdrLen:size]}
+			if hdrLen > 0 {
+				// "NATS/1.0 503" or "NATS/1.0 503 No Responders"
+				status := strings.SplitN(string(body[:hdrLen]), "\r\n", 2)[0]
+				m.status = strings.TrimSpace(strings.TrimPrefix(status, "NATS/1.0"))
+			}
+			select {
+			case c.msgs <- m:
+			default:
+			}
+		}
+	}
+}
+
+// wait waits for the PONG to the last PING or, with reply, the JetStream ack on it.
+func (c *natsConn) wait(ctx context.Context, reply string) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("nats: waiting for the server: %w", ctx.Err())
+		case <-c.done:
+			if c.err == nil {
+				return errors.New("nats: connection closed")
+			}
+			return fmt.Errorf("nats: %v", c.err)
+		case <-c.pongs:
+			if reply == "" {
+				return nil
+			}
+		case m := <-c.msgs:
+			if reply == "" || m.subject != reply {
+				continue // Late ack to something that already timed out
+			}
+			return jetStreamAck(m)
+		}
+	}
+}
+
+// jetStreamAck is the error in a JetStream ack, nil if the stream has the message.
+func jetStreamAck(m natsMsg) error {
+	if strings.HasPrefix(m.status, "503") {
+		return natsRejected("nats: no JetStream stream takes the subject")
+	}
+	var ack struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(m.data, &ack); err != nil {
+		return natsRejected("nats: bad JetStream ack: " + string(m.data))
+	}
+	if ack.Error != nil {
+		return natsRejected(fmt.Sprintf("nats: JetStream: %s (%d)", ack.Error.Description, ack.Error.Code))
+	}
+	return nil
+}
+
+// checkNATSSubject makes sure a rendered subject can be published to.
+func checkNATSSubject(s string) error {
+	switch {
+	case s == "":
+		return errors.New("nats: empty subject")
+	case strings.ContainsAny(s, " \t\r\n*>"):
+		return fmt.Errorf("nats: subject '%s' has a space or a wildcard in it", s)
+	case strings.HasPrefix(s, ".") || strings.HasSuffix(s, ".") || strings.Contains(s, ".."):
+		return fmt.Errorf("nats: subject '%s' has an empty token", s)
+	}
+	return nil
+}
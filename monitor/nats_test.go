@@ -0,0 +1,219 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// natsOp is a PUB or HPUB the fake server was sent, or CONNECT with its options.
+type natsOp struct {
+	op, subject, reply string
+	headers, payload   string
+}
+
+// fakeNATS is a server sending info, answering PINGs, and answering each HPUB with what ack gives: a
+// header status line ("NATS/1.0 503") and a body, sent to the HPUB's reply subject.
+func fakeNATS(t *testing.T, info string, ack func(op natsOp) (status, body string)) (addr string, got chan natsOp) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	got = make(chan natsOp, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveNATS(c, info, ack, got)
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func serveNATS(c net.Conn, info string, ack func(op natsOp) (status, body string), got chan natsOp) {
+	defer c.Close()
+	fmt.Fprintf(c, "INFO %s\r\n", info)
+	r := bufio.NewReader(c)
+	sid := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(strings.TrimRight(line, "\r\n"))
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "CONNECT":
+			got <- natsOp{op: "CONNECT", payload: strings.TrimSpace(strings.TrimPrefix(line, "CONNECT"))}
+		case "SUB":
+			sid = f[len(f)-1]
+		case "PING":
+			io.WriteString(c, "PONG\r\n")
+		case "PUB", "HPUB":
+			op := natsOp{op: f[0], subject: f[1]}
+			hdrLen := 0
+			if f[0] == "HPUB" {
+				op.reply = f[2]
+				hdrLen, _ = strconv.Atoi(f[3])
+			} else if len(f) == 4 {
+				op.reply = f[2]
+			}
+			size, _ := strconv.Atoi(f[len(f)-1])
+			body := make([]byte, size+2)
+			if _, err := io.ReadFull(r, body); err != nil || string(body[size:]) != "\r\n" {
+				return
+			}
+			op.headers, op.payload = string(body[:hdrLen]), string(body[hdrLen:size])
+			got <- op
+			if f[0] == "HPUB" && ack != nil {
+				status, data := ack(op)
+				if status == "" {
+					fmt.Fprintf(c, "MSG %s %s %d\r\n%s\r\n", op.reply, sid, len(data), data)
+				} else {
+					hdr := status + "\r\n\r\n"
+					fmt.Fprintf(c, "HMSG %s %s %d %d\r\n%s%s\r\n", op.reply, sid, len(hdr), len(hdr)+len(data), hdr, data)
+				}
+			}
+		}
+	}
+}
+
+func natsOut() *Outgoing {
+	return &Outgoing{Event: Event{Rule: &Rule{}}, Topic: "alert/A10Thunder",
+		Payload: map[string]interface{}{"rule": "conn-rate-limit", "event_id": "0123abcd"}}
+}
+
+// A core NATS publish: CONNECT with the credentials, then PUB on the topic with its slashes as dots.
+func TestNATSPublish(t *testing.T) {
+	addr, got := fakeNATS(t, `{"server_id": "test", "headers": true, "max_payload": 1048576}`, nil)
+	n, err := newNATSSink(NATSConfig{Servers: []string{"nats://" + addr}, Username: "a10crm", Password: "pw"}, "test-client", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Publish(context.Background(), natsOut()); err != nil {
+		t.Fatal(err)
+	}
+	connect := <-got
+	var opts map[string]interface{}
+	if err := json.Unmarshal([]byte(connect.payload), &opts); err != nil {
+		t.Fatalf("CONNECT %s: %v", connect.payload, err)
+	}
+	if opts["user"] != "a10crm" || opts["pass"] != "pw" || opts["name"] != "test-client" || opts["verbose"] != false {
+		t.Errorf("CONNECT %s", connect.payload)
+	}
+	pub := <-got
+	if pub.op != "PUB" || pub.subject != "alert.A10Thunder" || pub.reply != "" {
+		t.Errorf("published %+v", pub)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(pub.payload), &payload); err != nil || payload["rule"] != "conn-rate-limit" {
+		t.Errorf("payload %q", pub.payload)
+	}
+
+	// The connection is kept for the next one
+	if err := n.Publish(context.Background(), natsOut()); err != nil {
+		t.Fatal(err)
+	}
+	if op := <-got; op.op != "PUB" {
+		t.Errorf("second publish %+v", op)
+	}
+}
+
+// A JetStream publish: HPUB with the event ID as the Nats-Msg-Id, to an inbox the ack comes back on.
+func TestNATSJetStream(t *testing.T) {
+	for _, c := range []struct {
+		status, body, err string
+	}{
+		{"", `{"stream": "ALERTS", "seq": 1}`, ""},
+		{"", `{"error": {"code": 400, "description": "wrong last sequence"}}`, "nats: JetStream: wrong last sequence (400)"},
+		{"NATS/1.0 503", "", "nats: no JetStream stream takes the subject"},
+	} {
+		addr, got := fakeNATS(t, `{"headers": true}`, func(op natsOp) (string, string) { return c.status, c.body })
+		n, err := newNATSSink(NATSConfig{Servers: []string{addr}, JetStream: true, Stream: "ALERTS"}, "test-client", 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.Publish(context.Background(), natsOut())
+		if c.err == "" && err != nil || c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("ack %s %s: error %v, want %q", c.status, c.body, err, c.err)
+		}
+		<-got // CONNECT
+		pub := <-got
+		if pub.op != "HPUB" || pub.subject != "alert.A10Thunder" || !strings.HasPrefix(pub.reply, "_INBOX.") {
+			t.Errorf("published %+v", pub)
+		}
+		want := "NATS/1.0\r\nNats-Msg-Id: 0123abcd\r\nNats-Expected-Stream: ALERTS\r\n\r\n"
+		if pub.headers != want {
+			t.Errorf("headers %q, want %q", pub.headers, want)
+		}
+	}
+}
+
+// A server without headers can't take JetStream publishes, and a payload over max_payload isn't sent.
+func TestNATSServerLimits(t *testing.T) {
+	addr, _ := fakeNATS(t, `{"headers": false}`, nil)
+	n, _ := newNATSSink(NATSConfig{Servers: []string{addr}, JetStream: true}, "", 5*time.Second)
+	if err := n.Publish(context.Background(), natsOut()); err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Errorf("JetStream without headers: %v", err)
+	}
+	addr, _ = fakeNATS(t, `{"max_payload": 10}`, nil)
+	n, _ = newNATSSink(NATSConfig{Servers: []string{addr}}, "", 5*time.Second)
+	if err := n.Publish(context.Background(), natsOut()); err == nil || !strings.Contains(err.Error(), "max_payload") {
+		t.Errorf("over max_payload: %v", err)
+	}
+}
+
+// The reading side: PINGs get PONGs, MSG and HMSG are split into status and data, -ERR ends it.
+func TestNATSRead(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	c := &natsConn{conn: client, pongs: make(chan struct{}, 1), msgs: make(chan natsMsg, 8), done: make(chan struct{})}
+	go c.read(bufio.NewReader(client))
+	sr := bufio.NewReader(server)
+
+	io.WriteString(server, "PING\r\n")
+	if line, _ := sr.ReadString('\n'); line != "PONG\r\n" {
+		t.Errorf("answered PING with %q", line)
+	}
+	io.WriteString(server, "MSG _INBOX.x.1 1 5\r\nhello\r\n")
+	if m := <-c.msgs; m.subject != "_INBOX.x.1" || string(m.data) != "hello" || m.status != "" {
+		t.Errorf("MSG read as %+v", m)
+	}
+	io.WriteString(server, "HMSG _INBOX.x.2 1 30 32\r\nNATS/1.0 503 No Responders\r\n\r\nhi\r\n")
+	if m := <-c.msgs; m.subject != "_INBOX.x.2" || string(m.data) != "hi" || m.status != "503 No Responders" {
+		t.Errorf("HMSG read as %+v", m)
+	}
+	io.WriteString(server, "PONG\r\n")
+	if err := c.wait(context.Background(), ""); err != nil {
+		t.Errorf("wait for PONG: %v", err)
+	}
+	io.WriteString(server, "-ERR 'Authorization Violation'\r\n")
+	<-c.done
+	if c.err == nil || c.err.Error() != "Authorization Violation" {
+		t.Errorf("-ERR read as %v", c.err)
+	}
+}
+
+func TestCheckNATSSubject(t *testing.T) {
+	for s, ok := range map[string]bool{
+		"alert.A10Thunder": true, "a10.thunder1.conn-rate": true, "": false, "a b": false, "a.*": false,
+		"a.>": false, ".a": false, "a.": false, "a..b": false,
+	} {
+		if err := checkNATSSubject(s); (err == nil) != ok {
+			t.Errorf("checkNATSSubject(%q): %v", s, err)
+		}
+	}
+}
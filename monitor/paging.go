@@ -0,0 +1,180 @@
+package monitor
+
+//
+//  paging.go  --  Escalating an alert that goes on. A rule with "escalate" steps up, for each object (VIP,
+//    server, ...) on a device, the longer it keeps alerting:
+//
+//    { "name": "conn-rate-limit", "escalate": { "reset": "10m", "steps": [
+//        { "after": "15m", "severity": "critical", "topic": "alert/A10Thunder/p2" },
+//        { "after": "1h", "severity": "emergency", "topic": "alert/A10Thunder/p1", "sinks": ["pagerduty"] } ] } }
+//
+//    after     how long after the first alert the step is taken
+//    severity  the severity the events are published with from then on (and so their QoS, see qos.go),
+//              unless "magnitude" (magnitude.go) gives a higher one
+//    topic     where they go instead of the rule's topic
+//    sinks     outputs they go to as well as the rule's (see sinks.go)
+//    reset     how long without a match ends the incident, so the next one starts from the bottom. Default
+//              the rule's "recover" (see recovery.go) or 10m
+//
+//  The first match past each step is published whatever suppression or dedup would say, so a step is never
+//  missed behind a suppress window. Acks, snoozes and silences still hold it back, and an ack (acks.go)
+//  ends the escalation: an object still alerting once the ack is over starts again from the bottom.
+//  Escalated events have "escalation_level" (1 for the first step) and "alerting_since".
+//
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EscalatePolicy is a rule's "escalate".
+type EscalatePolicy struct {
+	Reset string           `json:"reset"`
+	Steps []EscalationStep `json:"steps"`
+
+	reset time.Duration
+}
+
+// EscalationStep is one step of an EscalatePolicy.
+type EscalationStep struct {
+	After    string   `json:"after"`
+	Severity string   `json:"severity"`
+	Topic    string   `json:"topic"`
+	Sinks    []string `json:"sinks"`
+
+	after time.Duration
+}
+
+func (p *EscalatePolicy) compile(r *Rule) error {
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("Rule '%s': escalate needs steps", r.Name)
+	}
+	p.reset = 10 * time.Minute
+	if r.recover > 0 {
+		p.reset = r.recover
+	}
+	if p.Reset != "" {
+		d, err := time.ParseDuration(p.Reset)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Rule '%s': bad escalate reset '%s'", r.Name, p.Reset)
+		}
+		p.reset = d
+	}
+	for i := range p.Steps {
+		s := &p.Steps[i]
+		d, err := time.ParseDuration(s.After)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Rule '%s': bad escalate step after '%s'", r.Name, s.After)
+		}
+		if i > 0 && d <= p.Steps[i-1].after {
+			return fmt.Errorf("Rule '%s': escalate steps must be in order of 'after'", r.Name)
+		}
+		s.after = d
+		if s.Severity != "" {
+			sev, ok := normalizeSeverity(s.Severity)
+			if !ok {
+				return fmt.Errorf("Rule '%s': unknown escalate severity '%s'", r.Name, s.Severity)
+			}
+			s.Severity = sev
+		}
+	}
+	return nil
+}
+
+type escalating struct {
+	started, last time.Time
+	level         int
+}
+
+// pager keeps track of how long each object has been alerting. Safe to use from several goroutines.
+type pager struct {
+	mu     sync.Mutex
+	alerts map[string]*escalating
+}
+
+func newPager() *pager {
+	return &pager{alerts: make(map[string]*escalating)}
+}
+
+// seen notes an alert, returning the level it is at (0 = not escalated) and whether it just got there.
+func (p *pager) seen(ev Event, now time.Time) (level int, since time.Time, stepped bool) {
+	if ev.Rule == nil || ev.Rule.Escalate == nil {
+		return 0, time.Time{}, false
+	}
+	pol := ev.Rule.Escalate
+	key := suppressKey(ev.Device, ev.Type, ev.Object)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.alerts[key]
+	if !ok || now.Sub(e.last) >= pol.reset {
+		e = &escalating{started: now}
+		p.alerts[key] = e
+	}
+	e.last = now
+	level = 0
+	for i, s := range pol.Steps {
+		if now.Sub(e.started) >= s.after {
+			level = i + 1
+		}
+	}
+	stepped = level > e.level
+	e.level = level
+	if len(p.alerts) > 1000 {
+		for k, o := range p.alerts {
+			if now.Sub(o.last) >= 24*time.Hour {
+				delete(p.alerts, k) // Long over; any others are restarted when their objects next come by
+			}
+		}
+	}
+	return level, e.started, stepped
+}
+
+// forget ends the object's escalation, once it is acked. Alerting on after the ack, it starts from the bottom.
+func (p *pager) forget(key string) {
+	p.mu.Lock()
+	delete(p.alerts, key)
+	p.mu.Unlock()
+}
+
+// escalate applies the step ev is at.
+func (ev *Event) escalate(level int, since time.Time) {
+	if level == 0 {
+		return
+	}
+	ev.Escalation = level
+	step := ev.Rule.Escalate.Steps[level-1]
+	if step.Severity != "" && !moreSevere(ev.Severity, step.Severity) {
+		ev.Severity = step.Severity // Unless "magnitude" has already raised it past the step
+	}
+	fields := make(map[string]interface{}, len(ev.Fields)+2)
+	for k, v := range ev.Fields {
+		fields[k] = v
+	}
+	fields["escalation_level"] = level
+	fields["alerting_since"] = since.UTC().Format(time.RFC3339)
+	ev.Fields = fields
+}
+
+// step is the escalation step ev is at, nil if none.
+func (ev Event) step() *EscalationStep {
+	if ev.Escalation == 0 || ev.Rule == nil || ev.Rule.Escalate == nil || ev.Escalation > len(ev.Rule.Escalate.Steps) {
+		return nil
+	}
+	return &ev.Rule.Escalate.Steps[ev.Escalation-1]
+}
+
+// sendsTo says whether ev goes to the named output: the rule's, and its escalation step's.
+func (ev Event) sendsTo(sink string) bool {
+	if ev.Rule.sendsTo(sink) {
+		return true
+	}
+	if s := ev.step(); s != nil {
+		for _, n := range s.Sinks {
+			if n == sink {
+				return true
+			}
+		}
+	}
+	return false
+}
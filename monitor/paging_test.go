@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+func newTestMonitor(t *testing.T, config Configuration) *Monitor {
+	t.Helper()
+	m, err := New(WithConfig(config), WithoutMQTT(), WithoutSyslog(), WithEventBuffer(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func connRateRecord(host string) format.LogParts {
+	return format.LogParts{"hostname": host, "severity": 4, "timestamp": time.Now(),
+		"content": "[ACOS]<4> Virtual server ws-vip connection rate limit 10 exceeded"}
+}
+
+// nextEvent is the next event published, nil if there isn't one.
+func nextEvent(m *Monitor) *Event {
+	select {
+	case ev := <-m.Events():
+		return &ev
+	default:
+		return nil
+	}
+}
+
+// An acked alert stays quiet, escalation steps or not, and its escalation is over.
+func TestAckStopsEscalation(t *testing.T) {
+	fn := writeRulesFile(t, `{ "rules": [ { "name": "conn-rate-limit", "suppress": "1h",
+		"escalate": { "reset": "1h", "steps": [ { "after": "40ms", "severity": "critical" },
+		                                        { "after": "80ms", "severity": "emergency" } ] } } ] }`)
+	m := newTestMonitor(t, Configuration{Rules_File: fn})
+
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	first := nextEvent(m)
+	if first == nil {
+		t.Fatal("first alert not published")
+	}
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	if ev := nextEvent(m); ev != nil {
+		t.Fatal("second alert not suppressed")
+	}
+	time.Sleep(50 * time.Millisecond)
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	if ev := nextEvent(m); ev == nil || ev.Severity != "critical" {
+		t.Fatalf("first step not published past suppression: %+v", ev)
+	}
+
+	key := first.alertID()
+	if err := m.a.suppress.ApplyAck(AckMessage{Key: key, Action: "ack"}, "test", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // Past the second step
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	if ev := nextEvent(m); ev != nil {
+		t.Fatalf("acked alert escalated: %+v", ev)
+	}
+
+	// Closed, it is news again, from the bottom of the escalation
+	if err := m.a.suppress.ApplyAck(AckMessage{Key: key, Action: "close"}, "test", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	if ev := nextEvent(m); ev == nil || ev.Severity != "warning" {
+		t.Fatalf("alert after close: %+v", ev)
+	}
+}
@@ -0,0 +1,56 @@
+package monitor
+
+//
+//  parsers.go  --  Parser plugins, for log formats (custom aFleX log statements, say) that are more than a
+//    rule can handle, without forking the agent. Each one is a Go plugin built against the plugin package:
+//
+//    go build -buildmode=plugin -o kv_aflex.so ./examples/parsers/kv_aflex
+//
+//    "parser_plugins": ["/opt/conn-rate-mon/parsers/kv_aflex.so"]
+//
+//  Records no rule matched are offered to each parser in turn; the first one to take a record turns it
+//  into an event, which then goes the same way as a rule match.
+//
+
+import (
+	"jdallen/a10-connection-rate-monitor/plugin"
+)
+
+type parserPlugin struct {
+	p     plugin.RecordParser
+	rules map[string]*Rule // One per event type, to hang the matches on
+}
+
+func loadParsers(fns []string) ([]*parserPlugin, error) {
+	var ps []*parserPlugin
+	for _, fn := range fns {
+		p, err := loadParser(fn)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, &parserPlugin{p: p, rules: make(map[string]*Rule)})
+	}
+	return ps, nil
+}
+
+// matchParsers offers the record to each parser plugin. Only called from the consumer goroutine.
+func matchParsers(ps []*parserPlugin, rec record) (Event, bool) {
+	if len(ps) == 0 {
+		return Event{}, false
+	}
+	pr := plugin.Record{Hostname: rec.Device, Tag: rec.Tag, Module: rec.Module, Message: rec.Message, Severity: rec.Severity, Facility: rec.Facility}
+	for _, pp := range ps {
+		ev, ok := pp.p.Parse(pr)
+		if !ok || ev.Type == "" {
+			continue
+		}
+		rk := ev.Type + "\x00" + ev.Topic
+		r, ok := pp.rules[rk]
+		if !ok {
+			r = &Rule{Name: pp.p.Name(), Type: ev.Type, Topic: ev.Topic}
+			pp.rules[rk] = r
+		}
+		return rec.event(r, ev.Severity, ev.Fields), true
+	}
+	return Event{}, false
+}
@@ -0,0 +1,31 @@
+//go:build cgo
+// +build cgo
+
+package monitor
+
+//
+//  parsers_cgo.go  --  Loading parser plugins (see parsers.go). Go plugins need cgo.
+//
+
+import (
+	"fmt"
+	goplugin "plugin"
+
+	"jdallen/a10-connection-rate-monitor/plugin"
+)
+
+func loadParser(fn string) (plugin.RecordParser, error) {
+	p, err := goplugin.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load parser plugin %s: %v", fn, err)
+	}
+	sym, err := p.Lookup("Parser")
+	if err != nil {
+		return nil, fmt.Errorf("Parser plugin %s has no Parser variable", fn)
+	}
+	rp, ok := sym.(plugin.RecordParser)
+	if !ok {
+		return nil, fmt.Errorf("Parser plugin %s: Parser doesn't implement plugin.RecordParser", fn)
+	}
+	return rp, nil
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+// +build !cgo
+
+package monitor
+
+import (
+	"errors"
+
+	"jdallen/a10-connection-rate-monitor/plugin"
+)
+
+func loadParser(fn string) (plugin.RecordParser, error) {
+	return nil, errors.New("Parser plugins need an agent built with cgo!")
+}
@@ -0,0 +1,131 @@
+package monitor
+
+//
+//  patterns.go  --  A library of named regex patterns, grok style, so rules for well-known ACOS messages
+//    don't need a regex written out. A rule can name a whole-message pattern:
+//
+//    { "name": "vip-rate", "pattern": "ACOS_CONN_RATE", "topic": "alert/rate" }
+//
+//  or build its regex out of pieces, with %{NAME} for a pattern and %{NAME:field} to publish what it matched:
+//
+//    { "name": "nat-pool", "regex": "^NAT pool %{WORD:pool} exhausted for %{IP:inside_ip}" }
+//
+//  The rules file can add its own, which can use the others:
+//
+//    "patterns": { "POOL": "[\\w-]+", "MY_POOL_EXHAUSTED": "^NAT pool %{POOL:pool} exhausted" }
+//
+//  The ACOS_ patterns are the built-in rules' regexes and match from the start of the message. A rule
+//  using one as its "pattern" gets the built-in rule's field types too, unless it gives its own "fields".
+//
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// basePatterns are the building blocks.
+var basePatterns = map[string]string{
+	"INT":              `[+-]?\d+`,
+	"NUMBER":           `[+-]?\d+(?:\.\d+)?`,
+	"WORD":             `\w+`,
+	"NOTSPACE":         `\S+`,
+	"SPACE":            `\s*`,
+	"DATA":             `.*?`,
+	"GREEDYDATA":       `.*`,
+	"QUOTEDSTRING":     `"[^"]*"`,
+	"IPV4":             `(?:\d{1,3}\.){3}\d{1,3}`,
+	"IPV6":             `[0-9a-fA-F]*:[0-9a-fA-F:.]*:[0-9a-fA-F.]*`,
+	"IP":               `(?:%{IPV4}|%{IPV6})`,
+	"PORT":             `\d{1,5}`,
+	"IPPORT":           `%{IP}(?::%{PORT})?`,
+	"HOSTNAME":         `[\w.-]+`,
+	"URIPATH":          `/[^\s?#]*`,
+	"URI":              `\S*`,
+	"ACOS_OBJECT_TYPE": `(?i:virtual[\s-]server|virtual[\s-]port|server[\s-]port|server)`,
+	"ACOS_OBJECT":      `\S+`,
+}
+
+// acosPatterns name the built-in rules' regexes.
+var acosPatterns = map[string]string{
+	"ACOS_CONN_RATE":        "conn-rate-limit",
+	"ACOS_CONN_LIMIT":       "conn-limit",
+	"ACOS_SERVER_STATE":     "server-state",
+	"ACOS_VIP_STATE":        "vip-state",
+	"ACOS_HM_FAIL":          "health-monitor",
+	"ACOS_SYN_COOKIE":       "ddos-syn-cookie",
+	"ACOS_SYN_FLOOD":        "ddos-syn-flood",
+	"ACOS_IP_ANOMALY":       "ddos-ip-anomaly",
+	"ACOS_AFLEX_HTTP_ERROR": "aflex-http-error",
+	"ACOS_WAF_VIOLATION":    "waf-violation",
+	"ACOS_SSL_HANDSHAKE":    "ssl-handshake",
+	"ACOS_SSL_CERT":         "ssl-cert-error",
+	"ACOS_SYSTEM_RESOURCE":  "system-resource",
+	"ACOS_CGNAT_QUOTA":      "cgnat-quota",
+	"ACOS_CGNAT_PORT_BATCH": "cgnat-port-batch",
+	"ACOS_FIXED_NAT":        "cgnat-fixed-nat",
+}
+
+func lookupPattern(name string, extra map[string]string) (string, bool) {
+	if p, ok := extra[name]; ok {
+		return p, true
+	}
+	if p, ok := basePatterns[name]; ok {
+		return p, true
+	}
+	if rule, ok := acosPatterns[name]; ok {
+		for _, r := range builtinRules {
+			if r.Name == rule {
+				return r.Regex, true
+			}
+		}
+	}
+	return "", false
+}
+
+var patternRef = regexp.MustCompile(`%\{(\w+)(?::(\w+))?\}`)
+
+// expandPatterns replaces the %{NAME} and %{NAME:field} references in a regex.
+func expandPatterns(src string, extra map[string]string) (string, error) {
+	for depth := 0; patternRef.MatchString(src); depth++ {
+		if depth == 10 {
+			return "", fmt.Errorf("Patterns nested too deep (or in a loop) in '%s'", src)
+		}
+		var bad error
+		src = patternRef.ReplaceAllStringFunc(src, func(ref string) string {
+			m := patternRef.FindStringSubmatch(ref)
+			p, ok := lookupPattern(m[1], extra)
+			if !ok {
+				bad = fmt.Errorf("Unknown pattern '%s'", m[1])
+				return ref
+			}
+			if m[2] != "" {
+				return "(?P<" + m[2] + ">" + p + ")"
+			}
+			return "(?:" + p + ")"
+		})
+		if bad != nil {
+			return "", bad
+		}
+	}
+	return src, nil
+}
+
+// expandPatterns fills in the rule's regex from its pattern and pattern references.
+func (r *Rule) expandPatterns(extra map[string]string) error {
+	if r.Pattern != "" && r.Regex == "" {
+		r.Regex = "%{" + r.Pattern + "}"
+		if rule, ok := acosPatterns[r.Pattern]; ok && len(r.Fields) == 0 {
+			for _, b := range builtinRules {
+				if b.Name == rule {
+					r.Fields = append([]string(nil), b.Fields...) // Same field types as the built-in rule
+				}
+			}
+		}
+	}
+	re, err := expandPatterns(r.Regex, extra)
+	if err != nil {
+		return fmt.Errorf("Rule '%s': %v", r.Name, err)
+	}
+	r.Regex = re
+	return nil
+}
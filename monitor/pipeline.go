@@ -0,0 +1,414 @@
+package monitor
+
+//
+//  pipeline.go  --  What happens to each Syslog record once it has been received: match it against the
+//    rules, build the payload, and send it to MQTT and any output plugins.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// agent holds everything the processing pipeline needs.
+type agent struct {
+	// -- Watchdog bookkeeping, see watchdog.go. Updated atomically, so kept first for 64-bit alignment.
+	received      uint64
+	processed     uint64
+	lastProcessed int64 // UnixNano
+	generation    uint64
+	stuck         uint64 // Records held by consumers the watchdog has given up on
+	lost          uint64 // MQTT events neither published nor spooled, see heartbeat.go
+	eventsLost    uint64 // Events dropped because Events() was full, see monitor.go
+	late          uint64 // Events whose time budget ran out, see deadlines.go
+
+	config       Configuration
+	ruleState    atomic.Value // *ruleState, swapped on reload. See reload.go
+	parsers      []*parserPlugin
+	reassembler  *reassembler // nil if not configured
+	dedup        *deduper     // nil if not configured
+	client       mqtt.Client  // nil WithoutMQTT
+	sinks        *fanout      // See sinks.go
+	counters     *Counters
+	metrics      *Metrics
+	suppress     *Suppressions
+	recovery     *recoveries
+	digest       *digester // nil if not configured
+	report       *reporter // nil if not configured
+	rates        *rates    // nil if not configured
+	windows      *deviceWindows
+	clusters     *clusters // nil if not configured
+	storm        *storm    // nil if there is no breaker
+	pager        *pager
+	silences     *silences
+	anomaly      *anomalies    // nil if not configured
+	quietDevices *quietDevices // nil if not configured
+	quiet        *quietHours
+	flaps        *flaps
+	health       *outputHealth
+	escalation   *escalation
+	grafana      *grafanaOutput // nil if not configured
+	keyer        *eventKeyer
+	redact       *redactor
+	spool        *spool       // nil if there isn't one
+	bucket       *tokenBucket // From 'mqtt_rate'; nil = no limit
+	deadlines    deadlines
+	qos          qosLevels // From 'mqtt_qos'
+	mirror       *mirror   // nil if 'mqtt_mirror' has no brokers
+	mqttFilter   *Expr     // From 'mqtt_filter'; nil = everything goes to MQTT
+	mqttFields   projection
+	channel      syslog.LogPartsChannel
+	events       chan Event      // See Monitor.Events
+	done         <-chan struct{} // Closed when Run's context is done
+	running      int32           // 1 while Run is, atomic. See Monitor.Handle
+}
+
+// Handle is called by the Syslog server for every record (it makes agent a syslog.Handler).
+func (a *agent) Handle(logParts format.LogParts, msgLen int64, err error) {
+	atomic.AddUint64(&a.received, 1)
+	if err != nil {
+		// Still worth processing: the parser hands over as much as it managed
+		reportError(a.config.Debug, errParseSyslog, err.Error())
+	}
+	select {
+	case a.channel <- logParts:
+	case <-a.done:
+	}
+}
+
+// consume processes records from the channel until the watchdog starts a newer generation, or ctx is done.
+func (a *agent) consume(ctx context.Context, gen uint64) {
+	for {
+		var logParts format.LogParts
+		select {
+		case <-ctx.Done():
+			return
+		case logParts = <-a.channel:
+		}
+		for _, lp := range a.reassembler.add(logParts, time.Now()) {
+			a.process(ctx, lp)
+		}
+		atomic.AddUint64(&a.processed, 1)
+		atomic.StoreInt64(&a.lastProcessed, time.Now().UnixNano())
+		if atomic.LoadUint64(&a.generation) != gen {
+			atomic.AddUint64(&a.stuck, ^uint64(0))
+			return // Replaced while we were stuck
+		}
+	}
+}
+
+func (a *agent) process(ctx context.Context, logParts format.LogParts) {
+	//
+	// Log records ("logParts") come in from Thunder looking like this:
+	// map[client:10.1.11.44:5456 content:[ACOS]<4> Virtual server ws-vip connection rate limit 10 exceeded facility:16
+	//   hostname:Testing1 priority:132 severity:4 tag:a10logd timestamp:2021-05-18 22:03:04 +0000 UTC tls_peer:]
+	// map[client:10.1.11.44:5456 content:[AFLEX]<6> http-error-status-log:HTTP Error: 10.147.95.128 - 404 - /blatt
+	//   facility:16 hostname:Testing1 priority:134 severity:6 tag:a10logd timestamp:2021-05-18 22:05:41 +0000 UTC tls_peer:]
+	config := a.config
+	rec := newRecord(logParts, time.Now(), &config.Timestamps)
+	host := rec.Device
+	if !config.Hosts.keep(host) {
+		return
+	}
+	config.Debug = a.escalation.debugFor(host, config.Debug) // Turned up while the device has an alert, see escalate.go
+	a.escalation.capture(host, logParts)
+	if config.Debug > 9 { // Output all incoming Syslog records.
+		fmt.Print(".")
+		fmt.Println(logParts)
+	}
+	a.counters.Received(host)
+	if ev, ok := a.quietDevices.heard(host, rec.Received); ok {
+		a.suppress.recovered(ev.alertID(), rec.Received)
+		a.emit(ctx, config, ev)
+	}
+	if rec.Substituted {
+		a.counters.TimestampSubstituted(host)
+	}
+	if !config.Syslog_Filter.keep(rec.Severity, rec.Facility) {
+		a.counters.Filtered(host)
+		return
+	}
+	rs := a.currentRules()
+	if d := rs.drops.match(rec); d != nil {
+		a.counters.Dropped(host, d.Name)
+		return
+	}
+	ev, ok := rs.rules.Match(rec)
+	if !ok {
+		if ev, ok = matchParsers(a.parsers, rec); !ok {
+			return
+		}
+	}
+	if a.deadlines.event > 0 {
+		ev.Deadline = rec.Received.Add(a.deadlines.event) // The budget starts when the record arrived
+	}
+	correlated, absorbed := rs.correlator.Observe(&ev, time.Now())
+	if absorbed {
+		a.counters.Matched(host, ev.Type) // The correlated event already stands for it
+	} else {
+		a.emit(ctx, config, ev)
+	}
+	for _, c := range correlated {
+		a.emit(ctx, config, c)
+	}
+}
+
+// emit counts an event and, unless something holds it back (a threshold, a silence, dedup or suppression),
+// delivers it.
+func (a *agent) emit(ctx context.Context, config Configuration, ev Event) {
+	host := ev.Device
+	if !ev.summary() {
+		ev.raiseSeverity()
+	}
+	a.counters.Matched(host, ev.Type)
+	if start, ok := a.storm.matched(ev, time.Now()); ok {
+		a.deliver(ctx, config, start)
+	}
+	a.escalation.trigger(host, ev.Severity)
+	if !ev.Recovered {
+		a.metrics.ObjectEvent(ev.Object, ev.Type, ev.Fields)
+	}
+	a.digest.add(ev)
+	a.report.add(ev)
+	a.rates.add(ev, time.Now())
+	a.windows.add(ev, time.Now())
+	a.anomaly.add(ev)
+	if a.clusters.merge(&ev, time.Now()) {
+		if config.Debug > 5 {
+			fmt.Println("Merged into cluster: " + suppressKey(host, ev.Type, ev.Object))
+		}
+		return
+	}
+	if !ev.summary() && ev.Rule.Flap != nil {
+		flapping, start, hold := a.flaps.seen(ev, time.Now())
+		if start {
+			a.emit(ctx, config, flapping)
+		}
+		if hold {
+			if config.Debug > 5 {
+				fmt.Println("Flapping: " + flapKey(ev))
+			}
+			return
+		}
+	}
+	if !ev.summary() {
+		t, reached := a.suppress.Reached(ev, time.Now())
+		a.recovery.seen(ev, reached, time.Now())
+		if !reached {
+			if config.Debug > 5 {
+				fmt.Println("Below threshold: " + suppressKey(host, ev.Type, ev.Object))
+			}
+			return
+		}
+		if t != nil {
+			ev.Fields = withThreshold(ev.Fields, t)
+		}
+	}
+	if !ev.summary() && ev.backUp() {
+		a.suppress.recovered(ev.alertID(), time.Now()) // Not held back by the down's ack, which it may end
+	} else if !ev.summary() && a.suppress.ackedEvent(ev, time.Now()) {
+		a.pager.forget(suppressKey(host, ev.Type, ev.Object)) // Someone has it; no more paging
+		if config.Debug > 5 {
+			fmt.Println("Acknowledged: " + suppressKey(host, ev.Type, ev.Object))
+		}
+		return
+	}
+	stepped := false
+	if !ev.summary() {
+		var level int
+		var since time.Time
+		level, since, stepped = a.pager.seen(ev, time.Now())
+		ev.escalate(level, since)
+	}
+	if name := a.silences.match(ev, time.Now()); name != "" {
+		a.counters.Silenced(host, name)
+		if config.Debug > 5 {
+			fmt.Println("Silenced by " + name + ": " + suppressKey(host, ev.Type, ev.Object))
+		}
+		return
+	}
+	if !ev.Recovered && !ev.backUp() && a.suppress.snoozed(ev.alertID(), time.Now()) {
+		if config.Debug > 5 {
+			fmt.Println("Snoozed: " + ev.alertID())
+		}
+		return
+	}
+	if !ev.summary() && !stepped && !a.dedup.first(ev, time.Now()) {
+		if config.Debug > 5 {
+			fmt.Println("Duplicate: " + host + "::" + ev.Message)
+		}
+		return
+	}
+	if !ev.summary() && !stepped && !a.suppress.Allow(ev, time.Now()) {
+		if config.Debug > 5 {
+			fmt.Println("Suppressed: " + suppressKey(host, ev.Type, ev.Object))
+		}
+		return
+	}
+	if a.storm.hold(ev) {
+		if config.Debug > 5 {
+			fmt.Println("Held back by alert storm: " + suppressKey(host, ev.Type, ev.Object))
+		}
+		return
+	}
+	a.deliver(ctx, config, ev)
+}
+
+// deliver publishes an event to the sinks (MQTT, the output plugins, Grafana), within the event's time
+// budget if it has one.
+func (a *agent) deliver(ctx context.Context, config Configuration, ev Event) {
+	host := ev.Device
+	if config.Debug > 5 {
+		fmt.Println("A10 Thunder node = " + host + "::" + ev.Message)
+	}
+	if ev.Deadline.IsZero() && a.deadlines.event > 0 {
+		ev.Deadline = time.Now().Add(a.deadlines.event) // Correlations and dedup summaries
+	}
+	if !ev.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, ev.Deadline)
+		defer cancel()
+		defer func() {
+			if ctx.Err() == context.DeadlineExceeded {
+				atomic.AddUint64(&a.late, 1)
+			}
+		}()
+	}
+	select {
+	case a.events <- ev:
+	default:
+		atomic.AddUint64(&a.eventsLost, 1)
+		countError(errDeliverEvents)
+	}
+	tctx, cancel := context.WithTimeout(ctx, a.deadlines.template)
+	defer cancel()
+	payload := ev.payload(tctx)
+	if !ev.Test {
+		alert := a.suppress.published(ev, time.Now()) // See lifecycle.go
+		payload["alert_state"] = alert.State
+		payload["alert_opened"] = alert.Opened.UTC().Format(time.RFC3339)
+		payload["incident_id"] = alert.Incident
+		payload["alert_sequence"] = alert.Published
+	}
+	config.Timestamps.addTimestamps(payload, ev)
+	addRunbook(payload, ev.Rule, config.Services)
+	addTags(payload, config.Tags)
+	a.redact.apply(payload) // Last, so nothing added above gets past it
+	if config.Emit_Deprecated {
+		addDeprecatedFields(payload) // From the redacted fields
+	}
+	// One ID for every sink and region, so NATS, AMQP and mirror consumers can all drop copies by it
+	payload["event_id"] = newEventID()
+	quiet := a.quiet.match(ev, time.Now())
+	if quiet != nil {
+		payload["quiet_hours"] = quiet.Name
+	}
+	base := config.Notify_Topic
+	if t, ok := config.Partition_Topics[ev.Partition]; ok && ev.Partition != "" {
+		base = t
+	}
+	if t, ok := config.Syslog_Filter.Severity_Topics[severityName(ev.SyslogSeverity)]; ok {
+		base = t
+	}
+	topic := ev.Rule.topicFor(tctx, base, payload)
+	if quiet != nil && quiet.Topic != "" {
+		topic = quiet.Topic
+	}
+	if s := ev.step(); s != nil && s.Topic != "" {
+		topic = s.Topic
+	}
+	a.sinks.publish(ctx, &Outgoing{Event: ev, Payload: payload, Topic: topic, Key: a.keyer.Key(tctx, payload), Quiet: quiet})
+}
+
+// mqttSink is the publish to mqtt_broker, with its spool, rate limit and mirrors.
+type mqttSink struct{ a *agent }
+
+func (s mqttSink) Name() string { return "mqtt" }
+
+// message is what goes to the broker for out, and at which QoS. False if MQTT doesn't get it.
+func (s mqttSink) message(out *Outgoing) ([]byte, byte, bool) {
+	a := s.a
+	if a.digest.replaces() || (a.mqttFilter != nil && !exprTrue(a.mqttFilter, out.Payload)) {
+		return nil, 0, false
+	}
+	mp := a.mirror.hint(a.mqttFields.apply(out.Payload), out.Payload) // After the projection, so consumers always have them
+	text, _ := json.Marshal(mp)
+	qos := a.qos.forEvent(out.Event)
+	if out.Quiet != nil && out.Quiet.QoS != nil {
+		qos = byte(*out.Quiet.QoS)
+	}
+	return text, qos, true
+}
+
+func (s mqttSink) Publish(ctx context.Context, out *Outgoing) error {
+	a, ev := s.a, out.Event
+	text, qos, ok := s.message(out)
+	if !ok {
+		return errSinkSkipped
+	}
+	defer a.mirror.publish(ctx, out.Topic, qos, text)()
+	if a.spool.holding() || !a.bucket.allow(time.Now()) {
+		// Behind the backlog or over the rate, see spool.go and smoother.go
+		if a.spool.put(ev.SyslogSeverity, out.Topic, qos, text) {
+			return errSinkQueued // The spool metrics cover it from here
+		}
+		a.bucket.wait()
+	}
+	if err := a.publishMQTT(ctx, out.Topic, qos, text); err != nil {
+		a.mirror.primaryDone(false)
+		code := timeoutCode(err, errDeliverMQTT, errDeliverMQTTTime)
+		if !a.spool.putFailed(ev.SyslogSeverity, out.Topic, qos, text, code) {
+			atomic.AddUint64(&a.lost, 1)
+		}
+		return &sinkError{code, err}
+	}
+	a.mirror.primaryDone(true)
+	if !ev.Test {
+		a.counters.Published(ev.Device, ev.Type)
+	}
+	return nil
+}
+
+// queue spools out while an earlier publish is still going, so it goes out behind it rather than being
+// dropped. The mirrors get it now, as they aren't the ones held up. False if there is no spool, or it's full.
+func (s mqttSink) queue(ctx context.Context, out *Outgoing) bool {
+	a := s.a
+	if a.spool == nil {
+		return false
+	}
+	text, qos, ok := s.message(out)
+	if !ok {
+		return true // Nothing to keep
+	}
+	a.mirror.publish(ctx, out.Topic, qos, text) // Not waited for
+	return a.spool.put(out.Event.SyslogSeverity, out.Topic, qos, text)
+}
+
+// publishMQTT publishes one message to the broker, waiting for it to go, up to the mqtt deadline.
+func (a *agent) publishMQTT(ctx context.Context, topic string, qos byte, text []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, a.deadlines.mqtt)
+	defer cancel()
+	token := a.client.Publish(topic, qos, false, text)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return fmt.Errorf("MQTT publish: %w", ctx.Err())
+	}
+}
+
+// clientHost is the address part of the "client" the Syslog server gives, e.g. "10.1.11.44:5456".
+func clientHost(client string) string {
+	if i := strings.LastIndex(client, ":"); i > 0 {
+		return client[:i]
+	}
+	return client
+}
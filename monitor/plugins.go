@@ -0,0 +1,205 @@
+package monitor
+
+//
+//  plugins.go  --  Out-of-process output plugins. Each plugin listed under 'plugins' in the config is
+//    started as a child process and gets a copy of every alert over its stdin, one JSON object per line.
+//    See PLUGINS.md for the protocol, and the 'plugin' package for a Go SDK.
+//
+//  "plugins": [
+//    { "name": "ticketing", "command": "/opt/plugins/ticket.py", "args": ["-v"], "options": {"queue": "NOC"},
+//      "filter": "event.severity in [\"critical\", \"error\"]" }
+//  ]
+//
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"jdallen/a10-connection-rate-monitor/plugin"
+)
+
+// PluginConfig is one entry of 'plugins' in the config.
+type PluginConfig struct {
+	Name    string                 `json:"name"`
+	Command string                 `json:"command"`
+	Args    []string               `json:"args"`
+	Options map[string]interface{} `json:"options"` // Handed to the plugin in the hello message
+	Filter  string                 `json:"filter"`  // Only send events this expression is true for, see expr.go
+	Fields  []string               `json:"fields"`  // Only send these payload fields, see project.go
+}
+
+const pluginRestartDelay = 10 * time.Second
+
+// pluginRejected is an error reported back by the plugin itself; the plugin is still healthy.
+type pluginRejected string
+
+func (e pluginRejected) Error() string { return string(e) }
+
+type outputPlugin struct {
+	cfg     PluginConfig
+	filter  *Expr
+	fields  projection
+	timeout time.Duration // For each reply, from the deadlines
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	replies   chan plugin.Reply
+	nextID    uint64
+	lastStart time.Time
+}
+
+func newOutputPlugins(cfgs []PluginConfig, timeout time.Duration) ([]*outputPlugin, error) {
+	var ps []*outputPlugin
+	for _, c := range cfgs {
+		for _, s := range builtinSinks {
+			if c.Name == s {
+				return nil, fmt.Errorf("Plugin %s: that name is taken by a built-in output, see sinks.go", c.Name)
+			}
+		}
+		p := &outputPlugin{cfg: c, timeout: timeout}
+		if c.Filter != "" {
+			f, err := compileExpr(c.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("Plugin %s: bad filter: %v", c.Name, err)
+			}
+			p.filter = f
+		}
+		fields, err := compileProjection(c.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("Plugin %s: %v", c.Name, err)
+		}
+		p.fields = fields
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// wants says whether the event passes the plugin's filter.
+func (p *outputPlugin) wants(payload map[string]interface{}) bool {
+	return p.filter == nil || exprTrue(p.filter, payload)
+}
+
+// start runs the plugin process and does the hello exchange. ctx is only for the hello; the process is kept
+// running after it. Caller holds p.mu.
+func (p *outputPlugin) start(ctx context.Context) error {
+	if time.Since(p.lastStart) < pluginRestartDelay {
+		return errors.New("waiting to restart")
+	}
+	p.lastStart = time.Now()
+
+	cmd := exec.Command(p.cfg.Command, p.cfg.Args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	replies := make(chan plugin.Reply, 1)
+	go func() {
+		in := bufio.NewScanner(stdout)
+		for in.Scan() {
+			var r plugin.Reply
+			if json.Unmarshal(in.Bytes(), &r) == nil {
+				replies <- r
+			}
+		}
+		close(replies)
+		cmd.Wait()
+	}()
+	p.cmd, p.stdin, p.replies = cmd, stdin, replies
+
+	hello := plugin.Hello{Type: "hello", Protocol: plugin.ProtocolVersion, Agent: Version, Name: p.cfg.Name, Options: p.cfg.Options}
+	if err := p.send(ctx, hello, 0); err != nil {
+		p.stop()
+		return fmt.Errorf("hello failed: %v", err)
+	}
+	return nil
+}
+
+// stop kills the plugin process; the next publish starts it again. Caller holds p.mu.
+func (p *outputPlugin) stop() {
+	if p.cmd != nil {
+		p.stdin.Close()
+		p.cmd.Process.Kill()
+	}
+	p.cmd = nil
+}
+
+// send writes one message and waits for the matching reply, until ctx is done. Caller holds p.mu.
+func (p *outputPlugin) send(ctx context.Context, msg interface{}, id uint64) error {
+	b, _ := json.Marshal(msg)
+	if _, err := p.stdin.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	for {
+		select {
+		case r, ok := <-p.replies:
+			if !ok {
+				return errors.New("plugin exited")
+			}
+			if r.ID != id {
+				continue // Late reply to something that already timed out
+			}
+			if !r.OK {
+				return pluginRejected(r.Error)
+			}
+			return nil
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("timed out waiting for reply: %w", ctx.Err())
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// Name is the plugin's name, see sinks.go.
+func (p *outputPlugin) Name() string { return p.cfg.Name }
+
+// Publish hands out to the plugin if it passes the filter.
+func (p *outputPlugin) Publish(ctx context.Context, out *Outgoing) error {
+	if !p.wants(out.Payload) {
+		return errSinkSkipped
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	if err := p.publish(ctx, out.Topic, out.Key, out.Payload); err != nil {
+		return &sinkError{timeoutCode(err, errDeliverPlugin, errDeliverPluginTim), err}
+	}
+	return nil
+}
+
+// publish hands one alert to the plugin, (re)starting it if it is not running.
+func (p *outputPlugin) publish(ctx context.Context, topic string, key string, payload map[string]interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		if err := p.start(ctx); err != nil {
+			return fmt.Errorf("plugin %s won't start: %v", p.cfg.Name, err)
+		}
+	}
+	p.nextID++
+	ev := plugin.Event{Type: "event", ID: p.nextID, Topic: topic, Key: key, Payload: p.fields.apply(payload)}
+	if err := p.send(ctx, ev, ev.ID); err != nil {
+		if _, ok := err.(pluginRejected); !ok {
+			p.stop() // Dead or wedged, start a fresh one next time
+		}
+		return fmt.Errorf("plugin %s: %v", p.cfg.Name, err)
+	}
+	return nil
+}
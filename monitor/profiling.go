@@ -0,0 +1,130 @@
+package monitor
+
+//
+//  profiling.go  --  Optional continuous profiling, so a slow or hungry agent in production can be looked
+//    at after the fact. Two ways of getting at the profiles:
+//
+//    - push: every 'interval' seconds a CPU and a heap profile are sent to a Pyroscope server's /ingest API.
+//    - pull: 'pprof_listen' serves the standard net/http/pprof endpoints, for Parca (or anything else that
+//      scrapes pprof) to collect from.
+//
+//  "profiling": { "server": "http://pyroscope:4040", "app_name": "conn-rate-mon", "interval": 15,
+//                 "pprof_listen": "127.0.0.1:6060" }
+//
+//  Note that a CPU profile can't be taken from the pprof endpoint while a push is in progress, and vice
+//  versa; use one or the other for CPU.
+//
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	httppprof "net/http/pprof"
+	"net/url"
+	"os"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// ProfilingConfig holds the 'profiling' section of the config.
+type ProfilingConfig struct {
+	Server       string `json:"server"` // Pyroscope base URL. Empty = no push
+	App_Name     string `json:"app_name"`
+	Auth_Token   string `json:"auth_token"`
+	Interval     int    `json:"interval"` // Seconds per profile, default 15
+	Pprof_Listen string `json:"pprof_listen"`
+}
+
+// pprofMux serves the net/http/pprof endpoints. They are on a mux of their own, not the default one, so
+// the listener can be shut down and nothing else on the default mux is served with them.
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	return mux
+}
+
+// startProfiling starts the pprof listener and the Pyroscope pusher, which stops when ctx is done. It
+// returns the func that shuts the listener down, freeing its address for the next Run.
+func startProfiling(ctx context.Context, pc ProfilingConfig, debug int) (stop func()) {
+	stop = func() {}
+	if pc.Pprof_Listen != "" {
+		stop = serveHTTP("pprof", pc.Pprof_Listen, pprofMux(), debug)
+	}
+	if pc.Server == "" {
+		return stop
+	}
+	if pc.App_Name == "" {
+		pc.App_Name = "a10-connection-rate-monitor"
+	}
+	if pc.Interval <= 0 {
+		pc.Interval = 15
+	}
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%s{hostname=%s,version=%s}", pc.App_Name, host, Version)
+
+	go func() {
+		for ctx.Err() == nil {
+			from := time.Now()
+			var cpu bytes.Buffer
+			cpuOK := pprof.StartCPUProfile(&cpu) == nil
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(pc.Interval) * time.Second):
+			}
+			if cpuOK {
+				pprof.StopCPUProfile()
+			}
+			until := time.Now()
+
+			var heap bytes.Buffer
+			pprof.WriteHeapProfile(&heap)
+
+			for _, p := range []struct {
+				data *bytes.Buffer
+				kind string
+			}{{&cpu, "cpu"}, {&heap, "heap"}} {
+				if p.data.Len() == 0 {
+					continue
+				}
+				if err := pushProfile(ctx, pc, name, from, until, p.data); err != nil {
+					reportError(debug, errProfilingPush, "Profile push ("+p.kind+") failed: "+err.Error())
+				}
+			}
+		}
+	}()
+	return stop
+}
+
+// pushProfile sends one pprof profile to the Pyroscope /ingest API.
+func pushProfile(ctx context.Context, pc ProfilingConfig, name string, from, until time.Time, data *bytes.Buffer) error {
+	q := url.Values{}
+	q.Set("name", name)
+	q.Set("from", strconv.FormatInt(from.Unix(), 10))
+	q.Set("until", strconv.FormatInt(until.Unix(), 10))
+	q.Set("format", "pprof")
+	q.Set("spyName", "gospy")
+	req, err := http.NewRequestWithContext(ctx, "POST", pc.Server+"/ingest?"+q.Encode(), data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if pc.Auth_Token != "" {
+		req.Header.Set("Authorization", "Bearer "+pc.Auth_Token)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("server said %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package monitor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The pprof listener goes when it is stopped, so the next Run can have the same address, and it only
+// serves pprof.
+func TestPprofListenerStops(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	get := func(path string) (int, error) {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	for i := 0; i < 2; i++ {
+		stop := startProfiling(context.Background(), ProfilingConfig{Pprof_Listen: addr}, 0)
+		code, err := get("/debug/pprof/")
+		for try := 0; try < 100 && err != nil; try++ {
+			time.Sleep(10 * time.Millisecond)
+			code, err = get("/debug/pprof/")
+		}
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("listen %d: /debug/pprof/ gave %d, %v", i+1, code, err)
+		}
+		if code, _ := get("/status"); code != http.StatusNotFound {
+			t.Errorf("listen %d: /status on the pprof listener gave %d", i+1, code)
+		}
+		stop()
+		if _, err := get("/debug/pprof/"); err == nil {
+			t.Fatalf("listen %d: still up after stop", i+1)
+		}
+	}
+}
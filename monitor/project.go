@@ -0,0 +1,53 @@
+package monitor
+
+//
+//  project.go  --  Picking which payload fields an output gets, and what they are called there, so external
+//    systems get only what they need. A projection is a list of field names, each optionally renamed:
+//
+//    "mqtt_fields": ["type", "severity", "hostname", "object_name as vip", "message"]
+//
+//  Fields the event doesn't have are left out. Filters and event keys still see the whole event.
+//
+
+import (
+	"fmt"
+	"strings"
+)
+
+type projectedField struct {
+	from string
+	to   string
+}
+
+// projection is a compiled field list. nil = everything.
+type projection []projectedField
+
+func compileProjection(fields []string) (projection, error) {
+	var p projection
+	for _, f := range fields {
+		parts := strings.Fields(f)
+		switch {
+		case len(parts) == 1:
+			p = append(p, projectedField{parts[0], parts[0]})
+		case len(parts) == 3 && strings.ToLower(parts[1]) == "as":
+			p = append(p, projectedField{parts[0], parts[2]})
+		default:
+			return nil, fmt.Errorf("Bad field '%s', should be \"name\" or \"name as newname\"", f)
+		}
+	}
+	return p, nil
+}
+
+// apply returns the payload with just the projected fields.
+func (p projection) apply(payload map[string]interface{}) map[string]interface{} {
+	if p == nil {
+		return payload
+	}
+	out := make(map[string]interface{}, len(p))
+	for _, f := range p {
+		if v, ok := payload[f.from]; ok {
+			out[f.to] = v
+		}
+	}
+	return out
+}
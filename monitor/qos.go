@@ -0,0 +1,74 @@
+package monitor
+
+//
+//  qos.go  --  The MQTT QoS each event is published with, by its severity, so the broker makes sure the
+//    alerts that matter get through while routine ones stay fire-and-forget:
+//
+//  "mqtt_qos": { "emergency": 2, "alert": 2, "critical": 2, "error": 1 }
+//
+//  Severities not given keep the default: QoS 1 for emergency, alert and critical, 0 for the rest. It goes
+//  by the event's severity, which a rule can set, not the record's. A spooled event is sent with the QoS it
+//  would have had. Events about the agent itself (diag_topic) always go at QoS 0.
+//
+//  The "severity" in the payload is always one of the Syslog names below. Rules, correlations and parser
+//  plugins can give the usual short forms ("crit", "err", "warn", "info" ...) and they are normalized;
+//  anything else stops a rule from loading, and from a parser plugin is replaced by the record's severity.
+//
+
+import (
+	"fmt"
+	"strings"
+)
+
+// severityAliases are the other spellings of the severity names.
+var severityAliases = map[string]string{
+	"emerg":         "emergency",
+	"panic":         "emergency",
+	"crit":          "critical",
+	"err":           "error",
+	"warn":          "warning",
+	"informational": "info",
+	"information":   "info",
+}
+
+// normalizeSeverity turns a severity as given into one of severityNames. False if it isn't one.
+func normalizeSeverity(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if a, ok := severityAliases[s]; ok {
+		s = a
+	}
+	if severityLevel(s) < 0 {
+		return "", false
+	}
+	return s, true
+}
+
+// qosLevels is the QoS for each Syslog severity number.
+type qosLevels [8]byte
+
+func newQoSLevels(cfg map[string]int) (qosLevels, error) {
+	q := qosLevels{1, 1, 1, 0, 0, 0, 0, 0}
+	for name, v := range cfg {
+		sev, ok := normalizeSeverity(name)
+		if !ok {
+			return q, fmt.Errorf("mqtt_qos: unknown severity '%s'", name)
+		}
+		if v < 0 || v > 2 {
+			return q, fmt.Errorf("mqtt_qos: QoS for '%s' must be 0, 1 or 2", name)
+		}
+		q[severityLevel(sev)] = byte(v)
+	}
+	return q, nil
+}
+
+// forEvent is the QoS to publish ev with.
+func (q qosLevels) forEvent(ev Event) byte {
+	sev := severityLevel(ev.Severity)
+	if sev < 0 {
+		sev = ev.SyslogSeverity
+	}
+	if sev < 0 || sev >= len(q) {
+		return 0
+	}
+	return q[sev]
+}
@@ -0,0 +1,202 @@
+package monitor
+
+//
+//  quiet.go  --  Quiet hours: times of day, days of the week and holidays when events go somewhere else,
+//    for sites whose overnight, weekend and holiday subscribers aren't the daytime NOC tooling. Each entry
+//    is a routing profile for the times it is on:
+//
+//  "quiet_hours": [
+//    { "name": "overnight", "schedule": "0 22 * * *", "duration": "9h", "zone": "Europe/London",
+//      "topic": "alert/A10Thunder/overnight", "qos": 0 },
+//    { "name": "weekend", "schedule": "0 0 * * 6", "duration": "48h", "severity": "warning,notice,info", "sinks": ["mqtt"] }
+//  ]
+//
+//    schedule, duration, zone  when it is on, as for silences (see silences.go)
+//    holidays                  dates it is on all day as well, in zone: "2026-12-25", or the name of a
+//                              list in the config's 'holidays'. With these, a schedule is optional
+//    skip_holidays             dates it is off, the same way, e.g. for a business hours profile
+//    device, object, type      which events it covers, as patterns like "thunder-lab-*". Default all of them
+//    severity                  only events of these severities (a comma-separated list). Default all
+//    topic                     the MQTT topic to publish to instead
+//    qos                       the MQTT QoS to publish at instead (see qos.go)
+//    sinks                     only these of the event's outputs (see sinks.go)
+//
+//  "holidays": { "uk": ["2026-12-25", "2026-12-26", "2027-01-01"] }
+//
+//  "quiet_hours": [
+//    { "name": "holiday", "holidays": ["uk"], "topic": "alert/A10Thunder/oncall" },
+//    { "name": "business-hours", "schedule": "0 8 * * 1-5", "duration": "10h", "skip_holidays": ["uk"],
+//      "topic": "alert/A10Thunder/noc", "sinks": ["mqtt", "servicenow"] },
+//    { "name": "after-hours", "schedule": "* * * * *", "duration": "1m", "topic": "alert/A10Thunder/oncall",
+//      "sinks": ["mqtt", "pagerduty"] } ]
+//
+//  The first entry that is on and covers an event is the one used, so the last can catch all the rest. An escalation step's topic (see
+//  paging.go) still wins over a quiet hours topic, so a page that has stepped up goes where it was meant to.
+//  The payload says which one it went by in "quiet_hours".
+//
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuietHours is one entry in 'quiet_hours'.
+type QuietHours struct {
+	Name     string   `json:"name"`
+	Schedule string   `json:"schedule"`
+	Duration string   `json:"duration"`
+	Zone     string   `json:"zone"`
+	Device   string   `json:"device"`
+	Object   string   `json:"object"`
+	Type     string   `json:"type"`
+	Severity string   `json:"severity"`
+	Topic    string   `json:"topic"`
+	QoS      *int     `json:"qos"`
+	Sinks    []string `json:"sinks"`
+
+	Holidays      []string `json:"holidays"`
+	Skip_Holidays []string `json:"skip_holidays"`
+
+	window     *cronWindow // nil without a schedule
+	zone       *time.Location
+	holidays   map[string]bool // Dates, as "2006-01-02"
+	skip       map[string]bool
+	severities map[string]bool // nil = all
+}
+
+func (q *QuietHours) compile(lists map[string][]string, known map[string]bool) error {
+	if q.Name == "" {
+		return errors.New("Quiet hours with no name!")
+	}
+	var err error
+	if q.Schedule != "" || len(q.Holidays) == 0 {
+		if q.window, err = newCronWindow(q.Schedule, q.Duration, q.Zone); err != nil {
+			return fmt.Errorf("Quiet hours '%s': %v", q.Name, err)
+		}
+	}
+	q.zone = time.Local
+	if q.Zone != "" {
+		if q.zone, err = time.LoadLocation(q.Zone); err != nil {
+			return fmt.Errorf("Quiet hours '%s': unknown timezone '%s'", q.Name, q.Zone)
+		}
+	}
+	if q.holidays, err = holidayDates(q.Holidays, lists); err != nil {
+		return fmt.Errorf("Quiet hours '%s': %v", q.Name, err)
+	}
+	if q.skip, err = holidayDates(q.Skip_Holidays, lists); err != nil {
+		return fmt.Errorf("Quiet hours '%s': %v", q.Name, err)
+	}
+	for _, pat := range []string{q.Device, q.Object, q.Type} {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("Quiet hours '%s': bad pattern '%s'", q.Name, pat)
+		}
+	}
+	if q.Severity != "" {
+		q.severities = make(map[string]bool)
+		for _, s := range strings.Split(q.Severity, ",") {
+			sev, ok := normalizeSeverity(s)
+			if !ok {
+				return fmt.Errorf("Quiet hours '%s': unknown severity '%s'", q.Name, s)
+			}
+			q.severities[sev] = true
+		}
+	}
+	if q.QoS != nil && (*q.QoS < 0 || *q.QoS > 2) {
+		return fmt.Errorf("Quiet hours '%s': qos must be 0, 1 or 2", q.Name)
+	}
+	for _, s := range q.Sinks {
+		if !known[s] {
+			return fmt.Errorf("Quiet hours '%s': no output called '%s' to send to", q.Name, s)
+		}
+	}
+	return nil
+}
+
+// holidayDates is the dates given, directly or by the name of a list in 'holidays'.
+func holidayDates(given []string, lists map[string][]string) (map[string]bool, error) {
+	dates := make(map[string]bool)
+	for _, h := range given {
+		list, ok := lists[h]
+		if !ok {
+			list = []string{h}
+		}
+		for _, d := range list {
+			if _, err := time.Parse("2006-01-02", d); err != nil {
+				if !ok {
+					return nil, fmt.Errorf("'%s' is neither a date (2006-01-02) nor a list in 'holidays'", d)
+				}
+				return nil, fmt.Errorf("bad date '%s' in holidays '%s'", d, h)
+			}
+			dates[d] = true
+		}
+	}
+	return dates, nil
+}
+
+// on says whether it is on at now. Caller holds the quietHours' mu, for the window.
+func (q *QuietHours) on(now time.Time) bool {
+	day := now.In(q.zone).Format("2006-01-02")
+	if q.skip[day] {
+		return false
+	}
+	return q.holidays[day] || (q.window != nil && q.window.active(now))
+}
+
+func (q *QuietHours) covers(ev Event) bool {
+	for _, m := range []struct{ pat, v string }{{q.Device, ev.Device}, {q.Object, ev.Object}, {q.Type, ev.Type}} {
+		if m.pat == "" {
+			continue
+		}
+		if ok, _ := path.Match(m.pat, m.v); !ok {
+			return false
+		}
+	}
+	return q.severities == nil || q.severities[ev.Severity]
+}
+
+// sendsTo says whether an event it covers still goes to sink.
+func (q *QuietHours) sendsTo(sink string) bool {
+	if q == nil || len(q.Sinks) == 0 {
+		return true
+	}
+	for _, s := range q.Sinks {
+		if s == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// quietHours are the entries from the config. Safe to use from several goroutines.
+type quietHours struct {
+	mu   sync.Mutex
+	list []*QuietHours
+}
+
+func newQuietHours(cfg []*QuietHours, holidays map[string][]string, known map[string]bool) (*quietHours, error) {
+	for _, q := range cfg {
+		if err := q.compile(holidays, known); err != nil {
+			return nil, err
+		}
+	}
+	return &quietHours{list: cfg}, nil
+}
+
+// match is the quiet hours ev goes by now, or nil.
+func (qh *quietHours) match(ev Event, now time.Time) *QuietHours {
+	if qh == nil || len(qh.list) == 0 {
+		return nil
+	}
+	qh.mu.Lock()
+	defer qh.mu.Unlock()
+	for _, q := range qh.list {
+		if q.covers(ev) && q.on(now) {
+			return q
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// outgoingSink keeps what it is given, topic and all.
+type outgoingSink struct{ got []*Outgoing }
+
+func (s *outgoingSink) Name() string { return "test" }
+
+func (s *outgoingSink) Publish(ctx context.Context, out *Outgoing) error {
+	s.got = append(s.got, out)
+	return nil
+}
+
+func newTestQuietHours(t *testing.T, cfg []*QuietHours, holidays map[string][]string) *quietHours {
+	t.Helper()
+	qh, err := newQuietHours(cfg, holidays, map[string]bool{"mqtt": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qh
+}
+
+// An overnight window is on from its start, in its zone, for its duration; the first entry that covers
+// an event is the one it goes by.
+func TestQuietHoursMatch(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	qh := newTestQuietHours(t, []*QuietHours{
+		{Name: "overnight-critical", Schedule: "0 22 * * *", Duration: "9h", Zone: "Europe/London", Severity: "critical"},
+		{Name: "overnight", Schedule: "0 22 * * *", Duration: "9h", Zone: "Europe/London", Device: "thunder-lab-*"},
+	}, nil)
+	lab := Event{Device: "thunder-lab-1", Severity: "warning"}
+	for _, c := range []struct {
+		at   time.Time
+		ev   Event
+		want string
+	}{
+		{time.Date(2026, 6, 1, 21, 59, 0, 0, london), lab, ""},
+		{time.Date(2026, 6, 1, 22, 0, 0, 0, london), lab, "overnight"},
+		{time.Date(2026, 6, 2, 6, 59, 0, 0, london), lab, "overnight"},
+		{time.Date(2026, 6, 2, 7, 0, 0, 0, london), lab, ""},
+		{time.Date(2026, 6, 2, 3, 0, 0, 0, london), Event{Device: "thunder1", Severity: "warning"}, ""},
+		{time.Date(2026, 6, 2, 3, 0, 0, 0, london), Event{Device: "thunder-lab-1", Severity: "critical"}, "overnight-critical"},
+	} {
+		got := ""
+		if q := qh.match(c.ev, c.at); q != nil {
+			got = q.Name
+		}
+		if got != c.want {
+			t.Errorf("%s at %v: got '%s', want '%s'", c.ev.Device, c.at, got, c.want)
+		}
+	}
+}
+
+// During quiet hours an event goes to their topic, and only to their outputs.
+func TestQuietHoursRouting(t *testing.T) {
+	always := func(sinks ...string) []*QuietHours {
+		return []*QuietHours{{Name: "overnight", Schedule: "* * * * *", Duration: "1m",
+			Topic: "alert/A10Thunder/overnight", Sinks: sinks}}
+	}
+	m := newTestMonitor(t, Configuration{Quiet_Hours: always()})
+	s := &outgoingSink{}
+	m.a.sinks.sinks, m.a.sinks.busy = []Sink{s}, make([]int32, 1)
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	if len(s.got) != 1 {
+		t.Fatalf("%d published", len(s.got))
+	}
+	if out := s.got[0]; out.Topic != "alert/A10Thunder/overnight" || out.Payload["quiet_hours"] != "overnight" {
+		t.Errorf("topic '%s', quiet_hours %v", out.Topic, out.Payload["quiet_hours"])
+	}
+
+	m = newTestMonitor(t, Configuration{Quiet_Hours: always("mqtt")})
+	s = &outgoingSink{}
+	m.a.sinks.sinks, m.a.sinks.busy = []Sink{s}, make([]int32, 1)
+	m.a.process(context.Background(), connRateRecord("thunder1"))
+	if len(s.got) != 0 {
+		t.Errorf("output not in the quiet hours' sinks got %d", len(s.got))
+	}
+}
+
+// A holiday entry is on all day on its dates, and a business hours one is off on the dates it skips.
+func TestQuietHoursHolidays(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	qh := newTestQuietHours(t, []*QuietHours{
+		{Name: "holiday", Holidays: []string{"uk"}, Zone: "Europe/London"},
+		{Name: "business-hours", Schedule: "0 8 * * 1-5", Duration: "10h", Zone: "Europe/London",
+			Skip_Holidays: []string{"uk", "2026-12-24"}},
+	}, map[string][]string{"uk": {"2026-12-25", "2026-12-26"}})
+	ev := Event{Device: "thunder1", Severity: "warning"}
+	for _, c := range []struct {
+		at   time.Time
+		want string
+	}{
+		{time.Date(2026, 12, 23, 12, 0, 0, 0, london), "business-hours"},
+		{time.Date(2026, 12, 24, 12, 0, 0, 0, london), ""},
+		{time.Date(2026, 12, 25, 12, 0, 0, 0, london), "holiday"},
+		{time.Date(2026, 12, 26, 3, 0, 0, 0, london), "holiday"},
+		{time.Date(2026, 12, 23, 20, 0, 0, 0, london), ""},
+	} {
+		got := ""
+		if q := qh.match(ev, c.at); q != nil {
+			got = q.Name
+		}
+		if got != c.want {
+			t.Errorf("at %v: got '%s', want '%s'", c.at, got, c.want)
+		}
+	}
+	if _, err := newQuietHours([]*QuietHours{{Name: "holiday", Holidays: []string{"christmas"}}}, nil, nil); err == nil {
+		t.Error("holidays that are neither a date nor a list")
+	}
+}
@@ -0,0 +1,167 @@
+package monitor
+
+//
+//  quietdevices.go  --  Noticing a Thunder device that has stopped sending Syslog records, since a dead
+//    logging path is an incident too: without it, a device that can't log looks the same as one with
+//    nothing wrong:
+//
+//  "device_silence": { "after": "15m", "devices": ["thunder-prod-1", "thunder-prod-2"], "severity": "critical" }
+//
+//    after     how long without a record is too long. "" (the default) = not watched
+//    devices   devices expected to send, watched from when the agent starts even if they never do. Any
+//              other device is watched from its first record
+//    severity  default critical
+//    topic     default notify_topic + "/device"
+//
+//  A device that goes quiet gets a "device.silent" event, with "last_heard" (RFC 3339, or missing if it
+//  hasn't sent anything since the agent started) and "silent_for". When it sends again, an all-clear
+//  "device.silent.recovered" (severity info, see recovery.go) says how long it was gone. The devices the
+//  filters in 'hosts' drop aren't watched.
+//
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DeviceSilenceConfig holds the 'device_silence' section of the config.
+type DeviceSilenceConfig struct {
+	After    string   `json:"after"`
+	Devices  []string `json:"devices"`
+	Severity string   `json:"severity"`
+	Topic    string   `json:"topic"`
+}
+
+type heardFrom struct {
+	last   time.Time // Zero if never, for the expected devices
+	since  time.Time // When watching started, for those
+	silent bool
+}
+
+type quietDevices struct {
+	after time.Duration
+	rule  *Rule
+
+	mu      sync.Mutex
+	devices map[string]*heardFrom
+}
+
+// newQuietDevices is nil if devices aren't watched.
+func newQuietDevices(cfg DeviceSilenceConfig, now time.Time) (*quietDevices, error) {
+	if cfg.After == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(cfg.After)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("device_silence: bad after '%s'", cfg.After)
+	}
+	if cfg.Severity == "" {
+		cfg.Severity = "critical"
+	}
+	sev, ok := normalizeSeverity(cfg.Severity)
+	if !ok {
+		return nil, fmt.Errorf("device_silence: unknown severity '%s'", cfg.Severity)
+	}
+	rule := &Rule{Name: "device-silence", Type: "device.silent", Severity: sev, Topic: cfg.Topic, subTopic: "device"}
+	if err := rule.compileTopic(); err != nil {
+		return nil, err
+	}
+	q := &quietDevices{after: d, rule: rule, devices: make(map[string]*heardFrom)}
+	for _, dev := range cfg.Devices {
+		q.devices[dev] = &heardFrom{since: now}
+	}
+	return q, nil
+}
+
+// heard notes a record from device. It returns the all-clear to publish if the device had gone silent.
+func (q *quietDevices) heard(device string, now time.Time) (Event, bool) {
+	if q == nil {
+		return Event{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	h, ok := q.devices[device]
+	if !ok {
+		q.devices[device] = &heardFrom{last: now}
+		return Event{}, false
+	}
+	was, silent := h.since, h.silent
+	if !h.last.IsZero() {
+		was = h.last
+	}
+	h.last, h.silent = now, false
+	if !silent {
+		return Event{}, false
+	}
+	ev := q.event(device, h, now)
+	ev.Type = q.rule.Type + ".recovered"
+	ev.Severity, ev.SyslogSeverity = "info", severityLevel("info")
+	ev.Recovered = true
+	ev.Fields["recovered"] = true
+	ev.Fields["recovered_type"] = q.rule.Type
+	ev.Fields["silent_for"] = now.Sub(was).Round(time.Second).String()
+	ev.Message = fmt.Sprintf("Syslog from %s again, after %s", device, now.Sub(was).Round(time.Second))
+	return ev, true
+}
+
+func (q *quietDevices) event(device string, h *heardFrom, now time.Time) Event {
+	ev := Event{Rule: q.rule, Device: device, Type: q.rule.Type, Severity: q.rule.Severity, SyslogSeverity: severityLevel(q.rule.Severity),
+		Time: now, Received: now, Fields: map[string]interface{}{}}
+	if !h.last.IsZero() {
+		ev.Fields["last_heard"] = h.last.UTC().Format(time.RFC3339)
+	}
+	return ev
+}
+
+// check is the devices that have just gone silent, as events.
+func (q *quietDevices) check(now time.Time) []Event {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []Event
+	for device, h := range q.devices {
+		was := h.since
+		if !h.last.IsZero() {
+			was = h.last
+		}
+		if h.silent || now.Sub(was) < q.after {
+			continue
+		}
+		h.silent = true
+		ev := q.event(device, h, now)
+		ev.Fields["silent_for"] = now.Sub(was).Round(time.Second).String()
+		if h.last.IsZero() {
+			ev.Message = fmt.Sprintf("No Syslog from %s since the agent started %s ago", device, now.Sub(was).Round(time.Second))
+		} else {
+			ev.Message = fmt.Sprintf("No Syslog from %s for %s", device, now.Sub(was).Round(time.Second))
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+// watchDevices publishes the events for devices going silent.
+func (a *agent) watchDevices(ctx context.Context) {
+	if a.quietDevices == nil {
+		return
+	}
+	every := a.quietDevices.after / 10
+	if every < time.Second {
+		every = time.Second
+	} else if every > 30*time.Second {
+		every = 30 * time.Second
+	}
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			for _, ev := range a.quietDevices.check(now) {
+				a.emit(ctx, a.config, ev)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package monitor
+
+//
+//  rates.go  --  Event rates per VIP (or other object), for dashboards of how often limits are actually
+//    being hit rather than the discrete alerts. Every interval the events per minute over a rolling window
+//    are published to a metrics topic:
+//
+//  "rates": { "interval": "1m", "window": "5m", "topic": "metrics/A10Thunder/rates", "max_objects": 100 }
+//
+//    interval     how often the rates are published. "" (the default) = no rates
+//    window       the rolling window they are worked out over, to the minute. Default 5m
+//    topic        where they go. Default notify_topic + "/rates"
+//    max_objects  the busiest this many objects are published. Default 100
+//    types        only count these event types. Default every type
+//
+//    { "type": "rates", "window": "5m0s", "until": "...", "objects": 12,
+//      "rates": [ { "hostname": "Testing1", "object": "ws-vip", "type": "conn.rate-limit", "events": 60, "per_minute": 12 }, ... ] }
+//
+//  Every match counts, published or not; summaries, all-clears and drills don't. An object drops out once
+//  it has had no events for a window. The same rates are in the metrics as a10crm_object_events_per_minute.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RatesConfig holds the 'rates' section of the config.
+type RatesConfig struct {
+	Interval    string   `json:"interval"`
+	Window      string   `json:"window"`
+	Topic       string   `json:"topic"`
+	Max_Objects int      `json:"max_objects"`
+	Types       []string `json:"types"`
+}
+
+type rateKey struct {
+	device, object, typ string
+}
+
+// objectRate is one object's rate over the window.
+type objectRate struct {
+	key       rateKey
+	events    uint64
+	perMinute float64
+}
+
+type rates struct {
+	interval time.Duration
+	minutes  int
+	topic    string
+	max      int
+	types    map[string]bool // nil = all
+
+	mu      sync.Mutex
+	objects map[rateKey]*ringCounts
+	last    []objectRate // The last published, for the metrics
+}
+
+// newRates is nil if rates aren't published.
+func newRates(cfg RatesConfig, notifyTopic string) (*rates, error) {
+	if cfg.Interval == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(cfg.Interval)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("Bad rates interval '%s'", cfg.Interval)
+	}
+	window := 5 * time.Minute
+	if cfg.Window != "" {
+		if window, err = time.ParseDuration(cfg.Window); err != nil || window < time.Minute {
+			return nil, fmt.Errorf("Bad rates window '%s', it needs to be a minute or more", cfg.Window)
+		}
+	}
+	r := &rates{interval: d, minutes: int(window / time.Minute), topic: cfg.Topic, max: cfg.Max_Objects, objects: make(map[rateKey]*ringCounts)}
+	if r.topic == "" {
+		r.topic = notifyTopic + "/rates"
+	}
+	if r.max <= 0 {
+		r.max = 100
+	}
+	if len(cfg.Types) > 0 {
+		r.types = make(map[string]bool)
+		for _, t := range cfg.Types {
+			r.types[t] = true
+		}
+	}
+	return r, nil
+}
+
+// add counts an event.
+func (r *rates) add(ev Event, now time.Time) {
+	if r == nil || ev.summary() || ev.Test || (r.types != nil && !r.types[ev.Type]) {
+		return
+	}
+	k := rateKey{ev.Device, ev.Object, ev.Type}
+	r.mu.Lock()
+	m, ok := r.objects[k]
+	if !ok {
+		m = newRingCounts(r.minutes, time.Minute)
+		r.objects[k] = m
+	}
+	m.add(now)
+	r.mu.Unlock()
+}
+
+// take works out the rates at now, busiest first, forgetting the objects with none.
+func (r *rates) take(now time.Time) (top []objectRate, objects int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := make([]objectRate, 0, len(r.objects))
+	for k, m := range r.objects {
+		n := m.sum(now, r.minutes)
+		if n == 0 {
+			delete(r.objects, k)
+			continue
+		}
+		all = append(all, objectRate{key: k, events: n, perMinute: math.Round(float64(n)/float64(r.minutes)*100) / 100})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if a.events != b.events {
+			return a.events > b.events
+		}
+		if a.key.device != b.key.device {
+			return a.key.device < b.key.device
+		}
+		if a.key.object != b.key.object {
+			return a.key.object < b.key.object
+		}
+		return a.key.typ < b.key.typ
+	})
+	top = all
+	if len(top) > r.max {
+		top = top[:r.max]
+	}
+	r.last = top
+	return top, len(all)
+}
+
+func (r *rates) payload(top []objectRate, objects int, now time.Time) map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(top))
+	for _, o := range top {
+		list = append(list, map[string]interface{}{"hostname": o.key.device, "object": o.key.object, "type": o.key.typ, "events": o.events, "per_minute": o.perMinute})
+	}
+	return map[string]interface{}{
+		"type":    "rates",
+		"message": fmt.Sprintf("Event rates for %d objects over %s", objects, time.Duration(r.minutes)*time.Minute),
+		"window":  (time.Duration(r.minutes) * time.Minute).String(),
+		"until":   now.UTC().Format(time.RFC3339),
+		"objects": objects,
+		"rates":   list,
+	}
+}
+
+// publishRates publishes the rates every interval.
+func (a *agent) publishRates(ctx context.Context) {
+	if a.rates == nil {
+		return
+	}
+	tick := time.NewTicker(a.rates.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			top, objects := a.rates.take(now)
+			if a.client == nil {
+				continue // Still worked out, for the metrics
+			}
+			payload := a.rates.payload(top, objects, now)
+			addTags(payload, a.config.Tags)
+			text, _ := json.Marshal(payload)
+			if err := a.publishMQTT(ctx, a.rates.topic, 0, text); err != nil {
+				reportError(a.config.Debug, timeoutCode(err, errDeliverMQTT, errDeliverMQTTTime), "Rates Publish Error: "+err.Error())
+			}
+		}
+	}
+}
+
+// writeMetrics adds the rates last worked out, see metrics.go.
+func (r *rates) writeMetrics(p *promWriter) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	last := r.last
+	r.mu.Unlock()
+	for _, o := range last {
+		p.metric("a10crm_object_events_per_minute", "gauge", "Events per minute for each object over the rates window.", fmt.Sprintf(`device="%s",object="%s",type="%s"`, promLabel(o.key.device), promLabel(o.key.object), promLabel(o.key.typ)), o.perMinute)
+	}
+}
@@ -0,0 +1,180 @@
+package monitor
+
+//
+//  reassemble.go  --  Puts messages that ACOS splits over several Syslog records (config audit entries, long
+//    aFleX errors) back together, so rules see one record. Records are held for a moment per device and tag;
+//    those that come in meanwhile looking like continuations are added to the held one, and it goes on
+//    once something else arrives from there or the timeout passes.
+//
+//  "reassemble": { "timeout_ms": 500, "start": "(?i)^(?:config|aflex)", "continuation": "^(?:\\s|\\.\\.\\.)",
+//                  "max_lines": 50 }
+//
+//  Only records whose message matches 'start' are held (default: all of them), which keeps the delay off
+//  everything else. 'continuation' is checked against the message with any "[MODULE]<n>" prefix removed;
+//  the default takes records starting with white space, "...", or "(cont)". The parts are joined with a
+//  space. A timeout_ms of 0 (the default) turns reassembly off.
+//
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// ReassembleConfig holds the 'reassemble' section of the config.
+type ReassembleConfig struct {
+	Timeout_Ms   int    `json:"timeout_ms"`
+	Start        string `json:"start"`
+	Continuation string `json:"continuation"`
+	Max_Lines    int    `json:"max_lines"` // Default 50
+}
+
+const defaultContinuation = `^(?:\s|\.\.\.|\(cont(?:inued)?\))`
+
+var modulePrefix = regexp.MustCompile(`^\[\w+\]<\d+> ?`)
+
+// reassembledKey marks a record coming back from the reassembler, so it isn't held again.
+const reassembledKey = "reassembled"
+
+type heldRecord struct {
+	parts format.LogParts
+	lines []string
+	at    time.Time
+}
+
+type reassembler struct {
+	timeout time.Duration
+	start   *regexp.Regexp
+	cont    *regexp.Regexp
+	max     int
+
+	mu   sync.Mutex
+	held map[string]*heldRecord
+}
+
+func newReassembler(cfg ReassembleConfig) (*reassembler, error) {
+	if cfg.Timeout_Ms <= 0 {
+		return nil, nil
+	}
+	r := &reassembler{timeout: time.Duration(cfg.Timeout_Ms) * time.Millisecond, max: cfg.Max_Lines, held: make(map[string]*heldRecord)}
+	if r.max <= 0 {
+		r.max = 50
+	}
+	if cfg.Start != "" {
+		re, err := regexp.Compile(cfg.Start)
+		if err != nil {
+			return nil, fmt.Errorf("Bad reassemble start regex: %v", err)
+		}
+		r.start = re
+	}
+	if cfg.Continuation == "" {
+		cfg.Continuation = defaultContinuation
+	}
+	re, err := regexp.Compile(cfg.Continuation)
+	if err != nil {
+		return nil, fmt.Errorf("Bad reassemble continuation regex: %v", err)
+	}
+	r.cont = re
+	return r, nil
+}
+
+func reassembleKey(lp format.LogParts) string {
+	host := fmt.Sprintf("%s", lp["hostname"])
+	if host == "" {
+		host = clientHost(fmt.Sprintf("%s", lp["client"]))
+	}
+	return fmt.Sprintf("%s\x00%v", host, lp["tag"])
+}
+
+// add takes a record in, returning the records ready to be processed.
+func (r *reassembler) add(lp format.LogParts, now time.Time) []format.LogParts {
+	if r == nil {
+		return []format.LogParts{lp}
+	}
+	if _, ok := lp[reassembledKey]; ok {
+		return []format.LogParts{lp}
+	}
+	key := reassembleKey(lp)
+	content := fmt.Sprintf("%s", lp["content"])
+	msg := content
+	if loc := modulePrefix.FindStringIndex(content); loc != nil {
+		msg = content[loc[1]:] // Unlike splitMessage, keeps leading white space that may mark a continuation
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.held[key]
+	if h != nil && r.cont.MatchString(msg) {
+		h.lines = append(h.lines, strings.TrimSpace(r.cont.ReplaceAllString(msg, "")))
+		if len(h.lines) >= r.max {
+			delete(r.held, key)
+			return []format.LogParts{h.record()}
+		}
+		return nil
+	}
+	var out []format.LogParts
+	if h != nil {
+		delete(r.held, key)
+		out = append(out, h.record())
+	}
+	if r.start != nil && !r.start.MatchString(strings.TrimSpace(msg)) {
+		return append(out, lp)
+	}
+	r.held[key] = &heldRecord{parts: lp, lines: []string{content}, at: now}
+	return out
+}
+
+// record is the held record with its continuations added.
+func (h *heldRecord) record() format.LogParts {
+	lp := make(format.LogParts, len(h.parts)+1)
+	for k, v := range h.parts {
+		lp[k] = v
+	}
+	lp["content"] = strings.Join(h.lines, " ")
+	lp[reassembledKey] = len(h.lines)
+	return lp
+}
+
+// expired takes out the records held for longer than the timeout.
+func (r *reassembler) expired(now time.Time) []format.LogParts {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []format.LogParts
+	for k, h := range r.held {
+		if now.Sub(h.at) >= r.timeout {
+			delete(r.held, k)
+			out = append(out, h.record())
+		}
+	}
+	return out
+}
+
+// reassembleTimeouts sends held records on once their time is up. They go back through the channel, so
+// only the consumer ever processes records.
+func (a *agent) reassembleTimeouts(ctx context.Context) {
+	if a.reassembler == nil {
+		return
+	}
+	tick := time.NewTicker(a.reassembler.timeout / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			for _, lp := range a.reassembler.expired(now) {
+				atomic.AddUint64(&a.received, 1) // Keeps the watchdog's sums right
+				select {
+				case a.channel <- lp:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
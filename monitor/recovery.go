@@ -0,0 +1,112 @@
+package monitor
+
+//
+//  recovery.go  --  All-clear events, so downstream systems can resolve an incident themselves instead of
+//    leaving it open for ever. A rule with "recover" publishes a recovered event for an object (VIP,
+//    server, ...) on a device once it has gone that long without matching again:
+//
+//    { "name": "conn-rate-limit", "recover": "5m" }
+//
+//  The recovered event is the last one again, with "<type>.recovered" as its type, severity info,
+//  "recovered": true, "recovered_type", "event_count", "first_seen" and "last_seen". It goes to the rule's
+//  topic. Matches held back by suppression or below a threshold keep the incident open, but one that never
+//  got past a threshold, so was never alerted on, gets no all-clear. Recovering also ends the object's
+//  suppression window, so the next incident is published straight away.
+//
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type incident struct {
+	ev          Event
+	first, last time.Time
+	count       int
+}
+
+// recoveries are the incidents that will get an all-clear. Safe to use from several goroutines.
+type recoveries struct {
+	mu        sync.Mutex
+	incidents map[string]*incident
+}
+
+func newRecoveries() *recoveries {
+	return &recoveries{incidents: make(map[string]*incident)}
+}
+
+// seen notes a match. alerted says whether it was alerted on, which is what opens an incident; other
+// matches only keep an open one going.
+func (r *recoveries) seen(ev Event, alerted bool, now time.Time) {
+	if ev.Rule == nil || ev.Rule.recover <= 0 {
+		return
+	}
+	key := suppressKey(ev.Device, ev.Type, ev.Object)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	inc, ok := r.incidents[key]
+	if !ok {
+		if !alerted {
+			return
+		}
+		inc = &incident{first: now}
+		r.incidents[key] = inc
+	}
+	inc.ev, inc.last = ev, now
+	inc.count++
+}
+
+// closed takes out the incidents that have been quiet for long enough, returning their recovered events.
+func (r *recoveries) closed(now time.Time) []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []Event
+	for k, inc := range r.incidents {
+		if now.Sub(inc.last) < inc.ev.Rule.recover {
+			continue
+		}
+		delete(r.incidents, k)
+		ev := inc.ev
+		ev.Fields = make(map[string]interface{}, len(inc.ev.Fields)+5)
+		for k, v := range inc.ev.Fields {
+			ev.Fields[k] = v
+		}
+		ev.Fields["recovered"] = true
+		ev.Fields["recovered_type"] = inc.ev.Type
+		ev.Fields["event_count"] = inc.count
+		ev.Fields["first_seen"] = inc.first.UTC().Format(time.RFC3339)
+		ev.Fields["last_seen"] = inc.last.UTC().Format(time.RFC3339)
+		ev.Type = inc.ev.Type + ".recovered"
+		ev.Severity, ev.SyslogSeverity = "info", severityLevel("info")
+		ev.Recovered = true
+		ev.Deadline = time.Time{}
+		obj := inc.ev.Object
+		if obj == "" {
+			obj = inc.ev.Device
+		}
+		ev.Message = fmt.Sprintf("%s recovered: no %s for %s", obj, inc.ev.Type, inc.ev.Rule.recover)
+		out = append(out, ev)
+	}
+	return out
+}
+
+// recoverySummaries publishes the recovered events as the incidents go quiet.
+func (a *agent) recoverySummaries(ctx context.Context) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			for _, ev := range a.recovery.closed(now) {
+				key := suppressKey(ev.Device, ev.Fields["recovered_type"].(string), ev.Object)
+				a.suppress.Reset(key)
+				a.suppress.recovered(key, now)
+				a.emit(ctx, a.config, ev)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package monitor
+
+//
+//  redact.go  --  Redaction of personal data before anything leaves the agent. Some log lines carry client
+//    addresses, user names and URIs that mustn't go to a shared broker, so 'redact' rules are applied to
+//    every event before MQTT, the output plugins or Grafana see it:
+//
+//  "redact": [ { "fields": ["client_ip", "message"], "action": "mask_ip" },
+//              { "fields": ["user"], "action": "hash", "key": "$A10_REDACT_KEY" },
+//              { "fields": ["uri", "message"], "action": "strip_query" },
+//              { "fields": ["cookie"], "action": "remove" } ]
+//
+//  mask_ip      zeroes the host part of every IP address in the field (the last octet of IPv4, the last
+//               64 bits of IPv6), so "10.1.2.3" becomes "10.1.2.0"
+//  hash         replaces the field with its HMAC-SHA256 under 'key' (a "$NAME" key is read from the
+//               environment). Without a key it is plain SHA-256, which is easily reversed for short values
+//  strip_query  drops the query string from every URL or path in the field
+//  remove       takes the field out altogether
+//
+//  "fields": ["*"] means every field. Rules are applied in order.
+//
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RedactRule is one entry of the 'redact' section of the config.
+type RedactRule struct {
+	Fields []string `json:"fields"`
+	Action string   `json:"action"` // mask_ip, hash, strip_query or remove
+	Key    string   `json:"key"`    // For hash
+}
+
+var (
+	textIPv4   = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	textIPv6   = regexp.MustCompile(`[0-9a-fA-F]*:[0-9a-fA-F:.]*:[0-9a-fA-F.]*`)
+	textQuery  = regexp.MustCompile(`(\S)\?[^\s"'<>]*`)
+	redactions = map[string]bool{"mask_ip": true, "hash": true, "strip_query": true, "remove": true}
+)
+
+type redactor struct {
+	rules []RedactRule
+}
+
+func newRedactor(rules []RedactRule) (*redactor, error) {
+	for i := range rules {
+		r := &rules[i]
+		if !redactions[r.Action] {
+			return nil, fmt.Errorf("Unknown redact action '%s'", r.Action)
+		}
+		if len(r.Fields) == 0 {
+			return nil, fmt.Errorf("Redact rule %d (%s) has no fields", i+1, r.Action)
+		}
+		if strings.HasPrefix(r.Key, "$") {
+			r.Key = os.Getenv(r.Key[1:])
+		}
+	}
+	return &redactor{rules: rules}, nil
+}
+
+// maskIPs masks every IP address in a piece of text.
+func maskIPs(s string) string {
+	s = textIPv4.ReplaceAllStringFunc(s, maskIP)
+	return textIPv6.ReplaceAllStringFunc(s, maskIP)
+}
+
+func (r *RedactRule) redact(payload map[string]interface{}, field string) {
+	v, ok := payload[field]
+	if !ok {
+		return
+	}
+	s, isString := v.(string)
+	switch r.Action {
+	case "remove":
+		delete(payload, field)
+	case "hash":
+		s = fmt.Sprint(v)
+		if r.Key != "" {
+			payload[field] = fmt.Sprintf("%x", hmacSHA256([]byte(r.Key), s))
+		} else {
+			payload[field] = sha256Hex([]byte(s))
+		}
+	case "mask_ip":
+		if isString {
+			payload[field] = maskIPs(s)
+		}
+	case "strip_query":
+		if isString {
+			payload[field] = textQuery.ReplaceAllString(s, "$1")
+		}
+	}
+}
+
+// apply redacts an event in place.
+func (rd *redactor) apply(payload map[string]interface{}) {
+	if rd == nil {
+		return
+	}
+	for i := range rd.rules {
+		r := &rd.rules[i]
+		for _, f := range r.Fields {
+			if f != "*" {
+				r.redact(payload, f)
+				continue
+			}
+			for k := range payload {
+				r.redact(payload, k)
+			}
+		}
+	}
+}
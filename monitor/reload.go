@@ -0,0 +1,100 @@
+package monitor
+
+//
+//  reload.go  --  Reloading the rules file without a restart. Send the agent a SIGHUP, or set 'rules_watch'
+//    (seconds) in the config to have it check the file for changes that often. The new rules are compiled
+//    first and swapped in all at once, so records keep flowing and a broken rules file just leaves the old
+//    rules in place. Correlations (see correlate.go) start over from nothing.
+//
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ruleState is everything that comes from the rules file.
+type ruleState struct {
+	rules      RuleSet
+	drops      dropRules
+	correlator *correlator
+	loaded     time.Time
+}
+
+// loadRuleState loads the config's rules file, checking it against the outputs there are (see sinks.go).
+// The file is read once, so the rules, correlations and drops all come from the same version of it.
+func loadRuleState(config *Configuration) (*ruleState, error) {
+	rf, err := readRulesFile(config.Rules_File)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := buildRules(rf)
+	if err != nil {
+		return nil, err
+	}
+	correlations, err := loadCorrelations(rf)
+	if err != nil {
+		return nil, err
+	}
+	drops, err := loadDropRules(rf)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSinks(rules, correlations, sinkNames(config)); err != nil {
+		return nil, err
+	}
+	return &ruleState{rules: rules, drops: drops, correlator: newCorrelator(correlations, config.Services), loaded: time.Now()}, nil
+}
+
+// currentRules is the rule state in use. The consumer calls it once per record.
+func (a *agent) currentRules() *ruleState {
+	return a.ruleState.Load().(*ruleState)
+}
+
+func (a *agent) reloadRules() error {
+	rs, err := loadRuleState(&a.config)
+	if err != nil {
+		return err
+	}
+	if err := checkSharedTopics(&a.config, rs); err != nil {
+		return err
+	}
+	a.ruleState.Store(rs)
+	fmt.Printf(">>> Rules reloaded from %s: %d rules\n", a.config.Rules_File, len(rs.rules))
+	return nil
+}
+
+// watchRules reloads the rules on SIGHUP, and when the file changes if 'rules_watch' is set.
+func (a *agent) watchRules(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if a.config.Rules_Watch > 0 && a.config.Rules_File != "" {
+		tick = time.Tick(time.Duration(a.config.Rules_Watch) * time.Second)
+	}
+	var lastMod time.Time
+	if fi, err := os.Stat(a.config.Rules_File); err == nil {
+		lastMod = fi.ModTime()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			fi, err := os.Stat(a.config.Rules_File)
+			if err != nil || !fi.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = fi.ModTime()
+		}
+		if err := a.reloadRules(); err != nil {
+			countError(errParseRules)
+			fmt.Println(">>> [" + errParseRules + "] Rules not reloaded, keeping the old ones: " + err.Error())
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package monitor
+
+import "testing"
+
+// The rules, correlations and drops all come out of the one read of the rules file.
+func TestLoadRuleState(t *testing.T) {
+	fn := writeRulesFile(t, `{ "builtin": false,
+		"patterns": { "HM": "Health monitor %{NOTSPACE:monitor}" },
+		"rules": [ { "name": "hm", "regex": "^%{HM} failed" } ],
+		"correlations": [ { "name": "two", "when": ["event.type == \"hm\"", "event.type == \"hm\""], "window": "1m" } ],
+		"drop": [ { "name": "lab", "regex": "^%{HM} " , "hostname": "thunder-lab" } ] }`)
+	rs, err := loadRuleState(&Configuration{Rules_File: fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.rules) != 1 || rs.rules[0].Name != "hm" {
+		t.Errorf("rules %v", rs.rules)
+	}
+	if len(rs.drops) != 1 || rs.drops[0].Name != "lab" {
+		t.Errorf("drops %v", rs.drops)
+	}
+	if len(rs.correlator.rules) != 1 || rs.correlator.rules[0].Name != "two" {
+		t.Errorf("correlations %v", rs.correlator.rules)
+	}
+
+	// A file that doesn't parse is one error, whichever part it is in
+	if _, err := loadRuleState(&Configuration{Rules_File: writeRulesFile(t, `{ "drop": [ `)}); err == nil {
+		t.Error("broken rules file loaded")
+	}
+}
@@ -0,0 +1,179 @@
+package monitor
+
+//
+//  report.go  --  A periodic report of the VIPs (and other objects) and devices with the most matches, for
+//    capacity planning: which services keep hitting their limits, rather than what is alerting now:
+//
+//  "report": { "interval": "24h", "top": 10, "types": ["conn.rate-limit"], "topic": "reports/A10Thunder" }
+//
+//    interval  how often a report is published, and the period it covers. "" (the default) = no reports
+//    top       how many objects and devices are listed. Default 10
+//    types     only count these event types. Default every type
+//    topic     where it goes. Default notify_topic + "/report"
+//
+//  Like a digest (see digest.go), every match counts, whether or not it was published, and summaries,
+//  all-clears and drills don't. The report is sent even for a quiet period:
+//
+//    { "type": "report", "message": "Top 10 of 212 objects, 1840 events in 24h0m0s", "from": "...", "until": "...",
+//      "total": 1840, "objects": 212, "devices": 4,
+//      "top_objects": [ { "hostname": "Testing1", "object": "ws-vip", "count": 960, "share": 0.52 }, ... ],
+//      "top_devices": [ { "hostname": "Testing1", "count": 1320, "share": 0.72 }, ... ] }
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReportConfig holds the 'report' section of the config.
+type ReportConfig struct {
+	Interval string   `json:"interval"`
+	Top      int      `json:"top"`
+	Types    []string `json:"types"`
+	Topic    string   `json:"topic"`
+}
+
+type reportKey struct {
+	device, object string
+}
+
+type reporter struct {
+	interval time.Duration
+	top      int
+	types    map[string]bool // nil = all
+	topic    string
+
+	mu      sync.Mutex
+	from    time.Time
+	objects map[reportKey]int
+}
+
+// newReporter is nil if there are no reports.
+func newReporter(cfg ReportConfig, notifyTopic string) (*reporter, error) {
+	if cfg.Interval == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(cfg.Interval)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("Bad report interval '%s'", cfg.Interval)
+	}
+	r := &reporter{interval: d, top: cfg.Top, topic: cfg.Topic, from: time.Now(), objects: make(map[reportKey]int)}
+	if r.top <= 0 {
+		r.top = 10
+	}
+	if r.topic == "" {
+		r.topic = notifyTopic + "/report"
+	}
+	if len(cfg.Types) > 0 {
+		r.types = make(map[string]bool)
+		for _, t := range cfg.Types {
+			r.types[t] = true
+		}
+	}
+	return r, nil
+}
+
+// add counts an event.
+func (r *reporter) add(ev Event) {
+	if r == nil || ev.summary() || ev.Test || (r.types != nil && !r.types[ev.Type]) {
+		return
+	}
+	r.mu.Lock()
+	r.objects[reportKey{ev.Device, ev.Object}]++
+	r.mu.Unlock()
+}
+
+// share is n out of total, to two places.
+func share(n int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(n)/float64(total)*100) / 100
+}
+
+// take builds the report up to now and starts the next one.
+func (r *reporter) take(now time.Time) map[string]interface{} {
+	r.mu.Lock()
+	objects, from := r.objects, r.from
+	r.objects, r.from = make(map[reportKey]int), now
+	r.mu.Unlock()
+
+	total := 0
+	devices := make(map[string]int)
+	keys := make([]reportKey, 0, len(objects))
+	for k, n := range objects {
+		total += n
+		devices[k.device] += n
+		if k.object != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if objects[a] != objects[b] {
+			return objects[a] > objects[b]
+		}
+		if a.device != b.device {
+			return a.device < b.device
+		}
+		return a.object < b.object
+	})
+	names := make([]string, 0, len(devices))
+	for d := range devices {
+		names = append(names, d)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if devices[names[i]] != devices[names[j]] {
+			return devices[names[i]] > devices[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	topObjects := make([]map[string]interface{}, 0, r.top)
+	for i := 0; i < len(keys) && i < r.top; i++ {
+		k := keys[i]
+		topObjects = append(topObjects, map[string]interface{}{"hostname": k.device, "object": k.object, "count": objects[k], "share": share(objects[k], total)})
+	}
+	topDevices := make([]map[string]interface{}, 0, r.top)
+	for i := 0; i < len(names) && i < r.top; i++ {
+		topDevices = append(topDevices, map[string]interface{}{"hostname": names[i], "count": devices[names[i]], "share": share(devices[names[i]], total)})
+	}
+	return map[string]interface{}{
+		"type":        "report",
+		"message":     fmt.Sprintf("Top %d of %d objects, %d events in %s", len(topObjects), len(keys), total, now.Sub(from).Round(time.Second)),
+		"from":        from.UTC().Format(time.RFC3339),
+		"until":       now.UTC().Format(time.RFC3339),
+		"total":       total,
+		"objects":     len(keys),
+		"devices":     len(devices),
+		"top_objects": topObjects,
+		"top_devices": topDevices,
+	}
+}
+
+// reports publishes a report every interval.
+func (a *agent) reports(ctx context.Context) {
+	if a.report == nil || a.client == nil {
+		return
+	}
+	tick := time.NewTicker(a.report.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			payload := a.report.take(now)
+			addTags(payload, a.config.Tags)
+			text, _ := json.Marshal(payload)
+			if err := a.publishMQTT(ctx, a.report.topic, 1, text); err != nil {
+				reportError(a.config.Debug, timeoutCode(err, errDeliverMQTT, errDeliverMQTTTime), "Report Publish Error: "+err.Error())
+			}
+		}
+	}
+}
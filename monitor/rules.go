@@ -0,0 +1,732 @@
+package monitor
+
+//
+//  rules.go  --  The rule engine that decides which Syslog records are interesting, and what gets
+//    pulled out of them. Rules come from the built-in list below, plus an optional rules file.
+//
+//  A rules file looks like:
+//
+//  {
+//    "builtin": true,
+//    "rules": [
+//      { "name": "vport-rate-limit",
+//        "module": "ACOS",
+//        "regex": "^Virtual port (?P<vport>\\S+) connection rate limit (?P<limit>\\d+) exceeded",
+//        "fields": ["vport", "limit:int"],
+//        "severity": "warning",
+//        "topic": "alert/A10Thunder/vport" }
+//    ]
+//  }
+//
+//  "suppress": "5m" on a rule publishes the first match per object (VIP etc.) per device, and only counts
+//  the rest until five minutes have passed; see suppress.go.
+//
+//  "threshold": { "count": 5, "within": "60s" } only publishes once an object has matched five times in
+//  60 seconds, so a momentary blip doesn't page anyone; see suppress.go. The config's 'thresholds' can
+//  override it for particular VIPs and devices, see thresholds.go.
+//
+//  "recover": "5m" publishes an all-clear for an object once it has gone five minutes without matching;
+//  see recovery.go.
+//
+//  "escalate" raises the severity of, re-routes or adds outputs for an object that keeps alerting; see
+//  paging.go.
+//
+//  A rule can also have a "filter" expression (see expr.go) that is checked against the parsed event,
+//  e.g. "filter": "event.limit >= 500 && event.hostname.startsWith(\"prod-\")".
+//
+//  "set" fills in (or overwrites) payload fields from templates, and "topic" can be one too, e.g.
+//  "set": { "client_ip": "{{maskIP .client_ip}}" }; see templates.go for the functions.
+//
+//  "sinks" sends a rule's matches to only some of the outputs, e.g. "sinks": ["mqtt"]; see sinks.go.
+//
+//  Records that should never get as far as the rules (known noise) can be thrown away with "drop"
+//  rules alongside "rules"; see drops.go.
+//
+//  Field types are int, float, lower, slug (lower case, spaces to dashes) and updown (maps words like
+//  "failed" and "recovered" to "down" and "up"), onoff (likewise "enabled"/"disabled" to "on"/"off") and
+//  allocfree ("allocated"/"released" to "alloc"/"free").
+//
+//  Rules are tried in order (built-ins first) and the first one that matches wins. A rule in the
+//  file with the same name as a built-in rule is laid over the top of it, so you only need to give
+//  the parts you want to change, e.g. { "name": "conn-rate-limit", "topic": "alert/ratelimit" }, or
+//  { "name": "aflex-http-error", "enabled": true } to turn on a built-in rule that is off by default.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Rule describes one kind of log record to watch for.
+type Rule struct {
+	Name          string                       `json:"name"`
+	Type          string                       `json:"type"`            // Event type published, e.g. "server.state". Defaults to the name
+	Module        string                       `json:"module"`          // Only match records from this module, e.g. "ACOS" or "AFLEX"
+	Regex         string                       `json:"regex"`           // Named groups (?P<name>...) become payload fields. May use %{PATTERN}s, see patterns.go
+	Pattern       string                       `json:"pattern"`         // A named pattern to use as the regex, e.g. "ACOS_CONN_RATE"
+	Contains      []string                     `json:"contains"`        // Simpler than a regex: all of these must appear in the message
+	Fields        []string                     `json:"fields"`          // Groups to publish, as "name" or "name:type". Empty = all of them
+	Severity      string                       `json:"severity"`        // Defaults to the Syslog severity of the record
+	Topic         string                       `json:"topic"`           // Defaults to notify_topic. May be a template, see templates.go
+	Filter        string                       `json:"filter"`          // Optional expression on the parsed event, see expr.go
+	Enabled       *bool                        `json:"enabled"`         // Set false to turn a rule off (default true)
+	Suppress      string                       `json:"suppress"`        // e.g. "5m": publish once per object per window, see suppress.go
+	Threshold     *Threshold                   `json:"threshold"`       // Only publish after this many matches per object, see suppress.go
+	Recover       string                       `json:"recover"`         // e.g. "5m": publish an all-clear after that long without a match, see recovery.go
+	Escalate      *EscalatePolicy              `json:"escalate"`        // Steps for an object that keeps alerting, see paging.go
+	Flap          *FlapPolicy                  `json:"flap"`            // One alert for an object flapping up and down, see flaps.go
+	Magnitude     *MagnitudePolicy             `json:"magnitude"`       // Severity by how far over the limit it is, see magnitude.go
+	Runbook       string                       `json:"runbook"`         // Link added to the payload, see runbooks.go
+	Remediation   string                       `json:"remediation"`     // Short hint added to the payload
+	Set           map[string]string            `json:"set"`             // Payload fields from templates over the event, see templates.go
+	SetBySeverity map[string]map[string]string `json:"set_by_severity"` // More of them, by the severity it is published with
+	Sinks         []string                     `json:"sinks"`           // Outputs to send matches to, e.g. ["mqtt", "servicenow"]. Empty = all. See sinks.go
+
+	re       *regexp.Regexp
+	topic    *template.Template // If Topic is a template
+	set      map[string]*template.Template
+	bySev    []severitySet // Most severe first
+	suppress time.Duration
+	recover  time.Duration
+	filter   *Expr
+	subTopic string                                     // Built-in rules with their own topic under notify_topic
+	object   func(fields map[string]interface{}) string // Built-in rules whose object_name is made of other fields
+	flapRule *Rule                                      // What flapping and stable events go out under, with Flap
+}
+
+// RulesFile is the layout of the file pointed to by 'rules_file' in the config.
+type RulesFile struct {
+	Builtin      *bool             `json:"builtin"` // Include the built-in rules (default true)
+	Rules        []json.RawMessage `json:"rules"`
+	Correlations []*Correlation    `json:"correlations"` // See correlate.go
+	Patterns     map[string]string `json:"patterns"`     // Named patterns for the rules' regexes, see patterns.go
+	Drop         []*DropRule       `json:"drop"`         // Records to throw away before matching, see drops.go
+}
+
+// connRateRegex is the conn-rate-limit rule's regex. The message is worded differently between ACOS 4.x
+// and 5.x, and again where the CLI-style object names are used; all of these are taken (one of each is in
+// examples/samples/conn-rate.log, for 'rules test'):
+//
+//	Virtual server ws-vip connection rate limit 100 exceeded
+//	Virtual server ws-vip connection rate limit 100 exceeded, dropping
+//	Virtual server ws-vip: connection rate limit exceeded (limit 100), drop
+//	virtual-server ws-vip conn-rate-limit 100 cps exceeded
+//	Connection rate limit 100 exceeded for virtual port ws-vip-443
+//	Virtual server ws-vip exceeded its connection rate limit of 100
+//	Virtual server ws-vip connection rate 150 exceeded limit 100
+//
+// Where the message gives the rate that went over the limit, as in the last one or with "(current 150)"
+// after any of the others, it is the "rate" field.
+var connRateRegex = `(?i)^(?:` +
+	// <object> <name> connection rate <rate> exceeded [its] limit [of] <limit>. First, since the next one
+	// would take the rate for the limit
+	`(?:slb\s+)?` + connRateObject + `\s+(?P<object_name>[^\s,;()]+?):?\s+conn(?:ection)?[\s-]rate\s+(?P<rate>\d+)` + connRatePer + `\s+exceed(?:ed|s)\s+(?:its\s+|the\s+)?(?:rate\s+)?limit\s+(?:of\s+)?` + connRateLimit +
+	`|` +
+	// <object> <name> connection rate limit <limit> exceeded [(limit <limit>)] [, <action>]
+	`(?:slb\s+)?` + connRateObject + `\s+(?P<object_name>[^\s,;()]+?):?\s+` + connRateWords + `(?:\s+` + connRateLimit + `)?\s+exceeded` +
+	`(?:\s+\((?:limit\s+)?(?P<limit>\d+)[^)]*\))?` + connRateCurrent +
+	`|` +
+	// connection rate limit <limit> exceeded for <object> <name>
+	connRateWords + `(?:\s+` + connRateLimit + `)?\s+exceeded\s+(?:for|on|by)\s+` + connRateObject + `\s+(?P<object_name>[^\s,;:()]+)` + connRateCurrent +
+	`|` +
+	// <object> <name> exceeded its connection rate limit of <limit>
+	`(?:slb\s+)?` + connRateObject + `\s+(?P<object_name>[^\s,;()]+?):?\s+exceeded\s+(?:its\s+|the\s+)?` + connRateWords + `(?:\s+(?:of\s+)?` + connRateLimit + `)?` + connRateCurrent +
+	`)(?:\s*[,:;]\s*(?:and\s+)?(?P<action>[a-z]+)|\s+(?P<action>dropping|dropped|drop|reset(?:ting)?|reject(?:ed|ing)?))?`
+
+const connRateObject = `(?P<object_type>virtual[\s-]server|virtual[\s-]port|server[\s-]port|server)`
+const connRateWords = `conn(?:ection)?[\s-]rate(?:[\s-]limit)?`
+const connRateLimit = `\(?(?P<limit>\d+)` + connRatePer + `\)?`
+const connRatePer = `(?:\s*(?:cps|/s(?:ec)?|per\s+sec(?:ond)?))?`
+const connRateCurrent = `(?:\s*[(,]\s*(?:current(?:\s+rate)?|rate|actual)\s*:?\s*(?P<rate>\d+)` + connRatePer + `\)?)?`
+
+// builtinRules are what the agent watches for out of the box.
+var builtinRules = []Rule{
+	{
+		Name:      "conn-rate-limit",
+		Type:      "conn.rate-limit",
+		Module:    "ACOS",
+		Regex:     connRateRegex,
+		Fields:    []string{"object_type:slug", "object_name", "limit:int", "rate:int", "action:lower"},
+		Severity:  "warning",
+		Magnitude: &MagnitudePolicy{},
+	},
+	{
+		// Same again for the concurrent connection limit: "Virtual server ws-vip connection limit 1000 exceeded"
+		Name:     "conn-limit",
+		Type:     "conn.limit",
+		Module:   "ACOS",
+		Regex:    `(?i)^(?P<object_type>virtual server|virtual port|server port|server)\s+(?P<object_name>\S+)\s+(?:concurrent\s+)?conn(?:ection)?s?\s+limit\s+(?P<limit>\d+)\s+exceeded(?:[,:]?\s+(?P<action>\w+))?`,
+		Fields:   []string{"object_type:slug", "object_name", "limit:int", "action:lower"},
+		Severity: "warning",
+	},
+	{
+		// "Server s1 (10.1.1.5) state changed to DOWN", "Server s1 port 80 is now up"
+		Name:   "server-state",
+		Type:   "server.state",
+		Module: "ACOS",
+		Regex:  `(?i)^(?:slb\s+)?(?P<object_type>server)\s+(?P<object_name>\S+)(?:\s+\((?P<address>[^)]+)\))?(?:\s+port\s+(?P<port>\d+))?\s+(?:state\s+(?:has\s+)?(?:been\s+)?changed\s+to|is(?:\s+now)?)\s+(?P<state>up|down)\b`,
+		Fields: []string{"object_type:lower", "object_name", "address", "port:int", "state:lower"},
+		Flap:   &FlapPolicy{},
+	},
+	{
+		// "Virtual server ws-vip state changed to DOWN", "Virtual server ws-vip port 443 is up"
+		Name:   "vip-state",
+		Type:   "vip.state",
+		Module: "ACOS",
+		Regex:  `(?i)^(?P<object_type>virtual server|virtual port)\s+(?P<object_name>\S+)(?:\s+port\s+(?P<port>\d+))?\s+(?:state\s+(?:has\s+)?(?:been\s+)?changed\s+to|is(?:\s+now)?)\s+(?P<state>up|down)\b`,
+		Fields: []string{"object_type:slug", "object_name", "port:int", "state:lower"},
+		Flap:   &FlapPolicy{},
+	},
+	{
+		// "Health monitor hm-http failed for server s1 port 80", "Health check hm-http on server s1:80 recovered"
+		Name:   "health-monitor",
+		Type:   "hm.state",
+		Module: "ACOS",
+		Regex:  `(?i)^health\s+(?:monitor|check)\s+(?P<monitor>\S+)\s+(?:(?P<state>failed|recovered|succeeded|passed)\s+)?(?:for|on)\s+server\s+(?P<server>[^\s:]+)(?::(?P<port>\d+)|\s+port\s+(?P<port>\d+))?(?:\s+(?:is\s+)?(?P<state>failed|down|recovered|succeeded|passed|up)\b)?`,
+		Fields: []string{"monitor", "server", "port:int", "state:updown"},
+		object: healthMonitorObject,
+	},
+	// -- DDoS protection. These go to notify_topic + "/ddos" unless the rule is given a topic.
+	{
+		// "SYN cookie enabled on virtual server ws-vip", "SYN-cookie has been deactivated on port ethernet1"
+		Name:     "ddos-syn-cookie",
+		Type:     "ddos.syn-cookie",
+		Regex:    `(?i)^syn[- ]cookies?\s+(?:(?:is|has been|was)\s+)?(?P<state>enabled|activated|turned on|disabled|deactivated|turned off)(?:\s+(?:on|for)\s+(?P<object_type>virtual server|virtual port|interface|port)\s+(?P<object_name>\S+))?`,
+		Fields:   []string{"state:onoff", "object_type:slug", "object_name"},
+		Severity: "warning",
+		subTopic: "ddos",
+	},
+	{
+		// "SYN flood detected on virtual server ws-vip"
+		Name:     "ddos-syn-flood",
+		Type:     "ddos.syn-flood",
+		Regex:    `(?i)^(?:ddos\s+)?syn[- ]flood\s+(?:attack\s+)?detected(?:\s+(?:on|for)\s+(?P<object_type>virtual server|virtual port|server|interface)\s+(?P<object_name>\S+))?`,
+		Fields:   []string{"object_type:slug", "object_name"},
+		Severity: "critical",
+		subTopic: "ddos",
+	},
+	{
+		// "IP anomaly drop: land attack from 10.1.1.1", "IP-anomaly dropped: ping of death, src 10.1.1.1, count 20"
+		Name:     "ddos-ip-anomaly",
+		Type:     "ddos.ip-anomaly",
+		Regex:    `(?i)^ip[- ]anomaly\s+drop(?:ped)?[:,]?\s+(?P<anomaly>[\w-]+(?:\s+[\w-]+)*?)(?:,?\s+(?:from|src|source)\s+(?P<client_ip>[0-9a-fA-F.:]+))?(?:,?\s+count\s+(?P<count>\d+))?\s*$`,
+		Fields:   []string{"anomaly:lower", "client_ip", "count:int"},
+		Severity: "warning",
+		subTopic: "ddos",
+	},
+	{
+		// aFleX http-error-status-log, e.g. "http-error-status-log:HTTP Error: 10.147.95.128 - 404 - /blatt"
+		// Off unless turned on in the rules file, since busy sites log a lot of these.
+		Name:     "aflex-http-error",
+		Type:     "aflex.http-error",
+		Module:   "AFLEX",
+		Regex:    `(?i)^(?P<log_name>[\w-]+):\s*HTTP Error:\s*(?P<client_ip>[0-9a-fA-F.:]+)\s+-\s+(?P<status>\d{3})\s+-\s+(?P<uri>\S*)`,
+		Fields:   []string{"log_name", "client_ip", "status:int", "uri"},
+		Enabled:  &disabled,
+		subTopic: "aflex",
+	},
+	// -- WAF. Goes to notify_topic + "/waf", for the application-security people.
+	{
+		// "WAF violation: policy waf-pol1, signature 2000123, client 10.1.2.3",
+		// "WAF: request denied, policy=waf-pol1 sig_id=2000123 src=10.1.2.3:5555 vip=ws-vip"
+		Name:     "waf-violation",
+		Type:     "waf.violation",
+		Regex:    `(?i)^waf\b.*?(?:\b(?:policy|template)[ =:]+"?(?P<policy>[\w.-]+)"?.*?)?\bsig(?:nature)?(?:[ _-]?id)?[ =:#]+"?(?P<signature_id>\d+)"?(?:.*?\b(?:client|src|source)(?:[ _-]?ip)?[ =:]+"?(?P<client_ip>[0-9a-fA-F.:]+?)(?::\d+)?(?:["\s,;)]|$))?(?:.*?\b(?:vip|virtual server|vs)[ =:]+"?(?P<object_name>[^\s",;]+))?`,
+		Fields:   []string{"policy", "signature_id:int", "client_ip", "object_name"},
+		Severity: "warning",
+		subTopic: "waf",
+	},
+	// -- Client-SSL. These go to notify_topic + "/ssl"; a run of them often comes just before customers notice.
+	{
+		// "SSL handshake failure: client 10.1.2.3, virtual server ws-vip, protocol TLSv1.0, cipher RC4-MD5, reason no shared cipher",
+		// "Client SSL handshake failed from 10.1.2.3:5123 to vip ws-vip:443 (TLS1.2, ECDHE-RSA-AES128-GCM-SHA256): certificate unknown"
+		Name:     "ssl-handshake",
+		Type:     "ssl.handshake-failure",
+		Regex:    `(?i)^(?:client[- ])?ssl(?:/tls)?\s+handshake\s+(?:failure|failed|error)s?\b(?:.*?\b(?:client|from|src)(?:[ _-]?ip)?[ =:]+(?P<client_ip>[0-9a-fA-F.:]+?)(?::\d+)?(?:[\s,;)]|$))?(?:.*?\b(?:virtual server|vip|vs)[ =:]+(?P<object_name>[^\s,;:()]+)(?::(?P<port>\d+))?)?(?:.*?\b(?:protocol|version)[ =:]+(?P<tls_version>[\w.]+)|.*?\((?P<tls_version>(?:TLS|SSL)v?[\d.]+),\s*(?P<cipher>[\w-]+))?(?:.*?\bcipher[ =:]+(?P<cipher>[\w-]+))?(?:.*?(?:\breason[ =:]+|\):\s*)(?P<reason>[^,;]*[^,;\s]))?`,
+		Fields:   []string{"client_ip", "object_name", "port:int", "tls_version", "cipher", "reason"},
+		Severity: "warning",
+		subTopic: "ssl",
+	},
+	{
+		// "SSL certificate error: certificate expired on virtual server ws-vip:443", "SSL certificate error: unknown CA, client 10.1.1.1"
+		Name:     "ssl-cert-error",
+		Type:     "ssl.cert-error",
+		Regex:    `(?i)^(?:client[- ])?ssl\s+cert(?:ificate)?\s+(?:error|failure|problem)[:,]?\s*(?P<reason>[^,;]+?)(?:,?\s+(?:on|for)\s+(?:virtual server|vip|vs)\s+(?P<object_name>[^\s,;:]+)(?::(?P<port>\d+))?)?(?:,?\s+(?:client|from|src)\s+(?P<client_ip>[0-9a-fA-F.:]+?)(?::\d+)?)?,?\s*$`,
+		Fields:   []string{"reason", "object_name", "port:int", "client_ip"},
+		Severity: "warning",
+		subTopic: "ssl",
+	},
+	// -- System resources. Goes to notify_topic + "/system".
+	{
+		// "CPU usage is high: 92%", "Data CPU 3 utilization 95% exceeds threshold 90%", "Session table usage is 85% (threshold 80%)"
+		Name:     "system-resource",
+		Type:     "system.resource",
+		Regex:    `(?i)^(?:system\s+)?(?:high\s+)?(?P<metric>(?:data\s+|control\s+)?cpu|memory|session[- ]table)(?:\s+(?P<cpu>\d+))?(?:\s+(?:usage|utili[sz]ation))?(?:\s+is)?(?:\s+(?:too\s+)?high|\s+exceed(?:ed|s)?|\s+above|\s+at|\s+reached)?(?:\s+threshold)?[:,]?\s*(?P<value>\d+(?:\.\d+)?)\s*%(?:.*?\bthreshold\s*(?:of\s*|is\s*|[:=]\s*)?(?P<threshold>\d+(?:\.\d+)?))?`,
+		Fields:   []string{"metric:slug", "cpu:int", "value:float", "threshold:float"},
+		Severity: "warning",
+		subTopic: "system",
+	},
+	// -- CGNAT. These go to notify_topic + "/cgnat". Port batch and fixed-NAT allocations are logged for
+	// every subscriber, so those two are off by default; quota exhaustion is what you want to be told about.
+	{
+		// "User-Quota Exceeded: Protocol TCP, Inside 100.64.1.7, NAT 203.0.113.5, Quota 1000"
+		Name:     "cgnat-quota",
+		Type:     "cgnat.quota-exceeded",
+		Regex:    `(?i)^(?:nat[- ])?(?P<quota_type>user|session|port)[- ]quota\s+exceeded[:,]?\s*(?:protocol\s+(?P<protocol>\w+),?\s*)?inside\s+(?:ip\s+)?(?P<inside_ip>[0-9a-fA-F.:]+?)(?:,?\s+nat\s+(?:ip\s+)?(?P<nat_ip>[0-9a-fA-F.:]+?))?(?:,?\s+quota\s+(?P<quota>\d+))?,?\s*$`,
+		Fields:   []string{"quota_type:lower", "protocol:lower", "inside_ip", "nat_ip", "quota:int"},
+		Severity: "warning",
+		subTopic: "cgnat",
+	},
+	{
+		// "NAT-TCP-B: 100.64.1.7 -> 203.0.113.5:1024-1535 alloc", "Port batch allocated: inside 100.64.1.7 nat 203.0.113.5 ports 1024-1535"
+		Name:     "cgnat-port-batch",
+		Type:     "cgnat.port-batch",
+		Regex:    `(?i)^(?:nat-(?P<protocol>tcp|udp|icmp)-b[:,]?\s+(?P<inside_ip>[0-9a-fA-F.:]+?)\s*->\s*(?P<nat_ip>[0-9.]+):(?P<port_start>\d+)-(?P<port_end>\d+)(?:\s+(?P<action>\w+))?|port[- ]batch\s+(?P<action>\w+)[:,]?\s+inside\s+(?P<inside_ip>[0-9a-fA-F.:]+?),?\s+nat\s+(?P<nat_ip>[0-9a-fA-F.:]+?),?\s+ports?\s+(?P<port_start>\d+)-(?P<port_end>\d+))`,
+		Fields:   []string{"protocol:lower", "inside_ip", "nat_ip", "port_start:int", "port_end:int", "action:allocfree"},
+		Enabled:  &disabled,
+		subTopic: "cgnat",
+	},
+	{
+		// Fixed-format NAT log template: "Fixed-NAT Alloc: inside 100.64.1.7 nat 203.0.113.5 ports 1024-2047"
+		Name:     "cgnat-fixed-nat",
+		Type:     "cgnat.fixed-nat",
+		Regex:    `(?i)^fixed[- ]nat(?:\s+port(?:\s+batch)?)?\s+(?P<action>\w+)[:,]?\s+inside\s+(?P<inside_ip>[0-9a-fA-F.:]+?),?\s+nat\s+(?P<nat_ip>[0-9a-fA-F.:]+?)(?:,?\s+ports?\s+(?P<port_start>\d+)-(?P<port_end>\d+))?\s*$`,
+		Fields:   []string{"inside_ip", "nat_ip", "port_start:int", "port_end:int", "action:allocfree"},
+		Enabled:  &disabled,
+		subTopic: "cgnat",
+	},
+}
+
+var disabled = false
+
+// Syslog severity numbers, by name
+var severityNames = []string{"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"}
+
+func severityName(sev int) string {
+	if sev < 0 || sev >= len(severityNames) {
+		return "unknown"
+	}
+	return severityNames[sev]
+}
+
+// Rule files are only ever a handful of rules, so a simple slice does.
+type RuleSet []*Rule
+
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return errors.New("Rule with no name!")
+	}
+	if r.Type == "" {
+		r.Type = r.Name
+	}
+	if r.Regex == "" && len(r.Contains) == 0 {
+		return fmt.Errorf("Rule '%s' needs a regex or contains list", r.Name)
+	}
+	if r.Regex != "" {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("Rule '%s': bad regex: %v", r.Name, err)
+		}
+		r.re = re
+	}
+	if r.Filter != "" {
+		x, err := compileExpr(r.Filter)
+		if err != nil {
+			return fmt.Errorf("Rule '%s': bad filter: %v", r.Name, err)
+		}
+		r.filter = x
+	}
+	if r.Severity != "" {
+		sev, ok := normalizeSeverity(r.Severity)
+		if !ok {
+			return fmt.Errorf("Rule '%s': unknown severity '%s'", r.Name, r.Severity)
+		}
+		r.Severity = sev
+	}
+	if r.Suppress != "" {
+		d, err := time.ParseDuration(r.Suppress)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Rule '%s': bad suppress window '%s'", r.Name, r.Suppress)
+		}
+		r.suppress = d
+	}
+	if r.Threshold != nil {
+		if err := r.Threshold.compile(); err != nil {
+			return fmt.Errorf("Rule '%s': %v", r.Name, err)
+		}
+	}
+	if r.Recover != "" {
+		d, err := time.ParseDuration(r.Recover)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Rule '%s': bad recover time '%s'", r.Name, r.Recover)
+		}
+		r.recover = d
+	}
+	if r.Escalate != nil {
+		if err := r.Escalate.compile(r); err != nil {
+			return err
+		}
+	}
+	if err := r.compileTopic(); err != nil {
+		return err
+	}
+	for k, src := range r.Set {
+		t, err := parseTemplate(k, src)
+		if err != nil {
+			return fmt.Errorf("Rule '%s': bad template for '%s': %v", r.Name, k, err)
+		}
+		if r.set == nil {
+			r.set = make(map[string]*template.Template)
+		}
+		r.set[k] = t
+	}
+	if err := r.compileSetBySeverity(); err != nil {
+		return err
+	}
+	for _, f := range r.Fields {
+		name, conv := splitField(f)
+		if _, ok := fieldConverters[conv]; !ok {
+			return fmt.Errorf("Rule '%s': unknown type '%s' for field '%s'", r.Name, conv, name)
+		}
+		if r.re != nil && r.re.SubexpIndex(name) < 0 {
+			return fmt.Errorf("Rule '%s': regex has no group named '%s'", r.Name, name)
+		}
+	}
+	if r.Magnitude != nil {
+		if err := r.Magnitude.compile(r); err != nil {
+			return err
+		}
+	}
+	if r.Flap != nil {
+		if err := r.Flap.compile(r); err != nil { // Last, since it copies the rule
+			return err
+		}
+	}
+	return nil
+}
+
+// compileTopic parses the topic if it is a template.
+func (r *Rule) compileTopic() error {
+	if !strings.Contains(r.Topic, "{{") {
+		return nil
+	}
+	t, err := parseTemplate("topic", r.Topic)
+	if err != nil {
+		return fmt.Errorf("Rule '%s': bad topic template: %v", r.Name, err)
+	}
+	r.topic = t
+	return nil
+}
+
+// clone is a copy of r that shares nothing with it. An overlay is unmarshalled into the copy of the built-in
+// rule, and json.Unmarshal writes into the slices, maps and structs it finds there, so anything shared would
+// change the built-in rule for every later load.
+func (r *Rule) clone() *Rule {
+	c := *r
+	c.Contains = append([]string(nil), r.Contains...)
+	c.Fields = append([]string(nil), r.Fields...)
+	c.Sinks = append([]string(nil), r.Sinks...)
+	if r.Enabled != nil {
+		e := *r.Enabled
+		c.Enabled = &e
+	}
+	if r.Threshold != nil {
+		t := *r.Threshold
+		c.Threshold = &t
+	}
+	if r.Escalate != nil {
+		e := *r.Escalate
+		e.Steps = append([]EscalationStep(nil), r.Escalate.Steps...)
+		for i := range e.Steps {
+			e.Steps[i].Sinks = append([]string(nil), e.Steps[i].Sinks...)
+		}
+		c.Escalate = &e
+	}
+	if r.Flap != nil {
+		f := *r.Flap
+		c.Flap = &f
+	}
+	if r.Magnitude != nil {
+		m := *r.Magnitude
+		m.Steps = append([]MagnitudeStep(nil), r.Magnitude.Steps...)
+		c.Magnitude = &m
+	}
+	if r.Set != nil {
+		c.Set = make(map[string]string, len(r.Set))
+		for k, v := range r.Set {
+			c.Set[k] = v
+		}
+	}
+	if r.SetBySeverity != nil {
+		c.SetBySeverity = make(map[string]map[string]string, len(r.SetBySeverity))
+		for sev, fields := range r.SetBySeverity {
+			c.SetBySeverity[sev] = make(map[string]string, len(fields))
+			for k, v := range fields {
+				c.SetBySeverity[sev][k] = v
+			}
+		}
+	}
+	return &c
+}
+
+// readRulesFile reads and parses the rules file, once for everything built from it (see reload.go). fn ""
+// is an empty one.
+func readRulesFile(fn string) (RulesFile, error) {
+	rf := RulesFile{}
+	if fn == "" {
+		return rf, nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return rf, errors.New("Unable to open Rules File!")
+	}
+	if err := json.Unmarshal(b, &rf); err != nil {
+		return rf, fmt.Errorf("Unable to parse Rules File: %v", err)
+	}
+	return rf, nil
+}
+
+// loadRules builds the rule set: the built-in rules, then whatever is in the rules file (if any).
+func loadRules(fn string) (RuleSet, error) {
+	rf, err := readRulesFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return buildRules(rf)
+}
+
+// buildRules is loadRules for a rules file already read.
+func buildRules(rf RulesFile) (RuleSet, error) {
+	var rs RuleSet
+	if rf.Builtin == nil || *rf.Builtin {
+		for i := range builtinRules {
+			rs = append(rs, builtinRules[i].clone())
+		}
+	}
+	for _, raw := range rf.Rules {
+		var name struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(raw, &name)
+		r, overlay := &Rule{}, false
+		for _, b := range rs {
+			if name.Name != "" && b.Name == name.Name {
+				r, overlay = b, true // Lay it over the built-in rule of the same name
+			}
+		}
+		if err := json.Unmarshal(raw, r); err != nil {
+			return nil, fmt.Errorf("Unable to parse rule '%s': %v", name.Name, err)
+		}
+		if !overlay {
+			rs = append(rs, r)
+		}
+	}
+	var enabled RuleSet
+	for _, r := range rs {
+		if r.Enabled != nil && !*r.Enabled {
+			continue
+		}
+		if err := r.expandPatterns(rf.Patterns); err != nil {
+			return nil, err
+		}
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+		enabled = append(enabled, r)
+	}
+	return enabled, nil
+}
+
+var msgHeader = regexp.MustCompile(`^\[(\w+)\]<(\d+)>\s*`)
+
+// splitMessage separates "[ACOS]<4> Virtual server ..." into the module name and the message text.
+func splitMessage(content string) (module string, msg string) {
+	p := msgHeader.FindStringSubmatch(content)
+	if p == nil {
+		return "", content
+	}
+	return p[1], content[len(p[0]):]
+}
+
+// On a multi-partition (RBA/L3V) Thunder, messages from a partition say so at the start or the end:
+// "[partition p1] Virtual server ...", "Partition p1: Virtual server ...", "Virtual server ... (partition p1)".
+var partitionHead = regexp.MustCompile(`(?i)^(?:\[\s*(?:partition|l3v|rba)[\s:=]+([\w.-]+)\s*\]|(?:partition|l3v)[\s:=]+([\w.-]+)\s*[:,])\s*`)
+var partitionTail = regexp.MustCompile(`(?i)[\s,]*(?:\(\s*(?:partition|l3v)[\s:=]+([\w.-]+)\s*\)|\bin\s+partition\s+([\w.-]+))\s*$`)
+
+// splitPartition takes the partition name out of the message, if it has one.
+func splitPartition(msg string) (partition string, rest string) {
+	for _, re := range []*regexp.Regexp{partitionHead, partitionTail} {
+		if p := re.FindStringSubmatchIndex(msg); p != nil {
+			for g := 1; g <= 2; g++ {
+				if p[2*g] >= 0 {
+					partition = msg[p[2*g]:p[2*g+1]]
+				}
+			}
+			return partition, msg[:p[0]] + msg[p[1]:]
+		}
+	}
+	return "", msg
+}
+
+// Match runs the record past each rule, returning the event for the first match. A rule with a
+// filter only matches if the filter is true for the parsed event.
+func (rs RuleSet) Match(rec record) (Event, bool) {
+	for _, r := range rs {
+		if fields, ok := r.match(rec.Module, rec.Message); ok {
+			ev := rec.event(r, r.Severity, fields)
+			if r.filter != nil {
+				if ok, _ := r.filter.Bool(ev.Payload()); !ok {
+					continue
+				}
+			}
+			return ev, true
+		}
+	}
+	return Event{}, false
+}
+
+func (r *Rule) match(module string, msg string) (map[string]interface{}, bool) {
+	if r.Module != "" && !strings.EqualFold(r.Module, module) {
+		return nil, false
+	}
+	for _, c := range r.Contains {
+		if !strings.Contains(msg, c) {
+			return nil, false
+		}
+	}
+	fields := make(map[string]interface{})
+	if r.re == nil {
+		return fields, true
+	}
+	p := r.re.FindStringSubmatch(msg)
+	if p == nil {
+		return nil, false
+	}
+	if len(r.Fields) == 0 {
+		for i, name := range r.re.SubexpNames() {
+			if name != "" {
+				fields[name] = p[i]
+			}
+		}
+		return fields, true
+	}
+	for _, f := range r.Fields {
+		name, conv := splitField(f)
+		fields[name] = fieldConverters[conv](capture(r.re, p, name))
+	}
+	if r.object != nil {
+		fields["object_name"] = r.object(fields)
+	}
+	return fields, true
+}
+
+// healthMonitorObject is the health-monitor rule's object, "<monitor>/<server>:<port>" (or without the port),
+// so each monitor on each server port is an alert of its own.
+func healthMonitorObject(fields map[string]interface{}) string {
+	mon, _ := fields["monitor"].(string)
+	server, _ := fields["server"].(string)
+	obj := mon + "/" + server
+	if port, ok := fields["port"].(int); ok {
+		obj += ":" + strconv.Itoa(port)
+	}
+	return obj
+}
+
+// capture returns the text of the named group. The same name can be used for more than one group
+// (for different wordings of the same message); the first one that matched is returned.
+func capture(re *regexp.Regexp, p []string, name string) string {
+	for i, n := range re.SubexpNames() {
+		if n == name && p[i] != "" {
+			return p[i]
+		}
+	}
+	return ""
+}
+
+func splitField(f string) (name string, conv string) {
+	if i := strings.Index(f, ":"); i >= 0 {
+		return f[:i], f[i+1:]
+	}
+	return f, ""
+}
+
+// upDown normalizes the different ways ACOS says something is up or down.
+var upDown = map[string]string{
+	"up": "up", "recovered": "up", "succeeded": "up", "passed": "up",
+	"down": "down", "failed": "down", "": "",
+}
+
+// onOff does the same for things being turned on and off.
+var onOff = map[string]string{
+	"enabled": "on", "activated": "on", "turned on": "on",
+	"disabled": "off", "deactivated": "off", "turned off": "off", "": "",
+}
+
+// allocFree normalizes port allocation log wording.
+var allocFree = map[string]string{
+	"alloc": "alloc", "allocated": "alloc", "allocate": "alloc", "": "",
+	"free": "free", "freed": "free", "release": "free", "released": "free", "dealloc": "free",
+}
+
+// fieldConverters turn the captured text into the value published for a "name:type" field.
+var fieldConverters = map[string]func(string) interface{}{
+	"":       func(s string) interface{} { return s },
+	"string": func(s string) interface{} { return s },
+	"lower":  func(s string) interface{} { return strings.ToLower(s) },
+	"slug":   func(s string) interface{} { return strings.Replace(strings.ToLower(s), " ", "-", -1) },
+	"updown": func(s string) interface{} { return upDown[strings.ToLower(s)] },
+	"onoff":  func(s string) interface{} { return onOff[strings.ToLower(s)] },
+	"allocfree": func(s string) interface{} {
+		if v, ok := allocFree[strings.ToLower(s)]; ok {
+			return v
+		}
+		return strings.ToLower(s)
+	},
+	"int": func(s string) interface{} {
+		if s == "" {
+			return nil // Optional group that didn't match
+		}
+		i, _ := strconv.Atoi(s)
+		return i
+	},
+	"float": func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	},
+}
+
+// TopicFor returns where matches of the rule are published. notifyTopic is notify_topic, or the
+// partition's entry in partition_topics. payload is the event, for topic templates.
+func (r *Rule) TopicFor(notifyTopic string, payload map[string]interface{}) string {
+	return r.topicFor(context.Background(), notifyTopic, payload)
+}
+
+// topicFor is TopicFor with the topic template rendered within ctx, see deadlines.go.
+func (r *Rule) topicFor(ctx context.Context, notifyTopic string, payload map[string]interface{}) string {
+	if r.topic != nil {
+		t, err := renderTemplate(ctx, r.topic, payload)
+		if err != nil {
+			countError(timeoutCode(err, errRenderTemplate, errRenderTimeout))
+		} else if t != "" {
+			return t
+		}
+		// A topic that won't render still has to go somewhere
+	} else if r.Topic != "" {
+		return r.Topic
+	}
+	if r.subTopic != "" {
+		return notifyTopic + "/" + r.subTopic
+	}
+	return notifyTopic
+}
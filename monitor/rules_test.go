@@ -0,0 +1,245 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+func writeRulesFile(t *testing.T, body string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fn := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(fn, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func findRule(rs RuleSet, name string) *Rule {
+	for _, r := range rs {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// An overlay on a built-in rule must not change the built-in rule itself, for this load or any later one.
+func TestLoadRulesOverlayLeavesBuiltinsAlone(t *testing.T) {
+	want := append([]string(nil), builtinRules[0].Fields...)
+	wantMag := *builtinRules[0].Magnitude
+	fn := writeRulesFile(t, `{ "rules": [
+		{ "name": "conn-rate-limit", "fields": ["object_name"], "contains": ["c"], "sinks": ["mqtt"],
+		  "magnitude": { "value": "rate", "limit": "limit", "steps": [ { "over": 2, "severity": "critical" } ] } },
+		{ "name": "conn-limit", "enabled": false }
+	] }`)
+	rs, err := loadRules(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := findRule(rs, "conn-rate-limit"); r == nil || !reflect.DeepEqual(r.Fields, []string{"object_name"}) {
+		t.Fatalf("overlay not applied: %+v", r)
+	}
+	if findRule(rs, "conn-limit") != nil {
+		t.Error("conn-limit still enabled")
+	}
+	if got := builtinRules[0].Fields; !reflect.DeepEqual(got, want) {
+		t.Errorf("built-in fields now %v, want %v", got, want)
+	}
+	if got := *builtinRules[0].Magnitude; !reflect.DeepEqual(got, wantMag) {
+		t.Errorf("built-in magnitude now %+v", got)
+	}
+	if e := builtinRules[1].Enabled; e != nil && !*e {
+		t.Error("built-in conn-limit disabled")
+	}
+
+	rs, err = loadRules("") // A reload without the file gets the built-in rules as they were
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := findRule(rs, "conn-rate-limit"); r == nil {
+		t.Error("conn-rate-limit missing after reload")
+	} else if !reflect.DeepEqual(r.Fields, want) || r.Sinks != nil || r.Contains != nil {
+		t.Errorf("reloaded built-in rule has fields %v, sinks %v, contains %v", r.Fields, r.Sinks, r.Contains)
+	}
+	if findRule(rs, "conn-limit") == nil {
+		t.Error("conn-limit missing after reload")
+	}
+}
+
+func TestRuleCloneSharesNothing(t *testing.T) {
+	on := true
+	r := &Rule{Name: "r", Contains: []string{"a"}, Fields: []string{"f"}, Sinks: []string{"mqtt"}, Enabled: &on,
+		Threshold: &Threshold{Count: 3}, Flap: &FlapPolicy{Transitions: 4},
+		Escalate:  &EscalatePolicy{Steps: []EscalationStep{{After: "5m", Sinks: []string{"pager"}}}},
+		Magnitude: &MagnitudePolicy{Steps: []MagnitudeStep{{Over: 2, Severity: "critical"}}},
+		Set:       map[string]string{"a": "b"}, SetBySeverity: map[string]map[string]string{"critical": {"c": "d"}}}
+	c := r.clone()
+	if !reflect.DeepEqual(c, r) {
+		t.Fatalf("clone differs: %+v", c)
+	}
+	c.Contains[0], c.Fields[0], c.Sinks[0], *c.Enabled = "x", "x", "x", false
+	c.Threshold.Count, c.Flap.Transitions = 9, 9
+	c.Escalate.Steps[0].After, c.Escalate.Steps[0].Sinks[0] = "x", "x"
+	c.Magnitude.Steps[0].Over = 9
+	c.Set["a"], c.SetBySeverity["critical"]["c"] = "x", "x"
+	if r.Contains[0] != "a" || r.Fields[0] != "f" || r.Sinks[0] != "mqtt" || !*r.Enabled ||
+		r.Threshold.Count != 3 || r.Flap.Transitions != 4 || r.Escalate.Steps[0].After != "5m" ||
+		r.Escalate.Steps[0].Sinks[0] != "pager" || r.Magnitude.Steps[0].Over != 2 || r.Set["a"] != "b" ||
+		r.SetBySeverity["critical"]["c"] != "d" {
+		t.Errorf("changing the clone changed the rule: %+v", r)
+	}
+}
+
+// Each ACOS release's wording of the connection rate limit message, and what conn-rate-limit takes out of
+// it. 0 for limit or rate is "not given".
+var connRateMessages = []struct {
+	msg         string
+	typ, name   string
+	limit, rate int
+	action      string
+}{
+	{"Virtual server ws-vip connection rate limit 100 exceeded", "virtual-server", "ws-vip", 100, 0, ""},
+	{"Virtual server ws-vip connection rate limit 100 exceeded, dropping", "virtual-server", "ws-vip", 100, 0, "dropping"},
+	{"Virtual port ws-vip-443 connection rate limit 100 exceeded: reset", "virtual-port", "ws-vip-443", 100, 0, "reset"},
+	{"Server port s1-80 connection rate limit 50 exceeded", "server-port", "s1-80", 50, 0, ""},
+	{"Virtual server ws-vip: connection rate limit exceeded (limit 100), drop", "virtual-server", "ws-vip", 100, 0, "drop"},
+	{"Virtual server ws-vip connection rate limit exceeded, dropping", "virtual-server", "ws-vip", 0, 0, "dropping"},
+	{"virtual-server ws-vip conn-rate-limit 100 cps exceeded", "virtual-server", "ws-vip", 100, 0, ""},
+	{"slb virtual-server ws-vip connection rate limit (100/s) exceeded", "virtual-server", "ws-vip", 100, 0, ""},
+	{"Connection rate limit 100 exceeded for virtual port ws-vip-443", "virtual-port", "ws-vip-443", 100, 0, ""},
+	{"Connection rate exceeded on server s1", "server", "s1", 0, 0, ""},
+	{"Virtual server ws-vip exceeded its connection rate limit of 100", "virtual-server", "ws-vip", 100, 0, ""},
+	{"Virtual server ws-vip exceeded connection rate limit 100 dropping", "virtual-server", "ws-vip", 100, 0, "dropping"},
+	{"Virtual server ws-vip connection rate 150 exceeded limit 100", "virtual-server", "ws-vip", 100, 150, ""},
+	{"Virtual server ws-vip connection rate limit 100 exceeded (current 150), dropping", "virtual-server", "ws-vip", 100, 150, "dropping"},
+	{"Virtual port ws-vip-443 connection rate 1500 cps exceeds its limit of 1000 cps", "virtual-port", "ws-vip-443", 1000, 1500, ""},
+}
+
+func TestConnRateRegex(t *testing.T) {
+	rs, err := loadRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := findRule(rs, "conn-rate-limit")
+	orNil := func(i int) interface{} {
+		if i == 0 {
+			return nil
+		}
+		return i
+	}
+	for _, c := range connRateMessages {
+		fields, ok := r.match("ACOS", c.msg)
+		if !ok {
+			t.Errorf("%q didn't match", c.msg)
+			continue
+		}
+		want := map[string]interface{}{"object_type": c.typ, "object_name": c.name, "limit": orNil(c.limit),
+			"rate": orNil(c.rate), "action": c.action}
+		if !reflect.DeepEqual(fields, want) {
+			t.Errorf("%q gave %v, want %v", c.msg, fields, want)
+		}
+	}
+
+	for _, msg := range []string{
+		"Virtual server ws-vip connection limit 1000 exceeded", // conn-limit's
+		"Server s1 state changed to DOWN",
+		"Virtual server ws-vip connection rate limit 100",
+	} {
+		if fields, ok := r.match("ACOS", msg); ok {
+			t.Errorf("%q matched: %v", msg, fields)
+		}
+	}
+	if _, ok := r.match("SYSTEM", connRateMessages[0].msg); ok {
+		t.Error("matched another module's message")
+	}
+}
+
+// Every message in the samples for 'rules test' is one the table has, so the two can't drift apart.
+func TestConnRateSamples(t *testing.T) {
+	f, err := os.Open("../examples/samples/conn-rate.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	known := map[string]bool{}
+	for _, c := range connRateMessages {
+		known[c.msg] = true
+	}
+	n := 0
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		line := lines.Text()
+		i := strings.Index(line, "[ACOS]<4> ")
+		if line == "" || strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		if msg := line[i+len("[ACOS]<4> "):]; !known[msg] {
+			t.Errorf("%q isn't in connRateMessages", msg)
+		}
+		n++
+	}
+	if n != len(connRateMessages) {
+		t.Errorf("%d samples, %d messages in the table", n, len(connRateMessages))
+	}
+}
+
+// capture takes the first group of that name that matched, whichever alternative it is in.
+func TestCapture(t *testing.T) {
+	rs, err := loadRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := findRule(rs, "conn-rate-limit").re
+	for msg, want := range map[string]string{
+		"Virtual server ws-vip connection rate 150 exceeded limit 100":            "100", // First alternative
+		"Virtual server ws-vip connection rate limit 100 exceeded":                "100", // Second
+		"Virtual server ws-vip: connection rate limit exceeded (limit 100), drop": "100", // Second, in the brackets
+		"Connection rate limit 100 exceeded for virtual port ws-vip-443":          "100", // Third
+		"Virtual server ws-vip exceeded its connection rate limit of 100":         "100", // Fourth
+		"Virtual server ws-vip connection rate limit exceeded, dropping":          "",
+	} {
+		if got := capture(re, re.FindStringSubmatch(msg), "limit"); got != want {
+			t.Errorf("%q: limit %q, want %q", msg, got, want)
+		}
+	}
+}
+
+// Each health monitor on each server port is an alert of its own.
+func TestHealthMonitorObject(t *testing.T) {
+	m := newTestMonitor(t, Configuration{})
+	ids := map[string]bool{}
+	for _, msg := range []string{
+		"Health monitor hm-http failed for server s1 port 80",
+		"Health monitor hm-tcp failed for server s1 port 80",
+		"Health check hm-http on server s2:80 failed",
+		"Health check hm-http on server s2 failed",
+	} {
+		m.a.process(context.Background(), format.LogParts{"hostname": "thunder1", "severity": 4,
+			"timestamp": time.Now(), "content": "[ACOS]<4> " + msg})
+		ev := nextEvent(m)
+		if ev == nil {
+			t.Fatalf("%q not published", msg)
+		}
+		ids[ev.alertID()] = true
+	}
+	for _, id := range []string{"thunder1/hm.state/hm-http/s1:80", "thunder1/hm.state/hm-tcp/s1:80",
+		"thunder1/hm.state/hm-http/s2:80", "thunder1/hm.state/hm-http/s2"} {
+		if !ids[id] {
+			t.Errorf("no alert %s in %v", id, ids)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package monitor
+
+//
+//  rulestest.go  --  The 'rules test' subcommand, for trying out a rules file before it goes live. Sample
+//    log lines are read from a file or stdin and run through the rules, parser plugins and correlations the
+//    agent would use, and what each line matched is printed with the fields taken from it:
+//
+//    a10-connection-rate-monitor rules test [-config config.json] [-rules rules.json] [samples.log]
+//
+//  A line can be a whole Syslog record, as the Thunder sends it:
+//
+//    <132>May 18 22:03:04 Testing1 a10logd: [ACOS]<4> Virtual server ws-vip connection rate limit 10 exceeded
+//
+//  or just the message, "[ACOS]<4> Virtual server ws-vip connection rate limit 10 exceeded", in which case
+//  the device is "test". Blank lines and lines starting with "#" are skipped. Lines a drop rule (see
+//  drops.go) throws away say which one. The exit status is 1 if any line was neither matched nor dropped,
+//  so it can go in a CI job over a file of lines that must all match.
+//
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// moduleSeverity is the "<4>" of a bare "[ACOS]<4> ..." message.
+var moduleSeverity = regexp.MustCompile(`^\[\w+\]<(\d)>`)
+
+// sampleParts turns a sample line into what the Syslog server would have handed over.
+func sampleParts(line string, now time.Time) format.LogParts {
+	if strings.HasPrefix(line, "<") {
+		p := (&lenientRFC3164{}).GetParser([]byte(line))
+		if p.Parse() == nil {
+			return p.Dump()
+		}
+	}
+	sev := 6
+	if m := moduleSeverity.FindStringSubmatch(line); m != nil {
+		sev, _ = strconv.Atoi(m[1])
+	}
+	return format.LogParts{"hostname": "test", "content": line, "severity": sev, "facility": 16, "timestamp": now}
+}
+
+// RulesCommand runs the 'rules' subcommand, returning the exit status.
+func RulesCommand(args []string) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Println("Usage: rules test [-config config.json] [-rules rules.json] [samples.log]")
+		return 2
+	}
+	fs := flag.NewFlagSet("rules test", flag.ContinueOnError)
+	configFile := fs.String("config", "./config.json", "config file, for rules_file, parser_plugins and notify_topic")
+	rulesFile := fs.String("rules", "", "rules file to test, instead of the config's rules_file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	config, err := LoadConfig(*configFile)
+	if err != nil && *configFile != "./config.json" {
+		fmt.Println(err)
+		return 2
+	}
+	if *rulesFile != "" {
+		config.Rules_File = *rulesFile
+	}
+	rs, err := loadRuleState(&config)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	parsers, err := loadParsers(config.Parser_Plugins)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		defer f.Close()
+		in = f
+	}
+	lines, matched, dropped := testRules(in, os.Stdout, rs, parsers, &config)
+	fmt.Printf("%d lines, %d matched, %d dropped, %d didn't\n", lines, matched, dropped, lines-matched-dropped)
+	if matched+dropped < lines {
+		return 1
+	}
+	return 0
+}
+
+// testRules runs each line of in through the rules, writing what matched to out.
+func testRules(in io.Reader, out io.Writer, rs *ruleState, parsers []*parserPlugin, config *Configuration) (lines int, matched int, dropped int) {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines++
+		now := time.Now()
+		rec := newRecord(sampleParts(line, now), now, &config.Timestamps)
+		if d := rs.drops.match(rec); d != nil {
+			dropped++
+			fmt.Fprintf(out, "line %d: dropped by %s\n", n, d.Name)
+			continue
+		}
+		ev, ok := rs.rules.Match(rec)
+		if !ok {
+			ev, ok = matchParsers(parsers, rec)
+		}
+		if !ok {
+			fmt.Fprintf(out, "line %d: no match: %s\n", n, rec.Message)
+			continue
+		}
+		matched++
+		cs, absorbed := rs.correlator.Observe(&ev, now)
+		fmt.Fprintf(out, "line %d: ", n)
+		printEvent(out, ev, config)
+		if absorbed {
+			fmt.Fprintf(out, "  (not published: absorbed by correlation %v)\n", ev.Fields["correlation_id"])
+		}
+		for _, c := range cs {
+			fmt.Fprintf(out, "  and then correlation ")
+			printEvent(out, c, config)
+		}
+	}
+	return lines, matched, dropped
+}
+
+func printEvent(out io.Writer, ev Event, config *Configuration) {
+	payload := ev.Payload()
+	fmt.Fprintf(out, "%s (%s, %s) on %s", ev.Rule.Name, ev.Type, ev.Severity, ev.Device)
+	if topic := ev.Rule.TopicFor(config.Notify_Topic, payload); topic != "" {
+		fmt.Fprintf(out, ", topic %s", topic)
+	}
+	fmt.Fprintln(out)
+	keys := make([]string, 0, len(ev.Fields))
+	for k := range ev.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(out, "    %s = %v\n", k, ev.Fields[k])
+	}
+}
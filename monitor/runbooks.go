@@ -0,0 +1,51 @@
+package monitor
+
+//
+//  runbooks.go  --  Runbook links and remediation hints, added to the payload of every event so whoever is
+//    on call lands straight on the right procedure. A rule can carry them:
+//
+//    { "name": "conn-rate-limit", "runbook": "https://wiki.example.com/rb/conn-rate", "remediation": "Check the VIP's upstream" }
+//
+//  and the 'services' section of config.json can give them per service (a VIP, service group or server,
+//  by name), which wins over the rule's:
+//
+//    "services": { "ws-vip": { "runbook": "https://wiki.example.com/rb/ws", "remediation": "Page the web team" } }
+//
+//  A server or service group can also say which VIP it is behind, for correlations by VIP (correlate.go):
+//
+//    "services": { "web-1": { "vip": "ws-vip" }, "sg-web": { "vip": "ws-vip" } }
+//
+
+// ServiceConfig is one entry in the 'services' section of the config.
+type ServiceConfig struct {
+	Runbook     string `json:"runbook"`
+	Remediation string `json:"remediation"`
+	VIP         string `json:"vip"`      // The VIP in front of this server or service group
+	Suppress    string `json:"suppress"` // Suppression window for this object's alerts, over the rule's. See suppress.go
+}
+
+// serviceFields are the payload fields looked up in 'services', most specific first.
+var serviceFields = []string{"service_group", "object_name", "server"}
+
+// addRunbook sets the runbook and remediation fields of the payload, if there are any for it.
+func addRunbook(payload map[string]interface{}, r *Rule, services map[string]ServiceConfig) {
+	runbook, remediation := r.Runbook, r.Remediation
+	for _, f := range serviceFields {
+		name, _ := payload[f].(string)
+		if svc, ok := services[name]; ok && name != "" {
+			if svc.Runbook != "" {
+				runbook = svc.Runbook
+			}
+			if svc.Remediation != "" {
+				remediation = svc.Remediation
+			}
+			break
+		}
+	}
+	if runbook != "" {
+		payload["runbook"] = runbook
+	}
+	if remediation != "" {
+		payload["remediation"] = remediation
+	}
+}
@@ -0,0 +1,255 @@
+package monitor
+
+//
+//  schema.go  --  Describes the payload this agent publishes, and the 'schema' subcommand that lets
+//    consumer teams compare the payloads of two agent versions before they upgrade.
+//
+//  Usage:
+//    a10-connection-rate-monitor schema dump                      # print this build's payload schema
+//    a10-connection-rate-monitor schema diff old.json [new.json]  # compare two schemas (new defaults to this build)
+//
+//  'diff' exits with 1 if anything breaking was found, so it can gate a CI pipeline.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Version is the agent version reported in events and the schema. main sets it from its agentVersion,
+// which is set at build time.
+var Version = "dev"
+
+// SchemaField describes one field of the published payload.
+type SchemaField struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Deprecated string `json:"deprecated,omitempty"`  // Agent version the field was deprecated in
+	ReplacedBy string `json:"replaced_by,omitempty"` // Field that carries the same value from now on
+
+	derive func(payload map[string]interface{}) (interface{}, bool) // For one that isn't just ReplacedBy's value
+}
+
+// PayloadSchema describes the shape of the messages published by one agent version.
+type PayloadSchema struct {
+	Version string        `json:"version"`
+	Format  string        `json:"format"` // "text" or "json"
+	Fields  []SchemaField `json:"fields"`
+}
+
+// payloadFields is the list of fields this build publishes. Keep deprecated fields in here (with
+// Deprecated and ReplacedBy set) for one release cycle after renaming or replacing them.
+var payloadFields = []SchemaField{
+	// Up to 0.1.3 the payload was just this line, not JSON. See legacyText
+	{Name: "text", Type: "string", Deprecated: "0.2.0", ReplacedBy: "message", derive: legacyText},
+	{Name: "rule", Type: "string"},
+	{Name: "type", Type: "string"},
+	{Name: "severity", Type: "string"}, // Always a Syslog severity name, see qos.go
+	{Name: "hostname", Type: "string"},
+	{Name: "message", Type: "string"},
+	{Name: "partition", Type: "string"},   // Only on multi-partition devices
+	{Name: "alert_id", Type: "string"},    // The suppression key, for acks (see acks.go)
+	{Name: "alert_state", Type: "string"}, // open, acknowledged or resolved, see lifecycle.go
+	{Name: "alert_opened", Type: "string"},
+	{Name: "incident_id", Type: "string"}, // The same from open to resolved, see lifecycle.go
+	{Name: "alert_sequence", Type: "int"},
+	{Name: "runbook", Type: "string"},
+	{Name: "remediation", Type: "string"},
+	{Name: "timestamp", Type: "string"}, // RFC 3339, UTC
+	{Name: "received", Type: "string"},
+	{Name: "timestamp_substituted", Type: "bool"}, // Only there when true
+	{Name: "test", Type: "bool"},                  // Only on drills, see drill.go
+	{Name: "repeat_count", Type: "int"},           // Only on dedup summaries, with first_seen and last_seen
+	{Name: "first_seen", Type: "string"},
+	{Name: "last_seen", Type: "string"},
+	{Name: "suppressed_count", Type: "int"}, // Only on suppression summaries, with first_seen and last_seen
+	{Name: "threshold_count", Type: "int"},  // Only from rules with a threshold
+	{Name: "threshold_window", Type: "string"},
+	{Name: "recovered", Type: "bool"}, // Only on all-clears, with recovered_type, event_count, first_seen and last_seen
+	{Name: "recovered_type", Type: "string"},
+	{Name: "event_count", Type: "int"},
+	{Name: "escalation_level", Type: "int"}, // Only on escalated events, with alerting_since. See paging.go
+	{Name: "alerting_since", Type: "string"},
+	{Name: "exceed_ratio", Type: "float"}, // Only from rules with a magnitude, with base_severity if it was raised. See magnitude.go
+	{Name: "base_severity", Type: "string"},
+	{Name: "baseline", Type: "float"}, // Only on anomaly events, with count, stddev, deviation and window. See anomaly.go
+	{Name: "stddev", Type: "float"},
+	{Name: "deviation", Type: "float"},
+	{Name: "window", Type: "string"},
+	{Name: "transitions", Type: "int"}, // Only on flapping and stable events, with flapping_since. See flaps.go
+	{Name: "flapping_since", Type: "string"},
+	{Name: "last_heard", Type: "string"}, // Only on device.silent events, with silent_for. See quietdevices.go
+	{Name: "silent_for", Type: "string"},
+	{Name: "storm_rate", Type: "int"}, // Only on alert.storm events, with rate. See storm.go
+	{Name: "storm_since", Type: "string"},
+	{Name: "quiet_hours", Type: "string"}, // Only during quiet hours, which entry it went by. See quiet.go
+	{Name: "cluster", Type: "string"},     // Only from members of a cluster, with cluster_members. See clusters.go
+	{Name: "cluster_members", Type: "list"},
+	{Name: "event_id", Type: "string"}, // The same in every region and for every sink
+	{Name: "regions", Type: "list"},    // Only with mqtt_mirror
+	// -- Fields of the built-in rules. Custom rules add their own.
+	{Name: "object_type", Type: "string"},
+	{Name: "object_name", Type: "string"},
+	{Name: "limit", Type: "int"}, // null when the message doesn't give it (some ACOS 5.x wordings)
+	{Name: "rate", Type: "int"},  // The rate that went over the limit; null when the message doesn't give it
+	{Name: "action", Type: "string"},
+	{Name: "address", Type: "string"},
+	{Name: "port", Type: "int"},
+	{Name: "state", Type: "string"},
+	{Name: "monitor", Type: "string"},
+	{Name: "server", Type: "string"},
+	{Name: "anomaly", Type: "string"},
+	{Name: "client_ip", Type: "string"},
+	{Name: "count", Type: "int"},
+	{Name: "log_name", Type: "string"},
+	{Name: "status", Type: "int"},
+	{Name: "uri", Type: "string"},
+	{Name: "quota_type", Type: "string"},
+	{Name: "protocol", Type: "string"},
+	{Name: "inside_ip", Type: "string"},
+	{Name: "nat_ip", Type: "string"},
+	{Name: "quota", Type: "int"},
+	{Name: "port_start", Type: "int"},
+	{Name: "port_end", Type: "int"},
+	{Name: "policy", Type: "string"},
+	{Name: "signature_id", Type: "int"},
+	{Name: "tls_version", Type: "string"},
+	{Name: "cipher", Type: "string"},
+	{Name: "reason", Type: "string"},
+	{Name: "metric", Type: "string"},
+	{Name: "cpu", Type: "int"},
+	{Name: "value", Type: "float"},
+	{Name: "threshold", Type: "float"},
+	{Name: "correlated", Type: "list"},       // Event types behind a correlated event, see correlate.go
+	{Name: "correlation_id", Type: "string"}, // On a correlated event, and the events that went into it
+	{Name: "events", Type: "list"},           // The events behind a correlated event
+	{Name: "vip", Type: "string"},            // On a correlated event "by": "vip"
+}
+
+func currentSchema() PayloadSchema {
+	return PayloadSchema{Version: Version, Format: "json", Fields: payloadFields}
+}
+
+// legacyText is the line that 0.1.3 and before published instead of the JSON,
+// "A10 Thunder node = <hostname>::<message>". A consumer still parsing it can take the "text" field until
+// it moves to the fields.
+func legacyText(payload map[string]interface{}) (interface{}, bool) {
+	host, _ := payload["hostname"].(string)
+	msg, ok := payload["message"].(string)
+	if !ok {
+		return nil, false
+	}
+	return "A10 Thunder node = " + host + "::" + msg, true
+}
+
+// addDeprecatedFields copies values into the deprecated field names, so consumers that have not
+// upgraded yet keep working. Only done when 'emit_deprecated' is set in the config.
+func addDeprecatedFields(payload map[string]interface{}) {
+	for _, f := range payloadFields {
+		if f.Deprecated == "" || f.ReplacedBy == "" {
+			continue
+		}
+		if f.derive != nil {
+			if v, ok := f.derive(payload); ok {
+				payload[f.Name] = v
+			}
+			continue
+		}
+		if v, ok := payload[f.ReplacedBy]; ok {
+			payload[f.Name] = v
+		}
+	}
+}
+
+func readSchema(fn string) (PayloadSchema, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return PayloadSchema{}, errors.New("Unable to open Schema File " + fn + "!")
+	}
+	var s PayloadSchema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return PayloadSchema{}, fmt.Errorf("Unable to parse Schema File %s: %v", fn, err)
+	}
+	return s, nil
+}
+
+// diffSchemas compares two payload schemas. Removing a field, changing its type or changing the
+// payload format is breaking; adding or deprecating a field is not.
+func diffSchemas(prev, next PayloadSchema) (breaking []string, notes []string) {
+	if prev.Format != next.Format {
+		breaking = append(breaking, fmt.Sprintf("payload format changed: %s -> %s", prev.Format, next.Format))
+	}
+	newFields := make(map[string]SchemaField)
+	for _, f := range next.Fields {
+		newFields[f.Name] = f
+	}
+	oldFields := make(map[string]SchemaField)
+	for _, f := range prev.Fields {
+		oldFields[f.Name] = f
+		nf, ok := newFields[f.Name]
+		switch {
+		case !ok && f.Deprecated != "":
+			breaking = append(breaking, fmt.Sprintf("field '%s' removed (deprecated since %s, use '%s')", f.Name, f.Deprecated, f.ReplacedBy))
+		case !ok:
+			breaking = append(breaking, fmt.Sprintf("field '%s' removed", f.Name))
+		case nf.Type != f.Type:
+			breaking = append(breaking, fmt.Sprintf("field '%s' type changed: %s -> %s", f.Name, f.Type, nf.Type))
+		case nf.Deprecated != "" && f.Deprecated == "":
+			notes = append(notes, fmt.Sprintf("field '%s' deprecated, use '%s' instead", f.Name, nf.ReplacedBy))
+		}
+	}
+	for _, f := range next.Fields {
+		if _, ok := oldFields[f.Name]; !ok {
+			notes = append(notes, fmt.Sprintf("field '%s' (%s) added", f.Name, f.Type))
+		}
+	}
+	return breaking, notes
+}
+
+// SchemaCommand runs the 'schema' subcommand, returning the exit status.
+func SchemaCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Usage: schema dump | schema diff old.json [new.json]")
+		return 2
+	}
+	switch args[0] {
+	case "dump":
+		b, _ := json.MarshalIndent(currentSchema(), "", "    ")
+		fmt.Println(string(b))
+		return 0
+	case "diff":
+		if len(args) < 2 {
+			fmt.Println("Usage: schema diff old.json [new.json]")
+			return 2
+		}
+		prev, err := readSchema(args[1])
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		next := currentSchema()
+		if len(args) > 2 {
+			if next, err = readSchema(args[2]); err != nil {
+				fmt.Println(err)
+				return 2
+			}
+		}
+		breaking, notes := diffSchemas(prev, next)
+		fmt.Printf("Comparing payload schema %s -> %s\n", prev.Version, next.Version)
+		for _, n := range notes {
+			fmt.Println("  " + n)
+		}
+		for _, b := range breaking {
+			fmt.Println("  BREAKING: " + b)
+		}
+		if len(breaking) > 0 {
+			return 1
+		}
+		fmt.Println("  No breaking changes.")
+		return 0
+	}
+	fmt.Println("Unknown schema command: " + args[0])
+	return 2
+}
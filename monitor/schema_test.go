@@ -0,0 +1,44 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// payloadSink keeps the payloads it is given.
+type payloadSink struct{ got []map[string]interface{} }
+
+func (s *payloadSink) Name() string { return "test" }
+
+func (s *payloadSink) Publish(ctx context.Context, out *Outgoing) error {
+	s.got = append(s.got, out.Payload)
+	return nil
+}
+
+// With emit_deprecated the payload keeps the 0.1.3 text line, made after redaction; without it, it doesn't.
+func TestEmitDeprecated(t *testing.T) {
+	for _, emit := range []bool{false, true} {
+		m := newTestMonitor(t, Configuration{Emit_Deprecated: emit,
+			Redact: []RedactRule{{Fields: []string{"message"}, Action: "mask_ip"}}})
+		s := &payloadSink{}
+		m.a.sinks.sinks, m.a.sinks.busy = []Sink{s}, make([]int32, 1)
+		m.a.process(context.Background(), format.LogParts{"hostname": "thunder1", "severity": 4, "timestamp": time.Now(),
+			"content": "[ACOS]<4> SSL handshake failure from 10.1.2.3"})
+		if len(s.got) != 1 {
+			t.Fatalf("emit_deprecated %v: %d published", emit, len(s.got))
+		}
+		text, ok := s.got[0]["text"]
+		if !emit {
+			if ok {
+				t.Errorf("text without emit_deprecated: %v", text)
+			}
+			continue
+		}
+		if text != "A10 Thunder node = thunder1::SSL handshake failure from 10.1.2.0" {
+			t.Errorf("text %q", text)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package monitor
+
+//
+//  sevfilter.go  --  Dropping and routing records by their Syslog severity and facility, before any rule
+//    sees them. Severities are the Syslog numbers (0 emergency ... 4 warning ... 7 debug), so
+//    "max_severity": 4 keeps warnings and worse and drops notice, info and debug.
+//
+//  "syslog_filter": { "max_severity": 4, "facilities": [16, 17], "severity_topics": {"critical": "alert/critical"} }
+//
+//  'severity_topics' sends events from records of that severity somewhere other than notify_topic (rule
+//  topics still win).
+//
+
+// SyslogFilterConfig holds the 'syslog_filter' section of the config.
+type SyslogFilterConfig struct {
+	Max_Severity    *int              `json:"max_severity"`    // Drop less severe (higher numbered) records. Unset = keep all
+	Facilities      []int             `json:"facilities"`      // Only keep these facilities. Empty = all
+	Severity_Topics map[string]string `json:"severity_topics"` // By severity name, used in place of notify_topic
+}
+
+// keep says whether a record with this severity and facility gets past the filter.
+func (f *SyslogFilterConfig) keep(severity int, facility int) bool {
+	if f.Max_Severity != nil && severity > *f.Max_Severity {
+		return false
+	}
+	if len(f.Facilities) == 0 {
+		return true
+	}
+	for _, fac := range f.Facilities {
+		if fac == facility {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package monitor
+
+//
+//  sharedsub.go  --  Help for consumers that scale out with MQTT 5 shared subscriptions, where several
+//    subscribers in a "$share/<group>/..." group split the messages between them:
+//
+//  "mqtt_shared": { "group": "a10-alerts" }
+//
+//  With a group set, every topic the agent can publish to (notify_topic, partition_topics, severity_topics,
+//  rule, escalation, correlation, quiet hours, anomaly and device_silence topics, the digest, report, rates
+//  and storm topics, diag_topic, heartbeat_topic) is checked when the config and rules load: no wildcards,
+//  no "$" at the start, no empty levels, since any of those would stop a shared subscription from matching.
+//  A rules file with a bad topic doesn't load (or reload). Templated topics are checked as far as their
+//  first "{{".
+//
+//  The subscription strings the consumers need, one per branch of the topic tree, are on GET /subscriptions
+//  and in GET /status (see api.go):
+//
+//    [ "$share/a10-alerts/alert/A10Thunder/#", "$share/a10-alerts/ops/#" ]
+//
+//  Subscribers that each want every message, rather than a share, use the same filters without the
+//  "$share/<group>/".
+//
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SharedConfig holds the 'mqtt_shared' section of the config.
+type SharedConfig struct {
+	Group string `json:"group"`
+}
+
+func (c *SharedConfig) check() error {
+	if c.Group == "" {
+		return nil
+	}
+	if strings.ContainsAny(c.Group, "/+#") {
+		return fmt.Errorf("mqtt_shared: group '%s' can't have '/', '+' or '#' in it", c.Group)
+	}
+	return nil
+}
+
+// checkPublishTopic makes sure a topic can be matched by a shared subscription.
+func checkPublishTopic(topic string) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("empty topic")
+	case strings.HasPrefix(topic, "$"):
+		return fmt.Errorf("topic '%s' starts with '$', which is kept for the broker", topic)
+	case strings.ContainsAny(topic, "+#"):
+		return fmt.Errorf("topic '%s' has an MQTT wildcard in it", topic)
+	case strings.HasPrefix(topic, "/") || strings.HasSuffix(topic, "/") || strings.Contains(topic, "//"):
+		return fmt.Errorf("topic '%s' has an empty level", topic)
+	}
+	return nil
+}
+
+// topicFilter is the subscription filter that takes everything a rule can publish to: its topic, or for a
+// templated topic, everything under the part before the template.
+func (r *Rule) topicFilter(notifyTopic string) string {
+	if r.topic != nil {
+		prefix := r.Topic[:strings.Index(r.Topic, "{{")]
+		if i := strings.LastIndex(prefix, "/"); i > 0 {
+			return prefix[:i] + "/#"
+		}
+		return "#"
+	}
+	return r.TopicFor(notifyTopic, nil)
+}
+
+// publishFilters is a filter for every topic the agent can publish to, with config and rs.
+func publishFilters(config *Configuration, rs *ruleState) []string {
+	var topics []string
+	add := func(t string) { topics = append(topics, t) }
+	bases := []string{config.Notify_Topic}
+	for _, t := range config.Partition_Topics {
+		bases = append(bases, t)
+	}
+	for _, t := range config.Syslog_Filter.Severity_Topics {
+		bases = append(bases, t)
+	}
+	for _, b := range bases {
+		add(b)
+	}
+	rules := append(RuleSet{}, rs.rules...)
+	for _, c := range rs.correlator.rules {
+		rules = append(rules, c.rule)
+	}
+	for _, r := range rules {
+		if r.Escalate != nil {
+			for _, s := range r.Escalate.Steps {
+				if s.Topic != "" {
+					add(s.Topic)
+				}
+			}
+		}
+		if r.topic != nil || r.Topic != "" {
+			add(r.topicFilter(config.Notify_Topic))
+			continue
+		}
+		for _, b := range bases {
+			add(r.TopicFor(b, nil))
+		}
+	}
+	for _, q := range config.Quiet_Hours {
+		if q.Topic != "" {
+			add(q.Topic)
+		}
+	}
+	if config.Device_Silence.After != "" {
+		if config.Device_Silence.Topic != "" {
+			add(config.Device_Silence.Topic)
+		} else {
+			add(config.Notify_Topic + "/device")
+		}
+	}
+	if config.Anomaly.Window != "" {
+		if config.Anomaly.Topic != "" {
+			add(config.Anomaly.Topic)
+		} else {
+			add(config.Notify_Topic + "/anomaly")
+		}
+	}
+	if config.Rates.Interval != "" {
+		if config.Rates.Topic != "" {
+			add(config.Rates.Topic)
+		} else {
+			add(config.Notify_Topic + "/rates")
+		}
+	}
+	if config.Report.Interval != "" {
+		if config.Report.Topic != "" {
+			add(config.Report.Topic)
+		} else {
+			add(config.Notify_Topic + "/report")
+		}
+	}
+	if config.Storm.Rate > 0 {
+		if config.Storm.Topic != "" {
+			add(config.Storm.Topic)
+		} else {
+			add(config.Notify_Topic + "/storm")
+		}
+	}
+	if config.Digest.Interval != "" {
+		if config.Digest.Topic != "" {
+			add(config.Digest.Topic)
+		} else {
+			add(config.Notify_Topic + "/digest")
+		}
+	}
+	if config.Heartbeat_Topic != "" {
+		add(config.Heartbeat_Topic)
+	}
+	if config.Diag_Topic != "" {
+		add(config.Diag_Topic)
+	} else {
+		add(config.Notify_Topic + "/agent")
+	}
+	return topics
+}
+
+// checkSharedTopics checks every topic the agent can publish to, if mqtt_shared is on.
+func checkSharedTopics(config *Configuration, rs *ruleState) error {
+	if config.MQTT_Shared.Group == "" {
+		return nil
+	}
+	for _, t := range publishFilters(config, rs) {
+		if strings.HasSuffix(t, "/#") || t == "#" {
+			t = strings.TrimSuffix(strings.TrimSuffix(t, "#"), "/")
+			if t == "" {
+				continue // A topic that is all template; nothing to check until it renders
+			}
+		}
+		if err := checkPublishTopic(t); err != nil {
+			return fmt.Errorf("mqtt_shared: %v", err)
+		}
+	}
+	return nil
+}
+
+// sharedSubscriptions is what consumers in the group should subscribe to: a filter per branch of the topic
+// tree, leaving out any that another one already covers.
+func sharedSubscriptions(config *Configuration, rs *ruleState) []string {
+	topics := publishFilters(config, rs)
+	seen := make(map[string]bool)
+	for _, t := range topics {
+		seen[t] = true
+	}
+	for _, t := range topics {
+		// A topic with others under it becomes a branch: "alert/A10Thunder/#" takes them all, and itself
+		for _, o := range topics {
+			if strings.HasPrefix(o, t+"/") {
+				delete(seen, t)
+				seen[t+"/#"] = true
+				break
+			}
+		}
+	}
+	var filters []string
+	for t := range seen {
+		covered := false
+		for o := range seen {
+			branch := strings.TrimSuffix(o, "/#")
+			if o != t && (o == "#" || (strings.HasSuffix(o, "/#") && (t == branch || strings.HasPrefix(t, branch+"/")))) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			filters = append(filters, "$share/"+config.MQTT_Shared.Group+"/"+t)
+		}
+	}
+	sort.Strings(filters)
+	return filters
+}
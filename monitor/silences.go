@@ -0,0 +1,310 @@
+package monitor
+
+//
+//  silences.go  --  Maintenance windows, for planned load tests and changes. While a silence is on, the
+//    events it covers are counted (and go into digests) but nothing is published for them:
+//
+//  "silences": [
+//    { "name": "load-test", "start": "2026-11-02T22:00:00Z", "end": "2026-11-03T01:00:00Z", "object": "ws-vip" },
+//    { "name": "patching", "schedule": "0 2 * * 6", "duration": "2h", "zone": "Europe/London", "device": "thunder-lab-*" }
+//  ]
+//
+//    start, end          a one-off window, RFC 3339. Either can be left out for "from now" or "until removed"
+//    schedule, duration  a repeating one: a cron schedule (minute hour day-of-month month day-of-week, with
+//                        *, lists, ranges and /steps; day 0 is Sunday) for when it starts, and how long it lasts
+//    zone                the timezone the schedule is in. Default the agent's
+//    device, object, type  which events it covers, as patterns like "thunder-lab-*". Default all of them
+//
+//  Summaries and all-clears for covered objects are held back too. On the API:
+//
+//    GET  /silences                 the silences, whether each is on, and how many events it has held back
+//    POST /silences                 add one (the same JSON as above). Lost on restart
+//    POST /silences/remove?name=... remove one
+//
+//  The POSTs are only there when 'api_token' is set: without it anyone who can reach the API could silence
+//  everything.
+//
+//  How many events each silence held back, per device, is in the counters and a10crm_events_silenced_total.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Silence is one entry in 'silences'.
+type Silence struct {
+	Name     string `json:"name"`
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	Device   string `json:"device,omitempty"`
+	Object   string `json:"object,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+
+	start, end time.Time
+	window     *cronWindow // nil without a schedule
+	silenced   uint64
+}
+
+func (s *Silence) compile() error {
+	if s.Name == "" {
+		return errors.New("Silence with no name!")
+	}
+	var err error
+	if s.Start != "" {
+		if s.start, err = time.Parse(time.RFC3339, s.Start); err != nil {
+			return fmt.Errorf("Silence '%s': bad start '%s'", s.Name, s.Start)
+		}
+	}
+	if s.End != "" {
+		if s.end, err = time.Parse(time.RFC3339, s.End); err != nil {
+			return fmt.Errorf("Silence '%s': bad end '%s'", s.Name, s.End)
+		}
+	}
+	if s.Schedule == "" && s.Start == "" && s.End == "" {
+		return fmt.Errorf("Silence '%s' needs a start, end or schedule", s.Name)
+	}
+	if s.Schedule != "" {
+		if s.window, err = newCronWindow(s.Schedule, s.Duration, s.Zone); err != nil {
+			return fmt.Errorf("Silence '%s': %v", s.Name, err)
+		}
+	}
+	for _, pat := range []string{s.Device, s.Object, s.Type} {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("Silence '%s': bad pattern '%s'", s.Name, pat)
+		}
+	}
+	return nil
+}
+
+// active says whether the silence is on at now.
+func (s *Silence) active(now time.Time) bool {
+	if !s.start.IsZero() && now.Before(s.start) {
+		return false
+	}
+	if !s.end.IsZero() && !now.Before(s.end) {
+		return false
+	}
+	return s.window == nil || s.window.active(now)
+}
+
+func (s *Silence) covers(ev Event) bool {
+	for _, m := range []struct{ pat, v string }{{s.Device, ev.Device}, {s.Object, ev.Object}, {s.Type, ev.Type}} {
+		if m.pat == "" {
+			continue
+		}
+		if ok, _ := path.Match(m.pat, m.v); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// silences are the silences from the config and the API. Safe to use from several goroutines.
+type silences struct {
+	mu   sync.Mutex
+	list []*Silence
+}
+
+func newSilences(cfg []*Silence) (*silences, error) {
+	for _, s := range cfg {
+		if err := s.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &silences{list: cfg}, nil
+}
+
+// match is the silence that holds ev back, "" if none does.
+func (ss *silences) match(ev Event, now time.Time) string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, s := range ss.list {
+		if s.covers(ev) && s.active(now) {
+			s.silenced++
+			return s.Name
+		}
+	}
+	return ""
+}
+
+func (ss *silences) registerAPI(mux *http.ServeMux, token string) {
+	mux.HandleFunc("/silences", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			if token == "" {
+				http.Error(w, "Adding a silence needs an api_token", http.StatusForbidden)
+				return
+			}
+			requireToken(token, ss.addHandler)(w, r)
+			return
+		}
+		now := time.Now()
+		ss.mu.Lock()
+		out := make([]map[string]interface{}, 0, len(ss.list))
+		for _, s := range ss.list {
+			out = append(out, map[string]interface{}{"silence": *s, "active": s.active(now), "silenced": s.silenced})
+		}
+		ss.mu.Unlock()
+		writeJSON(w, out)
+	})
+	if token == "" {
+		return
+	}
+	mux.HandleFunc("/silences/remove", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		for i, s := range ss.list {
+			if s.Name == name {
+				ss.list = append(ss.list[:i:i], ss.list[i+1:]...)
+				writeJSON(w, map[string]string{"result": "ok"})
+				return
+			}
+		}
+		http.Error(w, "No silence with that name", http.StatusNotFound)
+	}))
+}
+
+func (ss *silences) addHandler(w http.ResponseWriter, r *http.Request) {
+	s := &Silence{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		http.Error(w, "Bad silence: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.compile(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, o := range ss.list {
+		if o.Name == s.Name {
+			http.Error(w, "There is already a silence called '"+s.Name+"'", http.StatusConflict)
+			return
+		}
+	}
+	ss.list = append(ss.list, s)
+	writeJSON(w, map[string]string{"result": "ok"})
+}
+
+// cronWindow is a repeating window of time: duration long, from each time the schedule matches in zone.
+// Also used by quiet hours, see quiet.go.
+type cronWindow struct {
+	cron     *cronSchedule
+	duration time.Duration
+	zone     *time.Location
+	checked  time.Time // The minute active was last worked out for
+	on       bool
+}
+
+func newCronWindow(schedule string, duration string, zone string) (*cronWindow, error) {
+	c, err := parseCron(schedule)
+	if err != nil {
+		return nil, err
+	}
+	w := &cronWindow{cron: c, zone: time.Local}
+	if w.duration, err = time.ParseDuration(duration); err != nil || w.duration <= 0 {
+		return nil, errors.New("a schedule needs a duration, e.g. \"2h\"")
+	}
+	if zone != "" {
+		if w.zone, err = time.LoadLocation(zone); err != nil {
+			return nil, fmt.Errorf("unknown timezone '%s'", zone)
+		}
+	}
+	return w, nil
+}
+
+// active says whether the window is on at now. Not safe to use from several goroutines.
+func (w *cronWindow) active(now time.Time) bool {
+	minute := now.Truncate(time.Minute)
+	if minute.Equal(w.checked) {
+		return w.on
+	}
+	// On if it was due to start within the last duration
+	w.checked, w.on = minute, false
+	for t := minute; now.Sub(t) < w.duration; t = t.Add(-time.Minute) {
+		if w.cron.match(t.In(w.zone)) {
+			w.on = true
+			break
+		}
+	}
+	return w.on
+}
+
+// cronSchedule is a parsed 5-field cron schedule: which minutes, hours, days, months and weekdays.
+type cronSchedule struct {
+	fields         [5]map[int]bool
+	domAny, dowAny bool
+}
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("schedule '%s' needs 5 fields", spec)
+	}
+	c := &cronSchedule{domAny: parts[2] == "*", dowAny: parts[4] == "*"}
+	for i, part := range parts {
+		lo, hi := cronRanges[i][0], cronRanges[i][1]
+		c.fields[i] = make(map[int]bool)
+		for _, item := range strings.Split(part, ",") {
+			step := 1
+			if j := strings.Index(item, "/"); j >= 0 {
+				n, err := strconv.Atoi(item[j+1:])
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("bad step in schedule '%s'", spec)
+				}
+				step, item = n, item[:j]
+			}
+			from, to := lo, hi
+			if item != "*" {
+				var err error
+				bounds := strings.SplitN(item, "-", 2)
+				if from, err = strconv.Atoi(bounds[0]); err != nil {
+					return nil, fmt.Errorf("bad value '%s' in schedule '%s'", item, spec)
+				}
+				to = from
+				if len(bounds) == 2 {
+					if to, err = strconv.Atoi(bounds[1]); err != nil {
+						return nil, fmt.Errorf("bad value '%s' in schedule '%s'", item, spec)
+					}
+				} else if step > 1 {
+					to = hi // "5/15" is every 15 from 5
+				}
+			}
+			if from < lo || to > hi || from > to {
+				return nil, fmt.Errorf("'%s' is out of range in schedule '%s'", item, spec)
+			}
+			for v := from; v <= to; v += step {
+				c.fields[i][v] = true
+			}
+		}
+	}
+	if c.fields[4][7] {
+		c.fields[4][0] = true // Sunday both ways
+	}
+	return c, nil
+}
+
+func (c *cronSchedule) match(t time.Time) bool {
+	if !c.fields[0][t.Minute()] || !c.fields[1][t.Hour()] || !c.fields[3][int(t.Month())] {
+		return false
+	}
+	dom, dow := c.fields[2][t.Day()], c.fields[4][int(t.Weekday())]
+	if !c.domAny && !c.dowAny {
+		return dom || dow // As cron does
+	}
+	return dom && dow
+}
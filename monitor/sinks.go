@@ -0,0 +1,272 @@
+package monitor
+
+//
+//  sinks.go  --  Which outputs a rule's events go to. By default every event goes everywhere: MQTT, each
+//    output plugin and Grafana. A rule (or correlation) with "sinks" only goes to the ones it names, so
+//    server-down alerts can go to the ITSM plugin while conn-rate events stay on MQTT:
+//
+//    { "name": "health-monitor", "topic": "alert/A10Thunder/servers", "sinks": ["mqtt", "servicenow"] },
+//    { "name": "conn-rate-limit", "topic": "alert/A10Thunder/rate", "sinks": ["mqtt", "grafana"] }
+//
+//  The names are "mqtt", "grafana", "kafka", "nats", "amqp", "slack", "teams" and the 'name' of each entry
+//  in 'plugins' and 'webhooks'. A name that isn't one of those stops the rules from loading, so a typo can't
+//  quietly drop alerts.
+//  Events() (see monitor.go) gets every event whatever its sinks.
+//
+//  Each output is a Sink. deliver (pipeline.go) builds the payload, topic and key once and hands them to
+//  the fan-out, which gives them to every sink the event goes to at once, and keeps the output health
+//  (health.go) and error counts (errors.go) for all of them. It waits for them all, but no longer than the
+//  longest of the mqtt, plugin and sink deadlines (deadlines.go), so one slow output can't hold up the
+//  others or the next event. A sink still busy past that is left to finish on its own; until it does,
+//  the events it would get fail as deliver.sink_busy rather than piling up behind it, except where the sink
+//  can keep them for later: MQTT spools them (spool.go), if there is a spool, and sends them once the broker
+//  takes publishes again. A new destination is a Sink, a name here, and a line in newSinks; the pipeline
+//  doesn't change.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sink is one output.
+type Sink interface {
+	// Name is what rules give in "sinks" and what the output is called in the output health.
+	Name() string
+	// Publish delivers out, within ctx. errSinkSkipped and errSinkQueued aren't failures; any other
+	// error is one, counted under its code if it is a *sinkError.
+	Publish(ctx context.Context, out *Outgoing) error
+}
+
+// Outgoing is an event on its way out, with what deliver worked out for it once for every sink.
+type Outgoing struct {
+	Event   Event
+	Payload map[string]interface{}
+	Topic   string
+	Key     string      // See eventkey.go
+	Quiet   *QuietHours // The quiet hours it falls in, nil if none
+}
+
+var (
+	// errSinkSkipped is a sink leaving an event out, say one its filter doesn't take.
+	errSinkSkipped = errors.New("skipped")
+	// errSinkQueued is a sink taking an event to deliver later; it keeps the figures for that itself.
+	errSinkQueued = errors.New("queued")
+)
+
+// queueingSink is a sink that can keep an event for later while it is still busy with an earlier one,
+// rather than lose it. MQTT is one, with a spool.
+type queueingSink interface {
+	// queue takes out to deliver later, false if it can't.
+	queue(ctx context.Context, out *Outgoing) bool
+}
+
+// sinkError is a failed delivery, with its error code.
+type sinkError struct {
+	code string
+	err  error
+}
+
+func (e *sinkError) Error() string { return e.err.Error() }
+func (e *sinkError) Unwrap() error { return e.err }
+
+// fanout hands events to the sinks, all at once.
+type fanout struct {
+	sinks  []Sink
+	busy   []int32       // 1 while the sink at the same index has a publish going
+	wait   time.Duration // How long publish waits for the sinks
+	health *outputHealth
+	debug  int
+}
+
+// newSinks is every output that is configured: MQTT if there is a broker, then the plugins, Grafana, Kafka,
+// NATS, AMQP, the webhooks, Slack and Teams.
+func (a *agent) newSinks(plugins []*outputPlugin) (*fanout, error) {
+	f := &fanout{wait: a.deadlines.sink, health: a.health, debug: a.config.Debug}
+	for _, d := range []time.Duration{a.deadlines.mqtt, a.deadlines.plugin} {
+		if d > f.wait {
+			f.wait = d
+		}
+	}
+	if a.client != nil {
+		f.sinks = append(f.sinks, mqttSink{a})
+	}
+	for _, p := range plugins {
+		f.sinks = append(f.sinks, p)
+	}
+	if a.grafana != nil {
+		f.sinks = append(f.sinks, a.grafana)
+	}
+	kafka, err := newKafkaSink(a.config.Kafka, a.config.Client_ID, a.deadlines.sink)
+	if err != nil {
+		return nil, err
+	}
+	if kafka != nil {
+		f.sinks = append(f.sinks, kafka)
+	}
+	nats, err := newNATSSink(a.config.NATS, a.config.Client_ID, a.deadlines.sink)
+	if err != nil {
+		return nil, err
+	}
+	if nats != nil {
+		f.sinks = append(f.sinks, nats)
+	}
+	amqp, err := newAMQPSink(a.config.AMQP, a.config.Client_ID, a.deadlines.sink)
+	if err != nil {
+		return nil, err
+	}
+	if amqp != nil {
+		f.sinks = append(f.sinks, amqp)
+	}
+	taken := make(map[string]bool)
+	for _, s := range builtinSinks {
+		taken[s] = true
+	}
+	for _, p := range plugins {
+		taken[p.cfg.Name] = true
+	}
+	webhooks, err := newWebhookSinks(a.config.Webhooks, taken, a.deadlines.sink)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range webhooks {
+		f.sinks = append(f.sinks, w)
+	}
+	slack, err := newSlackSink(a.config.Slack, a.deadlines.sink)
+	if err != nil {
+		return nil, err
+	}
+	if slack != nil {
+		f.sinks = append(f.sinks, slack)
+	}
+	teams, err := newTeamsSink(a.config.Teams, a.deadlines.sink)
+	if err != nil {
+		return nil, err
+	}
+	if teams != nil {
+		f.sinks = append(f.sinks, teams)
+	}
+	f.busy = make([]int32, len(f.sinks))
+	return f, nil
+}
+
+// publish gives out to every sink its event goes to at once, and waits for them, up to f.wait or until ctx
+// is done. out is shared between the sinks, so they mustn't change it.
+func (f *fanout) publish(ctx context.Context, out *Outgoing) {
+	var wg sync.WaitGroup
+	for i, s := range f.sinks {
+		name := s.Name()
+		if !out.Event.sendsTo(name) || !out.Quiet.sendsTo(name) {
+			continue
+		}
+		if !atomic.CompareAndSwapInt32(&f.busy[i], 0, 1) {
+			if q, ok := s.(queueingSink); ok && q.queue(ctx, out) {
+				continue // Like errSinkQueued
+			}
+			f.health.record(name, false, 0)
+			reportError(f.debug, errDeliverSinkBusy, "Publish Error ("+name+"): still busy with an earlier event")
+			continue
+		}
+		wg.Add(1)
+		go func(i int, s Sink) {
+			defer wg.Done()
+			defer atomic.StoreInt32(&f.busy[i], 0)
+			f.publishTo(ctx, s, out)
+		}(i, s)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(f.wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// publishTo gives out to one sink and records how it went.
+func (f *fanout) publishTo(ctx context.Context, s Sink, out *Outgoing) {
+	name := s.Name()
+	start := time.Now()
+	err := s.Publish(ctx, out)
+	if err == errSinkSkipped || err == errSinkQueued {
+		return
+	}
+	f.health.record(name, err == nil, time.Since(start))
+	if err != nil {
+		code := errDeliverSink
+		var se *sinkError
+		if errors.As(err, &se) {
+			code = se.code
+		}
+		reportError(f.debug, code, "Publish Error ("+name+"): "+err.Error())
+	}
+}
+
+// builtinSinks are the outputs that aren't plugins.
+var builtinSinks = []string{"mqtt", "grafana", "kafka", "nats", "amqp", "slack", "teams"}
+
+// sinkNames is every output name a rule may give in "sinks".
+func sinkNames(config *Configuration) map[string]bool {
+	names := make(map[string]bool)
+	for _, s := range builtinSinks {
+		names[s] = true
+	}
+	for _, p := range config.Plugins {
+		names[p.Name] = true
+	}
+	for _, w := range config.Webhooks {
+		names[w.Name] = true
+	}
+	return names
+}
+
+// checkSinks makes sure every rule and correlation only names outputs there are.
+func checkSinks(rules RuleSet, correlations []*Correlation, known map[string]bool) error {
+	for _, r := range rules {
+		for _, s := range r.Sinks {
+			if !known[s] {
+				return fmt.Errorf("Rule '%s': no output called '%s' to send to", r.Name, s)
+			}
+		}
+		if r.Escalate == nil {
+			continue
+		}
+		for _, step := range r.Escalate.Steps {
+			for _, s := range step.Sinks {
+				if !known[s] {
+					return fmt.Errorf("Rule '%s': no output called '%s' to escalate to", r.Name, s)
+				}
+			}
+		}
+	}
+	for _, c := range correlations {
+		for _, s := range c.Sinks {
+			if !known[s] {
+				return fmt.Errorf("Correlation '%s': no output called '%s' to send to", c.Name, s)
+			}
+		}
+	}
+	return nil
+}
+
+// sendsTo says whether the rule's events go to the named output.
+func (r *Rule) sendsTo(sink string) bool {
+	if len(r.Sinks) == 0 {
+		return true
+	}
+	for _, s := range r.Sinks {
+		if s == sink {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package monitor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSink takes events after a delay, or not until it is let go.
+type testSink struct {
+	name  string
+	delay time.Duration
+	hold  chan struct{}
+	got   int32
+}
+
+func (s *testSink) Name() string { return s.name }
+
+func (s *testSink) Publish(ctx context.Context, out *Outgoing) error {
+	if s.hold != nil {
+		<-s.hold // Not watching ctx, like a wedged output
+	}
+	time.Sleep(s.delay)
+	atomic.AddInt32(&s.got, 1)
+	return nil
+}
+
+// The sinks get an event at once, and one that hangs holds up neither the others nor the pipeline.
+func TestFanoutSlowSink(t *testing.T) {
+	slow := &testSink{name: "slow", hold: make(chan struct{})}
+	fast := []*testSink{{name: "a", delay: 20 * time.Millisecond}, {name: "b", delay: 20 * time.Millisecond}}
+	f := &fanout{sinks: []Sink{slow, fast[0], fast[1]}, busy: make([]int32, 3), wait: 200 * time.Millisecond}
+	out := &Outgoing{Event: Event{Rule: &Rule{}}}
+
+	start := time.Now()
+	f.publish(context.Background(), out)
+	if took := time.Since(start); took < 200*time.Millisecond || took > time.Second {
+		t.Errorf("publish took %v, want about the 200ms wait", took)
+	}
+	for _, s := range fast {
+		if atomic.LoadInt32(&s.got) != 1 {
+			t.Errorf("%s didn't get the event", s.name)
+		}
+	}
+
+	// The hung sink misses the next one, and doesn't hold it up
+	before := errorCount(errDeliverSinkBusy)
+	start = time.Now()
+	f.publish(context.Background(), out)
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("second publish took %v, want the fast sinks' 20ms", took)
+	}
+	if errorCount(errDeliverSinkBusy) != before+1 {
+		t.Error("busy sink not counted")
+	}
+	for _, s := range fast {
+		if atomic.LoadInt32(&s.got) != 2 {
+			t.Errorf("%s didn't get the second event", s.name)
+		}
+	}
+	close(slow.hold) // Unstuck, it finishes the first event on its own and takes events again
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&slow.got); got != 1 || atomic.LoadInt32(&f.busy[0]) != 0 {
+		t.Errorf("slow sink got %d, busy %d", got, f.busy[0])
+	}
+	f.publish(context.Background(), out)
+	if got := atomic.LoadInt32(&slow.got); got != 2 {
+		t.Errorf("slow sink got %d after it came back", got)
+	}
+}
+
+func errorCount(code string) uint64 {
+	errorCounts.Lock()
+	defer errorCounts.Unlock()
+	return errorCounts.n[code]
+}
+
+// spoolingSink keeps what it gets while busy, like MQTT with a spool.
+type spoolingSink struct {
+	*testSink
+	queued int32
+}
+
+func (s *spoolingSink) queue(ctx context.Context, out *Outgoing) bool {
+	atomic.AddInt32(&s.queued, 1)
+	return true
+}
+
+// A busy sink that can keep events for later gets them kept, not dropped.
+func TestFanoutBusySinkQueues(t *testing.T) {
+	s := &spoolingSink{testSink: &testSink{name: "mqtt", hold: make(chan struct{})}}
+	f := &fanout{sinks: []Sink{s}, busy: make([]int32, 1), wait: 50 * time.Millisecond}
+	out := &Outgoing{Event: Event{Rule: &Rule{}}}
+	f.publish(context.Background(), out)
+	before := errorCount(errDeliverSinkBusy)
+	f.publish(context.Background(), out)
+	if atomic.LoadInt32(&s.queued) != 1 || errorCount(errDeliverSinkBusy) != before {
+		t.Errorf("busy sink queued %d, %d counted busy", s.queued, errorCount(errDeliverSinkBusy)-before)
+	}
+	close(s.hold)
+}
+
+// MQTT spools an event while it is busy, where there is a spool.
+func TestMQTTQueueSpools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := &Outgoing{Event: Event{Rule: &Rule{}, SyslogSeverity: 2}, Payload: map[string]interface{}{"type": "conn.rate-limit"},
+		Topic: "alert/A10Thunder"}
+
+	m := newTestMonitor(t, Configuration{})
+	if (mqttSink{m.a}).queue(context.Background(), out) {
+		t.Error("queued without a spool")
+	}
+	m = newTestMonitor(t, Configuration{Spool: SpoolConfig{Dir: dir}})
+	if !(mqttSink{m.a}).queue(context.Background(), out) {
+		t.Fatal("not spooled")
+	}
+	if pending, _ := m.a.spool.stats(); pending["critical"] != 1 {
+		t.Errorf("spool has %v", pending)
+	}
+}
@@ -0,0 +1,310 @@
+package monitor
+
+//
+//  slack.go  --  Slack as an output, so NOC channels get alerts they can read without a bridge in between.
+//    Either an incoming webhook, which posts to the channel it was made for:
+//
+//  "slack": { "webhook_url": "https://hooks.slack.com/services/T0000/B0000/XXXXXXXX" }
+//
+//    or a bot token with chat:write, which can post to any channel the bot is in:
+//
+//  "slack": { "token": "{{env \"SLACK_BOT_TOKEN\"}}", "channel": "#noc-a10",
+//             "fields": ["object_name as VIP", "rate", "limit", "partition", "incident_id"],
+//             "filter": "event.severity in [\"emergency\", \"alert\", \"critical\", \"error\"]" }
+//
+//    webhook_url   an incoming webhook URL
+//    token         a bot token (xoxb-...), a template like a webhook header so it can come from the
+//                  environment; messages go through chat.postMessage
+//    channel       with a token, the channel's name or ID. A template over the payload, so devices or
+//                  partitions can go to channels of their own
+//    title         the header of the message, a template over the payload. Default
+//                  "{{.severity}}: {{.rule}} on {{.hostname}}"
+//    fields        the payload fields shown under the message, in this order, each "name" or
+//                  "name as label" (see project.go). Default every field the message doesn't already show,
+//                  by name, up to 20
+//    username, icon_emoji  how the message is signed, where Slack lets it be changed
+//    api_url       where chat.postMessage is, for a proxy in front of Slack. Default https://slack.com/api
+//    retry         as for webhooks (webhook.go); a 429 waits out Slack's Retry-After
+//    filter        only send events this expression is true for, see expr.go
+//
+//  Each message is a Block Kit attachment coloured by severity, green for an all-clear (recovery.go): the
+//  title, the message, the fields two to a row, a button to the runbook if there is one (runbooks.go), and
+//  the rule, device and event time, shown in each reader's own time zone. Rules send to it as "slack" in
+//  "sinks". A failure is counted as deliver.slack, or deliver.slack_timeout (errors.go).
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SlackConfig is the 'slack' section of the config.
+type SlackConfig struct {
+	Webhook_URL string       `json:"webhook_url"`
+	Token       string       `json:"token"`
+	Channel     string       `json:"channel"`
+	Title       string       `json:"title"`
+	Fields      []string     `json:"fields"`
+	Username    string       `json:"username"`
+	Icon_Emoji  string       `json:"icon_emoji"`
+	API_URL     string       `json:"api_url"`
+	Retry       WebhookRetry `json:"retry"`
+	Filter      string       `json:"filter"`
+}
+
+const defaultChatTitle = "{{.severity}}: {{.rule}} on {{.hostname}}"
+
+// chatMaxFields is how many payload fields a message shows when 'fields' doesn't say.
+const chatMaxFields = 20
+
+// chatShown are the payload fields a chat message shows in its title and footer, or that only matter to
+// machines, so they aren't repeated among the fields.
+var chatShown = map[string]bool{"rule": true, "severity": true, "hostname": true, "message": true,
+	"runbook": true, "alert_id": true, "event_id": true, "alert_opened": true, "alert_sequence": true,
+	"timestamp_substituted": true, "test": true}
+
+type slackSink struct {
+	cfg     SlackConfig
+	title   *template.Template
+	channel *template.Template
+	fields  projection
+}
+
+// newSlackSink is the Slack output, nil if there isn't one configured. It is a webhook with its own body.
+func newSlackSink(c SlackConfig, timeout time.Duration) (*webhookSink, error) {
+	if c.Webhook_URL == "" && c.Token == "" {
+		return nil, nil
+	}
+	if c.Webhook_URL != "" && c.Token != "" {
+		return nil, errors.New("slack: a 'webhook_url' or a 'token', not both")
+	}
+	if c.Token != "" && c.Channel == "" {
+		return nil, errors.New("slack: a 'token' needs a 'channel' to post to")
+	}
+	s := &slackSink{cfg: c}
+	var err error
+	if c.Title == "" {
+		c.Title = defaultChatTitle
+	}
+	if s.title, err = parseTemplate("slack.title", c.Title); err != nil {
+		return nil, fmt.Errorf("slack: bad title template: %v", err)
+	}
+	if c.Channel != "" {
+		if s.channel, err = parseTemplate("slack.channel", c.Channel); err != nil {
+			return nil, fmt.Errorf("slack: bad channel template: %v", err)
+		}
+	}
+	if s.fields, err = compileProjection(c.Fields); err != nil {
+		return nil, fmt.Errorf("slack: %v", err)
+	}
+	hook := WebhookConfig{Name: "slack", URL: c.Webhook_URL, Content_Type: "application/json; charset=utf-8",
+		Retry: c.Retry, Filter: c.Filter}
+	if c.Token != "" {
+		if c.API_URL == "" {
+			c.API_URL = "https://slack.com/api"
+		}
+		hook.URL = strings.TrimSuffix(c.API_URL, "/") + "/chat.postMessage"
+		hook.Headers = map[string]string{"Authorization": "Bearer " + c.Token}
+	}
+	w, err := newWebhookSink(hook, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("slack: %v", err)
+	}
+	w.encode, w.codes = s.encode, [2]string{errDeliverSlack, errDeliverSlackTime}
+	if c.Token != "" {
+		w.check = checkSlackReply
+	}
+	return w, nil
+}
+
+type slackMessage struct {
+	Channel     string            `json:"channel,omitempty"`
+	Text        string            `json:"text"` // Notifications and clients without blocks
+	Username    string            `json:"username,omitempty"`
+	IconEmoji   string            `json:"icon_emoji,omitempty"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string        `json:"type"`
+	Text     *slackText    `json:"text,omitempty"`
+	Fields   []slackText   `json:"fields,omitempty"`
+	Elements []interface{} `json:"elements,omitempty"` // slackButtons in actions, slackTexts in a context
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackButton struct {
+	Type string    `json:"type"`
+	Text slackText `json:"text"`
+	URL  string    `json:"url"`
+}
+
+func (s *slackSink) encode(ctx context.Context, out *Outgoing, payload map[string]interface{}) ([]byte, error) {
+	title, err := renderTemplate(ctx, s.title, payload)
+	if err != nil {
+		return nil, fmt.Errorf("title: %w", err)
+	}
+	if title == "" {
+		title = templateString(payload["rule"]) // Slack won't take an empty header
+	}
+	title = truncateRunes(title, 150) // Slack's limit for a header
+	msg := &slackMessage{Text: slackEscape(title), Username: s.cfg.Username, IconEmoji: s.cfg.Icon_Emoji}
+	if s.channel != nil {
+		if msg.Channel, err = renderTemplate(ctx, s.channel, payload); err != nil {
+			return nil, fmt.Errorf("channel: %w", err)
+		}
+	}
+	blocks := []slackBlock{{Type: "header", Text: &slackText{"plain_text", title}}}
+	if m := templateString(payload["message"]); m != "" {
+		msg.Text += ": " + slackEscape(m)
+		text := &slackText{"mrkdwn", slackEscape(truncateRunes(m, 3000))}
+		blocks = append(blocks, slackBlock{Type: "section", Text: text})
+	}
+	fields := chatFields(s.fields, payload)
+	for len(fields) > 0 {
+		n := len(fields)
+		if n > 10 { // Slack's limit for a section
+			n = 10
+		}
+		section := slackBlock{Type: "section"}
+		for _, f := range fields[:n] {
+			text := "*" + slackEscape(f.name) + "*\n" + slackEscape(truncateRunes(f.value, 1900))
+			section.Fields = append(section.Fields, slackText{"mrkdwn", text})
+		}
+		blocks = append(blocks, section)
+		fields = fields[n:]
+	}
+	if rb := runbookURL(payload); rb != "" {
+		button := slackButton{Type: "button", Text: slackText{"plain_text", "Runbook"}, URL: rb}
+		blocks = append(blocks, slackBlock{Type: "actions", Elements: []interface{}{button}})
+	}
+	at := out.Event.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	footer := fmt.Sprintf("%s · %s · <!date^%d^{date_short_pretty} {time_secs}|%s>",
+		slackEscape(templateString(payload["rule"])), slackEscape(templateString(payload["hostname"])), at.Unix(),
+		at.UTC().Format(time.RFC3339))
+	blocks = append(blocks, slackBlock{Type: "context", Elements: []interface{}{slackText{"mrkdwn", footer}}})
+	msg.Attachments = []slackAttachment{{Color: slackColor(out.Event, payload), Blocks: blocks}}
+	return json.Marshal(msg)
+}
+
+// checkSlackReply finds the error in a chat.postMessage reply, which is a 200 either way.
+func checkSlackReply(body []byte) error {
+	var reply struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		if len(body) > 100 {
+			body = body[:100]
+		}
+		return &webhookError{status: 200, reason: "not a Slack API reply: " + string(bytes.TrimSpace(body))}
+	}
+	if !reply.OK {
+		return &webhookError{status: 200, reason: "Slack said " + reply.Error}
+	}
+	return nil
+}
+
+// slackColor is the attachment colour for the event: red for the worst severities down to blue, green for
+// an all-clear.
+func slackColor(ev Event, payload map[string]interface{}) string {
+	if ev.Recovered {
+		return "#2eb886"
+	}
+	switch sev := severityLevel(templateString(payload["severity"])); {
+	case sev >= 0 && sev <= 2:
+		return "#d40e0d"
+	case sev == 3:
+		return "#e8912d"
+	case sev == 4:
+		return "#daa038"
+	}
+	return "#439fe0"
+}
+
+// slackEscape makes text safe for mrkdwn, where &, < and > are markup.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// chatField is a payload field a chat message shows.
+type chatField struct {
+	name  string
+	value string
+}
+
+// chatFields is the fields of the payload to show: the projection's, in its order, or every field
+// chatShown doesn't cover, by name, up to chatMaxFields. Empty values are left out.
+func chatFields(p projection, payload map[string]interface{}) []chatField {
+	var fields []chatField
+	if p != nil {
+		for _, f := range p {
+			if v := chatValue(payload[f.from]); v != "" {
+				fields = append(fields, chatField{f.to, v})
+			}
+		}
+		return fields
+	}
+	names := make([]string, 0, len(payload))
+	for k := range payload {
+		if !chatShown[k] {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if v := chatValue(payload[k]); v != "" && len(fields) < chatMaxFields {
+			fields = append(fields, chatField{k, v})
+		}
+	}
+	return fields
+}
+
+// runbookURL is the event's runbook, if it is a link (runbooks.go) rather than a note.
+func runbookURL(payload map[string]interface{}) string {
+	if rb := templateString(payload["runbook"]); strings.HasPrefix(rb, "https://") || strings.HasPrefix(rb, "http://") {
+		return rb
+	}
+	return ""
+}
+
+// chatValue is a payload value as text: strings and numbers as they are, anything else as JSON.
+func chatValue(v interface{}) string {
+	switch v.(type) {
+	case nil, string, bool, int, int64, uint64, float64:
+		return templateString(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return templateString(v)
+	}
+	return string(b)
+}
+
+// truncateRunes is s cut to n characters, with an ellipsis if anything was cut.
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
@@ -0,0 +1,104 @@
+package monitor
+
+//
+//  smoother.go  --  Caps how fast events are published to the MQTT broker, so a log storm doesn't trip the
+//    broker's own rate limits (and get the agent disconnected). A token bucket: 'per_second' on average,
+//    with up to 'burst' at once after a quiet spell.
+//
+//  "mqtt_rate": { "per_second": 200, "burst": 500 }
+//
+//  Events over the limit go to the spool (see spool.go), which is sent on at the same rate once the storm
+//  has passed; without a spool, publishing waits its turn.
+//
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// RateConfig holds the 'mqtt_rate' section of the config.
+type RateConfig struct {
+	Per_Second float64 `json:"per_second"` // 0 = no limit
+	Burst      int     `json:"burst"`      // Default per_second, and at least 1
+}
+
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	tokens    float64
+	last      time.Time
+	throttled uint64 // Events that were over the rate
+}
+
+func newTokenBucket(cfg RateConfig) (*tokenBucket, error) {
+	if cfg.Per_Second < 0 || cfg.Burst < 0 {
+		return nil, errors.New("mqtt_rate can't be negative!")
+	}
+	if cfg.Per_Second == 0 {
+		return nil, nil
+	}
+	burst := float64(cfg.Burst)
+	if burst == 0 {
+		burst = cfg.Per_Second
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: cfg.Per_Second, burst: burst, tokens: burst, last: time.Now()}, nil
+}
+
+// refill adds the tokens earned since last time. Caller holds b.mu.
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// allow takes a token if there is one.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < 1 {
+		b.throttled++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait takes a token, waiting for one if need be.
+func (b *tokenBucket) wait() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens--
+	short := -b.tokens
+	if short > 0 {
+		b.throttled++
+	}
+	b.mu.Unlock()
+	if short > 0 {
+		time.Sleep(time.Duration(short / b.rate * float64(time.Second)))
+	}
+}
+
+// state is how the bucket stands, for the heartbeat: the tokens left, and how many events have been over the rate.
+func (b *tokenBucket) state() (tokens float64, throttled uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens, b.throttled
+}
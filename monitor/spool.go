@@ -0,0 +1,283 @@
+package monitor
+
+//
+//  spool.go  --  Keeps MQTT events on disk while the broker can't be reached, and sends them once it is back.
+//    There is one lane per priority, and the lanes are emptied in order, so a backlog of critical alerts goes
+//    out before the informational ones that piled up alongside it:
+//
+//    critical   emergency, alert and critical
+//    high       error and warning
+//    low        everything else
+//
+//  "spool": { "dir": "/var/spool/conn-rate-mon", "max_mb": 100 }
+//
+//  Each lane is a directory of numbered segment files of JSON lines. Once there is anything in the spool new
+//  events are spooled too, so that nothing jumps the queue. A lane past max_mb (default 100) drops new events.
+//
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpoolConfig holds the 'spool' section of the config.
+type SpoolConfig struct {
+	Dir    string `json:"dir"`
+	Max_MB int    `json:"max_mb"` // Per lane. Default 100
+}
+
+var spoolLanes = []string{"critical", "high", "low"}
+
+const spoolSegment = 1 << 20 // Bytes before a new segment file is started
+
+// spoolLane is the lane for a Syslog severity.
+func spoolLane(sev int) int {
+	switch {
+	case sev <= 2:
+		return 0
+	case sev <= 4:
+		return 1
+	}
+	return 2
+}
+
+type spooled struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+	QoS     byte            `json:"qos,omitempty"`   // See qos.go
+	Error   string          `json:"error,omitempty"` // Why it was spooled, if its publish failed. See errors.go
+}
+
+type spoolLaneState struct {
+	dir      string
+	segments []int // Sequence numbers, oldest first
+	bytes    int64
+	pending  int
+	dropped  uint64
+}
+
+type spool struct {
+	max   int64
+	debug int
+
+	mu    sync.Mutex
+	lanes []*spoolLaneState
+}
+
+func newSpool(cfg SpoolConfig, debug int) (*spool, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if cfg.Max_MB <= 0 {
+		cfg.Max_MB = 100
+	}
+	s := &spool{max: int64(cfg.Max_MB) << 20, debug: debug}
+	for _, name := range spoolLanes {
+		l := &spoolLaneState{dir: filepath.Join(cfg.Dir, name)}
+		if err := os.MkdirAll(l.dir, 0700); err != nil {
+			return nil, fmt.Errorf("Unable to create spool directory: %v", err)
+		}
+		// Pick up whatever was left from last time
+		fis, err := ioutil.ReadDir(l.dir)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read spool directory: %v", err)
+		}
+		for _, fi := range fis {
+			n, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), ".jsonl"))
+			if err != nil || fi.Size() == 0 {
+				continue
+			}
+			l.segments = append(l.segments, n)
+			l.bytes += fi.Size()
+			l.pending += countLines(filepath.Join(l.dir, fi.Name()))
+		}
+		sort.Ints(l.segments)
+		s.lanes = append(s.lanes, l)
+	}
+	return s, nil
+}
+
+func countLines(fn string) int {
+	b, _ := ioutil.ReadFile(fn)
+	return strings.Count(string(b), "\n")
+}
+
+func (l *spoolLaneState) segment(n int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%012d.jsonl", n))
+}
+
+// holding says whether there is a backlog, in which case new events should be spooled behind it.
+func (s *spool) holding() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.lanes {
+		if l.pending > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// put spools one event. False if there's no spool or it is full.
+func (s *spool) put(sev int, topic string, qos byte, payload []byte) bool {
+	return s.putFailed(sev, topic, qos, payload, "")
+}
+
+// putFailed spools an event whose publish failed with the given error code.
+func (s *spool) putFailed(sev int, topic string, qos byte, payload []byte, code string) bool {
+	if s == nil {
+		return false
+	}
+	line, _ := json.Marshal(spooled{Topic: topic, Payload: payload, QoS: qos, Error: code})
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.lanes[spoolLane(sev)]
+	if l.bytes+int64(len(line)) > s.max {
+		l.dropped++
+		countError(errSpoolFull)
+		return false
+	}
+	if len(l.segments) == 0 {
+		l.segments = append(l.segments, 1)
+	}
+	fn := l.segment(l.segments[len(l.segments)-1])
+	if fi, err := os.Stat(fn); err == nil && fi.Size() >= spoolSegment {
+		l.segments = append(l.segments, l.segments[len(l.segments)-1]+1)
+		fn = l.segment(l.segments[len(l.segments)-1])
+	}
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		reportError(s.debug, errSpoolIO, "Spool write error: "+err.Error())
+		return false
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		reportError(s.debug, errSpoolIO, "Spool write error: "+err.Error())
+		return false
+	}
+	l.bytes += int64(len(line))
+	l.pending++
+	return true
+}
+
+// stats is what is waiting in each lane, and what each has dropped.
+func (s *spool) stats() (pending map[string]int, dropped map[string]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, dropped = make(map[string]int), make(map[string]uint64)
+	for i, l := range s.lanes {
+		pending[spoolLanes[i]] = l.pending
+		dropped[spoolLanes[i]] = l.dropped
+	}
+	return pending, dropped
+}
+
+// writeMetrics adds the spool's metrics, see metrics.go.
+func (s *spool) writeMetrics(p *promWriter) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, l := range s.lanes {
+		p.metric("a10crm_spool_pending", "gauge", "Events waiting in the spool for the broker.", fmt.Sprintf(`lane="%s"`, spoolLanes[i]), l.pending)
+	}
+	for i, l := range s.lanes {
+		p.metric("a10crm_spool_dropped_total", "counter", "Events dropped because the spool lane was full.", fmt.Sprintf(`lane="%s"`, spoolLanes[i]), l.dropped)
+	}
+}
+
+// oldest takes the oldest segment of the first lane that has one, starting a new segment for writes if it
+// is the one being written to. -1 if the spool is empty.
+func (s *spool) oldest() (lane int, seq int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, l := range s.lanes {
+		if l.pending <= 0 {
+			l.segments, l.bytes = nil, 0 // Whatever is left is empty
+			continue
+		}
+		seq = l.segments[0]
+		if len(l.segments) == 1 {
+			l.segments = append(l.segments, seq+1)
+		}
+		return i, seq
+	}
+	return -1, 0
+}
+
+// flush sends the spool, highest priority lane first, until it is empty, publish fails or ctx is done.
+func (s *spool) flush(ctx context.Context, publish func(ctx context.Context, topic string, qos byte, payload []byte) error) {
+	for ctx.Err() == nil {
+		lane, seq := s.oldest()
+		if lane < 0 {
+			return
+		}
+		l := s.lanes[lane]
+		fn := l.segment(seq)
+		b, err := ioutil.ReadFile(fn)
+		if err != nil && !os.IsNotExist(err) {
+			reportError(s.debug, errSpoolIO, "Spool read error: "+err.Error())
+			return
+		}
+		sent, sentBytes := 0, 0
+		sc := bufio.NewScanner(strings.NewReader(string(b)))
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		var failed error
+		for sc.Scan() {
+			var ev spooled
+			if json.Unmarshal(sc.Bytes(), &ev) == nil {
+				if failed = publish(ctx, ev.Topic, ev.QoS, ev.Payload); failed != nil {
+					break
+				}
+			}
+			sent++
+			sentBytes += len(sc.Bytes()) + 1
+		}
+		s.mu.Lock()
+		l.pending -= sent
+		l.bytes -= int64(sentBytes)
+		if failed != nil {
+			// Keep the rest of the segment for next time
+			ioutil.WriteFile(fn, b[sentBytes:], 0600)
+			s.mu.Unlock()
+			if s.debug > 3 {
+				fmt.Println(">>> Spool flush stopped: " + failed.Error())
+			}
+			return
+		}
+		os.Remove(fn)
+		l.segments = l.segments[1:]
+		s.mu.Unlock()
+	}
+}
+
+// run flushes the spool whenever connected() says the broker is there, until ctx is done.
+func (s *spool) run(ctx context.Context, connected func() bool, publish func(ctx context.Context, topic string, qos byte, payload []byte) error) {
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if s.holding() && connected() {
+				s.flush(ctx, publish)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package monitor
+
+//
+//  sqs.go  --  Reads ack/close messages (see acks.go) from an Amazon SQS queue. Messages posted through SNS
+//    are unwrapped. Talks to SQS's JSON API directly, signing the requests itself (AWS Signature Version 4),
+//    so the whole AWS SDK isn't needed for two calls.
+//
+//  "sqs": { "queue_url": "https://sqs.eu-west-1.amazonaws.com/123456789012/thunder-acks",
+//           "region": "eu-west-1", "access_key": "AKIA...", "secret_key": "..." }
+//
+//  Region defaults to the one in the queue URL. Keys default to $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY
+//  and $AWS_SESSION_TOKEN.
+//
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SQSConfig holds the 'sqs' part of the 'acks' section.
+type SQSConfig struct {
+	Queue_URL     string `json:"queue_url"`
+	Region        string `json:"region"`
+	Access_Key    string `json:"access_key"`
+	Secret_Key    string `json:"secret_key"`
+	Session_Token string `json:"session_token"`
+}
+
+type sqsClient struct {
+	cfg      SQSConfig
+	endpoint string
+	host     string
+	service  string // In the signature's scope: "sqs"
+	http     *http.Client
+}
+
+func newSQSClient(cfg SQSConfig) (*sqsClient, error) {
+	u, err := url.Parse(cfg.Queue_URL)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("Bad SQS queue_url!")
+	}
+	if cfg.Region == "" {
+		// sqs.<region>.amazonaws.com
+		if p := strings.Split(u.Host, "."); len(p) >= 3 && p[0] == "sqs" {
+			cfg.Region = p[1]
+		} else {
+			return nil, errors.New("SQS region not given and not in queue_url!")
+		}
+	}
+	if cfg.Access_Key == "" {
+		cfg.Access_Key = os.Getenv("AWS_ACCESS_KEY_ID")
+		cfg.Secret_Key = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		cfg.Session_Token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if cfg.Access_Key == "" || cfg.Secret_Key == "" {
+		return nil, errors.New("No AWS keys for SQS!")
+	}
+	return &sqsClient{cfg: cfg, endpoint: u.Scheme + "://" + u.Host + "/", host: u.Host, service: "sqs",
+		http: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// sigV4Key is the Signature Version 4 signing key for the day ("20060102"), region and service.
+func sigV4Key(secret, day, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// sign adds the AWS Signature Version 4 headers to the request.
+func (c *sqsClient) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.cfg.Session_Token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.cfg.Session_Token)
+	}
+	// Headers to sign, in order
+	names := []string{"content-type", "host", "x-amz-date", "x-amz-security-token", "x-amz-target"}
+	var canon, signed []string
+	for _, n := range names {
+		v := req.Header.Get(n)
+		if n == "host" {
+			v = c.host
+		}
+		if v == "" {
+			continue
+		}
+		canon = append(canon, n+":"+v+"\n")
+		signed = append(signed, n)
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonical := "POST\n/\n\n" + strings.Join(canon, "") + "\n" + signedHeaders + "\n" + sha256Hex(body)
+	scope := day + "/" + c.cfg.Region + "/" + c.service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := sigV4Key(c.cfg.Secret_Key, day, c.cfg.Region, c.service)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.cfg.Access_Key+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+// call makes one SQS JSON API call, e.g. "ReceiveMessage".
+func (c *sqsClient) call(ctx context.Context, action string, in interface{}, out interface{}) error {
+	body, _ := json.Marshal(in)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	c.sign(req, body, time.Now())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("SQS %s: %s: %s", action, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+type sqsMessage struct {
+	ReceiptHandle string `json:"ReceiptHandle"`
+	Body          string `json:"Body"`
+}
+
+// pollSQS reads ack messages from the queue until ctx is done.
+func pollSQS(ctx context.Context, c *sqsClient, s *Suppressions, debug int) {
+	for ctx.Err() == nil {
+		var res struct {
+			Messages []sqsMessage `json:"Messages"`
+		}
+		err := c.call(ctx, "ReceiveMessage", map[string]interface{}{
+			"QueueUrl": c.cfg.Queue_URL, "MaxNumberOfMessages": 10, "WaitTimeSeconds": 20,
+		}, &res)
+		if err != nil {
+			if ctx.Err() == nil {
+				reportError(debug, errAckSQS, err.Error())
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		for _, m := range res.Messages {
+			if err := s.ApplyAck(parseAckBody(m.Body), "sqs", time.Now()); err != nil {
+				reportError(debug, errAckBad, "Bad ack from SQS: "+err.Error())
+			}
+			// Bad messages are deleted too; they won't get any better by being read again
+			if err := c.call(ctx, "DeleteMessage", map[string]string{"QueueUrl": c.cfg.Queue_URL, "ReceiptHandle": m.ReceiptHandle}, nil); err != nil {
+				reportError(debug, errAckSQS, err.Error())
+			}
+		}
+	}
+}
+
+// parseAckBody decodes an ack message, taking it out of an SNS notification if it is in one.
+func parseAckBody(body string) AckMessage {
+	var sns struct {
+		Type    string `json:"Type"`
+		Message string `json:"Message"`
+	}
+	if json.Unmarshal([]byte(body), &sns) == nil && sns.Type == "Notification" {
+		body = sns.Message
+	}
+	var msg AckMessage
+	json.Unmarshal([]byte(body), &msg)
+	return msg
+}
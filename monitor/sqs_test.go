@@ -0,0 +1,48 @@
+package monitor
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The signing key from AWS's "deriving the signing key" example.
+func TestSigV4Key(t *testing.T) {
+	key := sigV4Key("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	if got, want := hex.EncodeToString(key), "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Errorf("signing key %s, want %s", got, want)
+	}
+}
+
+// post-vanilla from AWS's Signature Version 4 test suite: a POST to / with no body and no other headers.
+func TestSigV4Sign(t *testing.T) {
+	c := &sqsClient{cfg: SQSConfig{Region: "us-east-1", Access_Key: "AKIDEXAMPLE",
+		Secret_Key: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, host: "example.amazonaws.com", service: "service"}
+	req, _ := http.NewRequest("POST", "https://example.amazonaws.com/", nil)
+	c.sign(req, nil, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization:\n%s\nwant\n%s", got, want)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+		t.Errorf("X-Amz-Date %s", got)
+	}
+
+	// An SQS call signs its content type, target and session token too, in order, and the time in UTC
+	c.cfg.Session_Token, c.service = "token", "sqs"
+	req, _ = http.NewRequest("POST", "https://example.amazonaws.com/", nil)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS.ReceiveMessage")
+	c.sign(req, []byte(`{}`), time.Date(2015, 8, 30, 14, 36, 0, 0, time.FixedZone("CEST", 2*3600)))
+	auth := req.Header.Get("Authorization")
+	if !strings.Contains(auth, "/20150830/us-east-1/sqs/aws4_request,") ||
+		!strings.Contains(auth, "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target,") {
+		t.Errorf("Authorization %s", auth)
+	}
+	if req.Header.Get("X-Amz-Security-Token") != "token" || req.Header.Get("X-Amz-Date") != "20150830T123600Z" {
+		t.Errorf("headers %v", req.Header)
+	}
+}
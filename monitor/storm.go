@@ -0,0 +1,274 @@
+package monitor
+
+//
+//  storm.go  --  A breaker for alert storms. When a whole data centre goes wrong at once, an alert per VIP
+//    is more than the broker and the pagers behind it can take, and more than anyone can read; past a
+//    rate, the agent stops publishing the events and sends summaries instead:
+//
+//  "storm": { "rate": 500, "calm": "5m", "every": "1m" }
+//
+//    rate      matches a minute, over every device, that start a storm. 0 (the default) = no breaker
+//    calm      how long the rate has to stay at or under it for the storm to end. Default 5m
+//    every     how often a summary is published while it lasts. Default 1m
+//    topic     where the storm events and summaries go. Default notify_topic + "/storm"
+//    severity  of the "alert.storm" event. Default critical
+//
+//  The match that takes the rate over publishes one "alert.storm" event, with "rate" and "storm_rate", to
+//  every output, like any alert. From then on nothing else is published (matches still count towards
+//  thresholds, windows and so on); every "every" an "alert.storm.summary" goes to MQTT with how many
+//  events were held back per device, VIP (or other object) and type, the most first:
+//
+//    { "type": "alert.storm.summary", "message": "1840 events held back from 12 devices in 1m0s",
+//      "rate": 1920, "storm_since": "...", "from": "...", "until": "...", "total": 1840,
+//      "counts": [ { "hostname": "thunder-dc1-a", "object": "ws-vip", "type": "conn.rate-limit", "count": 310 }, ... ] }
+//
+//  When it ends, a last summary and an "alert.storm.recovered" all-clear (see recovery.go) go out, and
+//  events are published again. Drills (drill.go) are never held back. Whether a storm is on, and how many
+//  events it has held back, are in the heartbeat's "storm" and the metrics (a10crm_storm_active,
+//  a10crm_storm_held_total).
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StormConfig holds the 'storm' section of the config.
+type StormConfig struct {
+	Rate     int    `json:"rate"`
+	Calm     string `json:"calm"`
+	Every    string `json:"every"`
+	Topic    string `json:"topic"`
+	Severity string `json:"severity"`
+}
+
+// stormMaxCounts is how many devices, objects and types a summary lists.
+const stormMaxCounts = 50
+
+type storm struct {
+	rate  uint64
+	calm  time.Duration
+	every time.Duration
+	rule  *Rule
+
+	mu      sync.Mutex
+	matches *ringCounts // A slot a second, for the last minute
+	active  bool
+	since   time.Time
+	calming time.Time // When the rate last went back under, zero if it hasn't
+	from    time.Time // Start of the summary being built
+	held    map[digestKey]int
+	total   uint64 // Held back, ever
+}
+
+// newStorm is nil if there is no breaker.
+func newStorm(cfg StormConfig) (*storm, error) {
+	if cfg.Rate <= 0 {
+		return nil, nil
+	}
+	s := &storm{rate: uint64(cfg.Rate), calm: 5 * time.Minute, every: time.Minute, matches: newRingCounts(60, time.Second), held: make(map[digestKey]int)}
+	for _, d := range []struct {
+		name string
+		v    string
+		to   *time.Duration
+	}{{"calm", cfg.Calm, &s.calm}, {"every", cfg.Every, &s.every}} {
+		if d.v == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.v)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("storm: bad %s '%s'", d.name, d.v)
+		}
+		*d.to = v
+	}
+	if cfg.Severity == "" {
+		cfg.Severity = "critical"
+	}
+	sev, ok := normalizeSeverity(cfg.Severity)
+	if !ok {
+		return nil, fmt.Errorf("storm: unknown severity '%s'", cfg.Severity)
+	}
+	s.rule = &Rule{Name: "alert-storm", Type: "alert.storm", Severity: sev, Topic: cfg.Topic, subTopic: "storm"}
+	if err := s.rule.compileTopic(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// topic is where the summaries go.
+func (s *storm) topic(notifyTopic string) string {
+	return s.rule.TopicFor(notifyTopic, nil)
+}
+
+// matched counts a match. With start, it is the one that started a storm, and ev is the event to publish
+// for that.
+func (s *storm) matched(m Event, now time.Time) (ev Event, start bool) {
+	if s == nil || m.summary() || m.Test {
+		return Event{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.matches.add(now)
+	rate := s.matches.sum(now, 60)
+	if s.active || rate <= s.rate {
+		return Event{}, false
+	}
+	s.active, s.since, s.from, s.calming = true, now, now, time.Time{}
+	ev = s.event(now, s.rule.Severity)
+	ev.Fields["rate"] = rate
+	ev.Fields["storm_rate"] = s.rate
+	ev.Message = fmt.Sprintf("Alert storm: %d events in the last minute, over %d; publishing summaries until it calms down", rate, s.rate)
+	return ev, true
+}
+
+func (s *storm) event(now time.Time, severity string) Event {
+	return Event{Rule: s.rule, Device: "all", Type: s.rule.Type, Severity: severity, SyslogSeverity: severityLevel(severity),
+		Time: now, Received: now, Fields: map[string]interface{}{}}
+}
+
+// hold says whether ev is held back by a storm, counting it for the summary.
+func (s *storm) hold(ev Event) bool {
+	if s == nil || ev.Test {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active {
+		return false
+	}
+	s.held[digestKey{ev.Device, ev.Object, ev.Type}]++
+	s.total++
+	return true
+}
+
+// check is what to publish at now: a summary, if one is due, and with end, the all-clear for a storm that
+// has calmed down.
+func (s *storm) check(now time.Time) (summary map[string]interface{}, clear Event, end bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active {
+		return nil, Event{}, false
+	}
+	rate := s.matches.sum(now, 60)
+	switch {
+	case rate > s.rate:
+		s.calming = time.Time{}
+	case s.calming.IsZero():
+		s.calming = now
+	case now.Sub(s.calming) >= s.calm:
+		end = true
+	}
+	if end || now.Sub(s.from) >= s.every {
+		summary = s.summary(now, rate)
+	}
+	if !end {
+		return summary, Event{}, false
+	}
+	s.active = false
+	clear = s.event(now, "info")
+	clear.Type = s.rule.Type + ".recovered"
+	clear.Recovered = true
+	clear.Fields["recovered"] = true
+	clear.Fields["recovered_type"] = s.rule.Type
+	clear.Fields["rate"] = rate
+	clear.Fields["storm_since"] = s.since.UTC().Format(time.RFC3339)
+	clear.Message = fmt.Sprintf("Alert storm over after %s; publishing events again", now.Sub(s.since).Round(time.Second))
+	return summary, clear, true
+}
+
+// summary is what was held back since the last one, which it starts again from. Caller holds s.mu.
+func (s *storm) summary(now time.Time, rate uint64) map[string]interface{} {
+	held, from := s.held, s.from
+	s.held, s.from = make(map[digestKey]int), now
+
+	keys := make([]digestKey, 0, len(held))
+	devices := make(map[string]bool)
+	total := 0
+	for k, n := range held {
+		keys = append(keys, k)
+		devices[k.device] = true
+		total += n
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if held[keys[i]] != held[keys[j]] {
+			return held[keys[i]] > held[keys[j]]
+		}
+		a, b := keys[i], keys[j]
+		if a.device != b.device {
+			return a.device < b.device
+		}
+		if a.object != b.object {
+			return a.object < b.object
+		}
+		return a.typ < b.typ
+	})
+	list := make([]map[string]interface{}, 0, stormMaxCounts)
+	for i, k := range keys {
+		if i == stormMaxCounts {
+			break
+		}
+		list = append(list, map[string]interface{}{"hostname": k.device, "object": k.object, "type": k.typ, "count": held[k]})
+	}
+	return map[string]interface{}{
+		"type":        s.rule.Type + ".summary",
+		"message":     fmt.Sprintf("%d events held back from %d devices in %s", total, len(devices), now.Sub(from).Round(time.Second)),
+		"rate":        rate,
+		"storm_since": s.since.UTC().Format(time.RFC3339),
+		"from":        from.UTC().Format(time.RFC3339),
+		"until":       now.UTC().Format(time.RFC3339),
+		"total":       total,
+		"counts":      list,
+	}
+}
+
+// state is whether a storm is on, and the events held back ever, for the heartbeat and metrics.
+func (s *storm) state() (active bool, held uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active, s.total
+}
+
+// writeMetrics adds the storm metrics, see metrics.go.
+func (s *storm) writeMetrics(p *promWriter) {
+	if s == nil {
+		return
+	}
+	active, held := s.state()
+	on := 0
+	if active {
+		on = 1
+	}
+	p.metric("a10crm_storm_active", "gauge", "1 while an alert storm is holding events back.", "", on)
+	p.metric("a10crm_storm_held_total", "counter", "Events held back by alert storms.", "", held)
+}
+
+// watchStorm publishes the summaries and the end of a storm.
+func (a *agent) watchStorm(ctx context.Context) {
+	if a.storm == nil {
+		return
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			summary, clear, end := a.storm.check(now)
+			if summary != nil && a.client != nil {
+				addTags(summary, a.config.Tags)
+				text, _ := json.Marshal(summary)
+				if err := a.publishMQTT(ctx, a.storm.topic(a.config.Notify_Topic), 1, text); err != nil {
+					reportError(a.config.Debug, timeoutCode(err, errDeliverMQTT, errDeliverMQTTTime), "Storm Summary Publish Error: "+err.Error())
+				}
+			}
+			if end {
+				a.deliver(ctx, a.config, clear)
+			}
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package monitor
+
+//
+//  suppress.go  --  Suppression state. A rule with a "suppress" window (e.g. "suppress": "5m") publishes
+//    the first match for an object (VIP, server, ...) on a device, then only counts further matches for it
+//    until the window ends. When a window that held anything back ends, a summary is published: the first
+//    event again, with "suppressed_count", "first_seen" and "last_seen". A VIP (or other object) can have
+//    a window of its own, whatever the rule says, in the config's 'services' (see runbooks.go):
+//
+//    "services": { "ws-vip": { "suppress": "2m" } }
+//
+//    A rule with a "threshold" (e.g. "threshold": { "count": 5, "within": "60s" }, or one from the config's
+//    'thresholds', see thresholds.go) counts matches per object on a device in an accumulator, and publishes nothing until there have been five in the last 60 seconds.
+//    The match that trips it is published with "threshold_count" and "threshold_window", and the count
+//    starts again. A suppress window on the same rule then keeps sustained saturation to one page per window.
+//    The accumulators are kept here too, so all of this state can be looked at and changed through the API
+//    during an incident:
+//
+//    GET  /suppressions                       open windows, accumulators, acks and snoozes
+//    POST /suppressions/reset?key=...         drop one window/accumulator (no key = all of them)
+//    POST /suppressions/extend?key=...&by=10m push a window's end out
+//    POST /acks                               acknowledge or close an alert, see acks.go
+//    GET  /alerts                             each alert's lifecycle, see lifecycle.go
+//    GET  /tuning                             thresholds and windows, which can be changed, see tuning.go
+//
+//  The POSTs need 'api_token' set (see api.go).
+//
+//  Keys look like "device/type/object", e.g. "Testing1/conn.rate-limit/ws-vip".
+//
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SuppressWindow is an open suppression window for one object on one device.
+type SuppressWindow struct {
+	Key        string    `json:"key"`
+	Device     string    `json:"device"`
+	Type       string    `json:"type"`
+	Object     string    `json:"object"`
+	Started    time.Time `json:"started"`
+	Until      time.Time `json:"until"`
+	Suppressed uint64    `json:"suppressed"` // Matches not published since the window opened
+	Last       time.Time `json:"last"`       // When the last of them came
+
+	ev Event // The one that was published, for the summary
+}
+
+// Accumulator counts matches towards a threshold for one object on one device.
+type Accumulator struct {
+	Key    string    `json:"key"`
+	Device string    `json:"device"`
+	Type   string    `json:"type"`
+	Object string    `json:"object"`
+	Since  time.Time `json:"since"` // The oldest match still counted
+	Count  int       `json:"count"`
+	Need   int       `json:"need"`
+	Within string    `json:"within"`
+
+	times  []time.Time // The matches counted, oldest first
+	within time.Duration
+}
+
+// Suppressions is safe to use from several goroutines.
+type Suppressions struct {
+	mu           sync.Mutex
+	windows      map[string]*SuppressWindow
+	accumulators map[string]*Accumulator
+	acks         map[string]*Ack          // See acks.go
+	snoozes      map[string]*Snooze       // See acks.go
+	ackFor       time.Duration            // How long an ack lasts if it doesn't say
+	byObject     map[string]time.Duration // Windows from 'services', by object name
+	byRule       map[string]time.Duration // Set through the API, by rule name. See tuning.go
+	thresholds   *thresholds              // From 'thresholds', see thresholds.go
+	alerts       map[string]*Alert        // By ID, see lifecycle.go
+	deviceCounts *deviceWindows           // For thresholds per device, see windows.go
+	pruned       time.Time                // When alerts were last pruned
+	tuned        time.Time                // When the thresholds or windows were last changed through the API
+}
+
+func newSuppressions(ackFor time.Duration) *Suppressions {
+	return &Suppressions{windows: make(map[string]*SuppressWindow), accumulators: make(map[string]*Accumulator),
+		acks: make(map[string]*Ack), snoozes: make(map[string]*Snooze), ackFor: ackFor, alerts: make(map[string]*Alert)}
+}
+
+func suppressKey(host string, class string, object string) string {
+	return host + "/" + class + "/" + object
+}
+
+// serviceWindows sets the windows that 'services' gives objects.
+func (s *Suppressions) serviceWindows(services map[string]ServiceConfig) error {
+	byObject := make(map[string]time.Duration)
+	for name, svc := range services {
+		if svc.Suppress == "" {
+			continue
+		}
+		d, err := time.ParseDuration(svc.Suppress)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Service '%s': bad suppress window '%s'", name, svc.Suppress)
+		}
+		byObject[name] = d
+	}
+	s.mu.Lock()
+	s.byObject = byObject
+	s.mu.Unlock()
+	return nil
+}
+
+// Allow says whether an event should be published, opening a window if its rule (or object) has one.
+func (s *Suppressions) Allow(m Event, now time.Time) bool {
+	obj := m.Object
+	key := suppressKey(m.Device, m.Type, obj)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !m.backUp() && s.acked(key, now) {
+		return false
+	}
+	window := m.Rule.suppress
+	if d, ok := s.byRule[m.Rule.Name]; ok {
+		window = d
+	}
+	if d, ok := s.byObject[obj]; ok && obj != "" {
+		window = d
+	}
+	if window <= 0 {
+		return true
+	}
+	if w, ok := s.windows[key]; ok && now.Before(w.Until) {
+		w.Suppressed++
+		w.Last = now
+		return false
+	}
+	s.windows[key] = &SuppressWindow{Key: key, Device: m.Device, Type: m.Type, Object: obj, Started: now, Until: now.Add(window), ev: m}
+	return true
+}
+
+// setThresholds sets the thresholds from the config's 'thresholds'.
+func (s *Suppressions) setThresholds(cfg ThresholdsConfig) error {
+	t, err := newThresholds(cfg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.thresholds = t
+	s.mu.Unlock()
+	return nil
+}
+
+// Reached counts a match towards its threshold (see thresholds.go), saying whether it trips it and
+// returning the threshold if there was more than one match to count. Events with no threshold always trip
+// it. The count starts again each time it trips.
+func (s *Suppressions) Reached(m Event, now time.Time) (*Threshold, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.thresholds.forEvent(m)
+	if t == nil || t.Count <= 1 {
+		return nil, true
+	}
+	if t.Per == "device" {
+		return t, s.deviceCounts.count(m.Device, m.Type, t.within, now) >= uint64(t.Count)
+	}
+	key := suppressKey(m.Device, m.Type, m.Object)
+	a, ok := s.accumulators[key]
+	if !ok {
+		a = &Accumulator{Key: key, Device: m.Device, Type: m.Type, Object: m.Object}
+		s.accumulators[key] = a
+	}
+	a.Need, a.Within, a.within = t.Count, t.within.String(), t.within
+	a.times = append(a.times, now)
+	a.expire(now)
+	if a.Count < a.Need {
+		return t, false
+	}
+	delete(s.accumulators, key)
+	return t, true
+}
+
+// expire stops counting the matches older than within.
+func (a *Accumulator) expire(now time.Time) {
+	i := 0
+	for i < len(a.times) && now.Sub(a.times[i]) >= a.within {
+		i++
+	}
+	a.times = a.times[i:]
+	a.Count = len(a.times)
+	if a.Count > 0 {
+		a.Since = a.times[0]
+	}
+}
+
+// withThreshold is fields with the threshold that was tripped added.
+func withThreshold(fields map[string]interface{}, t *Threshold) map[string]interface{} {
+	out := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		out[k] = v
+	}
+	out["threshold_count"] = t.Count
+	out["threshold_window"] = t.Within
+	return out
+}
+
+// closed takes out the windows that have ended, returning the summaries of those that held anything back.
+func (s *Suppressions) closed(now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneAlerts(now)
+	var out []Event
+	for k, w := range s.windows {
+		if now.Before(w.Until) {
+			continue
+		}
+		delete(s.windows, k)
+		if w.Suppressed == 0 {
+			continue
+		}
+		ev := w.ev
+		ev.Fields = make(map[string]interface{}, len(w.ev.Fields)+3)
+		for k, v := range w.ev.Fields {
+			ev.Fields[k] = v
+		}
+		ev.Fields["suppressed_count"] = w.Suppressed
+		ev.Fields["first_seen"] = w.Started.UTC().Format(time.RFC3339)
+		ev.Fields["last_seen"] = w.Last.UTC().Format(time.RFC3339)
+		ev.Suppressed = w.Suppressed
+		ev.Deadline = time.Time{} // Gets a budget of its own, see deadlines.go
+		ev.Message = fmt.Sprintf("%s (%d more suppressed in %s)", w.ev.Message, w.Suppressed, w.Until.Sub(w.Started).Round(time.Second))
+		out = append(out, ev)
+	}
+	return out
+}
+
+// suppressSummaries publishes the summaries as the windows end.
+func (a *agent) suppressSummaries(ctx context.Context) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			for _, ev := range a.suppress.closed(now) {
+				a.emit(ctx, a.config, ev)
+			}
+		}
+	}
+}
+
+// Snapshot returns the open windows and the accumulators, sorted by key. Closed windows are left out.
+func (s *Suppressions) Snapshot() ([]SuppressWindow, []Accumulator) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ws := []SuppressWindow{}
+	for k, w := range s.windows {
+		if !now.Before(w.Until) {
+			if w.Suppressed == 0 {
+				delete(s.windows, k) // Nothing to summarize, see closed
+			}
+			continue
+		}
+		ws = append(ws, *w)
+	}
+	as := []Accumulator{}
+	for k, a := range s.accumulators {
+		if a.expire(now); a.Count == 0 {
+			delete(s.accumulators, k)
+			continue
+		}
+		as = append(as, *a)
+	}
+	sort.Slice(ws, func(i, j int) bool { return ws[i].Key < ws[j].Key })
+	sort.Slice(as, func(i, j int) bool { return as[i].Key < as[j].Key })
+	return ws, as
+}
+
+// Reset drops the window and accumulator for key, or all of them if key is "". Returns how many went.
+func (s *Suppressions) Reset(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	if key == "" {
+		n = len(s.windows) + len(s.accumulators)
+		s.windows = make(map[string]*SuppressWindow)
+		s.accumulators = make(map[string]*Accumulator)
+		return n
+	}
+	if _, ok := s.windows[key]; ok {
+		delete(s.windows, key)
+		n++
+	}
+	if _, ok := s.accumulators[key]; ok {
+		delete(s.accumulators, key)
+		n++
+	}
+	return n
+}
+
+// Extend pushes the end of an open window out by d. False if there is no such window.
+func (s *Suppressions) Extend(key string, d time.Duration) (SuppressWindow, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.windows[key]
+	if !ok || !time.Now().Before(w.Until) {
+		return SuppressWindow{}, false
+	}
+	w.Until = w.Until.Add(d)
+	return *w, true
+}
+
+func (s *Suppressions) registerAPI(mux *http.ServeMux, token string) {
+	mux.HandleFunc("/suppressions", func(w http.ResponseWriter, r *http.Request) {
+		ws, as := s.Snapshot()
+		writeJSON(w, map[string]interface{}{"windows": ws, "accumulators": as, "acks": s.Acks(), "snoozes": s.Snoozes()})
+	})
+	mux.HandleFunc("/suppressions/reset", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"result": "ok", "reset": s.Reset(r.URL.Query().Get("key"))})
+	}))
+	mux.HandleFunc("/suppressions/extend", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		d, err := time.ParseDuration(r.URL.Query().Get("by"))
+		if err != nil || d <= 0 {
+			http.Error(w, "'by' must be a duration, e.g. 10m", http.StatusBadRequest)
+			return
+		}
+		win, ok := s.Extend(r.URL.Query().Get("key"), d)
+		if !ok {
+			http.Error(w, "No open window with that key", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, win)
+	}))
+	mux.HandleFunc("/acks", requireToken(token, s.ackHandler))
+	mux.HandleFunc("/alerts", s.alertsHandler)
+}
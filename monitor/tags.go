@@ -0,0 +1,59 @@
+package monitor
+
+//
+//  tags.go  --  Static tags naming this agent, added to every event it publishes (including its own
+//    diagnostics) and as labels on every metric, so consumers of several sites' agents can tell them
+//    apart without going by client IDs:
+//
+//  "tags": { "site": "ams1", "region": "eu-west", "environment": "prod" }
+//
+//  A tag doesn't replace a field the event already has. Names must be usable as Prometheus labels, and
+//  can't be one of the payload fields in schema.go or a metric's own labels.
+//
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var tagName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// checkTags vets the 'tags' section of the config.
+func checkTags(tags map[string]string) error {
+	for k := range tags {
+		if !tagName.MatchString(k) || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("Bad tag name '%s'", k)
+		}
+		switch k {
+		case "device", "object":
+			return fmt.Errorf("Tag '%s' is a metric label already", k)
+		}
+		for _, f := range payloadFields {
+			if f.Name == k {
+				return fmt.Errorf("Tag '%s' is a payload field already", k)
+			}
+		}
+	}
+	return nil
+}
+
+// addTags adds the tags to an event, leaving any fields it already has alone.
+func addTags(payload map[string]interface{}, tags map[string]string) {
+	for k, v := range tags {
+		if _, ok := payload[k]; !ok {
+			payload[k] = v
+		}
+	}
+}
+
+// tagLabels renders the tags as Prometheus labels, sorted, e.g. `region="eu-west",site="ams1"`.
+func tagLabels(tags map[string]string) string {
+	ls := make([]string, 0, len(tags))
+	for k, v := range tags {
+		ls = append(ls, fmt.Sprintf(`%s="%s"`, k, promLabel(v)))
+	}
+	sort.Strings(ls)
+	return strings.Join(ls, ",")
+}
@@ -0,0 +1,238 @@
+package monitor
+
+//
+//  teams.go  --  Microsoft Teams as an output, for organisations that live in Teams: each event posted to a
+//    channel's incoming webhook (a Workflows "post to a channel when a webhook request is received" URL,
+//    or an older Office 365 connector's) as an Adaptive Card.
+//
+//  "teams": { "webhook_url": "https://prod-00.westus.logic.azure.com/workflows/...",
+//             "cards": { "server_down": "/etc/conn-rate-mon/cards/server-down.json",
+//                        "default": "/etc/conn-rate-mon/cards/alert.json" },
+//             "fields": ["object_name as VIP", "rate", "limit", "partition"] }
+//
+//    webhook_url   the channel's webhook
+//    cards         card templates by event type (the payload's "type"), "default" for the types not
+//                  given. Each is a file holding the card's JSON as a template over the payload, read at
+//                  start; the "json" function (templates.go) quotes a value. What it renders has to be JSON
+//    title         the heading of the built-in card, a template over the payload. Default
+//                  "{{.severity}}: {{.rule}} on {{.hostname}}"
+//    fields        the payload fields the built-in card lists, as for Slack (slack.go)
+//    retry         as for webhooks (webhook.go)
+//    filter        only send events this expression is true for, see expr.go
+//
+//  An event type with no card of its own, and no "default", gets the built-in card: the title, on a band
+//  coloured by severity (green for an all-clear, see recovery.go), the message, the fields, the rule,
+//  device and event time in the reader's own time zone, and a button to the runbook if there is one
+//  (runbooks.go). A card file might be:
+//
+//    { "type": "AdaptiveCard", "version": "1.4", "body": [
+//        { "type": "TextBlock", "text": {{json (printf "%s is down" .object_name)}}, "weight": "Bolder" },
+//        { "type": "FactSet", "facts": [ { "title": "Device", "value": {{json .hostname}} } ] } ] }
+//
+//  Rules send to it as "teams" in "sinks". A failure is counted as deliver.teams, or deliver.teams_timeout
+//  (errors.go); a card that doesn't render, or isn't JSON, as render.template.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TeamsConfig is the 'teams' section of the config.
+type TeamsConfig struct {
+	Webhook_URL string            `json:"webhook_url"`
+	Cards       map[string]string `json:"cards"`
+	Title       string            `json:"title"`
+	Fields      []string          `json:"fields"`
+	Retry       WebhookRetry      `json:"retry"`
+	Filter      string            `json:"filter"`
+}
+
+type teamsSink struct {
+	cards  map[string]*template.Template
+	title  *template.Template
+	fields projection
+}
+
+// newTeamsSink is the Teams output, nil if there isn't one configured. It is a webhook with its own body.
+func newTeamsSink(c TeamsConfig, timeout time.Duration) (*webhookSink, error) {
+	if c.Webhook_URL == "" {
+		if len(c.Cards) > 0 {
+			return nil, errors.New("teams: 'cards' but no 'webhook_url' to post them to")
+		}
+		return nil, nil
+	}
+	s := &teamsSink{cards: make(map[string]*template.Template, len(c.Cards))}
+	for typ, fn := range c.Cards {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("teams: can't read the card for %s: %v", typ, err)
+		}
+		if s.cards[typ], err = parseTemplate("teams."+typ, string(b)); err != nil {
+			return nil, fmt.Errorf("teams: bad card template for %s (%s): %v", typ, fn, err)
+		}
+	}
+	var err error
+	if c.Title == "" {
+		c.Title = defaultChatTitle
+	}
+	if s.title, err = parseTemplate("teams.title", c.Title); err != nil {
+		return nil, fmt.Errorf("teams: bad title template: %v", err)
+	}
+	if s.fields, err = compileProjection(c.Fields); err != nil {
+		return nil, fmt.Errorf("teams: %v", err)
+	}
+	hook := WebhookConfig{Name: "teams", URL: c.Webhook_URL, Retry: c.Retry, Filter: c.Filter}
+	w, err := newWebhookSink(hook, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("teams: %v", err)
+	}
+	w.encode, w.check, w.codes = s.encode, checkTeamsReply, [2]string{errDeliverTeams, errDeliverTeamsTime}
+	return w, nil
+}
+
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string          `json:"contentType"`
+	Content     json.RawMessage `json:"content"`
+}
+
+// teamsCard is the built-in card.
+type teamsCard struct {
+	Schema  string                 `json:"$schema"`
+	Type    string                 `json:"type"`
+	Version string                 `json:"version"`
+	Body    []teamsElement         `json:"body"`
+	Actions []teamsAction          `json:"actions,omitempty"`
+	MSTeams map[string]interface{} `json:"msteams"`
+}
+
+// teamsElement is a Container, TextBlock or FactSet.
+type teamsElement struct {
+	Type     string         `json:"type"`
+	Style    string         `json:"style,omitempty"`
+	Bleed    bool           `json:"bleed,omitempty"`
+	Items    []teamsElement `json:"items,omitempty"`
+	Text     string         `json:"text,omitempty"`
+	Size     string         `json:"size,omitempty"`
+	Weight   string         `json:"weight,omitempty"`
+	IsSubtle bool           `json:"isSubtle,omitempty"`
+	Wrap     bool           `json:"wrap,omitempty"`
+	Facts    []teamsFact    `json:"facts,omitempty"`
+}
+
+type teamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+type teamsAction struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+func (s *teamsSink) encode(ctx context.Context, out *Outgoing, payload map[string]interface{}) ([]byte, error) {
+	typ := templateString(payload["type"])
+	t, ok := s.cards[typ]
+	if !ok {
+		typ = "default"
+		t, ok = s.cards[typ]
+	}
+	var card []byte
+	if ok {
+		c, err := renderTemplate(ctx, t, payload)
+		if err != nil {
+			return nil, fmt.Errorf("card for %s: %w", typ, err)
+		}
+		if !json.Valid([]byte(c)) {
+			return nil, fmt.Errorf("card for %s didn't render as JSON", typ)
+		}
+		card = []byte(c)
+	} else {
+		var err error
+		if card, err = s.builtin(ctx, out, payload); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(&teamsMessage{Type: "message",
+		Attachments: []teamsAttachment{{ContentType: "application/vnd.microsoft.card.adaptive", Content: card}}})
+}
+
+func (s *teamsSink) builtin(ctx context.Context, out *Outgoing, payload map[string]interface{}) ([]byte, error) {
+	title, err := renderTemplate(ctx, s.title, payload)
+	if err != nil {
+		return nil, fmt.Errorf("title: %w", err)
+	}
+	if title == "" {
+		title = templateString(payload["rule"])
+	}
+	heading := teamsElement{Type: "Container", Style: teamsStyle(out.Event, payload), Bleed: true,
+		Items: []teamsElement{{Type: "TextBlock", Text: title, Size: "Large", Weight: "Bolder", Wrap: true}}}
+	card := &teamsCard{Schema: "http://adaptivecards.io/schemas/adaptive-card.json", Type: "AdaptiveCard",
+		Version: "1.4", Body: []teamsElement{heading}, MSTeams: map[string]interface{}{"width": "Full"}}
+	if m := templateString(payload["message"]); m != "" {
+		card.Body = append(card.Body, teamsElement{Type: "TextBlock", Text: m, Wrap: true})
+	}
+	if fields := chatFields(s.fields, payload); len(fields) > 0 {
+		facts := teamsElement{Type: "FactSet"}
+		for _, f := range fields {
+			facts.Facts = append(facts.Facts, teamsFact{f.name, f.value})
+		}
+		card.Body = append(card.Body, facts)
+	}
+	at := out.Event.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	when := at.UTC().Format("2006-01-02T15:04:05Z")
+	footer := fmt.Sprintf("%s · %s · {{DATE(%s, SHORT)}} {{TIME(%s)}}", templateString(payload["rule"]),
+		templateString(payload["hostname"]), when, when)
+	card.Body = append(card.Body, teamsElement{Type: "TextBlock", Text: footer, Size: "Small", IsSubtle: true, Wrap: true})
+	if rb := runbookURL(payload); rb != "" {
+		card.Actions = []teamsAction{{Type: "Action.OpenUrl", Title: "Runbook", URL: rb}}
+	}
+	return json.Marshal(card)
+}
+
+// checkTeamsReply finds the error an Office 365 connector reports in its reply, which is a 200 either way:
+// "Webhook message delivery failed with error: Microsoft Teams endpoint returned HTTP error 429 ...". A
+// 429 there is tried again like any other.
+func checkTeamsReply(body []byte) error {
+	reply := strings.TrimSpace(string(body))
+	if !strings.Contains(reply, "failed with error") {
+		return nil
+	}
+	if len(reply) > 200 {
+		reply = reply[:200]
+	}
+	we := &webhookError{status: 200, reason: "Teams said " + reply}
+	if strings.Contains(reply, "HTTP error 429") {
+		we.status = 429
+	}
+	return we
+}
+
+// teamsStyle is the heading's container style for the event, as slackColor has it.
+func teamsStyle(ev Event, payload map[string]interface{}) string {
+	if ev.Recovered {
+		return "good"
+	}
+	switch sev := severityLevel(templateString(payload["severity"])); {
+	case sev >= 0 && sev <= 3:
+		return "attention"
+	case sev == 4:
+		return "warning"
+	}
+	return "accent"
+}
@@ -0,0 +1,175 @@
+package monitor
+
+//
+//  templates.go  --  The functions Go templates in the config and rules file can use: the event key (see
+//    eventkey.go), rule topics, and the payload fields a rule sets with "set". Enough to meet privacy and
+//    formatting needs without changing the agent:
+//
+//    sha256 X           hex SHA-256 of X
+//    hmac KEY X         hex HMAC-SHA256 of X; hashes nobody can reverse by trying every likely value
+//    truncate N X       the first N characters of X
+//    maskIP X           X with the host part zeroed: the last octet of an IPv4 address, the last 64 bits of IPv6
+//    env NAME           an environment variable, e.g. for the hmac key
+//    rdns X             the DNS name of IP address X, "" if it has none. Cached, see enrich.go
+//    json X             X as JSON, quoted and escaped, for bodies (webhook.go); "null" for a missing field
+//
+//    "set": { "client_ip": "{{maskIP .client_ip}}", "user": "{{hmac (env \"A10_HASH_KEY\") .user}}",
+//             "message": "{{truncate 200 .message}}" }
+//    "topic": "a10/{{.hostname}}/{{.type}}"
+//
+//  A rule's "set_by_severity" adds fields by the severity the event is published with, after any
+//  escalation (paging.go) or magnitude (magnitude.go) has raised it, so a critical alert can carry more
+//  than a warning. Each severity's fields go on events of that severity or worse; of those, the most
+//  severe one is used. They are rendered after "set", over the payload it made, and win over it:
+//
+//    "set_by_severity": { "warning":  { "summary": "{{.object_name}} over its limit" },
+//                         "critical": { "summary": "{{.object_name}} at {{.rate}}/s, limit {{.limit}}",
+//                                       "runbook": "https://wiki.example.com/a10/conn-rate#critical" } }
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// severitySet is one severity's "set_by_severity" fields.
+type severitySet struct {
+	level int
+	set   map[string]*template.Template
+}
+
+func (r *Rule) compileSetBySeverity() error {
+	r.bySev = nil
+	for name, fields := range r.SetBySeverity {
+		sev, ok := normalizeSeverity(name)
+		if !ok {
+			return fmt.Errorf("Rule '%s': unknown severity '%s' in set_by_severity", r.Name, name)
+		}
+		ss := severitySet{level: severityLevel(sev), set: make(map[string]*template.Template, len(fields))}
+		for k, src := range fields {
+			t, err := parseTemplate(k, src)
+			if err != nil {
+				return fmt.Errorf("Rule '%s': bad template for '%s' (%s): %v", r.Name, k, sev, err)
+			}
+			ss.set[k] = t
+		}
+		for _, o := range r.bySev {
+			if o.level == ss.level {
+				return fmt.Errorf("Rule '%s': severity '%s' given twice in set_by_severity", r.Name, sev)
+			}
+		}
+		r.bySev = append(r.bySev, ss)
+	}
+	sort.Slice(r.bySev, func(i, j int) bool { return r.bySev[i].level < r.bySev[j].level })
+	return nil
+}
+
+// setFor is the "set_by_severity" fields for an event of the severity, nil if there aren't any.
+func (r *Rule) setFor(severity string) map[string]*template.Template {
+	if r == nil {
+		return nil
+	}
+	level := severityLevel(severity)
+	for _, ss := range r.bySev {
+		if level >= 0 && level <= ss.level {
+			return ss.set
+		}
+	}
+	return nil
+}
+
+// templateString is a template argument as text. Fields missing from the payload are "".
+func templateString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+var templateFuncs = template.FuncMap{
+	"sha256": func(v interface{}) string {
+		if s := templateString(v); s != "" {
+			return sha256Hex([]byte(s))
+		}
+		return "" // Not the hash of nothing, which would look like a value
+	},
+	"hmac": func(key string, v interface{}) string {
+		if s := templateString(v); s != "" {
+			return fmt.Sprintf("%x", hmacSHA256([]byte(key), s))
+		}
+		return ""
+	},
+	"truncate": func(n int, v interface{}) string {
+		r := []rune(templateString(v))
+		if n >= 0 && len(r) > n {
+			r = r[:n]
+		}
+		return string(r)
+	},
+	"maskIP": func(v interface{}) string {
+		return maskIP(templateString(v))
+	},
+	"env":  os.Getenv,
+	"rdns": rdnsWithin(context.Background()), // execTemplate puts in one bound by the render's ctx
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// rdnsWithin is the rdns function, giving up on a lookup that is still going when ctx is done.
+func rdnsWithin(ctx context.Context) func(v interface{}) string {
+	return func(v interface{}) string {
+		if s := templateString(v); s != "" {
+			return enrichCaches["dns"].get(ctx, s)
+		}
+		return ""
+	}
+}
+
+// maskIP zeroes the host part of an IP address. Anything else comes back as it was.
+func maskIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+func parseTemplate(name string, src string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(src)
+}
+
+// renderTemplate runs t over an event within ctx. Fields missing from it come out empty. The only thing a
+// render waits on is rdns, which gives up when ctx is done, so a render past ctx's deadline ends there and
+// ctx's error is returned.
+func renderTemplate(ctx context.Context, t *template.Template, payload map[string]interface{}) (string, error) {
+	s, err := execTemplate(ctx, t, payload)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return s, err
+}
+
+func execTemplate(ctx context.Context, t *template.Template, payload map[string]interface{}) (string, error) {
+	if ctx.Done() != nil {
+		if c, err := t.Clone(); err == nil {
+			t = c.Funcs(template.FuncMap{"rdns": rdnsWithin(ctx)})
+		}
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, payload); err != nil {
+		return "", err
+	}
+	return strings.Replace(b.String(), "<no value>", "", -1), nil
+}
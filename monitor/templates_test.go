@@ -0,0 +1,47 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// rdns gives up with the render's deadline, rather than leaving the lookup (and the render) going, and
+// what it gave up on isn't cached.
+func TestRenderRDNSDeadline(t *testing.T) {
+	gaveUp := make(chan struct{})
+	lookups := 0
+	saved := enrichCaches["dns"]
+	enrichCaches["dns"] = newEnrichCache("dns", func(ctx context.Context, ip string) (string, error) {
+		if lookups++; lookups > 1 {
+			return "vip.example.com", nil
+		}
+		<-ctx.Done() // A resolver that doesn't answer
+		close(gaveUp)
+		return "", ctx.Err()
+	})
+	t.Cleanup(func() { enrichCaches["dns"] = saved })
+
+	tmpl, err := parseTemplate("name", "{{rdns .client_ip}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := map[string]interface{}{"client_ip": "10.1.2.3"}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if s, err := renderTemplate(ctx, tmpl, payload); err != context.DeadlineExceeded || s != "" {
+		t.Errorf("render past the deadline gave %q, %v", s, err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("render took %v", took)
+	}
+	select {
+	case <-gaveUp:
+	case <-time.After(time.Second):
+		t.Fatal("lookup still going after the render gave up")
+	}
+	if s, err := renderTemplate(context.Background(), tmpl, payload); err != nil || s != "vip.example.com" {
+		t.Errorf("next render gave %q, %v; the timed out lookup was cached", s, err)
+	}
+}
@@ -0,0 +1,142 @@
+package monitor
+
+//
+//  thresholds.go  --  Thresholds (see suppress.go) set in the config rather than on a rule, so known-bursty
+//    VIPs can need more matches before they alert and critical ones can alert on the first:
+//
+//  "thresholds": {
+//    "default": { "count": 3, "within": "60s" },
+//    "devices": { "thunder-lab-*": { "count": 10, "within": "60s" } },
+//    "objects": { "bursty-vip": { "count": 20, "within": "2m" }, "payments-vip": { "count": 1 } }
+//  }
+//
+//  For each event the first of these that applies is used: its object's, its device's (a pattern like
+//  "thunder-lab-*"), its rule's "threshold", then the default. A count of 1 alerts straight away and needs
+//  no "within".
+//
+//  With "per": "device", a threshold counts the matches of the event's type on the whole device rather
+//  than for the one object, from the sliding windows (see windows.go), so "within" has to be 1m, 5m or
+//  15m. Every match is published while the device is over it, rather than the count starting again.
+//
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// ThresholdsConfig holds the 'thresholds' section of the config.
+type ThresholdsConfig struct {
+	Default *Threshold            `json:"default"`
+	Devices map[string]*Threshold `json:"devices"` // By device pattern
+	Objects map[string]*Threshold `json:"objects"` // By VIP (or other object) name
+}
+
+// Threshold is how many matches an object needs, and how close together, before an event is published.
+type Threshold struct {
+	Count  int    `json:"count"`
+	Within string `json:"within"`
+	Per    string `json:"per"` // "object" (the default) or "device"
+
+	within time.Duration
+}
+
+func (t *Threshold) compile() error {
+	if t.Count < 1 {
+		return errors.New("threshold count must be at least 1")
+	}
+	if t.Count == 1 && t.Within == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(t.Within)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("bad threshold window '%s'", t.Within)
+	}
+	t.within = d
+	switch t.Per {
+	case "", "object":
+	case "device":
+		if !isSlidingWindow(d) {
+			return fmt.Errorf("a threshold per device needs a window of 1m, 5m or 15m, not '%s'", t.Within)
+		}
+	default:
+		return fmt.Errorf("threshold per '%s' should be \"object\" or \"device\"", t.Per)
+	}
+	return nil
+}
+
+type thresholds struct {
+	def      *Threshold
+	devices  map[string]*Threshold
+	patterns []string // The device patterns with wildcards, sorted
+	objects  map[string]*Threshold
+	rules    map[string]*Threshold // Set through the API, by rule name. See tuning.go
+}
+
+func newThresholds(cfg ThresholdsConfig) (*thresholds, error) {
+	t := &thresholds{def: cfg.Default, devices: cfg.Devices, objects: cfg.Objects}
+	if t.def != nil {
+		if err := t.def.compile(); err != nil {
+			return nil, fmt.Errorf("thresholds: default: %v", err)
+		}
+	}
+	for dev, th := range cfg.Devices {
+		if err := th.compile(); err != nil {
+			return nil, fmt.Errorf("thresholds: device '%s': %v", dev, err)
+		}
+		if _, err := path.Match(dev, ""); err != nil {
+			return nil, fmt.Errorf("thresholds: bad device pattern '%s'", dev)
+		}
+		if containsWildcard(dev) {
+			t.patterns = append(t.patterns, dev)
+		}
+	}
+	sort.Strings(t.patterns)
+	for obj, th := range cfg.Objects {
+		if err := th.compile(); err != nil {
+			return nil, fmt.Errorf("thresholds: object '%s': %v", obj, err)
+		}
+	}
+	return t, nil
+}
+
+// forEvent is the threshold for ev, nil if it has none.
+func (t *thresholds) forEvent(ev Event) *Threshold {
+	if t == nil {
+		return ruleThreshold(ev)
+	}
+	if th, ok := t.objects[ev.Object]; ok && ev.Object != "" {
+		return th
+	}
+	if th, ok := t.devices[ev.Device]; ok {
+		return th
+	}
+	for _, pat := range t.patterns {
+		if ok, _ := path.Match(pat, ev.Device); ok {
+			return t.devices[pat]
+		}
+	}
+	if th, ok := t.rules[ruleName(ev)]; ok {
+		return th
+	}
+	if th := ruleThreshold(ev); th != nil {
+		return th
+	}
+	return t.def
+}
+
+func ruleName(ev Event) string {
+	if ev.Rule == nil {
+		return ""
+	}
+	return ev.Rule.Name
+}
+
+func ruleThreshold(ev Event) *Threshold {
+	if ev.Rule == nil {
+		return nil
+	}
+	return ev.Rule.Threshold
+}
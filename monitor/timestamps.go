@@ -0,0 +1,116 @@
+package monitor
+
+//
+//  timestamps.go  --  Turning the record's timestamp into a real time. RFC 3164 timestamps have neither a
+//    year nor a timezone, and Thunder devices can be set to any zone, so each device (or wildcard pattern
+//    of them, as in hosts.go) can be given one. Times without a zone are read in it, the year is worked
+//    out from the time the record arrived, and every event gets them as RFC 3339 in UTC:
+//
+//  "timestamps": { "zone": "UTC", "device_zones": { "Testing1": "America/New_York", "ams-*": "Europe/Amsterdam" },
+//                  "use": "device" }
+//
+//  "timestamp" in the payload is the device's time ("use": "device", the default) or the time the agent
+//  got the record ("use": "received"), which is the one to trust if device clocks can't be. "received"
+//  is always there too.
+//
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// TimestampConfig holds the 'timestamps' section of the config.
+type TimestampConfig struct {
+	Zone         string            `json:"zone"`         // For devices not in device_zones. Default UTC
+	Device_Zones map[string]string `json:"device_zones"` // Device name or pattern to IANA zone name
+	Use          string            `json:"use"`          // "device" (default) or "received"
+
+	zone     *time.Location
+	zones    map[string]*time.Location
+	patterns []string // The keys of device_zones with wildcards, sorted
+}
+
+// check loads the zones.
+func (t *TimestampConfig) check() error {
+	switch t.Use {
+	case "", "device", "received":
+	default:
+		return fmt.Errorf("Timestamps 'use' must be \"device\" or \"received\"")
+	}
+	t.zone = time.UTC
+	if t.Zone != "" {
+		l, err := time.LoadLocation(t.Zone)
+		if err != nil {
+			return fmt.Errorf("Unknown timezone '%s'", t.Zone)
+		}
+		t.zone = l
+	}
+	t.zones = make(map[string]*time.Location)
+	t.patterns = nil
+	for dev, z := range t.Device_Zones {
+		l, err := time.LoadLocation(z)
+		if err != nil {
+			return fmt.Errorf("Unknown timezone '%s' for '%s'", z, dev)
+		}
+		if _, err := path.Match(dev, ""); err != nil {
+			return err
+		}
+		t.zones[dev] = l
+		if containsWildcard(dev) {
+			t.patterns = append(t.patterns, dev)
+		}
+	}
+	sort.Strings(t.patterns)
+	return nil
+}
+
+func containsWildcard(s string) bool {
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+// zoneFor is the timezone a device's clock is in.
+func (t *TimestampConfig) zoneFor(device string) *time.Location {
+	if l, ok := t.zones[device]; ok {
+		return l
+	}
+	for _, pat := range t.patterns {
+		if ok, _ := path.Match(pat, device); ok {
+			return t.zones[pat]
+		}
+	}
+	if t.zone == nil {
+		return time.UTC
+	}
+	return t.zone
+}
+
+// deviceTime reads a timestamp without a zone or year (the Syslog library gives it as UTC, in the current
+// year) in the device's zone, and picks the year that puts it nearest to when it was received.
+func (t *TimestampConfig) deviceTime(device string, ts time.Time, received time.Time) time.Time {
+	ts = time.Date(received.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), ts.Nanosecond(), t.zoneFor(device))
+	switch {
+	case ts.Sub(received) > 24*time.Hour: // "Dec 31 23:59:59" received on the 1st of January
+		ts = ts.AddDate(-1, 0, 0)
+	case received.Sub(ts) > 335*24*time.Hour: // "Jan  1 00:00:01" received the day before, by our clock
+		ts = ts.AddDate(1, 0, 0)
+	}
+	return ts
+}
+
+// addTimestamps puts the event's times in the payload.
+func (t *TimestampConfig) addTimestamps(payload map[string]interface{}, e Event) {
+	ts := e.Time
+	if t.Use == "received" {
+		ts = e.Received
+	}
+	payload["timestamp"] = ts.UTC().Format(time.RFC3339)
+	payload["received"] = e.Received.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,69 @@
+package monitor
+
+//
+//  tls.go  --  The 'tls' part of an output that connects to its brokers over TLS (kafka.go, ...):
+//
+//  "tls": { "ca_file": "/etc/conn-rate-mon/ca.pem", "cert_file": "client.pem", "key_file": "client.key" }
+//
+//    ca_file               the CAs to trust for the brokers' certificates. Default the system's
+//    cert_file, key_file   a client certificate, for brokers that want one
+//    server_name           the name to check the certificate against. Default the host connected to
+//    insecure_skip_verify  don't check the certificate at all; for trying things out only
+//
+//  "tls": {} is TLS with the defaults.
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig is the 'tls' of an output.
+type TLSConfig struct {
+	CA_File              string `json:"ca_file"`
+	Cert_File            string `json:"cert_file"`
+	Key_File             string `json:"key_file"`
+	Server_Name          string `json:"server_name"`
+	Insecure_Skip_Verify bool   `json:"insecure_skip_verify"`
+}
+
+// config is the tls.Config for c, nil if c is. section is for the errors.
+func (c *TLSConfig) config(section string) (*tls.Config, error) {
+	if c == nil {
+		return nil, nil
+	}
+	t := &tls.Config{ServerName: c.Server_Name, InsecureSkipVerify: c.Insecure_Skip_Verify}
+	if c.CA_File != "" {
+		pem, err := ioutil.ReadFile(c.CA_File)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't read ca_file: %v", section, err)
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates in ca_file '%s'", section, c.CA_File)
+		}
+	}
+	if (c.Cert_File == "") != (c.Key_File == "") {
+		return nil, fmt.Errorf("%s: cert_file and key_file go together", section)
+	}
+	if c.Cert_File != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert_File, c.Key_File)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad client certificate: %v", section, err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// forHost is t for connecting to host: with its name to check, unless one was given.
+func forHost(t *tls.Config, host string) *tls.Config {
+	if t.ServerName != "" {
+		return t
+	}
+	t = t.Clone()
+	t.ServerName = host
+	return t
+}
@@ -0,0 +1,215 @@
+package monitor
+
+//
+//  tuning.go  --  Changing thresholds and suppression windows while the agent runs, for tuning the noise
+//    during an incident without a restart or an edit to the rules file:
+//
+//    GET  /tuning    the thresholds and windows in force, as below
+//    POST /tuning    change some of them; the body has just the ones to change
+//
+//  { "thresholds": { "default": { "count": 3, "within": "60s" },
+//                    "devices": { "thunder-lab-*": { "count": 10, "within": "60s" } },
+//                    "objects": { "bursty-vip": { "count": 20, "within": "2m" } } },
+//    "suppress":   { "ws-vip": "2m" },
+//    "rules":      { "conn-rate-limit": { "suppress": "10m", "threshold": { "count": 5, "within": "1m" } } } }
+//
+//  "thresholds" is laid out like the config's 'thresholds' (thresholds.go) and "suppress" like the windows
+//  in 'services' (runbooks.go); "rules" stands in for a rule's own "suppress" and "threshold". What the
+//  POST gives is laid over what there is: a threshold with a count of 0 and a window of "" are taken
+//  out, going back to the next one that applies, and a rule given as {} goes back to what the rules
+//  file says. "suppress": "0s" turns a window off. The whole change is checked before any of it is used,
+//  so a bad one changes nothing.
+//
+//  Changes last until the agent restarts; a rules reload keeps them. They apply to the next match: an open
+//  window keeps its end (POST /suppressions/extend moves that) and an accumulator is held to the new count
+//  from its next match. Silences are changed at /silences (silences.go). POST is only there when
+//  'api_token' is set, as anyone who can reach the API could otherwise turn the alerts off.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Tuning is what GET /tuning gives and POST /tuning takes.
+type Tuning struct {
+	Thresholds ThresholdsConfig      `json:"thresholds"`
+	Suppress   map[string]string     `json:"suppress"` // Windows by object
+	Rules      map[string]RuleTuning `json:"rules"`
+	Changed    *time.Time            `json:"changed,omitempty"` // When it was last changed through the API
+}
+
+// RuleTuning stands in for a rule's own suppress window and threshold.
+type RuleTuning struct {
+	Suppress  string     `json:"suppress,omitempty"`
+	Threshold *Threshold `json:"threshold,omitempty"`
+}
+
+// Tuning is the thresholds and windows in force.
+func (s *Suppressions) Tuning() Tuning {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := Tuning{Suppress: make(map[string]string), Rules: make(map[string]RuleTuning)}
+	if s.thresholds != nil {
+		t.Thresholds = s.thresholds.config()
+		for name, th := range s.thresholds.rules {
+			t.Rules[name] = RuleTuning{Threshold: th}
+		}
+	}
+	for obj, d := range s.byObject {
+		t.Suppress[obj] = d.String()
+	}
+	for name, d := range s.byRule {
+		rt := t.Rules[name]
+		rt.Suppress = d.String()
+		t.Rules[name] = rt
+	}
+	if !s.tuned.IsZero() {
+		changed := s.tuned
+		t.Changed = &changed
+	}
+	return t
+}
+
+// config is the thresholds as they were configured, with any changes.
+func (t *thresholds) config() ThresholdsConfig {
+	cfg := ThresholdsConfig{Default: t.def, Devices: make(map[string]*Threshold), Objects: make(map[string]*Threshold)}
+	for k, th := range t.devices {
+		cfg.Devices[k] = th
+	}
+	for k, th := range t.objects {
+		cfg.Objects[k] = th
+	}
+	return cfg
+}
+
+// unset says whether a threshold in a change takes one out.
+func unset(th *Threshold) bool {
+	return th == nil || th.Count == 0
+}
+
+// Tune lays a change over the thresholds and windows in force. known says whether there is a rule of
+// that name.
+func (s *Suppressions) Tune(change Tuning, known func(rule string) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg := ThresholdsConfig{Devices: make(map[string]*Threshold), Objects: make(map[string]*Threshold)}
+	rules := make(map[string]*Threshold)
+	if s.thresholds != nil {
+		cfg = s.thresholds.config()
+		for k, th := range s.thresholds.rules {
+			rules[k] = th
+		}
+	}
+	if change.Thresholds.Default != nil {
+		cfg.Default = change.Thresholds.Default
+		if unset(cfg.Default) {
+			cfg.Default = nil
+		}
+	}
+	for k, th := range change.Thresholds.Devices {
+		if cfg.Devices[k] = th; unset(th) {
+			delete(cfg.Devices, k)
+		}
+	}
+	for k, th := range change.Thresholds.Objects {
+		if cfg.Objects[k] = th; unset(th) {
+			delete(cfg.Objects, k)
+		}
+	}
+	t, err := newThresholds(cfg)
+	if err != nil {
+		return err
+	}
+
+	byObject := make(map[string]time.Duration, len(s.byObject))
+	for k, d := range s.byObject {
+		byObject[k] = d
+	}
+	for obj, w := range change.Suppress {
+		if w == "" {
+			delete(byObject, obj)
+			continue
+		}
+		d, err := time.ParseDuration(w)
+		if err != nil || d < 0 {
+			return fmt.Errorf("suppress: bad window '%s' for '%s'", w, obj)
+		}
+		byObject[obj] = d
+	}
+
+	byRule := make(map[string]time.Duration, len(s.byRule))
+	for k, d := range s.byRule {
+		byRule[k] = d
+	}
+	for name, rt := range change.Rules {
+		if !known(name) {
+			return fmt.Errorf("rules: no rule named '%s'", name)
+		}
+		if rt.Suppress == "" && rt.Threshold == nil {
+			delete(byRule, name)
+			delete(rules, name)
+			continue
+		}
+		if rt.Suppress != "" {
+			d, err := time.ParseDuration(rt.Suppress)
+			if err != nil || d < 0 {
+				return fmt.Errorf("Rule '%s': bad suppress window '%s'", name, rt.Suppress)
+			}
+			byRule[name] = d
+		}
+		switch {
+		case rt.Threshold == nil:
+		case rt.Threshold.Count == 0:
+			delete(rules, name)
+		default:
+			if err := rt.Threshold.compile(); err != nil {
+				return fmt.Errorf("Rule '%s': %v", name, err)
+			}
+			rules[name] = rt.Threshold
+		}
+	}
+
+	t.rules = rules
+	s.thresholds, s.byObject, s.byRule = t, byObject, byRule
+	s.tuned = time.Now().UTC()
+	return nil
+}
+
+func (a *agent) registerTuningAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/tuning", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeJSON(w, a.suppress.Tuning())
+			return
+		}
+		if a.config.API_Token == "" {
+			http.Error(w, "Changing the tuning needs an api_token", http.StatusForbidden)
+			return
+		}
+		requireToken(a.config.API_Token, func(w http.ResponseWriter, r *http.Request) {
+			var change Tuning
+			if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+				http.Error(w, "Bad tuning: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			known := func(name string) bool {
+				for _, rule := range a.currentRules().rules {
+					if rule.Name == name {
+						return true
+					}
+				}
+				return false
+			}
+			if err := a.suppress.Tune(change, known); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if a.config.Debug > 0 {
+				fmt.Println("Thresholds and suppression windows changed through the API")
+			}
+			writeJSON(w, a.suppress.Tuning())
+		})(w, r)
+	})
+}
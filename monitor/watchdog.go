@@ -0,0 +1,91 @@
+package monitor
+
+//
+//  watchdog.go  --  Notices when the processing goroutine has stopped taking records off the channel even
+//    though the Syslog listener is still receiving them (a wedged MQTT publish, a stuck plugin, a deadlock),
+//    starts a fresh consumer, and publishes a diagnostic event about it to 'diag_topic'.
+//
+//  The stuck goroutine can't be killed, but if it ever comes unstuck it finishes its record and exits.
+//
+//  "watchdog_timeout": 60    seconds without progress before restarting; -1 turns the watchdog off
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const defaultWatchdogTimeout = 60
+
+func (a *agent) watchdog(ctx context.Context) {
+	timeout := time.Duration(a.config.Watchdog_Timeout) * time.Second
+	if a.config.Watchdog_Timeout == 0 {
+		timeout = defaultWatchdogTimeout * time.Second
+	}
+	if timeout < 0 {
+		return
+	}
+	tick := time.NewTicker(timeout / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		received := atomic.LoadUint64(&a.received)
+		processed := atomic.LoadUint64(&a.processed)
+		stuck := atomic.LoadUint64(&a.stuck)
+		stalled := time.Since(time.Unix(0, atomic.LoadInt64(&a.lastProcessed)))
+		if received <= processed+stuck || stalled < timeout {
+			continue
+		}
+
+		atomic.AddUint64(&a.stuck, 1) // The old consumer is holding one record
+		gen := atomic.AddUint64(&a.generation, 1)
+		if a.config.Debug > 3 {
+			fmt.Printf(">>> Watchdog: no record processed for %v with %d waiting, restarting pipeline\n", stalled.Round(time.Second), received-processed-stuck)
+		}
+		atomic.StoreInt64(&a.lastProcessed, time.Now().UnixNano()) // Give the new consumer a full timeout
+		go a.consume(ctx, gen)
+		go a.diagnostic(ctx, map[string]interface{}{
+			"type":       "agent.watchdog",
+			"message":    "Processing pipeline stalled, restarted",
+			"received":   received,
+			"processed":  processed,
+			"stalled":    int(stalled.Seconds()),
+			"generation": gen,
+		})
+	}
+}
+
+// diagTopic is where the agent reports on itself.
+func (a *agent) diagTopic() string {
+	if a.config.Diag_Topic != "" {
+		return a.config.Diag_Topic
+	}
+	return a.config.Notify_Topic + "/agent"
+}
+
+// diagnostic publishes an event about the agent itself. It never waits long, since the broker
+// connection may be the thing that is stuck.
+func (a *agent) diagnostic(ctx context.Context, ev map[string]interface{}) {
+	a.diagnosticTo(ctx, a.diagTopic(), ev)
+}
+
+// diagnosticTo is diagnostic, to another topic.
+func (a *agent) diagnosticTo(ctx context.Context, topic string, ev map[string]interface{}) {
+	if a.client == nil {
+		return
+	}
+	ev["version"] = Version
+	ev["timestamp"] = time.Now().UTC().Format(time.RFC3339)
+	addTags(ev, a.config.Tags)
+	text, _ := json.Marshal(ev)
+	if err := a.publishMQTT(ctx, topic, 0, text); err != nil && a.config.Debug > 3 {
+		fmt.Println(">>> Diagnostic publish failed: " + err.Error())
+	}
+}
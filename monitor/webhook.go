@@ -0,0 +1,350 @@
+package monitor
+
+//
+//  webhook.go  --  HTTP webhooks, for the systems there is no output of their own for. Each entry under
+//    'webhooks' is a sink of its own, named like a plugin:
+//
+//  "webhooks": [
+//    { "name": "opsgenie", "url": "https://api.opsgenie.com/v2/alerts", "method": "POST",
+//      "headers": { "Authorization": "GenieKey {{env \"OPSGENIE_KEY\"}}" },
+//      "body": "{ \"message\": {{json .message}}, \"alias\": {{json .incident_id}}, \"priority\": \"P2\" }",
+//      "retry": { "attempts": 3, "backoff": "1s" }, "secret": "...", "filter": "event.severity == \"critical\"" }
+//  ]
+//
+//    name              what rules give in "sinks" (sinks.go) and what it is called in the output health
+//    url               a template over the payload, like a rule's "topic"
+//    method            POST (the default), PUT or PATCH
+//    headers           each value a template over the payload
+//    body              a template over the payload; the "json" function (templates.go) quotes a value for
+//                      JSON. Default the payload as JSON
+//    content_type      Default "application/json"
+//    retry             "attempts" in all (default 3), the first "backoff" between them (default 1s, doubling
+//                      each time), and "max_backoff" (default 30s)
+//    secret            signs the body: "signature_header" (default X-Signature-256) is "sha256=" and the hex
+//                      HMAC-SHA256 of the body with it, as GitHub does it
+//    tls               see tls.go, for a private CA or a client certificate
+//    filter            only send events this expression is true for, see expr.go
+//    fields            only send these payload fields, see project.go, to the templates and the default body
+//
+//  Any 2xx is delivered. A connection failure, a 429 or a 5xx is tried again, after the backoff or the
+//  Retry-After the server gives, but never longer than max_backoff; anything else, a 400 say, is not.
+//  Every attempt has to fit in the "sink" deadline (deadlines.go), and none is made once the publish is
+//  called off. The status and the start of the response body are in the error.
+//
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// WebhookConfig is one entry of 'webhooks' in the config.
+type WebhookConfig struct {
+	Name             string            `json:"name"`
+	URL              string            `json:"url"`
+	Method           string            `json:"method"`
+	Headers          map[string]string `json:"headers"`
+	Body             string            `json:"body"`
+	Content_Type     string            `json:"content_type"`
+	Retry            WebhookRetry      `json:"retry"`
+	Secret           string            `json:"secret"`
+	Signature_Header string            `json:"signature_header"`
+	TLS              *TLSConfig        `json:"tls"`
+	Filter           string            `json:"filter"`
+	Fields           []string          `json:"fields"`
+}
+
+// WebhookRetry is the 'retry' of a webhook.
+type WebhookRetry struct {
+	Attempts    int    `json:"attempts"`
+	Backoff     string `json:"backoff"`
+	Max_Backoff string `json:"max_backoff"`
+}
+
+type webhookSink struct {
+	cfg      WebhookConfig
+	url      *template.Template
+	headers  map[string]*template.Template
+	body     *template.Template // nil = the payload as JSON
+	attempts int
+	backoff  time.Duration
+	max      time.Duration
+	filter   *Expr
+	fields   projection
+	client   *http.Client
+	timeout  time.Duration
+
+	// For outputs built on a webhook (slack.go): the body in place of 'body', a look at a 2xx response
+	// for APIs that report errors in one, and the error codes.
+	encode func(ctx context.Context, out *Outgoing, payload map[string]interface{}) ([]byte, error)
+	check  func(body []byte) error
+	codes  [2]string // Failed, timed out
+}
+
+// webhookError is a response that isn't a 2xx. Only some are worth trying again.
+type webhookError struct {
+	status     int
+	body       string
+	retryAfter time.Duration
+	reason     string // The API's own error, for a 2xx that wasn't one
+}
+
+func (e *webhookError) Error() string {
+	if e.reason != "" {
+		return e.reason
+	}
+	if e.body == "" {
+		return fmt.Sprintf("HTTP %d", e.status)
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.status, e.body)
+}
+
+// newWebhookSinks checks the 'webhooks' section. taken is the names other outputs already have.
+func newWebhookSinks(cfgs []WebhookConfig, taken map[string]bool, timeout time.Duration) ([]*webhookSink, error) {
+	var ws []*webhookSink
+	for _, c := range cfgs {
+		if c.Name == "" || c.URL == "" {
+			return nil, errors.New("webhooks: each needs a 'name' and a 'url'")
+		}
+		if taken[c.Name] {
+			return nil, fmt.Errorf("Webhook %s: that name is taken by another output", c.Name)
+		}
+		taken[c.Name] = true
+		w, err := newWebhookSink(c, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Webhook %s: %v", c.Name, err)
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
+
+func newWebhookSink(c WebhookConfig, timeout time.Duration) (*webhookSink, error) {
+	w := &webhookSink{cfg: c, headers: make(map[string]*template.Template), attempts: 3, backoff: time.Second,
+		max: 30 * time.Second, timeout: timeout, codes: [2]string{errDeliverWebhook, errDeliverWebhookTime}}
+	switch w.cfg.Method = strings.ToUpper(c.Method); w.cfg.Method {
+	case "":
+		w.cfg.Method = "POST"
+	case "POST", "PUT", "PATCH":
+	default:
+		return nil, fmt.Errorf("method %s, not POST, PUT or PATCH", c.Method)
+	}
+	if w.cfg.Content_Type == "" {
+		w.cfg.Content_Type = "application/json"
+	}
+	if w.cfg.Signature_Header == "" {
+		w.cfg.Signature_Header = "X-Signature-256"
+	}
+	var err error
+	if w.url, err = parseTemplate(c.Name+".url", c.URL); err != nil {
+		return nil, fmt.Errorf("bad url template: %v", err)
+	}
+	for h, src := range c.Headers {
+		if w.headers[h], err = parseTemplate(c.Name+"."+h, src); err != nil {
+			return nil, fmt.Errorf("bad template for header %s: %v", h, err)
+		}
+	}
+	if c.Body != "" {
+		if w.body, err = parseTemplate(c.Name+".body", c.Body); err != nil {
+			return nil, fmt.Errorf("bad body template: %v", err)
+		}
+	}
+	if c.Retry.Attempts < 0 {
+		return nil, errors.New("retry attempts can't be below 0")
+	}
+	if c.Retry.Attempts > 0 {
+		w.attempts = c.Retry.Attempts
+	}
+	for _, d := range []struct {
+		name string
+		v    string
+		to   *time.Duration
+	}{{"backoff", c.Retry.Backoff, &w.backoff}, {"max_backoff", c.Retry.Max_Backoff, &w.max}} {
+		if d.v == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.v)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("bad retry %s '%s'", d.name, d.v)
+		}
+		*d.to = v
+	}
+	if c.Filter != "" {
+		if w.filter, err = compileExpr(c.Filter); err != nil {
+			return nil, fmt.Errorf("bad filter: %v", err)
+		}
+	}
+	if w.fields, err = compileProjection(c.Fields); err != nil {
+		return nil, err
+	}
+	t, err := c.TLS.config("tls")
+	if err != nil {
+		return nil, err
+	}
+	w.client = &http.Client{}
+	if t != nil {
+		w.client.Transport = &http.Transport{TLSClientConfig: t, Proxy: http.ProxyFromEnvironment}
+	}
+	return w, nil
+}
+
+// Name is the webhook's name, see sinks.go.
+func (w *webhookSink) Name() string { return w.cfg.Name }
+
+// Publish renders the request for out and sends it, trying again as 'retry' says.
+func (w *webhookSink) Publish(ctx context.Context, out *Outgoing) error {
+	if w.filter != nil && !exprTrue(w.filter, out.Payload) {
+		return errSinkSkipped
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	req, err := w.render(ctx, out, w.fields.apply(out.Payload))
+	if err != nil {
+		return &sinkError{timeoutCode(err, errRenderTemplate, errRenderTimeout), err}
+	}
+	if err = w.post(ctx, req); err != nil {
+		return &sinkError{timeoutCode(err, w.codes[0], w.codes[1]), fmt.Errorf("%s: %w", w.what(), err)}
+	}
+	return nil
+}
+
+// what is the sink in errors: "webhook NAME", or the output built on one.
+func (w *webhookSink) what() string {
+	if w.encode != nil {
+		return w.cfg.Name
+	}
+	return "webhook " + w.cfg.Name
+}
+
+// post sends req, trying again as 'retry' says.
+func (w *webhookSink) post(ctx context.Context, req *webhookRequest) error {
+	var err error
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err = w.send(ctx, req)
+		if err == nil {
+			return nil
+		}
+		wait := backoff
+		var we *webhookError
+		if errors.As(err, &we) {
+			if we.status != http.StatusTooManyRequests && we.status < 500 {
+				break // The request itself is wrong; sending it again won't help
+			}
+			if we.retryAfter > 0 {
+				wait = we.retryAfter
+			}
+		}
+		if wait > w.max {
+			wait = w.max // A Retry-After of an hour isn't waited out either
+		}
+		if attempt >= w.attempts {
+			break
+		}
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) < wait {
+			break // No time left for another go
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			break
+		}
+		if backoff *= 2; backoff > w.max {
+			backoff = w.max
+		}
+	}
+	if ctx.Err() != nil && !errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%v: %w", err, ctx.Err())
+	}
+	return err
+}
+
+// webhookRequest is a rendered request, ready to send as often as it takes.
+type webhookRequest struct {
+	url     string
+	headers map[string]string
+	body    []byte
+}
+
+func (w *webhookSink) render(ctx context.Context, out *Outgoing, payload map[string]interface{}) (*webhookRequest, error) {
+	u, err := renderTemplate(ctx, w.url, payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s: url: %w", w.what(), err)
+	}
+	req := &webhookRequest{url: u, headers: make(map[string]string, len(w.headers)+2)}
+	for h, t := range w.headers {
+		if req.headers[h], err = renderTemplate(ctx, t, payload); err != nil {
+			return nil, fmt.Errorf("%s: header %s: %w", w.what(), h, err)
+		}
+	}
+	switch {
+	case w.encode != nil:
+		if req.body, err = w.encode(ctx, out, payload); err != nil {
+			return nil, fmt.Errorf("%s: %w", w.what(), err)
+		}
+	case w.body == nil:
+		req.body, _ = json.Marshal(payload)
+	default:
+		b, err := renderTemplate(ctx, w.body, payload)
+		if err != nil {
+			return nil, fmt.Errorf("%s: body: %w", w.what(), err)
+		}
+		req.body = []byte(b)
+	}
+	req.headers["Content-Type"] = w.cfg.Content_Type
+	if w.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.cfg.Secret))
+		mac.Write(req.body)
+		req.headers[w.cfg.Signature_Header] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return req, nil
+}
+
+// send makes one attempt.
+func (w *webhookSink) send(ctx context.Context, r *webhookRequest) error {
+	req, err := http.NewRequest(w.cfg.Method, r.url, bytes.NewReader(r.body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for h, v := range r.headers {
+		req.Header.Set(h, v)
+	}
+	req.Header.Set("User-Agent", "a10-connection-rate-monitor/"+Version)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20)) // All of it, so the connection can be used again
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if w.check != nil {
+			return w.check(body)
+		}
+		return nil
+	}
+	if len(body) > 200 {
+		body = body[:200]
+	}
+	we := &webhookError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		we.retryAfter = time.Duration(s) * time.Second
+	}
+	return we
+}
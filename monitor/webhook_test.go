@@ -0,0 +1,53 @@
+package monitor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A Retry-After longer than max_backoff is cut down to it, and a done ctx ends the retries at once.
+func TestWebhookRetryWait(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	retry := WebhookRetry{Attempts: 3, Backoff: "10ms", Max_Backoff: "50ms"}
+	w, err := newWebhookSink(WebhookConfig{Name: "test", URL: srv.URL, Retry: retry}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &Outgoing{Event: Event{Rule: &Rule{}}, Payload: map[string]interface{}{"rule": "r"}}
+
+	start := time.Now()
+	if err := w.Publish(context.Background(), out); err == nil {
+		t.Fatal("no error from a 503")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %v, waited out the Retry-After", took)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	w.max, w.attempts = time.Hour, 10
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start = time.Now()
+	if err := w.Publish(ctx, out); err == nil {
+		t.Fatal("no error after ctx was done")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %v after ctx was done", took)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("%d attempts after ctx was done, want 1", n)
+	}
+}
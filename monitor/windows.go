@@ -0,0 +1,158 @@
+package monitor
+
+//
+//  windows.go  --  Sliding windows of the matches per device and event type, over the last 1, 5 and 15
+//    minutes, kept to the 10 seconds. Always on; they are in the metrics as a10crm_events_window, e.g.
+//
+//    a10crm_events_window{device="Testing1",type="conn.rate-limit",window="5m"} 212
+//
+//  and a threshold (see thresholds.go) can use them, with "per": "device", to alert on how busy a device
+//  is as a whole rather than one VIP:
+//
+//    { "name": "conn-rate-limit", "threshold": { "count": 200, "within": "5m", "per": "device" } }
+//
+//  Every match counts, published or not; summaries, all-clears and drills don't. A device and type with
+//  nothing in 15 minutes is dropped.
+//
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// slidingWindows are the windows kept, by name.
+var slidingWindows = []struct {
+	name string
+	d    time.Duration
+}{{"1m", time.Minute}, {"5m", 5 * time.Minute}, {"15m", 15 * time.Minute}}
+
+const windowSlot = 10 * time.Second
+
+// ringCounts is a count for each of the last few slots of time, as a ring.
+type ringCounts struct {
+	width  int64   // Seconds per slot
+	slots  []int64 // Unix time / width
+	counts []uint64
+}
+
+func newRingCounts(n int, width time.Duration) *ringCounts {
+	return &ringCounts{width: int64(width / time.Second), slots: make([]int64, n), counts: make([]uint64, n)}
+}
+
+func (c *ringCounts) add(now time.Time) {
+	slot := now.Unix() / c.width
+	i := int(slot % int64(len(c.slots)))
+	if c.slots[i] > slot {
+		return // Older than the ring holds
+	}
+	if c.slots[i] != slot {
+		c.slots[i], c.counts[i] = slot, 0
+	}
+	c.counts[i]++
+}
+
+// sum is the count over the last n slots to now, n no more than the ring holds.
+func (c *ringCounts) sum(now time.Time, n int) uint64 {
+	oldest := now.Unix()/c.width - int64(n) + 1
+	var total uint64
+	for i, slot := range c.slots {
+		if slot >= oldest {
+			total += c.counts[i]
+		}
+	}
+	return total
+}
+
+type windowKey struct {
+	device, typ string
+}
+
+// deviceWindows is safe to use from several goroutines.
+type deviceWindows struct {
+	mu     sync.Mutex
+	slots  int
+	keys   map[windowKey]*ringCounts
+	pruned time.Time
+}
+
+func newDeviceWindows() *deviceWindows {
+	return &deviceWindows{slots: int(slidingWindows[len(slidingWindows)-1].d / windowSlot), keys: make(map[windowKey]*ringCounts)}
+}
+
+// add counts an event.
+func (w *deviceWindows) add(ev Event, now time.Time) {
+	if ev.summary() || ev.Test {
+		return
+	}
+	k := windowKey{ev.Device, ev.Type}
+	w.mu.Lock()
+	c, ok := w.keys[k]
+	if !ok {
+		c = newRingCounts(w.slots, windowSlot)
+		w.keys[k] = c
+	}
+	c.add(now)
+	if now.Sub(w.pruned) >= time.Minute {
+		w.pruned = now
+		for k, c := range w.keys {
+			if c.sum(now, w.slots) == 0 {
+				delete(w.keys, k)
+			}
+		}
+	}
+	w.mu.Unlock()
+}
+
+// count is the matches of typ on device in the last d, one of slidingWindows.
+func (w *deviceWindows) count(device string, typ string, d time.Duration, now time.Time) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c, ok := w.keys[windowKey{device, typ}]
+	if !ok {
+		return 0
+	}
+	return c.sum(now, int(d/windowSlot))
+}
+
+// isSlidingWindow says whether d is one of the windows kept.
+func isSlidingWindow(d time.Duration) bool {
+	for _, sw := range slidingWindows {
+		if sw.d == d {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMetrics adds the windows, see metrics.go.
+func (w *deviceWindows) writeMetrics(p *promWriter) {
+	now := time.Now()
+	w.mu.Lock()
+	keys := make([]windowKey, 0, len(w.keys))
+	sums := make(map[windowKey][]uint64, len(w.keys))
+	for k, c := range w.keys {
+		var s []uint64
+		for _, sw := range slidingWindows {
+			s = append(s, c.sum(now, int(sw.d/windowSlot)))
+		}
+		if s[len(s)-1] == 0 {
+			continue
+		}
+		keys = append(keys, k)
+		sums[k] = s
+	}
+	w.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].device != keys[j].device {
+			return keys[i].device < keys[j].device
+		}
+		return keys[i].typ < keys[j].typ
+	})
+	for _, k := range keys {
+		for i, sw := range slidingWindows {
+			p.metric("a10crm_events_window", "gauge", "Records that matched a rule, per device and type, in the last 1, 5 and 15 minutes.", fmt.Sprintf(`device="%s",type="%s",window="%s"`, promLabel(k.device), promLabel(k.typ), sw.name), sums[k][i])
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package plugin
+
+// Parser plugins are different from output plugins: they are Go plugins (built with
+// "go build -buildmode=plugin") loaded into the agent itself, for log formats the rules can't express.
+// The plugin exports a variable named Parser that implements RecordParser:
+//
+//	type myParser struct{}
+//
+//	func (myParser) Name() string { return "my-aflex" }
+//
+//	func (myParser) Parse(r plugin.Record) (plugin.Parsed, bool) {
+//		if r.Module != "AFLEX" || !strings.HasPrefix(r.Message, "my-log:") {
+//			return plugin.Parsed{}, false
+//		}
+//		return plugin.Parsed{Type: "aflex.my-log", Fields: map[string]interface{}{...}}, true
+//	}
+//
+//	var Parser myParser
+//
+// Records only get to the parser plugins if no rule matched them. The plugin has to be built
+// against the same version of this package (and with the same Go version) as the agent.
+
+// Record is a Syslog record as the parser plugins see it.
+type Record struct {
+	Hostname string
+	Tag      string
+	Module   string // e.g. "ACOS" or "AFLEX", from the "[ACOS]<4>" at the start of the content
+	Message  string // The content without that prefix
+	Severity int    // Syslog severity number
+	Facility int
+}
+
+// Parsed is what a parser plugin makes of a record.
+type Parsed struct {
+	Type     string                 // Event type, e.g. "aflex.my-log". Required
+	Severity string                 // e.g. "warning". Defaults to the Syslog severity of the record
+	Topic    string                 // Defaults to notify_topic
+	Fields   map[string]interface{} // Become payload fields
+}
+
+// RecordParser is implemented by the Parser variable of a parser plugin.
+type RecordParser interface {
+	Name() string
+	Parse(r Record) (Parsed, bool)
+}
@@ -0,0 +1,116 @@
+// Package plugin is a small SDK for writing output plugins for the A10 connection rate monitor in Go.
+//
+// Plugins are separate programs that the agent starts and feeds events to over stdin/stdout, as
+// described in PLUGINS.md. A plugin only has to implement Sink and call Serve:
+//
+//	type printer struct{ prefix string }
+//
+//	func (p *printer) Init(h plugin.Hello) error {
+//		p.prefix, _ = h.Options["prefix"].(string)
+//		return nil
+//	}
+//
+//	func (p *printer) Publish(ev plugin.Event) error {
+//		fmt.Fprintln(os.Stderr, p.prefix, ev.Topic, ev.Payload["message"])
+//		return nil
+//	}
+//
+//	func main() {
+//		if err := plugin.Serve(&printer{}); err != nil {
+//			os.Exit(1)
+//		}
+//	}
+//
+// Anything a plugin wants logged should go to stderr; stdout belongs to the protocol.
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+// ProtocolVersion is the version of the stdin/stdout protocol this package speaks.
+const ProtocolVersion = 1
+
+// Hello is the first message the agent sends after starting the plugin.
+type Hello struct {
+	Type     string                 `json:"type"` // "hello"
+	Protocol int                    `json:"protocol"`
+	Agent    string                 `json:"agent"` // Agent version
+	Name     string                 `json:"name"`  // Plugin name from the agent config
+	Options  map[string]interface{} `json:"options"`
+}
+
+// Event is one alert to be delivered by the plugin.
+type Event struct {
+	Type    string                 `json:"type"` // "event"
+	ID      uint64                 `json:"id"`
+	Topic   string                 `json:"topic"`
+	Key     string                 `json:"key,omitempty"` // Partition key, from 'event_key' in the agent config
+	Payload map[string]interface{} `json:"payload"`
+}
+
+// Reply is sent back for the hello and for every event.
+type Reply struct {
+	ID    uint64 `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Sink is implemented by the plugin.
+type Sink interface {
+	Init(hello Hello) error
+	Publish(ev Event) error
+}
+
+// Serve runs the plugin side of the protocol on stdin/stdout until the agent closes stdin.
+func Serve(s Sink) error {
+	return ServeIO(s, os.Stdin, os.Stdout)
+}
+
+// ServeIO is Serve with the streams given explicitly.
+func ServeIO(s Sink, r io.Reader, w io.Writer) error {
+	in := bufio.NewScanner(r)
+	in.Buffer(make([]byte, 64*1024), 1024*1024)
+	out := json.NewEncoder(w)
+
+	if !in.Scan() {
+		return errors.New("plugin: no hello from agent")
+	}
+	var hello Hello
+	if err := json.Unmarshal(in.Bytes(), &hello); err != nil || hello.Type != "hello" {
+		return errors.New("plugin: bad hello from agent")
+	}
+	if err := s.Init(hello); err != nil {
+		out.Encode(Reply{OK: false, Error: err.Error()})
+		return err
+	}
+	if err := out.Encode(Reply{OK: true}); err != nil {
+		return err
+	}
+
+	for in.Scan() {
+		var ev Event
+		if err := json.Unmarshal(in.Bytes(), &ev); err != nil {
+			// The agent waits for the reply with the event's id, so send it back if it can be read at all
+			var id struct {
+				ID uint64 `json:"id"`
+			}
+			json.Unmarshal(in.Bytes(), &id)
+			out.Encode(Reply{ID: id.ID, OK: false, Error: "bad event: " + err.Error()})
+			continue
+		}
+		reply := Reply{ID: ev.ID, OK: true}
+		if err := s.Publish(ev); err != nil {
+			reply.OK = false
+			reply.Error = err.Error()
+		}
+		if err := out.Encode(reply); err != nil {
+			return err
+		}
+	}
+	return in.Err()
+}
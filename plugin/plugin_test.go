@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testSink struct{ got []Event }
+
+func (s *testSink) Init(h Hello) error { return nil }
+
+func (s *testSink) Publish(ev Event) error {
+	s.got = append(s.got, ev)
+	if ev.Topic == "fail" {
+		return errors.New("no")
+	}
+	return nil
+}
+
+// Every event gets a reply with its id, even one that can't be decoded.
+func TestServeIOReplies(t *testing.T) {
+	in := strings.Join([]string{
+		`{"type": "hello", "protocol": 1, "name": "test"}`,
+		`{"type": "event", "id": 1, "topic": "alert/A10Thunder", "payload": {"rule": "r"}}`,
+		`{"type": "event", "id": 2, "topic": "fail", "payload": {}}`,
+		`{"type": "event", "id": 3, "topic": "alert/A10Thunder", "payload": "not an object"}`,
+		`{"type": "event", "id": 4, "topic": `,
+	}, "\n") + "\n"
+	var out strings.Builder
+	s := &testSink{}
+	if err := ServeIO(s, strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := []Reply{{ID: 0, OK: true}, {ID: 1, OK: true}, {ID: 2, OK: false}, {ID: 3, OK: false}, {ID: 0, OK: false}}
+	replies := bufio.NewScanner(strings.NewReader(out.String()))
+	for i := 0; replies.Scan(); i++ {
+		var r Reply
+		if err := json.Unmarshal(replies.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) || r.ID != want[i].ID || r.OK != want[i].OK || r.OK != (r.Error == "") {
+			t.Errorf("reply %d: %+v", i, r)
+		}
+	}
+	if len(s.got) != 2 {
+		t.Errorf("published %d events, want 2", len(s.got))
+	}
+}